@@ -56,11 +56,15 @@ func LoginByPassword(ctx context.Context, username string, password string, ip s
 
 func LoginByPublicKey(ctx context.Context, username string, pk string, ip string) (sess *Session, err error) {
 	pk = strings.TrimSpace(pk)
-	enc := util.EncryptAES(pk)
-	cnt := int64(0)
-	if err = mysql.DB.Model(&model.PublicKey{}).Where("username = ? AND pk = ?", username, enc).Count(&cnt).Error; err != nil || cnt == 0 {
-		err = fmt.Errorf("%w", err)
-		logger.L().Warn("find pk failed", zap.Int64("cnt", cnt), zap.Error(err))
+	pks := make([]*model.PublicKey, 0)
+	if err = mysql.DB.Model(&model.PublicKey{}).Where("username = ?", username).Find(&pks).Error; err != nil {
+		logger.L().Warn("find pk failed", zap.Error(err))
+		return
+	}
+	// ciphertexts are nonced so keys are compared after decrypted
+	if !lo.ContainsBy(pks, func(p *model.PublicKey) bool { return strings.TrimSpace(util.DecryptAES(p.Pk)) == pk }) {
+		err = fmt.Errorf("public key not found")
+		logger.L().Warn("find pk failed", zap.Int("cnt", len(pks)), zap.Error(err))
 		return
 	}
 
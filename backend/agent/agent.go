@@ -0,0 +1,211 @@
+// Package agent is a gateway running inside networks oneterm can not reach. It dials out to the ssh server of oneterm,
+// registers itself as the gateway it is enrolled for and connects to targets for channels oneterm opens back through it.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// UserPrefix is followed by the gateway id in the user name agents login with
+	UserPrefix = "agent:"
+	// RequestType is the global request agents register with and keep alive by
+	RequestType = "oneterm-agent"
+	// ChannelType is the type of channels opened by oneterm to connect to targets
+	ChannelType = "direct-tcpip"
+
+	KeepAliveInterval = time.Second * 30
+
+	minBackoff = time.Second * 5
+	maxBackoff = time.Minute
+)
+
+// Forward is the payload of channels opened by oneterm, it is the same as direct-tcpip of RFC 4254
+type Forward struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+type Config struct {
+	// Server is the address of the ssh server of oneterm
+	Server    string
+	GatewayId int
+	// Token is the enrollment token, it is only needed until the key of the agent is enrolled
+	Token string
+	// KeyPath is the private key of the agent, it is generated if it does not exist.
+	// The host key of the server is trusted on first use and kept in KeyPath.known
+	KeyPath string
+}
+
+// User returns the user name of the agent of the gateway
+func User(gatewayId int) string {
+	return UserPrefix + strconv.Itoa(gatewayId)
+}
+
+// ParseUser returns the gateway id of the agent user name
+func ParseUser(user string) (int, bool) {
+	if !strings.HasPrefix(user, UserPrefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(user, UserPrefix))
+	return id, err == nil && id > 0
+}
+
+// Run keeps the agent connected until ctx is done
+func Run(ctx context.Context, cfg *Config) error {
+	signer, err := loadKey(cfg.KeyPath)
+	if err != nil {
+		return err
+	}
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := serve(ctx, cfg, signer)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		zap.L().Warn("agent disconnected", zap.String("server", cfg.Server), zap.Duration("retry", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func serve(ctx context.Context, cfg *Config, signer ssh.Signer) (err error) {
+	auths := []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	if cfg.Token != "" {
+		auths = append(auths, ssh.Password(cfg.Token))
+	}
+	cli, err := ssh.Dial("tcp", cfg.Server, &ssh.ClientConfig{
+		User:            User(cfg.GatewayId),
+		Auth:            auths,
+		HostKeyCallback: trustOnFirstUse(cfg.KeyPath + ".known"),
+		Timeout:         time.Second * 10,
+	})
+	if err != nil {
+		return
+	}
+	defer cli.Close()
+
+	chans := cli.HandleChannelOpen(ChannelType)
+	if ok, _, err := cli.SendRequest(RequestType, true, nil); err != nil || !ok {
+		return fmt.Errorf("register agent failed: %v", err)
+	}
+	zap.L().Info("agent connected", zap.String("server", cfg.Server), zap.Int("gatewayId", cfg.GatewayId))
+
+	go func() {
+		tk := time.NewTicker(KeepAliveInterval)
+		defer tk.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				cli.Close()
+				return
+			case <-tk.C:
+				if _, _, err := cli.SendRequest(RequestType, true, nil); err != nil {
+					cli.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for nc := range chans {
+		go forward(nc)
+	}
+
+	return errors.New("connection closed")
+}
+
+// forward connects to the target of the channel and copies between them
+func forward(nc ssh.NewChannel) {
+	f := &Forward{}
+	if err := ssh.Unmarshal(nc.ExtraData(), f); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	addr := net.JoinHostPort(f.DestAddr, strconv.Itoa(int(f.DestPort)))
+	conn, err := net.DialTimeout("tcp", addr, time.Second*5)
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(conn, ch)
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	io.Copy(ch, conn)
+	ch.Close()
+	conn.Close()
+}
+
+func loadKey(path string) (ssh.Signer, error) {
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "oneterm agent")
+		if err != nil {
+			return nil, err
+		}
+		bs = pem.EncodeToMemory(block)
+		if err = os.WriteFile(path, bs, 0o600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(bs)
+}
+
+func trustOnFirstUse(path string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := ssh.MarshalAuthorizedKey(key)
+		trusted, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			zap.L().Info("trust host key of server on first use", zap.String("fingerprint", ssh.FingerprintSHA256(key)))
+			return os.WriteFile(path, presented, 0o600)
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(bytes.TrimSpace(trusted), bytes.TrimSpace(presented)) {
+			return fmt.Errorf("host key of server changed, presented %s, remove %s to trust it", ssh.FingerprintSHA256(key), path)
+		}
+		return nil
+	}
+}
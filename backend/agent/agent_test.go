@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseUser(t *testing.T) {
+	if id, ok := ParseUser(User(42)); !ok || id != 42 {
+		t.Fatalf("ParseUser(User(42)) = %d, %v", id, ok)
+	}
+	for _, user := range []string{"root", "agent:", "agent:x", "agent:0", "agent:-1", "42"} {
+		if id, ok := ParseUser(user); ok {
+			t.Errorf("ParseUser(%q) = %d, want not an agent", user, id)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.key")
+	signer, err := loadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("key is saved as %v, %v", fi, err)
+	}
+	loaded, err := loadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.PublicKey().Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Fatal("key loaded again is not the generated one")
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.key.known")
+	cb := trustOnFirstUse(path)
+	key, other := newSigner(t).PublicKey(), newSigner(t).PublicKey()
+	if err := cb("server", nil, key); err != nil {
+		t.Fatalf("first key error = %v", err)
+	}
+	if err := cb("server", nil, key); err != nil {
+		t.Fatalf("trusted key error = %v", err)
+	}
+	if err := cb("server", nil, other); err == nil {
+		t.Fatal("changed key error = nil")
+	}
+}
+
+func newSigner(t *testing.T) gossh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testServer is the ssh server of oneterm on loopback enrolling agents of a gateway by a token
+type testServer struct {
+	addr      string
+	gatewayId int
+	token     string
+
+	mtx      sync.Mutex
+	enrolled string
+	// registered receives connections of agents registered
+	registered chan *gossh.ServerConn
+}
+
+func newServer(t *testing.T, gatewayId int, token string) *testServer {
+	s := &testServer{gatewayId: gatewayId, token: token, registered: make(chan *gossh.ServerConn, 8)}
+	s.serve(t, "127.0.0.1:0", newSigner(t))
+	return s
+}
+
+// serve starts the server on addr with the host key
+func (s *testServer) serve(t *testing.T, addr string, hostKey gossh.Signer) *ssh.Server {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ssh.Server{
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			if ctx.User() == User(s.gatewayId) && s.enrolled == string(gossh.MarshalAuthorizedKey(key)) {
+				return true
+			}
+			ctx.SetValue("agentKey", key)
+			return false
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			key, ok := ctx.Value("agentKey").(ssh.PublicKey)
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			if !ok || ctx.User() != User(s.gatewayId) || s.token == "" || password != s.token {
+				return false
+			}
+			s.enrolled, s.token = string(gossh.MarshalAuthorizedKey(key)), ""
+			return true
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			RequestType: func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+				if conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn); ok {
+					s.registered <- conn
+				}
+				return true, nil
+			},
+		},
+	}
+	srv.AddHostKey(hostKey)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	s.addr = ln.Addr().String()
+	return srv
+}
+
+// run runs the agent until stop is called or t ends, stop returns the error Run returns
+func run(t *testing.T, cfg *Config) (stop func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, cfg) }()
+	var once sync.Once
+	var err error
+	stop = func() error {
+		once.Do(func() {
+			cancel()
+			err = <-done
+		})
+		return err
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+func (s *testServer) waitRegistered(t *testing.T) *gossh.ServerConn {
+	t.Helper()
+	select {
+	case conn := <-s.registered:
+		return conn
+	case <-time.After(time.Second * 5):
+		t.Fatal("agent is not registered")
+		return nil
+	}
+}
+
+// newEcho starts a target on loopback echoing what it reads
+func newEcho(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func forwardTo(t *testing.T, conn *gossh.ServerConn, addr *net.TCPAddr) (gossh.Channel, error) {
+	ch, reqs, err := conn.OpenChannel(ChannelType, gossh.Marshal(&Forward{DestAddr: addr.IP.String(), DestPort: uint32(addr.Port), OriginAddr: "127.0.0.1"}))
+	if err != nil {
+		return nil, err
+	}
+	go gossh.DiscardRequests(reqs)
+	t.Cleanup(func() { ch.Close() })
+	return ch, nil
+}
+
+func TestRun(t *testing.T) {
+	s := newServer(t, 7, "token")
+	keyPath := filepath.Join(t.TempDir(), "agent.key")
+	stop := run(t, &Config{Server: s.addr, GatewayId: 7, Token: "token", KeyPath: keyPath})
+
+	conn := s.waitRegistered(t)
+	if conn.User() != User(7) {
+		t.Fatalf("agent logged in as %s", conn.User())
+	}
+	signer, err := loadKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mtx.Lock()
+	enrolled, token := s.enrolled, s.token
+	s.mtx.Unlock()
+	if enrolled != string(gossh.MarshalAuthorizedKey(signer.PublicKey())) || token != "" {
+		t.Fatalf("enrolled %q by token %q, want the key of the agent by the token", enrolled, token)
+	}
+
+	ch, err := forwardTo(t, conn, newEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ch.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(ch, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo through the agent = %q, %v", buf, err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	if _, err = forwardTo(t, conn, ln.Addr().(*net.TCPAddr)); err == nil {
+		t.Fatal("channel to a closed port is accepted")
+	}
+
+	if err = stop(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// the enrolled key is enough once the token is consumed
+	run(t, &Config{Server: s.addr, GatewayId: 7, KeyPath: keyPath})
+	s.waitRegistered(t)
+}
+
+func TestRunNotEnrolled(t *testing.T) {
+	s := newServer(t, 7, "token")
+	cfg := &Config{Server: s.addr, GatewayId: 7, Token: "wrong", KeyPath: filepath.Join(t.TempDir(), "agent.key")}
+	signer, err := loadKey(cfg.KeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = serve(context.Background(), cfg, signer); err == nil {
+		t.Fatal("serve() with a wrong token error = nil")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.enrolled != "" {
+		t.Fatal("key is enrolled by a wrong token")
+	}
+}
+
+func TestRunHostKeyChanged(t *testing.T) {
+	s := newServer(t, 7, "token")
+	cfg := &Config{Server: s.addr, GatewayId: 7, Token: "token", KeyPath: filepath.Join(t.TempDir(), "agent.key")}
+	signer, err := loadKey(cfg.KeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, cfg, signer) }()
+	s.waitRegistered(t)
+	cancel()
+	<-done
+
+	// another server on the address of the trusted one
+	other := &testServer{gatewayId: 7, token: "token", registered: make(chan *gossh.ServerConn, 8)}
+	other.serve(t, "127.0.0.1:0", newSigner(t))
+	cfg.Server = other.addr
+	if err = serve(context.Background(), cfg, signer); err == nil {
+		t.Fatal("serve() to a server of another host key error = nil")
+	}
+}
@@ -40,6 +40,8 @@ func RunApi() error {
 			account.DELETE("/:id", c.DeleteAccount)
 			account.PUT("/:id", c.UpdateAccount)
 			account.GET("", c.GetAccounts)
+			account.POST("/:id/rotate", c.RotateAccount)
+			account.GET("/ca", c.GetCaPublicKey)
 		}
 
 		asset := v1.Group("asset")
@@ -71,6 +73,7 @@ func RunApi() error {
 			gateway.POST("", c.CreateGateway)
 			gateway.DELETE("/:id", c.DeleteGateway)
 			gateway.PUT("/:id", c.UpdateGateway)
+			gateway.POST("/:id/enroll", c.EnrollGateway)
 			gateway.GET("", c.GetGateways)
 		}
 
@@ -106,6 +109,29 @@ func RunApi() error {
 			connect.GET("/:asset_id/:account_id/:protocol", c.Connect)
 			connect.GET("/monitor/:session_id", c.ConnectMonitor)
 			connect.POST("/close/:session_id", c.ConnectClose)
+			connect.POST("/token/:asset_id/:account_id/:protocol", c.ConnectToken)
+		}
+
+		approval := v1.Group("approval")
+		{
+			approval.GET("", c.GetApprovals)
+			approval.GET("/monitor", c.ApprovalMonitor)
+			approval.POST("/approve/:id", c.ApproveCommand)
+			approval.POST("/reject/:id", c.RejectCommand)
+		}
+
+		hostKey := v1.Group("host_key")
+		{
+			hostKey.POST("", c.CreateHostKey)
+			hostKey.DELETE("/:id", c.DeleteHostKey)
+			hostKey.POST("/:id/approve", c.ApproveHostKey)
+			hostKey.GET("", c.GetHostKeys)
+		}
+
+		k8s := v1.Group("k8s")
+		{
+			k8s.GET("/namespaces/:asset_id/:account_id", c.K8sNamespaces)
+			k8s.GET("/pods/:asset_id/:account_id", c.K8sPods)
 		}
 
 		file := v1.Group("file")
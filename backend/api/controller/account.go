@@ -14,13 +14,37 @@ import (
 	"github.com/veops/oneterm/acl"
 	"github.com/veops/oneterm/conf"
 	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/k8s"
 	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/schedule"
 	"github.com/veops/oneterm/util"
 )
 
 var (
 	accountPreHooks = []preHook[*model.Account]{
 		func(ctx *gin.Context, data *model.Account) {
+			if data.Managed && (data.AccountType != model.AUTHMETHOD_PASSWORD || data.SecretPath != "" || data.RotateDays < 0) {
+				ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": schedule.ErrNotManaged}})
+				return
+			}
+			if data.SecretPath != "" {
+				if _, err := util.GetSecret(ctx, data.SecretPath); err != nil {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+				}
+				return
+			}
+			if data.AccountType == model.AUTHMETHOD_KUBECONFIG {
+				if _, err := k8s.ParseKubeconfig([]byte(data.Pk)); err != nil {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+				}
+				return
+			}
+			if data.AccountType == model.AUTHMETHOD_CERTIFICATE {
+				if _, err := util.CaPublicKey(); err != nil {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+				}
+				return
+			}
 			if data.AccountType == model.AUTHMETHOD_PUBLICKEY {
 				if data.Phrase == "" {
 					_, err := ssh.ParsePrivateKey([]byte(data.Pk))
@@ -38,6 +62,10 @@ var (
 			}
 		},
 		func(ctx *gin.Context, data *model.Account) {
+			if data.SecretPath != "" {
+				data.Password, data.Pk, data.Phrase = "", "", ""
+				return
+			}
 			data.Password = util.EncryptAES(data.Password)
 			data.Pk = util.EncryptAES(data.Pk)
 			data.Phrase = util.EncryptAES(data.Phrase)
@@ -119,6 +147,49 @@ func (c *Controller) UpdateAccount(ctx *gin.Context) {
 	doUpdate(ctx, true, &model.Account{}, accountPreHooks...)
 }
 
+// RotateAccount godoc
+//
+//	@Tags		account
+//	@Param		id	path		int	true	"account id"
+//	@Success	200	{object}	HttpResponse{data=schedule.RotateRecord}
+//	@Router		/account/:id/rotate [post]
+func (c *Controller) RotateAccount(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": "rotate password"}})
+		return
+	}
+
+	record, err := schedule.Rotate(ctx, cast.ToInt(ctx.Param("id")), currentUser.Uid, ctx.ClientIP())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.AbortWithError(http.StatusNotFound, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+			return
+		}
+		code := lo.Ternary(errors.Is(err, schedule.ErrRotating) || errors.Is(err, schedule.ErrNotManaged), http.StatusBadRequest, http.StatusInternalServerError)
+		ctx.AbortWithError(code, &ApiError{Code: lo.Ternary(code == http.StatusBadRequest, ErrBadRequest, ErrInternal), Data: map[string]any{"err": err}})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, NewHttpResponseWithData(record))
+}
+
+// GetCaPublicKey godoc
+//
+//	@Tags		account
+//	@Produce	plain
+//	@Success	200	{string}	string	"public key of the ssh ca in authorized_keys format"
+//	@Router		/account/ca [get]
+func (c *Controller) GetCaPublicKey(ctx *gin.Context) {
+	pk, err := util.CaPublicKey()
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrBadRequest, Data: map[string]any{"err": err}})
+		return
+	}
+
+	ctx.Data(http.StatusOK, "text/plain; charset=utf-8", pk)
+}
+
 // GetAccounts godoc
 //
 //	@Tags		account
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+
+	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/model"
+	gsession "github.com/veops/oneterm/session"
+)
+
+// GetApprovals godoc
+//
+//	@Tags		approval
+//	@Success	200	{object}	HttpResponse{data=ListData{list=[]model.Approval}}
+//	@Router		/approval [get]
+func (c *Controller) GetApprovals(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": acl.READ}})
+		return
+	}
+
+	approvals := gsession.GetPendingApprovals()
+	res := &ListData{
+		Count: int64(len(approvals)),
+		List:  lo.Map(approvals, func(a *model.Approval, _ int) any { return a }),
+	}
+	ctx.JSON(http.StatusOK, NewHttpResponseWithData(res))
+}
+
+// ApprovalMonitor godoc
+//
+//	@Tags		approval
+//	@Success	200	{object}	HttpResponse
+//	@Router		/approval/monitor [get]
+func (c *Controller) ApprovalMonitor(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": "approve command"}})
+		return
+	}
+
+	ws, err := Upgrader.Upgrade(ctx.Writer, ctx.Request, http.Header{
+		"sec-websocket-protocol": {ctx.GetHeader("sec-websocket-protocol")},
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer ws.Close()
+
+	key := fmt.Sprintf("%d-%d", currentUser.GetUid(), time.Now().UnixNano())
+	gsession.WatchApprovals(key, ws)
+	defer gsession.UnwatchApprovals(key)
+
+	for {
+		if _, _, err = ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// ApproveCommand godoc
+//
+//	@Tags		approval
+//	@Param		id	path		string	true	"approval id"
+//	@Success	200	{object}	HttpResponse
+//	@Router		/approval/approve/:id [post]
+func (c *Controller) ApproveCommand(ctx *gin.Context) {
+	resolveApproval(ctx, model.APPROVALSTATUS_APPROVED)
+}
+
+// RejectCommand godoc
+//
+//	@Tags		approval
+//	@Param		id	path		string	true	"approval id"
+//	@Success	200	{object}	HttpResponse
+//	@Router		/approval/reject/:id [post]
+func (c *Controller) RejectCommand(ctx *gin.Context) {
+	resolveApproval(ctx, model.APPROVALSTATUS_REJECTED)
+}
+
+func resolveApproval(ctx *gin.Context, status int) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": "approve command"}})
+		return
+	}
+
+	id := ctx.Param("id")
+	a := gsession.GetApprovalById(id)
+	if a == nil {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "invalid approval id"}})
+		return
+	}
+	if a.Uid == currentUser.GetUid() {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": "approve own command"}})
+		return
+	}
+	gsession.ResolveApproval(id, status, currentUser.GetUserName())
+
+	ctx.JSON(http.StatusOK, defaultHttpResponse)
+}
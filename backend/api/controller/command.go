@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -18,6 +19,16 @@ import (
 )
 
 var (
+	commandPreHooks = []preHook[*model.Command]{
+		func(ctx *gin.Context, data *model.Command) {
+			for _, c := range data.Cmds {
+				if _, err := regexp.Compile(c); err != nil {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+					return
+				}
+			}
+		},
+	}
 	commandDcs = []deleteCheck{
 		func(ctx *gin.Context, id int) {
 			assetName := ""
@@ -44,7 +55,7 @@ var (
 //	@Success	200		{object}	HttpResponse
 //	@Router		/command [post]
 func (c *Controller) CreateCommand(ctx *gin.Context) {
-	doCreate(ctx, true, &model.Command{}, conf.RESOURCE_COMMAND)
+	doCreate(ctx, true, &model.Command{}, conf.RESOURCE_COMMAND, commandPreHooks...)
 }
 
 // DeleteCommand godoc
@@ -65,7 +76,7 @@ func (c *Controller) DeleteCommand(ctx *gin.Context) {
 //	@Success	200		{object}	HttpResponse
 //	@Router		/command/:id [put]
 func (c *Controller) UpdateCommand(ctx *gin.Context) {
-	doUpdate(ctx, true, &model.Command{})
+	doUpdate(ctx, true, &model.Command{}, commandPreHooks...)
 }
 
 // GetCommands godoc
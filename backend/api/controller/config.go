@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
 	"github.com/spf13/cast"
 	"gorm.io/gorm"
 
@@ -31,6 +32,14 @@ func (c *Controller) PostConfig(ctx *gin.Context) {
 		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
 		return
 	}
+	if !validRetention(&cfg.Retention) || lo.ContainsBy(lo.Values(cfg.NodeRetentions), func(r *model.Retention) bool { return !validRetention(r) }) {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "invalid retention days"}})
+		return
+	}
+	if cfg.ApprovalTimeout < 0 {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "invalid approval timeout"}})
+		return
+	}
 	cfg.Id = 0
 	cfg.CreatorId = currentUser.GetUid()
 	cfg.UpdaterId = currentUser.GetUid()
@@ -71,3 +80,7 @@ func (c *Controller) GetConfig(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, NewHttpResponseWithData(cfg))
 }
+
+func validRetention(r *model.Retention) bool {
+	return r != nil && r.ReplayDays >= 0 && r.SessionDays >= 0 && r.FileHistoryDays >= 0 && r.HistoryDays >= 0
+}
@@ -2,8 +2,11 @@ package controller
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
@@ -26,13 +29,23 @@ import (
 	"github.com/veops/oneterm/api/guacd"
 	mysql "github.com/veops/oneterm/db"
 	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/hostkey"
 	myi18n "github.com/veops/oneterm/i18n"
 	"github.com/veops/oneterm/logger"
 	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/replay"
 	gsession "github.com/veops/oneterm/session"
+	"github.com/veops/oneterm/session/parser"
 	"github.com/veops/oneterm/util"
 )
 
+const (
+	approvalTimeout     = time.Minute * 5
+	maxStdinLine        = 1 << 20
+	maxStdinShown       = 64
+	guacdRecordingDelay = time.Second * 10
+)
+
 var (
 	Upgrader = websocket.Upgrader{
 		ReadBufferSize:  4096,
@@ -66,6 +79,11 @@ func read(sess *gsession.Session) error {
 					}
 				}
 			} else if sess.SessionType == model.SESSIONTYPE_CLIENT {
+				if sess.Command != "" {
+					// input of commands is not typed on a terminal, it is forwarded line by line until EOF
+					go copyStdin(sess)
+					return nil
+				}
 				sess.IdleTk.Reset(sess.IdleTimout)
 				chs.InChan <- sess.CliRw.Read()
 			}
@@ -78,18 +96,19 @@ func write(sess *gsession.Session) {
 	out := chs.OutBuf.Bytes()
 
 	if sess.SessionType == model.SESSIONTYPE_WEB && sess.Ws != nil {
-		if len(out) > 0 || !strings.Contains(sess.Protocol, "ssh") {
+		if len(out) > 0 || !sess.IsSsh() {
 			sess.Ws.WriteMessage(websocket.TextMessage, out)
 		}
 	} else if sess.SessionType == model.SESSIONTYPE_CLIENT && len(out) > 0 {
 		sess.CliRw.Write(out)
 	}
 
-	if len(out) > 0 && strings.Contains(sess.Protocol, "ssh") {
+	if len(out) > 0 && sess.IsSsh() {
 		sess.SshRecoder.Write(out)
 	}
 
 	writeToMonitors(sess.Monitors, out)
+	gsession.RelayToMonitors(sess, out)
 	chs.OutBuf.Reset()
 }
 
@@ -100,8 +119,74 @@ func writeErrMsg(sess *gsession.Session, msg string) {
 	write(sess)
 }
 
+// writeInput forwards user input to the remote side, every line is checked by the command filter before its enter is sent.
+// Input is held while a command is waiting for approval, ctrl+c cancels the approval.
+// Commands to be approved are refused in pastes since the rest of a paste can not be held
+func writeInput(sess *gsession.Session, in []byte) {
+	if sess.Approval != nil {
+		if bytes.IndexByte(in, 0x03) >= 0 {
+			gsession.ResolveApproval(sess.Approval.Id, model.APPROVALSTATUS_CANCELED, sess.UserName)
+		}
+		return
+	}
+	sess.SshParser.Input(in, sess.Chans.Win, func(lines ...string) parser.Verdict {
+		line, cmd := sess.CmdFilter.Load().Match(lines...)
+		if cmd == nil {
+			return parser.Pass
+		}
+		if cmd.Action == model.COMMANDACTION_APPROVE && !sess.SshParser.Pasting() {
+			sess.Approval = gsession.NewApproval(sess, line, cmd, approvalTime())
+			writeLocalized(sess, myi18n.MsgSshCommandApproving, map[string]any{"Command": line})
+			return parser.Hold
+		}
+		sess.SshParser.Reject(line, model.SESSIONCMD_LEVEL_BLOCKED, fmt.Sprintf("blocked by %s", cmd.Name))
+		writeLocalized(sess, myi18n.MsgSshCommandRefused, map[string]any{"Command": line})
+		return parser.Block
+	})
+}
+
+// handleApproval sends or drops the held command line according to the approval result
+func handleApproval(sess *gsession.Session, a *model.Approval) {
+	chs := sess.Chans
+	sess.Approval = nil
+	result := ""
+	switch a.Status {
+	case model.APPROVALSTATUS_APPROVED:
+		writeLocalized(sess, myi18n.MsgSshCommandApproved, map[string]any{"Approver": a.Approver})
+		sess.SshParser.SetLevel(model.SESSIONCMD_LEVEL_APPROVED)
+		sess.SshParser.AddInput([]byte{'\r'})
+		chs.Win.Write([]byte{'\r'})
+		return
+	case model.APPROVALSTATUS_REJECTED:
+		result = fmt.Sprintf("rejected by %s", a.Approver)
+		writeLocalized(sess, myi18n.MsgSshCommandRejected, map[string]any{"Command": a.Cmd, "Approver": a.Approver})
+	case model.APPROVALSTATUS_EXPIRED:
+		result = "approval timeout"
+		writeLocalized(sess, myi18n.MsgSshCommandApprovalTimeout, map[string]any{"Command": a.Cmd})
+	default:
+		result = "canceled"
+	}
+	sess.SshParser.Reject(a.Cmd, model.SESSIONCMD_LEVEL_REJECTED, result)
+	chs.Win.Write([]byte{0x05, 0x15, '\r'})
+}
+
+func writeLocalized(sess *gsession.Session, msg *i18n.Message, data map[string]any) {
+	s, _ := sess.Localizer.Localize(&i18n.LocalizeConfig{
+		DefaultMessage: msg,
+		TemplateData:   data,
+	})
+	sess.Chans.OutBuf.Write([]byte("\r\n" + s))
+	write(sess)
+}
+
 func HandleSsh(sess *gsession.Session) (err error) {
 	defer func() {
+		if sess.Approval != nil {
+			gsession.ResolveApproval(sess.Approval.Id, model.APPROVALSTATUS_CANCELED, "")
+		}
+		sess.SshParser.Close()
+		sess.SshRecoder.Close()
+		gsession.UnregisterSession(sess.SessionId)
 		sess.Status = model.SESSIONSTATUS_OFFLINE
 		sess.ClosedAt = lo.ToPtr(time.Now())
 		if err = gsession.UpsertSession(sess); err != nil {
@@ -123,6 +208,11 @@ func HandleSsh(sess *gsession.Session) (err error) {
 		for {
 			select {
 			case <-sess.Gctx.Done():
+				for len(chs.OutChan) > 0 {
+					out := <-chs.OutChan
+					sess.SshParser.AddOutput(out)
+					chs.OutBuf.Write(out)
+				}
 				write(sess)
 				return nil
 			case <-sess.IdleTk.C:
@@ -132,11 +222,13 @@ func HandleSsh(sess *gsession.Session) (err error) {
 				if mysql.DB.Model(asset).Where("id = ?", sess.AssetId).First(asset).Error != nil {
 					continue
 				}
-				if checkTime(asset.AccessAuth) {
-					continue
+				if !CheckTime(asset.AccessAuth) {
+					writeErrMsg(sess, "invalid access time\n\n")
+					return &ApiError{Code: ErrAccessTime}
+				}
+				if filter, err := gsession.NewCmdFilter(asset.CmdIds); err == nil {
+					sess.CmdFilter.Store(filter)
 				}
-				writeErrMsg(sess, "invalid access time\n\n")
-				return &ApiError{Code: ErrAccessTime}
 			case closeBy := <-chs.CloseChan:
 				writeErrMsg(sess, "closed by admin\n\n")
 				logger.L().Info("closed by", zap.String("admin", closeBy))
@@ -149,7 +241,7 @@ func HandleSsh(sess *gsession.Session) (err error) {
 					msg := in[1:]
 					switch rt {
 					case '1':
-						chs.Win.Write(msg)
+						writeInput(sess, msg)
 					case '9':
 						continue
 					case 'w':
@@ -163,9 +255,15 @@ func HandleSsh(sess *gsession.Session) (err error) {
 						}
 					}
 				} else if sess.SessionType == model.SESSIONTYPE_CLIENT {
-					chs.Win.Write(in)
+					writeInput(sess, in)
 				}
+			case a := <-chs.ApprovalChan:
+				handleApproval(sess, a)
 			case out := <-chs.OutChan:
+				if sess.Command != "" {
+					sess.IdleTk.Reset(sess.IdleTimout)
+				}
+				sess.SshParser.AddOutput(out)
 				chs.OutBuf.Write(out)
 			case <-tk.C:
 				write(sess)
@@ -187,6 +285,12 @@ func HandleSsh(sess *gsession.Session) (err error) {
 func handleGuacd(sess *gsession.Session) (err error) {
 	defer func() {
 		sess.GuacdTunnel.Disconnect()
+		sess.GuacdTunnel.Close()
+		// guacd finishes the recording after the connection is closed
+		time.AfterFunc(guacdRecordingDelay, func() {
+			replay.Upload(context.Background(), sess.SessionId)
+		})
+		gsession.UnregisterSession(sess.SessionId)
 		sess.Status = model.SESSIONSTATUS_OFFLINE
 		sess.ClosedAt = lo.ToPtr(time.Now())
 		if err = gsession.UpsertSession(sess); err != nil {
@@ -213,7 +317,7 @@ func handleGuacd(sess *gsession.Session) (err error) {
 				if mysql.DB.Model(asset).Where("id = ?", sess.AssetId).First(asset).Error != nil {
 					continue
 				}
-				if checkTime(asset.AccessAuth) {
+				if CheckTime(asset.AccessAuth) {
 					continue
 				}
 				return &ApiError{Code: ErrAccessTime}
@@ -256,6 +360,7 @@ func DoConnect(ctx *gin.Context, ws *websocket.Conn) (sess *gsession.Session, er
 
 	sess = gsession.NewSession(ctx)
 	sess.Ws = ws
+	sess.Localizer = i18n.NewLocalizer(myi18n.Bundle, ctx.PostForm("lang"), ctx.GetHeader("Accept-Language"))
 	sess.Session = &model.Session{
 		SessionType: ctx.GetInt("sessionType"),
 		SessionId:   uuid.New().String(),
@@ -275,6 +380,13 @@ func DoConnect(ctx *gin.Context, ws *websocket.Conn) (sess *gsession.Session, er
 		if sess.SshRecoder, err = gsession.NewAsciinema(sess.SessionId, w, h); err != nil {
 			return
 		}
+		sess.SshParser = parser.NewParser(sess.SessionId, gsession.RecordCmd)
+		sess.Command = ctx.GetString("command")
+		var filter *gsession.CmdFilter
+		if filter, err = gsession.NewCmdFilter(asset.CmdIds); err != nil {
+			return
+		}
+		sess.CmdFilter.Store(filter)
 	}
 	if sess.SessionType == model.SESSIONTYPE_WEB {
 		sess.ClientIp = ctx.ClientIP()
@@ -282,7 +394,7 @@ func DoConnect(ctx *gin.Context, ws *websocket.Conn) (sess *gsession.Session, er
 		sess.ClientIp = ctx.RemoteIP()
 	}
 
-	if !checkTime(asset.AccessAuth) {
+	if !CheckTime(asset.AccessAuth) {
 		err = &ApiError{Code: ErrAccessTime}
 		ctx.AbortWithError(http.StatusBadRequest, err)
 		return
@@ -296,6 +408,10 @@ func DoConnect(ctx *gin.Context, ws *websocket.Conn) (sess *gsession.Session, er
 	switch strings.Split(sess.Protocol, ":")[0] {
 	case "ssh":
 		go connectSsh(ctx, sess, asset, account, gateway)
+	case "telnet":
+		go connectTelnet(ctx, sess, asset, account, gateway)
+	case "k8s":
+		go connectK8s(ctx, sess, asset, account, gateway)
 	case "vnc", "rdp":
 		go connectGuacd(ctx, sess, asset, account, gateway)
 	default:
@@ -308,7 +424,7 @@ func DoConnect(ctx *gin.Context, ws *websocket.Conn) (sess *gsession.Session, er
 		return
 	}
 
-	gsession.GetOnlineSession().Store(sess.SessionId, sess)
+	gsession.RegisterSession(sess)
 	gsession.UpsertSession(sess)
 
 	return
@@ -324,25 +440,25 @@ func connectSsh(ctx *gin.Context, sess *gsession.Session, asset *model.Asset, ac
 		}
 	}()
 
-	ip, port, err := util.Proxy(uuid.New().String(), "ssh", asset, gateway)
+	auth, err := util.GetAuth(account, sess.SessionId)
 	if err != nil {
 		return
 	}
 
-	auth, err := util.GetAuth(account)
+	conn, err := util.Proxy(ctx, sess.SessionId, "ssh", asset, gateway)
 	if err != nil {
 		return
 	}
 
-	sshCli, err := gossh.Dial("tcp", fmt.Sprintf("%s:%d", ip, port), &gossh.ClientConfig{
-		User:            account.Account,
-		Auth:            []gossh.AuthMethod{auth},
-		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
-		Timeout:         time.Second * 3,
-	})
+	sshCli, err := ggateway.NewClient(conn, hostkey.Config(&gossh.ClientConfig{
+		User:    account.Account,
+		Auth:    []gossh.AuthMethod{auth},
+		Timeout: time.Second * 3,
+	}, asset.Id, 0, util.GetPort("ssh", asset)))
 	if err != nil {
 		return
 	}
+	defer sshCli.Close()
 
 	sshSess, err := sshCli.NewSession()
 	if err != nil {
@@ -355,51 +471,78 @@ func connectSsh(ctx *gin.Context, sess *gsession.Session, asset *model.Asset, ac
 	sshSess.Stdout = chs.Wout
 	sshSess.Stderr = chs.Wout
 
-	modes := gossh.TerminalModes{
-		gossh.ECHO:          1,
-		gossh.TTY_OP_ISPEED: 14400,
-		gossh.TTY_OP_OSPEED: 14400,
-	}
-	if err = sshSess.RequestPty("xterm", h, w, modes); err != nil {
-		logger.L().Error("ssh request pty failed", zap.Error(err))
-		return
-	}
-	if err = sshSess.Shell(); err != nil {
-		logger.L().Error("ssh start shell failed", zap.Error(err))
-		return
+	if sess.Command != "" {
+		if err = startCommand(ctx, sess, sshSess); err != nil {
+			logger.L().Error("ssh start command failed", zap.Error(err))
+			return
+		}
+	} else {
+		modes := gossh.TerminalModes{
+			gossh.ECHO:          1,
+			gossh.TTY_OP_ISPEED: 14400,
+			gossh.TTY_OP_OSPEED: 14400,
+		}
+		if err = sshSess.RequestPty("xterm", h, w, modes); err != nil {
+			logger.L().Error("ssh request pty failed", zap.Error(err))
+			return
+		}
+		if err = sshSess.Shell(); err != nil {
+			logger.L().Error("ssh start shell failed", zap.Error(err))
+			return
+		}
+		sess.G.Go(func() error {
+			err = sshSess.Wait()
+			return fmt.Errorf("ssh session wait end %w", err)
+		})
 	}
 
-	sess.G.Go(func() error {
-		err = sshSess.Wait()
-		return fmt.Errorf("ssh session wait end %w", err)
-	})
-
 	chs.ErrChan <- err
 
 	sess.G.Go(func() error {
-		buf := bufio.NewReader(chs.Rout)
+		return readOutput(sess)
+	})
+	sess.G.Go(func() error {
+		defer sshSess.Close()
+		defer sess.Chans.Rout.Close()
+		defer sess.Chans.Win.Close()
 		for {
 			select {
 			case <-sess.Gctx.Done():
 				return nil
-			default:
-				rn, size, err := buf.ReadRune()
-				if err != nil {
-					return err
-				}
-				if size <= 0 || rn == utf8.RuneError {
+			case <-chs.AwayChan:
+				return fmt.Errorf("away")
+			case window := <-chs.WindowChan:
+				if err := sshSess.WindowChange(window.Height, window.Width); err != nil {
+					logger.L().Warn("reset window size failed", zap.Error(err))
 					continue
 				}
-				p := make([]byte, utf8.RuneLen(rn))
-				utf8.EncodeRune(p, rn)
-				chs.OutChan <- p
+				sess.SshRecoder.Resize(window.Width, window.Height)
 			}
 		}
 	})
+
+	sess.G.Wait()
+
+	return
+}
+
+// relayConn relays the terminal of rwc through the channels of the session as ssh does, so that recording, commands and monitoring work the same.
+// It returns once the session ends, the error the output of rwc ends with is turned by end into the one the session ends with
+func relayConn(sess *gsession.Session, rwc io.ReadWriteCloser, resize func(width, height int) error, end func(err error) error) {
+	chs := sess.Chans
+	go io.Copy(rwc, chs.Rin)
+	sess.G.Go(func() error {
+		_, err := io.Copy(chs.Wout, rwc)
+		chs.Wout.Close()
+		return end(err)
+	})
 	sess.G.Go(func() error {
-		defer sshSess.Close()
-		defer sess.Chans.Rout.Close()
-		defer sess.Chans.Win.Close()
+		return readOutput(sess)
+	})
+	sess.G.Go(func() error {
+		defer rwc.Close()
+		defer chs.Rout.Close()
+		defer chs.Win.Close()
 		for {
 			select {
 			case <-sess.Gctx.Done():
@@ -407,7 +550,7 @@ func connectSsh(ctx *gin.Context, sess *gsession.Session, asset *model.Asset, ac
 			case <-chs.AwayChan:
 				return fmt.Errorf("away")
 			case window := <-chs.WindowChan:
-				if err := sshSess.WindowChange(window.Height, window.Width); err != nil {
+				if err := resize(window.Width, window.Height); err != nil {
 					logger.L().Warn("reset window size failed", zap.Error(err))
 					continue
 				}
@@ -417,10 +560,176 @@ func connectSsh(ctx *gin.Context, sess *gsession.Session, asset *model.Asset, ac
 	})
 
 	sess.G.Wait()
+}
+
+// readOutput sends output of the terminal in Rout to OutChan rune by rune
+func readOutput(sess *gsession.Session) error {
+	chs := sess.Chans
+	buf := bufio.NewReader(chs.Rout)
+	for {
+		select {
+		case <-sess.Gctx.Done():
+			return nil
+		default:
+			rn, size, err := buf.ReadRune()
+			if err != nil {
+				return err
+			}
+			if size <= 0 || rn == utf8.RuneError {
+				continue
+			}
+			p := make([]byte, utf8.RuneLen(rn))
+			utf8.EncodeRune(p, rn)
+			chs.OutChan <- p
+		}
+	}
+}
+
+// startCommand runs the command of an exec request unless it is refused by the command filter,
+// commands to be approved are started once they are approved and the client waits until then.
+// Stderr is relayed to the client directly and the session ends once the output is drained after the command exits
+func startCommand(ctx *gin.Context, sess *gsession.Session, sshSess *gossh.Session) (err error) {
+	chs := sess.Chans
+	stderr, _ := ctx.Value("stderr").(io.Writer)
+	sshSess.Stderr = &execStderr{sess: sess, w: stderr}
+
+	if line, cmd := sess.CmdFilter.Load().Match(sess.Command); cmd != nil {
+		level, result := model.SESSIONCMD_LEVEL_BLOCKED, fmt.Sprintf("blocked by %s", cmd.Name)
+		if cmd.Action == model.COMMANDACTION_APPROVE {
+			level, result = approveCommand(sess, sshSess.Stderr, line, cmd)
+		} else {
+			writeStderr(sess, sshSess.Stderr, myi18n.MsgSshCommandRefused, map[string]any{"Command": line})
+		}
+		if result != "" {
+			sess.SshParser.Reject(line, level, result)
+			sess.ExitCode = 1
+			return chs.Wout.Close()
+		}
+		sess.SshParser.SetLevel(level)
+	}
+
+	sess.SshParser.Exec(sess.Command)
+	if err = sshSess.Start(sess.Command); err != nil {
+		return
+	}
+	sess.G.Go(func() error {
+		sess.ExitCode = exitCode(sshSess.Wait())
+		return chs.Wout.Close()
+	})
 
 	return
 }
 
+// approveCommand waits for the approval of the command line of an exec request, result is empty if it is approved
+func approveCommand(sess *gsession.Session, stderr io.Writer, line string, cmd *model.Command) (level int, result string) {
+	a := gsession.NewApproval(sess, line, cmd, approvalTime())
+	writeStderr(sess, stderr, myi18n.MsgSshCommandApproving, map[string]any{"Command": line})
+	select {
+	case a = <-sess.Chans.ApprovalChan:
+	case <-sess.Gctx.Done():
+		gsession.ResolveApproval(a.Id, model.APPROVALSTATUS_CANCELED, "")
+		a.Status = model.APPROVALSTATUS_CANCELED
+	}
+	switch a.Status {
+	case model.APPROVALSTATUS_APPROVED:
+		writeStderr(sess, stderr, myi18n.MsgSshCommandApproved, map[string]any{"Approver": a.Approver})
+		return model.SESSIONCMD_LEVEL_APPROVED, ""
+	case model.APPROVALSTATUS_REJECTED:
+		writeStderr(sess, stderr, myi18n.MsgSshCommandRejected, map[string]any{"Command": a.Cmd, "Approver": a.Approver})
+		result = fmt.Sprintf("rejected by %s", a.Approver)
+	case model.APPROVALSTATUS_EXPIRED:
+		writeStderr(sess, stderr, myi18n.MsgSshCommandApprovalTimeout, map[string]any{"Command": a.Cmd})
+		result = "approval timeout"
+	default:
+		result = "canceled"
+	}
+	return model.SESSIONCMD_LEVEL_REJECTED, result
+}
+
+// copyStdin forwards the input of an exec request line by line, every line is checked by the command filter and recorded before it is sent.
+// Input stops at a refused line. Approvals are not waited for since they are served by the loop of the session,
+// and lines too long to be checked are refused if the filter has any command
+func copyStdin(sess *gsession.Session) {
+	chs := sess.Chans
+	defer chs.Win.Close()
+	stderr := &execStderr{sess: sess, w: sess.CliRw.Stderr}
+	cut := false
+	for {
+		bs, more, err := readLine(sess.CliRw.Reader, maxStdinLine)
+		if len(bs) > 0 {
+			s := string(bs)
+			if more || cut {
+				if !sess.CmdFilter.Load().Empty() {
+					sess.SshParser.Stdin(lo.Substring(s, 0, maxStdinShown), model.SESSIONCMD_LEVEL_BLOCKED, "line too long")
+					writeStderr(sess, stderr, myi18n.MsgSshCommandRefused, map[string]any{"Command": lo.Substring(s, 0, maxStdinShown) + "..."})
+					return
+				}
+			} else if line, cmd := sess.CmdFilter.Load().Match(s); cmd != nil {
+				sess.SshParser.Stdin(line, model.SESSIONCMD_LEVEL_BLOCKED, lo.Ternary(cmd.Action == model.COMMANDACTION_APPROVE,
+					"approval is not supported for input", fmt.Sprintf("blocked by %s", cmd.Name)))
+				writeStderr(sess, stderr, myi18n.MsgSshCommandRefused, map[string]any{"Command": line})
+				return
+			} else {
+				sess.SshParser.Stdin(s, model.SESSIONCMD_LEVEL_NORMAL, "")
+			}
+			if _, err := chs.Win.Write(bs); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+		cut = more
+	}
+}
+
+// readLine reads a line with its line feed, lines longer than max are read in pieces and more is true until the last piece
+func readLine(r *bufio.Reader, max int) (line []byte, more bool, err error) {
+	for len(line) < max {
+		var frag []byte
+		frag, err = r.ReadSlice('\n')
+		line = append(line, frag...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return
+		}
+		err = nil
+	}
+	return line, true, nil
+}
+
+func writeStderr(sess *gsession.Session, w io.Writer, msg *i18n.Message, data map[string]any) {
+	s, _ := sess.Localizer.Localize(&i18n.LocalizeConfig{
+		DefaultMessage: msg,
+		TemplateData:   data,
+	})
+	w.Write([]byte(s + "\n"))
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	ee := &gossh.ExitError{}
+	if errors.As(err, &ee) {
+		return ee.ExitStatus()
+	}
+	return 255
+}
+
+// execStderr writes stderr of commands to the client and the recording
+type execStderr struct {
+	sess *gsession.Session
+	w    io.Writer
+}
+
+func (e *execStderr) Write(p []byte) (int, error) {
+	e.sess.SshRecoder.Write(p)
+	if e.w == nil {
+		return len(p), nil
+	}
+	return e.w.Write(p)
+}
+
 func connectGuacd(ctx *gin.Context, sess *gsession.Session, asset *model.Asset, account *model.Account, gateway *model.Gateway) (err error) {
 	chs := sess.Chans
 	defer func() {
@@ -545,19 +854,40 @@ func (c *Controller) ConnectMonitor(ctx *gin.Context) {
 		return
 	}
 
+	key := fmt.Sprintf("%d-%s-%d", currentUser.Uid, sessionId, time.Now().Nanosecond())
+	g, gctx := errgroup.WithContext(ctx)
 	if sess = gsession.GetOnlineSessionById(sessionId); sess == nil {
-		err = &ApiError{Code: ErrInvalidSessionId, Data: map[string]any{"sessionId": sessionId}}
-		return
+		// the session is served by another node, its output and end are relayed over redis
+		if sess = gsession.GetRemoteSession(gctx, sessionId, key); sess == nil {
+			err = &ApiError{Code: ErrInvalidSessionId, Data: map[string]any{"sessionId": sessionId}}
+			return
+		}
+		g.Go(func() error {
+			select {
+			case <-gctx.Done():
+			case <-sess.Chans.AwayChan:
+				localizer := i18n.NewLocalizer(myi18n.Bundle, ctx.Query("lang"), ctx.GetHeader("Accept-Language"))
+				msg, _ := localizer.Localize(&i18n.LocalizeConfig{
+					TemplateData:   map[string]any{"sessionId": sessionId},
+					DefaultMessage: myi18n.MsgSessionEnd,
+				})
+				ws.WriteMessage(websocket.TextMessage, []byte(msg))
+				ws.Close()
+			}
+			return nil
+		})
 	}
 
-	g, gctx := errgroup.WithContext(ctx)
+	if sess.IsTunnel() || sess.IsDb() {
+		err = &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "tunnels and databases can not be monitored"}}
+		return
+	}
 	if !sess.IsSsh() {
 		g.Go(func() error {
 			return monitGuacd(ctx, sess, chs, ws)
 		})
 	}
 
-	key := fmt.Sprintf("%d-%s-%d", currentUser.Uid, sessionId, time.Now().Nanosecond())
 	sess.Monitors.Store(key, ws)
 	defer sess.Monitors.Delete(key)
 
@@ -679,39 +1009,13 @@ func (c *Controller) ConnectClose(ctx *gin.Context) {
 
 func offlineSession(ctx *gin.Context, sessionId string, closer string) {
 	logger.L().Debug("offline", zap.String("session_id", sessionId), zap.String("closer", closer))
-	defer gsession.GetOnlineSession().Delete(sessionId)
-	session := gsession.GetOnlineSessionById(sessionId)
-	if session == nil {
-		return
-	}
-	if closer != "" && session.Chans != nil {
-		select {
-		case session.Chans.CloseChan <- closer:
-			break
-		case <-time.After(time.Second):
-			break
-		}
-
-	}
-	session.Monitors.Range(func(key, value any) bool {
-		ws, ok := value.(*websocket.Conn)
-		if ok && ws != nil {
-			lang := ctx.PostForm("lang")
-			accept := ctx.GetHeader("Accept-Language")
-			localizer := i18n.NewLocalizer(myi18n.Bundle, lang, accept)
-			cfg := &i18n.LocalizeConfig{
-				TemplateData:   map[string]any{"sessionId": sessionId},
-				DefaultMessage: myi18n.MsgSessionEnd,
-			}
-			msg, _ := localizer.Localize(cfg)
-			ws.WriteMessage(websocket.TextMessage, []byte(msg))
-			ws.Close()
-		}
-		return true
-	})
+	lang := ctx.PostForm("lang")
+	accept := ctx.GetHeader("Accept-Language")
+	gsession.OfflineSession(sessionId, closer, i18n.NewLocalizer(myi18n.Bundle, lang, accept))
 }
 
-func checkTime(data *model.AccessAuth) bool {
+// CheckTime reports whether now is in the access time of an asset
+func CheckTime(data *model.AccessAuth) bool {
 	now := time.Now()
 	in := true
 	if (data.Start != nil && now.Before(*data.Start)) || (data.End != nil && now.After(*data.End)) {
@@ -739,6 +1043,74 @@ func checkAuthorization(user *acl.Session, asset *model.Asset, accountId int) bo
 	return acl.IsAdmin(user) || lo.Contains(asset.Authorization[accountId], user.GetRid())
 }
 
+// newClientSession returns a session of user connecting to the protocol of the asset as the account by a client other than the web
+func newClientSession(ctx *gin.Context, user *acl.Session, asset *model.Asset, account *model.Account, gateway *model.Gateway, protocol string) *gsession.Session {
+	sess := gsession.NewSession(ctx)
+	sess.Session = &model.Session{
+		SessionType: model.SESSIONTYPE_CLIENT,
+		SessionId:   uuid.New().String(),
+		Uid:         user.GetUid(),
+		UserName:    user.GetUserName(),
+		AssetId:     asset.Id,
+		AssetInfo:   fmt.Sprintf("%s(%s)", asset.Name, asset.Ip),
+		AccountId:   account.Id,
+		AccountInfo: fmt.Sprintf("%s(%s)", account.Name, account.Account),
+		GatewayId:   asset.GatewayId,
+		GatewayInfo: lo.Ternary(asset.GatewayId == 0, "", fmt.Sprintf("%s(%s)", gateway.Name, gateway.Host)),
+		Protocol:    protocol,
+		ClientIp:    ctx.RemoteIP(),
+		Status:      model.SESSIONSTATUS_ONLINE,
+	}
+	return sess
+}
+
+// serveClientSession saves the session online and runs relays in it until one of them ends, the access time of the asset is over
+// or an admin closes the session. closers are closed then to stop the other relays and the session is saved offline after they return
+func serveClientSession(sess *gsession.Session, asset *model.Asset, closers []io.Closer, relays ...func() error) {
+	gsession.RegisterSession(sess)
+	gsession.UpsertSession(sess)
+	defer func() {
+		gsession.UnregisterSession(sess.SessionId)
+		sess.Status = model.SESSIONSTATUS_OFFLINE
+		sess.ClosedAt = lo.ToPtr(time.Now())
+		if err := gsession.UpsertSession(sess); err != nil {
+			logger.L().Error("offline session failed", zap.String("id", sess.SessionId), zap.Error(err))
+		}
+	}()
+
+	for _, relay := range relays {
+		sess.G.Go(relay)
+	}
+	sess.G.Go(func() error {
+		defer func() {
+			for _, c := range closers {
+				c.Close()
+			}
+		}()
+		tk := time.NewTicker(time.Minute)
+		defer tk.Stop()
+		for {
+			select {
+			case <-sess.Gctx.Done():
+				return nil
+			case <-tk.C:
+				if mysql.DB.Model(asset).Where("id = ?", sess.AssetId).First(asset).Error != nil {
+					continue
+				}
+				if !CheckTime(asset.AccessAuth) {
+					return &ApiError{Code: ErrAccessTime}
+				}
+			case closeBy := <-sess.Chans.CloseChan:
+				return &ApiError{Code: ErrAdminClose, Data: map[string]any{"admin": closeBy}}
+			}
+		}
+	})
+
+	if err := sess.G.Wait(); err != nil {
+		logger.L().Debug("session end", zap.String("id", sess.SessionId), zap.String("protocol", sess.Protocol), zap.Error(err))
+	}
+}
+
 func handleError(ctx *gin.Context, sess *gsession.Session, err error, ws *websocket.Conn, chs *gsession.SessionChans) {
 	defer func() {
 		if chs == nil {
@@ -769,3 +1141,13 @@ func idleTime() (d time.Duration) {
 	d = time.Second * time.Duration(cfg.Timeout)
 	return
 }
+
+func approvalTime() (d time.Duration) {
+	d = approvalTimeout
+	cfg := &model.Config{}
+	if err := mysql.DB.Where(cfg).First(cfg).Error; err != nil || cfg.ApprovalTimeout <= 0 {
+		return
+	}
+	d = time.Second * time.Duration(cfg.ApprovalTimeout)
+	return
+}
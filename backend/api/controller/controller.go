@@ -275,7 +275,10 @@ func doUpdate[T model.Model](ctx *gin.Context, needAcl bool, md T, preHooks ...p
 			if cast.ToBool(ctx.Value("isAuthWithKey")) {
 				selects = []string{"ip", "protocols", "authorization"}
 			}
+		case *model.Gateway:
+			omits = append(omits, "status", "last_seen_at", "agent_key", "enroll_token", "enroll_expired_at")
 		case *model.Account:
+			omits = append(omits, "rotated_at")
 			if cast.ToBool(ctx.Value("isAuthWithKey")) {
 				selects = []string{"password", "phrase", "pk", "account_type"}
 			}
@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+
+	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/conf"
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/dbproxy"
+	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+	gsession "github.com/veops/oneterm/session"
+	"github.com/veops/oneterm/util"
+)
+
+const (
+	dbTokenTTL = time.Minute * 5
+	// maxStmtLen is runes of statements recorded, the rest is dropped
+	maxStmtLen = 16384
+)
+
+// DbConn is a client of the database proxy which has logged in by a token
+type DbConn interface {
+	// Login authenticates to the database on remote as user
+	Login(remote net.Conn, user, password string) error
+	// Relay forwards between the client and the database until either side closes,
+	// statements are passed to audit before they are sent and are refused if it returns an error
+	Relay(audit dbproxy.Audit) error
+	Close() error
+}
+
+// serverNamer is a DbConn verifying the certificate or the pinned key of the database by its host
+type serverNamer interface {
+	SetServerName(host string)
+}
+
+// DbProxyPort returns the port the database proxy listens on for the protocol, 0 means it is not proxied
+func DbProxyPort(protocol string) int {
+	switch strings.ToLower(strings.Split(protocol, ":")[0]) {
+	case "mysql":
+		return conf.Cfg.DbProxy.MysqlPort
+	case "postgresql":
+		return conf.Cfg.DbProxy.PostgresqlPort
+	case "redis":
+		return conf.Cfg.DbProxy.RedisPort
+	}
+	return 0
+}
+
+// ConnectToken godoc
+//
+//	@Tags		connect
+//	@Param		asset_id	path		int		true	"asset id"
+//	@Param		account_id	path		int		true	"account id"
+//	@Param		protocol	path		string	true	"protocol, e.g. mysql:3306, postgresql:5432 or redis:6379"
+//	@Success	200			{object}	HttpResponse{data=map[string]any}
+//	@Router		/connect/token/:asset_id/:account_id/:protocol [post]
+func (c *Controller) ConnectToken(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+
+	assetId, accountId := cast.ToInt(ctx.Param("asset_id")), cast.ToInt(ctx.Param("account_id"))
+	asset, _, _, err := util.GetAAG(assetId, accountId)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+		return
+	}
+	if !checkAuthorization(currentUser, asset, accountId) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": "connect"}})
+		return
+	}
+	protocol := ctx.Param("protocol")
+	port := DbProxyPort(protocol)
+	if port == 0 || !lo.Contains(asset.Protocols, protocol) {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": fmt.Sprintf("%s is not proxied for the asset", protocol)}})
+		return
+	}
+
+	token, err := gsession.NewDbToken(ctx, currentUser, assetId, accountId, protocol, dbTokenTTL)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
+		return
+	}
+	host, _, err := net.SplitHostPort(ctx.Request.Host)
+	if err != nil {
+		host = ctx.Request.Host
+	}
+
+	ctx.JSON(http.StatusOK, NewHttpResponseWithData(map[string]any{
+		"host":       host,
+		"port":       port,
+		"user":       token.Id,
+		"password":   token.Secret,
+		"expired_at": token.ExpiredAt,
+	}))
+}
+
+// ConnectDb logs dc in to the database of the protocol param as the account and relays it.
+// Statements are checked by the command filters of the asset and recorded as commands of the session.
+// dc is left open if it fails to login so that the error can be told in its protocol
+func ConnectDb(ctx *gin.Context, dc DbConn) (err error) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+
+	assetId, accountId := cast.ToInt(ctx.Param("asset_id")), cast.ToInt(ctx.Param("account_id"))
+	asset, account, gateway, err := util.GetAAG(assetId, accountId)
+	if err != nil {
+		return
+	}
+	if !CheckTime(asset.AccessAuth) {
+		return &ApiError{Code: ErrAccessTime}
+	}
+	if !checkAuthorization(currentUser, asset, accountId) {
+		return &ApiError{Code: ErrLogin}
+	}
+	protocol := ctx.Param("protocol")
+	if !lo.Contains(asset.Protocols, protocol) {
+		return &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": fmt.Sprintf("%s is not a protocol of the asset", protocol)}}
+	}
+
+	sess := newClientSession(ctx, currentUser, asset, account, gateway, protocol)
+	filter, err := gsession.NewCmdFilter(asset.CmdIds)
+	if err != nil {
+		return
+	}
+	sess.CmdFilter.Store(filter)
+
+	defer ggateway.GetGatewayManager().Close(sess.SessionId)
+	remote, err := util.Proxy(ctx, sess.SessionId, strings.ToLower(strings.Split(protocol, ":")[0]), asset, gateway)
+	if err != nil {
+		return &ApiError{Code: ErrConnectServer, Data: map[string]any{"err": err}}
+	}
+	defer remote.Close()
+	if sn, ok := dc.(serverNamer); ok {
+		sn.SetServerName(asset.Ip)
+	}
+	if err = dc.Login(remote, account.Account, account.Password); err != nil {
+		return &ApiError{Code: ErrConnectServer, Data: map[string]any{"err": err}}
+	}
+
+	serveClientSession(sess, asset, []io.Closer{dc, remote}, func() error {
+		return fmt.Errorf("db closed %w", dc.Relay(func(stmt, shown string) (func(result string), error) {
+			return auditStmt(sess, stmt, shown)
+		}))
+	})
+
+	return nil
+}
+
+// auditStmt records shown as a command of the session and checks stmt, it returns an error if stmt is blocked or not approved.
+// Otherwise done sets the result of the command once the database has run it
+func auditStmt(sess *gsession.Session, stmt, shown string) (done func(result string), err error) {
+	c := &model.SessionCmd{
+		SessionId: sess.SessionId,
+		Cmd:       lo.Substring(shown, 0, maxStmtLen),
+		Level:     model.SESSIONCMD_LEVEL_NORMAL,
+		CreatedAt: time.Now(),
+	}
+	defer func() {
+		if err != nil {
+			c.Result = err.Error()
+		} else {
+			done = func(result string) {
+				if err := mysql.DB.Model(c).Update("result", result).Error; err != nil {
+					logger.L().Error("record session cmd result failed", zap.String("sessionId", sess.SessionId), zap.Error(err))
+				}
+			}
+		}
+		if err := mysql.DB.Create(c).Error; err != nil {
+			logger.L().Error("record session cmd failed", zap.String("sessionId", sess.SessionId), zap.Error(err))
+		}
+	}()
+
+	line, cmd := sess.CmdFilter.Load().Match(dbproxy.Statements(stmt)...)
+	if cmd == nil {
+		return
+	}
+	if cmd.Action != model.COMMANDACTION_APPROVE {
+		c.Level = model.SESSIONCMD_LEVEL_BLOCKED
+		return nil, fmt.Errorf("blocked by %s", cmd.Name)
+	}
+
+	// the client waits for the result of the statement until it is approved
+	a := gsession.NewApproval(sess, line, cmd, approvalTime())
+	select {
+	case a = <-sess.Chans.ApprovalChan:
+	case <-sess.Gctx.Done():
+		gsession.ResolveApproval(a.Id, model.APPROVALSTATUS_CANCELED, "")
+		a.Status = model.APPROVALSTATUS_CANCELED
+	}
+	switch a.Status {
+	case model.APPROVALSTATUS_APPROVED:
+		c.Level = model.SESSIONCMD_LEVEL_APPROVED
+		return
+	case model.APPROVALSTATUS_REJECTED:
+		err = fmt.Errorf("rejected by %s", a.Approver)
+	case model.APPROVALSTATUS_EXPIRED:
+		err = fmt.Errorf("approval timeout")
+	default:
+		err = fmt.Errorf("canceled")
+	}
+	c.Level = model.SESSIONCMD_LEVEL_REJECTED
+	return
+}
@@ -1,9 +1,13 @@
 package controller
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/samber/lo"
@@ -12,15 +16,42 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/agent"
 	"github.com/veops/oneterm/conf"
 	mysql "github.com/veops/oneterm/db"
+	ggateway "github.com/veops/oneterm/gateway"
 	"github.com/veops/oneterm/model"
 	"github.com/veops/oneterm/util"
 )
 
+const (
+	enrollTokenTTL = time.Hour * 24
+	// agentOfflineAfter is when agents of nodes gone without updating status are regarded as offline
+	agentOfflineAfter = agent.KeepAliveInterval * 3
+)
+
 var (
 	gatewayPreHooks = []preHook[*model.Gateway]{
 		func(ctx *gin.Context, data *model.Gateway) {
+			if data.Type == model.GATEWAYTYPE_GROUP {
+				data.Host, data.Port, data.Account, data.Password, data.Pk, data.Phrase, data.SecretPath, data.ParentId = "", 0, "", "", "", "", "", 0
+				return
+			}
+			data.MemberIds = nil
+			if data.Type == model.GATEWAYTYPE_AGENT {
+				if data.ParentId != 0 {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "agents dial out to oneterm and can not have a parent gateway"}})
+					return
+				}
+				data.Host, data.Port, data.Account, data.Password, data.Pk, data.Phrase, data.SecretPath = "", 0, "", "", "", "", ""
+				return
+			}
+			if data.SecretPath != "" {
+				if _, err := util.GetSecret(ctx, data.SecretPath); err != nil {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+				}
+				return
+			}
 			if data.AccountType == model.AUTHMETHOD_PUBLICKEY {
 				if data.Phrase == "" {
 					_, err := ssh.ParsePrivateKey([]byte(data.Pk))
@@ -38,6 +69,57 @@ var (
 			}
 		},
 		func(ctx *gin.Context, data *model.Gateway) {
+			if data.Type != model.GATEWAYTYPE_GROUP {
+				return
+			}
+			id := cast.ToInt(ctx.Param("id"))
+			data.MemberIds = lo.Uniq(data.MemberIds)
+			if len(data.MemberIds) == 0 || lo.Contains(data.MemberIds, id) {
+				ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "gateway group needs members other than itself"}})
+				return
+			}
+			members := make([]*model.Gateway, 0)
+			if err := mysql.DB.Model(&model.Gateway{}).Where("id IN ?", []int(data.MemberIds)).Find(&members).Error; err != nil {
+				ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
+				return
+			}
+			if len(members) != len(data.MemberIds) || lo.ContainsBy(members, func(m *model.Gateway) bool { return m.Type == model.GATEWAYTYPE_GROUP }) {
+				ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "members of gateway group should be existing gateways which are not groups"}})
+				return
+			}
+			if id == 0 {
+				return
+			}
+			cnt := int64(0)
+			if err := mysql.DB.Model(&model.Gateway{}).Where(fmt.Sprintf("parent_id = ? OR JSON_CONTAINS(member_ids, '%d')", id), id).Count(&cnt).Error; err != nil || cnt > 0 {
+				ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "gateway which is a parent or a member of groups can not be a group"}})
+				return
+			}
+		},
+		func(ctx *gin.Context, data *model.Gateway) {
+			id := cast.ToInt(ctx.Param("id"))
+			for pid, hops := data.ParentId, 1; pid != 0; hops++ {
+				if pid == id || hops >= util.MaxGatewayHops {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": fmt.Sprintf("parent gateway makes a loop or a chain longer than %d hops", util.MaxGatewayHops)}})
+					return
+				}
+				parent := &model.Gateway{}
+				if err := mysql.DB.Model(parent).Where("id = ?", pid).First(parent).Error; err != nil {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+					return
+				}
+				if parent.Type == model.GATEWAYTYPE_GROUP {
+					ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "gateway group can not be a parent"}})
+					return
+				}
+				pid = parent.ParentId
+			}
+		},
+		func(ctx *gin.Context, data *model.Gateway) {
+			if data.SecretPath != "" {
+				data.Password, data.Pk, data.Phrase = "", "", ""
+				return
+			}
 			data.Password = util.EncryptAES(data.Password)
 			data.Pk = util.EncryptAES(data.Pk)
 			data.Phrase = util.EncryptAES(data.Phrase)
@@ -60,6 +142,19 @@ var (
 				d.AssetCount = m[d.Id]
 			}
 		},
+		func(ctx *gin.Context, data []*model.Gateway) {
+			for _, d := range data {
+				h := lo.TernaryF(d.Type == model.GATEWAYTYPE_GROUP,
+					func() ggateway.Health { return ggateway.GetGatewayManager().GroupHealth(d.MemberIds...) },
+					func() ggateway.Health { return ggateway.GetGatewayManager().Health(d.Id) })
+				d.Latency, d.LastError, d.TunnelCount = h.Latency.Milliseconds(), h.LastError, h.Tunnels
+				if d.Type != model.GATEWAYTYPE_AGENT {
+					d.Status = h.Status
+				} else if d.LastSeenAt == nil || time.Since(*d.LastSeenAt) > agentOfflineAfter {
+					d.Status = model.GATEWAYSTATUS_OFFLINE
+				}
+			}
+		},
 		func(ctx *gin.Context, data []*model.Gateway) {
 			for _, d := range data {
 				d.Password = util.DecryptAES(d.Password)
@@ -84,6 +179,21 @@ var (
 			err = lo.Ternary[error](err == nil, &ApiError{Code: ErrHasDepency, Data: map[string]any{"name": assetName}}, err)
 			ctx.AbortWithError(code, err)
 		},
+		func(ctx *gin.Context, id int) {
+			gatewayName := ""
+			err := mysql.DB.
+				Model(&model.Gateway{}).
+				Select("name").
+				Where(fmt.Sprintf("parent_id = ? OR JSON_CONTAINS(member_ids, '%d')", id), id).
+				First(&gatewayName).
+				Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return
+			}
+			code := lo.Ternary(err == nil, http.StatusBadRequest, http.StatusInternalServerError)
+			err = lo.Ternary[error](err == nil, &ApiError{Code: ErrHasDepency, Data: map[string]any{"name": gatewayName}}, err)
+			ctx.AbortWithError(code, err)
+		},
 	}
 )
 
@@ -118,6 +228,49 @@ func (c *Controller) UpdateGateway(ctx *gin.Context) {
 	doUpdate(ctx, true, &model.Gateway{}, gatewayPreHooks...)
 }
 
+// EnrollGateway godoc
+//
+//	@Tags		gateway
+//	@Param		id	path		int	true	"gateway id"
+//	@Success	200	{object}	HttpResponse{data=map[string]any}
+//	@Router		/gateway/:id/enroll [post]
+func (c *Controller) EnrollGateway(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": "enroll agent"}})
+		return
+	}
+
+	gateway := &model.Gateway{}
+	if err := mysql.DB.Model(gateway).Where("id = ? AND type = ?", cast.ToInt(ctx.Param("id")), model.GATEWAYTYPE_AGENT).First(gateway).Error; err != nil {
+		code := lo.Ternary(errors.Is(err, gorm.ErrRecordNotFound), http.StatusBadRequest, http.StatusInternalServerError)
+		ctx.AbortWithError(code, &ApiError{Code: lo.Ternary(code == http.StatusBadRequest, ErrInvalidArgument, ErrInternal), Data: map[string]any{"err": err}})
+		return
+	}
+
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
+		return
+	}
+	token, expiredAt := hex.EncodeToString(bs), time.Now().Add(enrollTokenTTL)
+	// the agent enrolled before has to enroll again
+	if err := mysql.DB.
+		Model(gateway).
+		Where("id = ?", gateway.Id).
+		UpdateColumns(map[string]any{"agent_key": "", "enroll_token": ggateway.EnrollTokenHash(token), "enroll_expired_at": &expiredAt, "updater_id": currentUser.Uid}).
+		Error; err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, NewHttpResponseWithData(map[string]any{
+		"token":      token,
+		"user":       agent.User(gateway.Id),
+		"expired_at": expiredAt,
+	}))
+}
+
 // GetGateways godoc
 //
 //	@Tags		gateway
@@ -128,7 +281,7 @@ func (c *Controller) UpdateGateway(ctx *gin.Context) {
 //	@Param		ids			query		string	false	"gateway ids"
 //	@Param		name		query		string	false	"gateway name"
 //	@Param		info		query		bool	false	"is info mode"
-//	@Param		type		query		int		false	"account type"
+//	@Param		type		query		int		false	"gateway type, ssh=0 agent=1 group=2"
 //	@Success	200			{object}	HttpResponse{data=ListData{list=[]model.Gateway}}
 //	@Router		/gateway [get]
 func (c *Controller) GetGateways(ctx *gin.Context) {
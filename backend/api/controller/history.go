@@ -16,10 +16,10 @@ import (
 //	@Tags		history
 //	@Param		page_index	query		int		true	"page_index"
 //	@Param		page_size	query		int		true	"page_size"
-//	@Param		type		query		string	false	"type"	Enums(account, asset, command, gateway, node, public_key)
+//	@Param		type		query		string	false	"type"	Enums(account, asset, command, gateway, host_key, node, public_key)
 //	@Param		target_id	query		int		false	"target_id"
 //	@Param		uid			query		int		false	"uid"
-//	@Param		action_type	query		int		false	"create=1 delete=2 update=3"
+//	@Param		action_type	query		int		false	"create=1 delete=2 update=3 rotate=4 key_change=5"
 //	@Param		start		query		string	false	"start time, RFC3339"
 //	@Param		end			query		string	false	"end time, RFC3339"
 //	@Param		search		query		string	false	"search"
@@ -52,6 +52,7 @@ func (c *Controller) GetHistoryTypeMapping(ctx *gin.Context) {
 		"asset":      myi18n.MsgTypeMappingAsset,
 		"command":    myi18n.MsgTypeMappingCommand,
 		"gateway":    myi18n.MsgTypeMappingGateway,
+		"host_key":   myi18n.MsgTypeMappingHostKey,
 		"node":       myi18n.MsgTypeMappingNode,
 		"public_key": myi18n.MsgTypeMappingPublicKey,
 	}
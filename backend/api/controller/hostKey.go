@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"gorm.io/gorm"
+
+	"github.com/veops/oneterm/acl"
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/hostkey"
+	"github.com/veops/oneterm/model"
+)
+
+var (
+	hostKeyPreHooks = []preHook[*model.HostKey]{
+		func(ctx *gin.Context, data *model.HostKey) {
+			currentUser, _ := acl.GetSessionFromCtx(ctx)
+			if !acl.IsAdmin(currentUser) {
+				ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": acl.WRITE}})
+			}
+		},
+		func(ctx *gin.Context, data *model.HostKey) {
+			if (data.AssetId == 0) == (data.GatewayId == 0) || data.Port <= 0 {
+				ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "one of asset_id and gateway_id and port are required"}})
+				return
+			}
+			if err := hostkey.Parse(data, data.Key); err != nil {
+				ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrWrongPk, Data: nil})
+				return
+			}
+			data.Status = model.HOSTKEY_STATUS_TRUSTED
+			cnt := int64(0)
+			if err := hostkey.Scope(mysql.DB.Model(data), data).Where("status = ?", model.HOSTKEY_STATUS_TRUSTED).Count(&cnt).Error; err != nil {
+				ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
+				return
+			}
+			if cnt > 0 {
+				ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": "host key is already trusted, reset it first"}})
+			}
+		},
+	}
+	hostKeyDcs = []deleteCheck{
+		func(ctx *gin.Context, id int) {
+			currentUser, _ := acl.GetSessionFromCtx(ctx)
+			if !acl.IsAdmin(currentUser) {
+				ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": acl.DELETE}})
+			}
+		},
+	}
+)
+
+// CreateHostKey godoc
+//
+//	@Tags		host_key
+//	@Param		hostKey	body		model.HostKey	true	"host key, key is in authorized_keys format"
+//	@Success	200		{object}	HttpResponse
+//	@Router		/host_key [post]
+func (c *Controller) CreateHostKey(ctx *gin.Context) {
+	doCreate(ctx, false, &model.HostKey{}, "", hostKeyPreHooks...)
+}
+
+// DeleteHostKey godoc
+//
+//	@Tags		host_key
+//	@Param		id	path		int	true	"host key id"
+//	@Success	200	{object}	HttpResponse
+//	@Router		/host_key/:id [delete]
+func (c *Controller) DeleteHostKey(ctx *gin.Context) {
+	doDelete(ctx, false, &model.HostKey{}, hostKeyDcs...)
+}
+
+// ApproveHostKey godoc
+//
+//	@Tags		host_key
+//	@Param		id	path		int	true	"host key id"
+//	@Success	200	{object}	HttpResponse
+//	@Router		/host_key/:id/approve [post]
+func (c *Controller) ApproveHostKey(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": acl.WRITE}})
+		return
+	}
+
+	pending := &model.HostKey{}
+	if err := mysql.DB.Model(pending).Where("id = ? AND status = ?", cast.ToInt(ctx.Param("id")), model.HOSTKEY_STATUS_PENDING).First(pending).Error; err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			code, err = http.StatusBadRequest, fmt.Errorf("no pending host key")
+		}
+		ctx.AbortWithError(code, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+		return
+	}
+
+	if err := mysql.DB.Transaction(func(tx *gorm.DB) (err error) {
+		trusted := &model.HostKey{}
+		if err = hostkey.Scope(tx.Model(trusted), pending).Where("status = ?", model.HOSTKEY_STATUS_TRUSTED).First(trusted).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return
+		}
+		if err = hostkey.Scope(tx, pending).Where("status = ?", model.HOSTKEY_STATUS_TRUSTED).Delete(&model.HostKey{}).Error; err != nil {
+			return
+		}
+		pending.Status, pending.UpdaterId = model.HOSTKEY_STATUS_TRUSTED, currentUser.Uid
+		if err = tx.Model(pending).Select("status", "updater_id").Updates(pending).Error; err != nil {
+			return
+		}
+		h := &model.History{
+			RemoteIp:   ctx.ClientIP(),
+			Type:       pending.TableName(),
+			TargetId:   pending.Id,
+			ActionType: model.ACTION_UPDATE,
+			New:        hostkey.ToMap(pending),
+			CreatorId:  currentUser.Uid,
+			CreatedAt:  time.Now(),
+		}
+		if trusted.Id > 0 {
+			h.Old = hostkey.ToMap(trusted)
+		}
+		return tx.Create(h).Error
+	}); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, defaultHttpResponse)
+}
+
+// GetHostKeys godoc
+//
+//	@Tags		host_key
+//	@Param		page_index	query		int		true	"page_index"
+//	@Param		page_size	query		int		true	"page_size"
+//	@Param		asset_id	query		int		false	"asset id"
+//	@Param		gateway_id	query		int		false	"gateway id"
+//	@Param		port		query		int		false	"port"
+//	@Param		status		query		int		false	"trusted=1 pending=2"
+//	@Param		search		query		string	false	"fingerprint"
+//	@Success	200			{object}	HttpResponse{data=ListData{list=[]model.HostKey}}
+//	@Router		/host_key [get]
+func (c *Controller) GetHostKeys(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": acl.READ}})
+		return
+	}
+
+	db := mysql.DB.Model(&model.HostKey{})
+	db = filterEqual(ctx, db, "asset_id", "gateway_id", "port", "status")
+	db = filterSearch(ctx, db, "fingerprint")
+
+	doGet[*model.HostKey](ctx, false, db, "")
+}
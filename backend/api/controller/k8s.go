@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+
+	"github.com/veops/oneterm/acl"
+	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/k8s"
+	"github.com/veops/oneterm/model"
+	gsession "github.com/veops/oneterm/session"
+	"github.com/veops/oneterm/util"
+)
+
+const (
+	k8sDefaultShell = "sh"
+)
+
+// K8sNamespaces godoc
+//
+//	@Tags		k8s
+//	@Param		asset_id	path		int	true	"asset_id"
+//	@Param		account_id	path		int	true	"account_id"
+//	@Success	200			{object}	HttpResponse{data=ListData{list=[]string}}
+//	@Router		/k8s/namespaces/:asset_id/:account_id [get]
+func (c *Controller) K8sNamespaces(ctx *gin.Context) {
+	cli, sid, err := k8sClientFromCtx(ctx)
+	if err != nil {
+		return
+	}
+	defer ggateway.GetGatewayManager().Close(sid)
+	defer cli.Close()
+
+	namespaces, err := cli.Namespaces(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+		return
+	}
+	ctx.JSON(http.StatusOK, NewHttpResponseWithData(&ListData{
+		Count: int64(len(namespaces)),
+		List:  lo.ToAnySlice(namespaces),
+	}))
+}
+
+// K8sPods godoc
+//
+//	@Tags		k8s
+//	@Param		asset_id	path		int		true	"asset_id"
+//	@Param		account_id	path		int		true	"account_id"
+//	@Param		namespace	query		string	true	"namespace"
+//	@Success	200			{object}	HttpResponse{data=ListData{list=[]k8s.Pod}}
+//	@Router		/k8s/pods/:asset_id/:account_id [get]
+func (c *Controller) K8sPods(ctx *gin.Context) {
+	cli, sid, err := k8sClientFromCtx(ctx)
+	if err != nil {
+		return
+	}
+	defer ggateway.GetGatewayManager().Close(sid)
+	defer cli.Close()
+
+	pods, err := cli.Pods(ctx, ctx.Query("namespace"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+		return
+	}
+	ctx.JSON(http.StatusOK, NewHttpResponseWithData(&ListData{
+		Count: int64(len(pods)),
+		List:  lo.ToAnySlice(pods),
+	}))
+}
+
+func k8sClientFromCtx(ctx *gin.Context) (cli *k8s.Client, sid string, err error) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+	if !acl.IsAdmin(currentUser) && !HasAuthorization(ctx) {
+		err = &ApiError{Code: ErrNoPerm, Data: map[string]any{}}
+		ctx.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	asset, account, gateway, err := util.GetAAG(cast.ToInt(ctx.Param("asset_id")), cast.ToInt(ctx.Param("account_id")))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+		return
+	}
+	sid = uuid.New().String()
+	if cli, err = k8sClient(sid, asset, account, gateway); err != nil {
+		ggateway.GetGatewayManager().Close(sid)
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+	}
+	return
+}
+
+// k8sClient returns the client of the api server of the asset, it is dialed through the gateway for the session.
+// The address of the api server is always the asset, servers in kubeconfig are only used to verify certificates
+func k8sClient(sessionId string, asset *model.Asset, account *model.Account, gateway *model.Gateway) (*k8s.Client, error) {
+	cfg := &k8s.Config{}
+	switch account.AccountType {
+	case model.AUTHMETHOD_TOKEN:
+		cfg.Token, cfg.CAData = account.Password, []byte(account.Pk)
+	case model.AUTHMETHOD_KUBECONFIG:
+		var err error
+		if cfg, err = k8s.ParseKubeconfig([]byte(account.Pk)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("account of k8s should be a token or a kubeconfig")
+	}
+	cfg.Host = net.JoinHostPort(asset.Ip, cast.ToString(util.GetPort("k8s", asset)))
+	cfg.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return util.Proxy(ctx, sessionId, "k8s", asset, gateway)
+	}
+	return k8s.NewClient(cfg)
+}
+
+// connectK8s execs a shell in the container of query namespace, pod and container.
+// The shell is a command run without a terminal so it is checked by the command filter and recorded before it starts,
+// shells to be approved are refused as well since the connection is not held before the terminal is ready
+func connectK8s(ctx *gin.Context, sess *gsession.Session, asset *model.Asset, account *model.Account, gateway *model.Gateway) (err error) {
+	w, h := cast.ToInt(ctx.Query("w")), cast.ToInt(ctx.Query("h"))
+	chs := sess.Chans
+	defer func() {
+		ggateway.GetGatewayManager().Close(sess.SessionId)
+		if err != nil {
+			chs.ErrChan <- err
+		}
+	}()
+
+	namespace, pod, container := ctx.Query("namespace"), ctx.Query("pod"), ctx.Query("container")
+	if namespace == "" || pod == "" {
+		return fmt.Errorf("namespace and pod are required")
+	}
+	shell := lo.Ternary(ctx.Query("shell") == "", k8sDefaultShell, ctx.Query("shell"))
+	if line, cmd := sess.CmdFilter.Load().Match(shell); cmd != nil {
+		sess.SshParser.Reject(line, model.SESSIONCMD_LEVEL_BLOCKED, fmt.Sprintf("blocked by %s", cmd.Name))
+		return fmt.Errorf("shell %s is blocked by %s", line, cmd.Name)
+	}
+	cli, err := k8sClient(sess.SessionId, asset, account, gateway)
+	if err != nil {
+		return
+	}
+	defer cli.Close()
+	exec, err := cli.Exec(ctx, &k8s.ExecOptions{
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		Command:   strings.Fields(shell),
+		Width:     w,
+		Height:    h,
+	})
+	if err != nil {
+		return
+	}
+	defer exec.Close()
+	sess.SshParser.Exec(shell)
+	sess.Target = strings.TrimSuffix(fmt.Sprintf("%s/%s/%s", namespace, pod, container), "/")
+
+	chs.ErrChan <- nil
+
+	relayConn(sess, exec, exec.Resize, func(err error) error {
+		if err == nil {
+			err = exec.Err()
+		}
+		return fmt.Errorf("k8s exec end %w", err)
+	})
+
+	return
+}
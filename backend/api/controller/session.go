@@ -2,10 +2,7 @@ package controller
 
 import (
 	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,6 +13,7 @@ import (
 	mysql "github.com/veops/oneterm/db"
 	"github.com/veops/oneterm/logger"
 	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/replay"
 )
 
 var (
@@ -173,20 +171,13 @@ func (c *Controller) CreateSessionReplay(ctx *gin.Context) {
 		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
 		return
 	}
+	defer file.Close()
 
-	content, err := io.ReadAll(file)
-	if err != nil {
-		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
-		return
-	}
-
-	f, err := os.Create(filepath.Join("/replay", fmt.Sprintf("%s.cast", ctx.Param("session_id"))))
-	if err != nil {
+	name := fmt.Sprintf("%s.cast", ctx.Param("session_id"))
+	if err = replay.Save(ctx, name, file); err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
 		return
 	}
-	defer f.Close()
-	f.Write(content)
 
 	ctx.JSON(http.StatusOK, defaultHttpResponse)
 }
@@ -198,14 +189,25 @@ func (c *Controller) CreateSessionReplay(ctx *gin.Context) {
 //	@Success	200			{object}	string
 //	@Router		/session/replay/:session_id [get]
 func (c *Controller) GetSessionReplay(ctx *gin.Context) {
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
 	sessionId := ctx.Param("session_id")
 	session := &model.Session{}
 	if err := mysql.DB.Model(session).Where("session_id = ?", sessionId).First(session).Error; err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, &ApiError{Code: ErrInternal, Data: map[string]any{"err": err}})
+		return
+	}
+	if !acl.IsAdmin(currentUser) && session.Uid != currentUser.GetUid() {
+		ctx.AbortWithError(http.StatusForbidden, &ApiError{Code: ErrNoPerm, Data: map[string]any{"perm": acl.READ}})
+		return
 	}
-	filename := sessionId
-	if session.IsSsh() {
-		filename += ".cast"
+	filename := session.ReplayName()
+	rc, size, err := replay.Open(ctx, filename)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": err}})
+		return
 	}
-	ctx.FileAttachment(filepath.Join("/replay", filename), filename)
+	defer rc.Close()
+	ctx.DataFromReader(http.StatusOK, size, "application/octet-stream", rc, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, filename),
+	})
 }
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+
+	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/model"
+	gsession "github.com/veops/oneterm/session"
+	"github.com/veops/oneterm/telnet"
+	"github.com/veops/oneterm/util"
+)
+
+// connectTelnet connects to the telnet server of the asset and logs in with the account by answering its prompts
+func connectTelnet(ctx *gin.Context, sess *gsession.Session, asset *model.Asset, account *model.Account, gateway *model.Gateway) (err error) {
+	w, h := cast.ToInt(ctx.Query("w")), cast.ToInt(ctx.Query("h"))
+	chs := sess.Chans
+	defer func() {
+		ggateway.GetGatewayManager().Close(sess.SessionId)
+		if err != nil {
+			chs.ErrChan <- err
+		}
+	}()
+
+	conn, err := util.Proxy(ctx, sess.SessionId, "telnet", asset, gateway)
+	if err != nil {
+		return
+	}
+	tc := telnet.NewConn(conn, "xterm", w, h, account.Account, account.Password)
+	defer tc.Close()
+
+	chs.ErrChan <- nil
+
+	relayConn(sess, tc, tc.WindowChange, func(err error) error {
+		return fmt.Errorf("telnet connection closed %w", err)
+	})
+
+	return
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+
+	"github.com/veops/oneterm/acl"
+	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/util"
+)
+
+// ConnectTunnel forwards conn to the asset port of the protocol param "tunnel:<port>" through the gateway of the asset.
+// The tunnel is recorded as a session with bytes transferred in both directions and ends once the asset closes it
+func ConnectTunnel(ctx *gin.Context, conn io.ReadWriteCloser) (err error) {
+	defer conn.Close()
+	currentUser, _ := acl.GetSessionFromCtx(ctx)
+
+	assetId, accountId := cast.ToInt(ctx.Param("asset_id")), cast.ToInt(ctx.Param("account_id"))
+	asset, account, gateway, err := util.GetAAG(assetId, accountId)
+	if err != nil {
+		return
+	}
+	if !CheckTime(asset.AccessAuth) {
+		return &ApiError{Code: ErrAccessTime}
+	}
+	if !checkAuthorization(currentUser, asset, accountId) {
+		return &ApiError{Code: ErrLogin}
+	}
+	_, port, _ := strings.Cut(ctx.Param("protocol"), ":")
+	protocol, ok := lo.Find(asset.Protocols, func(p string) bool {
+		_, pt, _ := strings.Cut(p, ":")
+		return pt == port
+	})
+	if !ok {
+		return &ApiError{Code: ErrInvalidArgument, Data: map[string]any{"err": fmt.Sprintf("port %s is not a protocol of the asset", port)}}
+	}
+
+	sess := newClientSession(ctx, currentUser, asset, account, gateway, ctx.Param("protocol"))
+
+	defer ggateway.GetGatewayManager().Close(sess.SessionId)
+	remote, err := util.Proxy(ctx, sess.SessionId, strings.ToLower(protocol), asset, gateway)
+	if err != nil {
+		return &ApiError{Code: ErrConnectServer, Data: map[string]any{"err": err}}
+	}
+	defer remote.Close()
+
+	serveClientSession(sess, asset, []io.Closer{conn, remote},
+		func() (err error) {
+			sess.BytesIn, err = io.Copy(remote, conn)
+			if tc, ok := remote.(*net.TCPConn); ok {
+				tc.CloseWrite()
+			}
+			return
+		},
+		func() (err error) {
+			sess.BytesOut, err = io.Copy(conn, remote)
+			return fmt.Errorf("tunnel closed %w", err)
+		})
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package file
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -9,12 +10,14 @@ import (
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 
+	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/hostkey"
 	"github.com/veops/oneterm/util"
 )
 
 var (
 	fm = &FileManager{
-		sftps:    map[string]*sftp.Client{},
+		sftps:    map[string]*fileClient{},
 		lastTime: map[string]time.Time{},
 		mtx:      sync.Mutex{},
 	}
@@ -29,7 +32,10 @@ func init() {
 				fm.mtx.Lock()
 				defer fm.mtx.Unlock()
 				for k, v := range fm.lastTime {
-					if v.Before(time.Now().Add(time.Minute * 10)) {
+					if time.Since(v) > time.Minute*10 {
+						if fc, ok := fm.sftps[k]; ok {
+							fc.close()
+						}
 						delete(fm.sftps, k)
 						delete(fm.lastTime, k)
 					}
@@ -39,8 +45,21 @@ func init() {
 	}()
 }
 
+// fileClient is a cached sftp client, sid is the gateway session it is dialed through
+type fileClient struct {
+	cli    *sftp.Client
+	sshCli *ssh.Client
+	sid    string
+}
+
+func (fc *fileClient) close() {
+	fc.cli.Close()
+	fc.sshCli.Close()
+	ggateway.GetGatewayManager().Close(fc.sid)
+}
+
 type FileManager struct {
-	sftps    map[string]*sftp.Client
+	sftps    map[string]*fileClient
 	lastTime map[string]time.Time
 	mtx      sync.Mutex
 }
@@ -65,9 +84,8 @@ func (fm *FileManager) GetFileClient(assetId, accountId int) (cli *sftp.Client,
 		fm.lastTime[key] = time.Now()
 	}()
 
-	cli, ok := fm.sftps[key]
-	if ok {
-		return
+	if fc, ok := fm.sftps[key]; ok {
+		return fc.cli, nil
 	}
 
 	asset, account, gateway, err := util.GetAAG(assetId, accountId)
@@ -75,28 +93,36 @@ func (fm *FileManager) GetFileClient(assetId, accountId int) (cli *sftp.Client,
 		return
 	}
 
-	ip, port, err := util.Proxy(uuid.New().String(), "sftp,ssh", asset, gateway)
+	sid := uuid.New().String()
+	defer func() {
+		if err != nil {
+			ggateway.GetGatewayManager().Close(sid)
+		}
+	}()
+	auth, err := util.GetAuth(account, sid)
 	if err != nil {
 		return
 	}
 
-	auth, err := util.GetAuth(account)
+	conn, err := util.Proxy(context.Background(), sid, "sftp,ssh", asset, gateway)
 	if err != nil {
 		return
 	}
 
-	sshCli, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", ip, port), &ssh.ClientConfig{
-		User:            account.Account,
-		Auth:            []ssh.AuthMethod{auth},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         time.Second * 3,
-	})
+	sshCli, err := ggateway.NewClient(conn, hostkey.Config(&ssh.ClientConfig{
+		User:    account.Account,
+		Auth:    []ssh.AuthMethod{auth},
+		Timeout: time.Second * 3,
+	}, asset.Id, 0, util.GetPort("sftp,ssh", asset)))
 	if err != nil {
 		return
 	}
 
-	cli, err = sftp.NewClient(sshCli)
-	fm.sftps[key] = cli
+	if cli, err = sftp.NewClient(sshCli); err != nil {
+		sshCli.Close()
+		return
+	}
+	fm.sftps[key] = &fileClient{cli: cli, sshCli: sshCli, sid: sid}
 
 	return
 }
@@ -17,7 +17,6 @@ import (
 
 const (
 	VERSION          = "VERSION_1_5_0"
-	RECORDING_PATH   = "/replay"
 	CREATE_RECORDING = "true"
 	IGNORE_CERT      = "true"
 )
@@ -62,7 +61,7 @@ func NewTunnel(connectionId, sessionId string, w, h, dpi int, protocol string, a
 				func() map[string]string {
 					return map[string]string{
 						"version":               VERSION,
-						"recording-path":        RECORDING_PATH,
+						"recording-path":        conf.Cfg.Replay.Path,
 						"create-recording-path": CREATE_RECORDING,
 						"ignore-cert":           IGNORE_CERT,
 						"width":                 cast.ToString(w),
@@ -91,15 +90,18 @@ func NewTunnel(connectionId, sessionId string, w, h, dpi int, protocol string, a
 		t.Config.Parameters["recording-name"] = t.SessionId
 	}
 	if gateway != nil && gateway.Id != 0 && t.ConnectionId == "" {
-		t.gw, err = ggateway.GetGatewayManager().Open(t.SessionId, asset.Ip, cast.ToInt(port), gateway)
+		t.gw, err = ggateway.GetGatewayManager().Listen(t.SessionId, asset.Ip, cast.ToInt(port), gateway)
 		if err != nil {
+			conn.Close()
 			return t, err
 		}
-		t.Config.Parameters["hostname"] = "localhost"
+		t.Config.Parameters["hostname"] = t.gw.LocalIp
 		t.Config.Parameters["port"] = cast.ToString(t.gw.LocalPort)
 	}
 
-	err = t.handshake()
+	if err = t.handshake(); err != nil {
+		t.Close()
+	}
 
 	return
 }
@@ -210,6 +212,7 @@ func (t *Tunnel) assert(opcode string) (instruction *Instruction, err error) {
 	return
 }
 
+// Close closes the gateway listener of the tunnel, guacd can not connect to the asset afterwards
 func (t *Tunnel) Close() {
 	ggateway.GetGatewayManager().Close(t.SessionId)
 }
@@ -0,0 +1,37 @@
+// The agent runs inside a network oneterm can not reach and serves as a gateway of type agent, e.g.
+//
+//	oneterm-agent --server oneterm.example.com:2222 --gateway 3 --token <enrollment token>
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/veops/oneterm/agent"
+)
+
+func main() {
+	cfg := &agent.Config{}
+	pflag.StringVar(&cfg.Server, "server", "", "address of the ssh server of oneterm")
+	pflag.IntVar(&cfg.GatewayId, "gateway", 0, "id of the gateway")
+	pflag.StringVar(&cfg.Token, "token", os.Getenv("ONETERM_AGENT_TOKEN"), "enrollment token, it is only needed for the first connection")
+	pflag.StringVar(&cfg.KeyPath, "key", "oneterm-agent.key", "private key of the agent, it is generated if it does not exist")
+	pflag.Parse()
+
+	zap.ReplaceGlobals(zap.Must(zap.NewProduction()))
+	if cfg.Server == "" || cfg.GatewayId <= 0 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := agent.Run(ctx, cfg); err != nil {
+		zap.L().Fatal("agent stopped", zap.Error(err))
+	}
+}
@@ -34,6 +34,16 @@ var (
 		Auth: Auth{
 			Custom: map[string]string{},
 		},
+		Replay: ReplayConfig{
+			Path:    "/replay",
+			Storage: "local",
+		},
+		Secret: SecretConfig{
+			CacheTtl: 60,
+		},
+		DbProxy: DbProxyConfig{
+			Host: "0.0.0.0",
+		},
 	}
 )
 
@@ -112,6 +122,23 @@ type SshConfig struct {
 	Host       string `yaml:"host"`
 	Port       int    `yaml:"port"`
 	PrivateKey string `yaml:"privateKey"`
+	// CaKey signs certificates of accounts whose type is certificate
+	CaKey string `yaml:"caKey"`
+	// CertValidity is seconds certificates are valid, default is 300
+	CertValidity int `yaml:"certValidity"`
+}
+
+type DbProxyConfig struct {
+	Host string `yaml:"host"`
+	// MysqlPort is where mysql clients connect with one-time tokens, it is disabled if it is 0
+	MysqlPort int `yaml:"mysqlPort"`
+	// PostgresqlPort is where postgresql clients connect with one-time tokens, it is disabled if it is 0
+	PostgresqlPort int `yaml:"postgresqlPort"`
+	// RedisPort is where redis clients connect with one-time tokens, it is disabled if it is 0
+	RedisPort int `yaml:"redisPort"`
+	// MysqlServerKeys are pem encoded public keys of mysql databases by the hosts of their assets,
+	// accounts of caching_sha2_password needing full authentication login only to databases pinned here
+	MysqlServerKeys []*KV `yaml:"mysqlServerKeys"`
 }
 
 type GuacdConfig struct {
@@ -119,17 +146,66 @@ type GuacdConfig struct {
 	Port int    `yaml:"port"`
 }
 
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+}
+
+type ReplayConfig struct {
+	// Path where recordings are written while sessions are online, it must be shared with guacd
+	Path string `yaml:"path"`
+	// Storage where finished recordings are kept, local or s3
+	Storage string   `yaml:"storage"`
+	S3      S3Config `yaml:"s3"`
+	// MasterKeyId is id of the master key wrapping data keys of new recordings, recordings are not encrypted if it is empty
+	MasterKeyId string `yaml:"masterKeyId"`
+	// MasterKeys are base64 encoded 32 bytes keys, old keys must be kept until recordings are rewrapped
+	MasterKeys []*KV `yaml:"masterKeys"`
+}
+
+type EncryptionConfig struct {
+	// Version of the key used to encrypt, the latest version is used if it is 0
+	Version int `yaml:"version"`
+	// Keys are base64 encoded 32 bytes keys, Key of each item is its version
+	Keys []*KV `yaml:"keys"`
+	// KeyFile contains lines of version=base64 key
+	KeyFile string `yaml:"keyFile"`
+}
+
+type VaultConfig struct {
+	Addr      string `yaml:"addr"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"`
+	// Mount is the mount path of the kv v2 secrets engine, default is secret
+	Mount     string `yaml:"mount"`
+	Namespace string `yaml:"namespace"`
+}
+
+type SecretConfig struct {
+	Vault VaultConfig `yaml:"vault"`
+	// CacheTtl is seconds to cache secrets read from the store
+	CacheTtl int `yaml:"cacheTtl"`
+}
+
 type ConfigYaml struct {
-	Mode      string      `yaml:"mode"`
-	I18nDir   string      `yaml:"i18nDir"`
-	Log       LogConfig   `yaml:"log"`
-	Redis     RedisConfig `yaml:"redis"`
-	Mysql     MysqlConfig `yaml:"mysql"`
-	Guacd     GuacdConfig `yaml:"guacd"`
-	Http      HttpConfig  `yaml:"http"`
-	Ssh       SshConfig   `yaml:"ssh"`
-	Auth      Auth        `yaml:"auth"`
-	SecretKey string      `yaml:"secretKey"`
+	Mode       string           `yaml:"mode"`
+	I18nDir    string           `yaml:"i18nDir"`
+	Log        LogConfig        `yaml:"log"`
+	Redis      RedisConfig      `yaml:"redis"`
+	Mysql      MysqlConfig      `yaml:"mysql"`
+	Guacd      GuacdConfig      `yaml:"guacd"`
+	Http       HttpConfig       `yaml:"http"`
+	Ssh        SshConfig        `yaml:"ssh"`
+	DbProxy    DbProxyConfig    `yaml:"dbProxy"`
+	Auth       Auth             `yaml:"auth"`
+	Replay     ReplayConfig     `yaml:"replay"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Secret     SecretConfig     `yaml:"secret"`
+	SecretKey  string           `yaml:"secretKey"`
 }
 
 func GetResourceTypeName(key string) (val string) {
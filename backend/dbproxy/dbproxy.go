@@ -0,0 +1,24 @@
+// Package dbproxy speaks database protocols as a server to clients and as a client to databases.
+// Clients login to the proxy by their own credentials and are relayed to databases logged in as other users,
+// statements of them are passed to an audit function before they are sent
+package dbproxy
+
+import (
+	"errors"
+	"strings"
+)
+
+// Audit checks stmt before it is sent and refuses it if err is not nil, shown is stmt as it is recorded
+// which may have long arguments truncated. done is called with the result of stmt, such as rows affected, if the protocol tells it
+type Audit func(stmt, shown string) (done func(result string), err error)
+
+// Statements returns stmt followed by every statement of it to be checked by the command filter,
+// statements are split by semicolons and line feeds
+func Statements(stmt string) []string {
+	return append([]string{stmt}, strings.FieldsFunc(stmt, func(r rune) bool { return r == '\n' || r == ';' })...)
+}
+
+var (
+	// ErrAccessDenied is told to clients as a failed login of their protocols
+	ErrAccessDenied = errors.New("access denied")
+)
@@ -0,0 +1,30 @@
+package dbproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/session/cmdfilter"
+)
+
+func deny(name string, patterns ...string) *model.Command {
+	return &model.Command{Name: name, Cmds: patterns, Enable: true, Action: model.COMMANDACTION_DENY}
+}
+
+// filterAudit refuses statements hit by cmds the same way as database sessions do, done is called with results of the others as they are shown
+func filterAudit(t *testing.T, done func(stmt, result string), cmds ...*model.Command) Audit {
+	f, errs := cmdfilter.New(cmds)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	return func(stmt, shown string) (func(string), error) {
+		if _, cmd := f.Match(Statements(stmt)...); cmd != nil {
+			return nil, fmt.Errorf("blocked by %s", cmd.Name)
+		}
+		if done == nil {
+			return nil, nil
+		}
+		return func(result string) { done(shown, result) }, nil
+	}
+}
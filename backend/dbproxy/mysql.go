@@ -0,0 +1,619 @@
+package dbproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	mysqlServerVersion = "8.0.36-oneterm"
+	mysqlLoginTimeout  = time.Second * 30
+	// mysqlMaxPayload is the max payload of a packet, longer payloads are split into packets of it and the rest
+	mysqlMaxPayload = 1<<24 - 1
+	// mysqlCharset is utf8mb4_general_ci
+	mysqlCharset = 45
+
+	mysqlNativePassword = "mysql_native_password"
+	mysqlCachingSha2    = "caching_sha2_password"
+
+	clientLongPassword         = 1 << 0
+	clientFoundRows            = 1 << 1
+	clientLongFlag             = 1 << 2
+	clientConnectWithDb        = 1 << 3
+	clientIgnoreSpace          = 1 << 8
+	clientProtocol41           = 1 << 9
+	clientInteractive          = 1 << 10
+	clientSsl                  = 1 << 11
+	clientIgnoreSigpipe        = 1 << 12
+	clientTransactions         = 1 << 13
+	clientSecureConnection     = 1 << 15
+	clientMultiStatements      = 1 << 16
+	clientMultiResults         = 1 << 17
+	clientPsMultiResults       = 1 << 18
+	clientPluginAuth           = 1 << 19
+	clientConnectAttrs         = 1 << 20
+	clientPluginAuthLenencData = 1 << 21
+
+	// mysqlCapabilities are what the proxy offers, ssl, compression and local infile are not relayed
+	mysqlCapabilities = clientLongPassword | clientFoundRows | clientLongFlag | clientConnectWithDb | clientIgnoreSpace |
+		clientProtocol41 | clientInteractive | clientIgnoreSigpipe | clientTransactions | clientSecureConnection |
+		clientMultiStatements | clientMultiResults | clientPsMultiResults | clientPluginAuth | clientConnectAttrs |
+		clientPluginAuthLenencData
+	// mysqlRelayed change the format of packets relayed as is, the database must support those negotiated by the client
+	mysqlRelayed = clientProtocol41 | clientTransactions | clientMultiResults | clientPsMultiResults | clientSecureConnection
+
+	comQuit        = 0x01
+	comInitDb      = 0x02
+	comQuery       = 0x03
+	comChangeUser  = 0x11
+	comStmtPrepare = 0x16
+
+	mysqlOk         = 0x00
+	mysqlMoreData   = 0x01
+	mysqlAuthSwitch = 0xfe
+	mysqlErr        = 0xff
+
+	erAccessDenied = 1045
+	erUnknown      = 1105
+)
+
+var (
+	MysqlConnId atomic.Uint32
+)
+
+// mysqlError is an ERR packet
+type mysqlError struct {
+	Code    uint16
+	State   string
+	Message string
+}
+
+func (e *mysqlError) Error() string {
+	return fmt.Sprintf("ERROR %d (%s): %s", e.Code, e.State, e.Message)
+}
+
+func parseMysqlError(p []byte) *mysqlError {
+	e := &mysqlError{Code: erUnknown, State: "HY000"}
+	if len(p) < 3 {
+		return e
+	}
+	e.Code, p = binary.LittleEndian.Uint16(p[1:]), p[3:]
+	if len(p) >= 6 && p[0] == '#' {
+		e.State, p = string(p[1:6]), p[6:]
+	}
+	e.Message = string(p)
+	return e
+}
+
+// MysqlConn is a client of the mysql protocol
+type MysqlConn struct {
+	conn   net.Conn
+	remote net.Conn
+	// seq is the sequence of the next packet to the client during login
+	seq       byte
+	flags     uint32
+	maxPacket uint32
+	charset   byte
+	user      string
+	db        string
+	plugin    string
+	auth      []byte
+	scramble  []byte
+	loggedIn  bool
+	// serverName is the host of the database
+	serverName string
+
+	// ServerKeys are pinned public keys of databases by their hosts, the password is sent by full authentication
+	// of caching_sha2_password only if the key of the database is pinned since its connection is not verified
+	ServerKeys map[string]*rsa.PublicKey
+}
+
+func NewMysqlConn(conn net.Conn) *MysqlConn {
+	return &MysqlConn{conn: conn}
+}
+
+// SetServerName sets the host of the database whose pinned key is used for full authentication
+func (m *MysqlConn) SetServerName(host string) {
+	m.serverName = host
+}
+
+// Handshake greets the client and reads its login request
+func (m *MysqlConn) Handshake() (user string, err error) {
+	m.scramble = make([]byte, 20)
+	if _, err = rand.Read(m.scramble); err != nil {
+		return
+	}
+	// the scramble is printable so that clients reading it as a string get all of it
+	for i, b := range m.scramble {
+		m.scramble[i] = b%94 + 33
+	}
+	p := append([]byte{10}, mysqlServerVersion...)
+	p = append(p, 0)
+	p = binary.LittleEndian.AppendUint32(p, MysqlConnId.Add(1))
+	p = append(p, m.scramble[:8]...)
+	p = append(p, 0)
+	p = binary.LittleEndian.AppendUint16(p, uint16(mysqlCapabilities&0xffff))
+	p = append(p, mysqlCharset)
+	// SERVER_STATUS_AUTOCOMMIT
+	p = binary.LittleEndian.AppendUint16(p, 2)
+	p = binary.LittleEndian.AppendUint16(p, uint16(mysqlCapabilities>>16))
+	p = append(p, byte(len(m.scramble)+1))
+	p = append(p, make([]byte, 10)...)
+	p = append(p, m.scramble[8:]...)
+	p = append(p, 0)
+	p = append(p, mysqlCachingSha2...)
+	p = append(p, 0)
+	if err = m.write(p); err != nil {
+		return
+	}
+
+	if p, err = m.read(); err != nil {
+		return
+	}
+	r := &payload{p: p}
+	flags := r.uint32()
+	if flags&clientProtocol41 == 0 || flags&clientSecureConnection == 0 {
+		return "", fmt.Errorf("client of protocol before 4.1 is not supported")
+	}
+	if flags&clientSsl != 0 {
+		return "", fmt.Errorf("ssl is not supported")
+	}
+	m.flags = flags & mysqlCapabilities
+	m.maxPacket = r.uint32()
+	m.charset = r.byte()
+	r.next(23)
+	m.user = r.cstring()
+	if m.flags&clientPluginAuthLenencData != 0 {
+		m.auth = r.next(int(r.lenenc()))
+	} else {
+		m.auth = r.next(int(r.byte()))
+	}
+	if m.flags&clientConnectWithDb != 0 {
+		m.db = r.cstring()
+	}
+	if m.flags&clientPluginAuth != 0 {
+		m.plugin = r.cstring()
+	}
+	return m.user, r.err
+}
+
+// Verify checks the scrambled password of the client against password,
+// clients of plugins other than mysql_native_password and caching_sha2_password are switched to the former
+func (m *MysqlConn) Verify(password string) (err error) {
+	plugin, auth := m.plugin, m.auth
+	switch plugin {
+	case mysqlNativePassword, mysqlCachingSha2:
+	default:
+		if m.flags&clientPluginAuth == 0 {
+			plugin = mysqlNativePassword
+			break
+		}
+		p := append([]byte{mysqlAuthSwitch}, mysqlNativePassword...)
+		p = append(p, 0)
+		p = append(p, m.scramble...)
+		if err = m.write(append(p, 0)); err != nil {
+			return
+		}
+		if auth, err = m.read(); err != nil {
+			return
+		}
+		plugin = mysqlNativePassword
+	}
+
+	if subtle.ConstantTimeCompare(auth, scramblePassword(plugin, m.scramble, password)) != 1 {
+		return fmt.Errorf("wrong password")
+	}
+	if plugin == mysqlCachingSha2 {
+		// fast authentication succeeded
+		err = m.write([]byte{mysqlMoreData, 3})
+	}
+	return
+}
+
+// Login logs in to the database on remote as user with the options of the client, the OK of the database is relayed to the client
+func (m *MysqlConn) Login(remote net.Conn, user, password string) (err error) {
+	m.remote = remote
+	remote.SetDeadline(time.Now().Add(mysqlLoginTimeout))
+	defer remote.SetDeadline(time.Time{})
+
+	p, seq, err := readPacket(remote)
+	if err != nil {
+		return
+	}
+	if len(p) > 0 && p[0] == mysqlErr {
+		return parseMysqlError(p)
+	}
+	r := &payload{p: p}
+	if v := r.byte(); v != 10 {
+		return fmt.Errorf("unsupported protocol version %d", v)
+	}
+	r.cstring()
+	r.next(4)
+	scramble := append([]byte{}, r.next(8)...)
+	r.next(1)
+	caps := uint32(r.uint16())
+	r.next(3)
+	caps |= uint32(r.uint16()) << 16
+	n := int(r.byte())
+	r.next(10)
+	scramble = append(scramble, r.next(max(13, n-8)-1)...)
+	r.next(1)
+	plugin := r.cstring()
+	if r.err != nil {
+		return fmt.Errorf("invalid handshake of database: %w", r.err)
+	}
+	if missing := m.flags & mysqlRelayed &^ caps; missing != 0 {
+		return fmt.Errorf("database does not support capabilities %#x", missing)
+	}
+
+	flags := m.flags&caps&^(clientConnectAttrs|clientConnectWithDb|clientPluginAuthLenencData) | clientPluginAuth
+	if m.db != "" {
+		flags |= clientConnectWithDb
+	}
+	if plugin == "" {
+		plugin = mysqlNativePassword
+	}
+	auth := scramblePassword(plugin, scramble, password)
+	resp := binary.LittleEndian.AppendUint32(nil, flags)
+	resp = binary.LittleEndian.AppendUint32(resp, lo.Ternary(m.maxPacket == 0, mysqlMaxPayload, m.maxPacket))
+	resp = append(resp, m.charset)
+	resp = append(resp, make([]byte, 23)...)
+	resp = append(resp, user...)
+	resp = append(resp, 0, byte(len(auth)))
+	resp = append(resp, auth...)
+	if m.db != "" {
+		resp = append(resp, m.db...)
+		resp = append(resp, 0)
+	}
+	resp = append(resp, plugin...)
+	resp = append(resp, 0)
+
+	for {
+		seq++
+		if err = writePacket(remote, seq, resp); err != nil {
+			return
+		}
+		if p, seq, err = readPacket(remote); err != nil {
+			return
+		}
+		if len(p) == 0 {
+			return fmt.Errorf("empty packet of database")
+		}
+		switch p[0] {
+		case mysqlOk:
+			if err = m.write(p); err == nil {
+				m.loggedIn = true
+			}
+			return
+		case mysqlErr:
+			return parseMysqlError(p)
+		case mysqlAuthSwitch:
+			r := &payload{p: p[1:]}
+			plugin = r.cstring()
+			scramble = bytes.TrimSuffix(r.rest(), []byte{0})
+			resp = scramblePassword(plugin, scramble, password)
+			if resp == nil {
+				return fmt.Errorf("unsupported auth plugin %s of database", plugin)
+			}
+		case mysqlMoreData:
+			if plugin != mysqlCachingSha2 || len(p) < 2 {
+				return fmt.Errorf("unexpected auth data of database")
+			}
+			switch p[1] {
+			case 3:
+				// fast authentication succeeded and OK follows
+				if p, _, err = readPacket(remote); err != nil {
+					return
+				}
+				if len(p) > 0 && p[0] == mysqlErr {
+					return parseMysqlError(p)
+				}
+				if err = m.write(p); err == nil {
+					m.loggedIn = true
+				}
+				return
+			case 4:
+				// full authentication without tls encrypts the password by the public key of the database,
+				// a key returned by the database on request is not trusted as anyone in the path can replace it
+				key, ok := m.ServerKeys[m.serverName]
+				if !ok {
+					return fmt.Errorf("full authentication needs the public key of database %s pinned", m.serverName)
+				}
+				if resp, err = fullAuth(key, scramble, password); err != nil {
+					return
+				}
+			default:
+				return fmt.Errorf("unexpected auth data of database")
+			}
+		default:
+			return fmt.Errorf("unexpected packet 0x%02x of database", p[0])
+		}
+	}
+}
+
+// fullAuth returns the password encrypted by the public key of the database
+func fullAuth(key *rsa.PublicKey, scramble []byte, password string) ([]byte, error) {
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, key, plain, nil)
+}
+
+// ParseServerKey parses the pem encoded rsa public key of a mysql database
+func ParseServerKey(key string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key of database")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key of database is not rsa")
+	}
+	return rsaPub, nil
+}
+
+// Relay forwards commands of the client to the database, statements of queries, prepares and changes of
+// databases are audited and refused with an ERR. Changing user is refused since it logs in without the proxy
+func (m *MysqlConn) Relay(audit Audit) error {
+	errs := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(m.conn, m.remote)
+		errs <- err
+	}()
+	go func() {
+		errs <- m.relayCommands(audit)
+	}()
+	return <-errs
+}
+
+func (m *MysqlConn) relayCommands(audit Audit) error {
+	for {
+		p, raw, seq, err := m.readCommand()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		stmt := ""
+		if seq == 0 && len(p) > 0 {
+			switch p[0] {
+			case comQuery, comStmtPrepare:
+				stmt = string(p[1:])
+			case comInitDb:
+				stmt = "USE " + string(p[1:])
+			case comChangeUser:
+				if err = writePacket(m.conn, 1, errPayload(&mysqlError{Code: erAccessDenied, State: "28000", Message: "changing user is not allowed"})); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if stmt != "" {
+			if _, err = audit(stmt, stmt); err != nil {
+				if err = writePacket(m.conn, 1, errPayload(&mysqlError{Code: erUnknown, State: "HY000", Message: "oneterm: " + err.Error()})); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if _, err = m.remote.Write(raw); err != nil {
+			return err
+		}
+		if seq == 0 && len(p) > 0 && p[0] == comQuit {
+			return nil
+		}
+	}
+}
+
+// readCommand reads a payload of the client which may span packets, raw is the packets to be relayed
+func (m *MysqlConn) readCommand() (p, raw []byte, seq byte, err error) {
+	for i := 0; ; i++ {
+		h := make([]byte, 4)
+		if _, err = io.ReadFull(m.conn, h); err != nil {
+			return
+		}
+		n := int(h[0]) | int(h[1])<<8 | int(h[2])<<16
+		if i == 0 {
+			seq = h[3]
+		}
+		raw = append(raw, h...)
+		raw = append(raw, make([]byte, n)...)
+		if _, err = io.ReadFull(m.conn, raw[len(raw)-n:]); err != nil {
+			return
+		}
+		p = append(p, raw[len(raw)-n:]...)
+		if n < mysqlMaxPayload {
+			return
+		}
+	}
+}
+
+// Fail sends err to the client if it has not logged in to the database
+func (m *MysqlConn) Fail(err error) {
+	if m.loggedIn {
+		return
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		m.writeErr(&mysqlError{Code: erAccessDenied, State: "28000", Message: fmt.Sprintf("Access denied for user '%s'", m.user)})
+		return
+	}
+	m.writeErr(&mysqlError{Code: erUnknown, State: "HY000", Message: err.Error()})
+}
+
+func (m *MysqlConn) Close() error {
+	return m.conn.Close()
+}
+
+func (m *MysqlConn) read() (p []byte, err error) {
+	p, seq, err := readPacket(m.conn)
+	m.seq = seq + 1
+	return
+}
+
+func (m *MysqlConn) write(p []byte) (err error) {
+	err = writePacket(m.conn, m.seq, p)
+	m.seq++
+	return
+}
+
+func (m *MysqlConn) writeErr(e *mysqlError) error {
+	return m.write(errPayload(e))
+}
+
+func errPayload(e *mysqlError) []byte {
+	p := binary.LittleEndian.AppendUint16([]byte{mysqlErr}, e.Code)
+	p = append(p, '#')
+	p = append(p, e.State...)
+	return append(p, e.Message...)
+}
+
+func readPacket(r io.Reader) (p []byte, seq byte, err error) {
+	h := make([]byte, 4)
+	if _, err = io.ReadFull(r, h); err != nil {
+		return
+	}
+	p = make([]byte, int(h[0])|int(h[1])<<8|int(h[2])<<16)
+	_, err = io.ReadFull(r, p)
+	return p, h[3], err
+}
+
+// writePacket writes a payload shorter than mysqlMaxPayload
+func writePacket(w io.Writer, seq byte, p []byte) error {
+	n := len(p)
+	_, err := w.Write(append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, p...))
+	return err
+}
+
+// scramblePassword returns the auth data of the plugin, it is nil if the plugin is not supported
+func scramblePassword(plugin string, scramble []byte, password string) []byte {
+	if password == "" {
+		return []byte{}
+	}
+	if len(scramble) > 20 {
+		scramble = scramble[:20]
+	}
+	switch plugin {
+	case mysqlNativePassword:
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		stage1 := sha1.Sum([]byte(password))
+		stage2 := sha1.Sum(stage1[:])
+		h := sha1.New()
+		h.Write(scramble)
+		h.Write(stage2[:])
+		return xor(stage1[:], h.Sum(nil))
+	case mysqlCachingSha2:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		stage1 := sha256.Sum256([]byte(password))
+		stage2 := sha256.Sum256(stage1[:])
+		h := sha256.New()
+		h.Write(stage2[:])
+		h.Write(scramble)
+		return xor(stage1[:], h.Sum(nil))
+	}
+	return nil
+}
+
+func xor(a, b []byte) []byte {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+// payload reads fields of a packet, reading beyond the end sets err and returns zero values
+type payload struct {
+	p   []byte
+	err error
+}
+
+func (r *payload) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.p) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	bs := r.p[:n]
+	r.p = r.p[n:]
+	return bs
+}
+
+func (r *payload) byte() byte {
+	if bs := r.next(1); bs != nil {
+		return bs[0]
+	}
+	return 0
+}
+
+func (r *payload) uint16() uint16 {
+	if bs := r.next(2); bs != nil {
+		return binary.LittleEndian.Uint16(bs)
+	}
+	return 0
+}
+
+func (r *payload) uint32() uint32 {
+	if bs := r.next(4); bs != nil {
+		return binary.LittleEndian.Uint32(bs)
+	}
+	return 0
+}
+
+func (r *payload) lenenc() uint64 {
+	switch b := r.byte(); b {
+	case 0xfc:
+		return uint64(r.uint16())
+	case 0xfd:
+		bs := r.next(3)
+		if bs == nil {
+			return 0
+		}
+		return uint64(bs[0]) | uint64(bs[1])<<8 | uint64(bs[2])<<16
+	case 0xfe:
+		bs := r.next(8)
+		if bs == nil {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(bs)
+	default:
+		return uint64(b)
+	}
+}
+
+func (r *payload) cstring() string {
+	i := bytes.IndexByte(r.p, 0)
+	if r.err != nil || i < 0 {
+		// the last string of some packets is not terminated
+		s := string(r.p)
+		r.p = nil
+		return s
+	}
+	s := string(r.p[:i])
+	r.p = r.p[i+1:]
+	return s
+}
+
+func (r *payload) rest() []byte {
+	bs := r.p
+	r.p = nil
+	return bs
+}
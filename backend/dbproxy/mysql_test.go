@@ -0,0 +1,211 @@
+package dbproxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	gomysql "github.com/go-sql-driver/mysql"
+)
+
+// serve accepts one connection of ln and runs f on it
+func serve(t *testing.T, f func(conn net.Conn) error) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err = f(conn); err != nil {
+			t.Log(err)
+		}
+	}()
+	return ln
+}
+
+// newFakeMysql is a database of user root and its password, it answers every query with OK and records them
+func newFakeMysql(t *testing.T, password string, queries chan<- string) net.Listener {
+	return serve(t, func(conn net.Conn) error {
+		u := NewMysqlConn(conn)
+		user, err := u.Handshake()
+		if err != nil {
+			return err
+		}
+		if user != "root" || u.db != "test" {
+			return fmt.Errorf("login of %s to %s", user, u.db)
+		}
+		if err = u.Verify(password); err != nil {
+			u.Fail(ErrAccessDenied)
+			return err
+		}
+		if err = u.write([]byte{mysqlOk, 0, 0, 2, 0, 0, 0}); err != nil {
+			return err
+		}
+		for {
+			p, _, err := readPacket(conn)
+			if err != nil || p[0] == comQuit {
+				return nil
+			}
+			queries <- string(p[1:])
+			if err = writePacket(conn, 1, []byte{mysqlOk, 0, 0, 2, 0, 0, 0}); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func TestMysql(t *testing.T) {
+	queries := make(chan string, 4)
+	upstream := newFakeMysql(t, "dbpass", queries)
+	defer upstream.Close()
+
+	proxy := serve(t, func(conn net.Conn) error {
+		m := NewMysqlConn(conn)
+		if _, err := m.Handshake(); err != nil {
+			return err
+		}
+		if err := m.Verify("secret"); err != nil {
+			m.Fail(ErrAccessDenied)
+			return err
+		}
+		remote, err := net.Dial("tcp", upstream.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+		if err = m.Login(remote, "root", "dbpass"); err != nil {
+			m.Fail(err)
+			return err
+		}
+		return m.Relay(filterAudit(t, nil, deny("drop", `(?i)^drop\s`)))
+	})
+	defer proxy.Close()
+
+	db, err := sql.Open("mysql", fmt.Sprintf("token:secret@tcp(%s)/test", proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if q := <-queries; q != "INSERT INTO t VALUES (1)" {
+		t.Fatalf("query = %q", q)
+	}
+	me := &gomysql.MySQLError{}
+	if _, err = db.Exec("DROP TABLE t"); !errors.As(err, &me) || me.Number != erUnknown || !strings.Contains(me.Message, "blocked by drop") {
+		t.Fatalf("Exec(DROP) error = %v", err)
+	}
+	if _, err = db.Exec("SELECT 1;\ndrop table t"); !errors.As(err, &me) || !strings.Contains(me.Message, "blocked by drop") {
+		t.Fatalf("Exec(SELECT; drop) error = %v", err)
+	}
+	if _, err = db.Exec("DELETE FROM t"); err != nil {
+		t.Fatal(err)
+	}
+	if q := <-queries; q != "DELETE FROM t" {
+		t.Fatalf("query = %q, the blocked ones must not be sent", q)
+	}
+}
+
+func TestMysqlAccessDenied(t *testing.T) {
+	proxy := serve(t, func(conn net.Conn) error {
+		m := NewMysqlConn(conn)
+		if _, err := m.Handshake(); err != nil {
+			return err
+		}
+		if err := m.Verify("secret"); err != nil {
+			m.Fail(ErrAccessDenied)
+		}
+		return nil
+	})
+	defer proxy.Close()
+
+	db, err := sql.Open("mysql", fmt.Sprintf("token:wrong@tcp(%s)/", proxy.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	me := &gomysql.MySQLError{}
+	if err = db.Ping(); !errors.As(err, &me) || me.Number != erAccessDenied {
+		t.Fatalf("Ping() error = %v, want access denied", err)
+	}
+}
+
+func TestMysqlFullAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		keys   map[string]*rsa.PublicKey
+		want   string
+		wantOk bool
+	}{
+		{name: "pinned", keys: map[string]*rsa.PublicKey{"127.0.0.1": &key.PublicKey}, want: "dbpass", wantOk: true},
+		{name: "pinned for another host", keys: map[string]*rsa.PublicKey{"10.0.0.1": &key.PublicKey}},
+		{name: "not pinned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan string, 1)
+			// upstream asks for full authentication as a database without the account in its cache
+			upstream := serve(t, func(conn net.Conn) error {
+				u := NewMysqlConn(conn)
+				if _, err := u.Handshake(); err != nil {
+					return err
+				}
+				if err := u.write([]byte{mysqlMoreData, 4}); err != nil {
+					return err
+				}
+				p, err := u.read()
+				if err != nil {
+					received <- ""
+					return nil
+				}
+				plain, err := rsa.DecryptOAEP(sha1.New(), nil, key, p, nil)
+				if err != nil {
+					received <- string(p)
+					return nil
+				}
+				for i := range plain {
+					plain[i] ^= u.scramble[i%len(u.scramble)]
+				}
+				received <- strings.TrimSuffix(string(plain), "\x00")
+				return u.write([]byte{mysqlOk, 0, 0, 2, 0, 0, 0})
+			})
+			defer upstream.Close()
+
+			client, peer := net.Pipe()
+			defer client.Close()
+			go io.Copy(io.Discard, peer)
+			remote, err := net.Dial("tcp", upstream.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &MysqlConn{conn: client, flags: mysqlRelayed, ServerKeys: tt.keys}
+			m.SetServerName("127.0.0.1")
+			err = m.Login(remote, "root", "dbpass")
+			remote.Close()
+			if (err == nil) != tt.wantOk {
+				t.Fatalf("Login() error = %v", err)
+			}
+			if got := <-received; got != tt.want {
+				t.Fatalf("database received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
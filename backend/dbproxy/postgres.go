@@ -0,0 +1,688 @@
+package dbproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	pgLoginTimeout = time.Second * 30
+	// pgMaxMessage is the max length of messages, it is the max size of a field of the database
+	pgMaxMessage = 1 << 30
+	// pgMaxLoginMessage is the max length of messages before login, they are of authentication only
+	pgMaxLoginMessage = 1 << 16
+
+	pgProtocol3      = 3 << 16
+	pgCancelRequest  = 80877102
+	pgSslRequest     = 80877103
+	pgGssEncRequest  = 80877104
+	pgScramSha256    = "SCRAM-SHA-256"
+	pgScramIteration = 4096
+
+	pgAuthOk           = 0
+	pgAuthCleartext    = 3
+	pgAuthMd5          = 5
+	pgAuthSasl         = 10
+	pgAuthSaslContinue = 11
+	pgAuthSaslFinal    = 12
+)
+
+// pgError is an ErrorResponse
+type pgError struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+func (e *pgError) body() []byte {
+	var b []byte
+	for _, f := range []struct {
+		typ byte
+		val string
+	}{{'S', e.Severity}, {'V', e.Severity}, {'C', e.Code}, {'M', e.Message}} {
+		b = append(b, f.typ)
+		b = append(b, f.val...)
+		b = append(b, 0)
+	}
+	return append(b, 0)
+}
+
+func parsePgError(body []byte) *pgError {
+	e := &pgError{}
+	for len(body) > 1 {
+		typ := body[0]
+		i := bytes.IndexByte(body[1:], 0)
+		if i < 0 {
+			break
+		}
+		val := string(body[1 : i+1])
+		body = body[i+2:]
+		switch typ {
+		case 'S':
+			e.Severity = val
+		case 'C':
+			e.Code = val
+		case 'M':
+			e.Message = val
+		}
+	}
+	return e
+}
+
+// pgPending is what the client waits for from the database, responses are matched to statements by their order
+type pgPending struct {
+	kind    byte
+	done    func(result string)
+	results []string
+	// blocked is the error told in place of the ReadyForQuery of the Sync sent for a blocked statement,
+	// the ReadyForQuery is told as well if it is a simple query
+	blocked *pgError
+	query   bool
+}
+
+const (
+	pendingQuery   = 'Q'
+	pendingExecute = 'E'
+	pendingSync    = 'S'
+	pendingBlocked = 'B'
+)
+
+// PostgresConn is a client of the postgresql frontend/backend protocol 3.0
+type PostgresConn struct {
+	conn   net.Conn
+	remote net.Conn
+	user   string
+	// params are of the startup message of the client except user, in pairs of names and values
+	params   []string
+	loggedIn bool
+	// serverName is the host the certificate of the database is verified for
+	serverName string
+
+	mtx     sync.Mutex
+	pending []*pgPending
+}
+
+func NewPostgresConn(conn net.Conn) *PostgresConn {
+	return &PostgresConn{conn: conn}
+}
+
+// SetServerName sets the host of the database, the password is sent in cleartext or md5
+// only if the database is connected by tls with a certificate verified for it
+func (c *PostgresConn) SetServerName(host string) {
+	c.serverName = host
+}
+
+// Handshake reads the startup message of the client, encryption requests are declined
+func (c *PostgresConn) Handshake() (user string, err error) {
+	for {
+		body, err := readPgStartup(c.conn)
+		if err != nil {
+			return "", err
+		}
+		r := &pgPayload{payload{p: body}}
+		switch code := r.int32(); code {
+		case pgSslRequest, pgGssEncRequest:
+			if _, err = c.conn.Write([]byte{'N'}); err != nil {
+				return "", err
+			}
+			continue
+		case pgCancelRequest:
+			return "", fmt.Errorf("cancel request is not supported")
+		case pgProtocol3:
+		default:
+			return "", fmt.Errorf("unsupported protocol %d.%d", code>>16, code&0xffff)
+		}
+		for {
+			name := r.cstring()
+			if name == "" || r.err != nil {
+				break
+			}
+			val := r.cstring()
+			switch name {
+			case "user":
+				c.user = val
+			case "replication":
+				return "", fmt.Errorf("replication is not supported")
+			default:
+				c.params = append(c.params, name, val)
+			}
+		}
+		if c.user == "" {
+			return "", fmt.Errorf("user is required")
+		}
+		return c.user, r.err
+	}
+}
+
+// Verify authenticates the client by SCRAM-SHA-256 with password, AuthenticationOk is sent once it logs in to the database
+func (c *PostgresConn) Verify(password string) (err error) {
+	if err = writePgMessage(c.conn, 'R', append(be32(pgAuthSasl), pgScramSha256+"\x00\x00"...)); err != nil {
+		return
+	}
+	typ, body, err := readPgMessage(c.conn, pgMaxLoginMessage)
+	if err != nil {
+		return
+	}
+	r := &pgPayload{payload{p: body}}
+	if mech := r.cstring(); typ != 'p' || mech != pgScramSha256 {
+		return fmt.Errorf("unsupported sasl mechanism %s", mech)
+	}
+	clientFirst := string(r.next(int(r.int32())))
+	// channel binding is not supported without tls
+	gs2, clientFirstBare, ok := cutN(clientFirst, ",", 2)
+	if !ok || (!strings.HasPrefix(gs2, "n,") && !strings.HasPrefix(gs2, "y,")) {
+		return fmt.Errorf("invalid client first message")
+	}
+	clientNonce := scramAttr(clientFirstBare, 'r')
+	if clientNonce == "" {
+		return fmt.Errorf("invalid client first message")
+	}
+
+	salt := make([]byte, 16)
+	serverNonce := make([]byte, 18)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	if _, err = rand.Read(serverNonce); err != nil {
+		return
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), pgScramIteration)
+	if err = writePgMessage(c.conn, 'R', append(be32(pgAuthSaslContinue), serverFirst...)); err != nil {
+		return
+	}
+
+	if typ, body, err = readPgMessage(c.conn, pgMaxLoginMessage); err != nil {
+		return
+	}
+	clientFinal := string(body)
+	withoutProof, proof, ok := strings.Cut(clientFinal, ",p=")
+	if typ != 'p' || !ok || scramAttr(withoutProof, 'r') != nonce || scramAttr(withoutProof, 'c') != base64.StdEncoding.EncodeToString([]byte(gs2+",")) {
+		return fmt.Errorf("invalid client final message")
+	}
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientProof, serverSignature := scramProofs(password, salt, pgScramIteration, authMessage)
+	if subtle.ConstantTimeCompare([]byte(proof), []byte(base64.StdEncoding.EncodeToString(clientProof))) != 1 {
+		return fmt.Errorf("wrong password")
+	}
+	return writePgMessage(c.conn, 'R', append(be32(pgAuthSaslFinal), "v="+base64.StdEncoding.EncodeToString(serverSignature)...))
+}
+
+// Login logs in to the database on remote as user with parameters of the client, tls is used if the database supports it.
+// The database defaults to the user as it does without the proxy.
+// Certificates not verified are accepted as sslmode=require of libpq, but the password is then only proven by SCRAM
+func (c *PostgresConn) Login(remote net.Conn, user, password string) (err error) {
+	c.remote = remote
+	remote.SetDeadline(time.Now().Add(pgLoginTimeout))
+	defer remote.SetDeadline(time.Time{})
+
+	if err = writePgStartup(remote, pgSslRequest, nil); err != nil {
+		return
+	}
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(remote, b); err != nil {
+		return
+	}
+	verified := false
+	if b[0] == 'S' {
+		tc := tls.Client(remote, &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				verified = c.serverName != "" && verifyPgCert(cs, c.serverName) == nil
+				return nil
+			},
+		})
+		if err = tc.Handshake(); err != nil {
+			return
+		}
+		c.remote = tc
+	}
+
+	params := []string{"user", user}
+	for i := 0; i+1 < len(c.params); i += 2 {
+		name, val := c.params[i], c.params[i+1]
+		if name == "database" && val == c.user {
+			val = user
+		}
+		params = append(params, name, val)
+	}
+	if err = writePgStartup(c.remote, pgProtocol3, params); err != nil {
+		return
+	}
+	ok, err := pgAuthenticate(c.remote, user, password, verified)
+	if err != nil {
+		return
+	}
+	if err = writePgMessage(c.conn, 'R', ok); err == nil {
+		c.loggedIn = true
+	}
+	return
+}
+
+// verifyPgCert verifies the certificate chain of cs by the system roots for host
+func verifyPgCert(cs tls.ConnectionState, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificate of database")
+	}
+	opts := x509.VerifyOptions{DNSName: host, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// pgAuthenticate answers authentication requests of the database until it succeeds and returns the AuthenticationOk.
+// The password is sent in cleartext or md5 only if the connection is verified, a database starting SCRAM
+// must prove it knows the password before AuthenticationOk
+func pgAuthenticate(rw io.ReadWriter, user, password string, verified bool) (ok []byte, err error) {
+	var clientFirstBare, clientNonce, serverSignature string
+	scram, proven := false, false
+	for {
+		typ, body, err := readPgMessage(rw, pgMaxLoginMessage)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'E':
+			return nil, parsePgError(body)
+		case 'N', 'v':
+			// notices and negotiation of minor versions
+			continue
+		case 'R':
+		default:
+			return nil, fmt.Errorf("unexpected message %c of database", typ)
+		}
+		r := &pgPayload{payload{p: body}}
+		switch code := r.int32(); code {
+		case pgAuthOk:
+			if scram && !proven {
+				return nil, fmt.Errorf("database logged in without proving the password")
+			}
+			return body, nil
+		case pgAuthCleartext:
+			if !verified {
+				return nil, fmt.Errorf("cleartext password is not sent to database without verified tls")
+			}
+			err = writePgMessage(rw, 'p', append([]byte(password), 0))
+		case pgAuthMd5:
+			if !verified {
+				return nil, fmt.Errorf("md5 password is not sent to database without verified tls")
+			}
+			// md5(md5(password + user) + salt)
+			sum := md5.Sum([]byte(password + user))
+			sum = md5.Sum(append([]byte(hex.EncodeToString(sum[:])), r.next(4)...))
+			err = writePgMessage(rw, 'p', append([]byte("md5"+hex.EncodeToString(sum[:])), 0))
+		case pgAuthSasl:
+			var mechs []string
+			for m := r.cstring(); m != ""; m = r.cstring() {
+				mechs = append(mechs, m)
+			}
+			if !strings.Contains(strings.Join(mechs, ","), pgScramSha256) {
+				return nil, fmt.Errorf("unsupported sasl mechanisms %v of database", mechs)
+			}
+			nonce := make([]byte, 18)
+			if _, err = rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			clientNonce, scram = base64.StdEncoding.EncodeToString(nonce), true
+			// the user of the startup message is used by the database
+			clientFirstBare = "n=,r=" + clientNonce
+			msg := append([]byte(pgScramSha256), 0)
+			msg = append(msg, be32(len(clientFirstBare)+3)...)
+			err = writePgMessage(rw, 'p', append(msg, "n,,"+clientFirstBare...))
+		case pgAuthSaslContinue:
+			serverFirst := string(r.rest())
+			nonce, salt, iter := scramAttr(serverFirst, 'r'), scramAttr(serverFirst, 's'), scramAttr(serverFirst, 'i')
+			if !strings.HasPrefix(nonce, clientNonce) {
+				return nil, fmt.Errorf("invalid nonce of database")
+			}
+			saltBytes, err := base64.StdEncoding.DecodeString(salt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid salt of database: %w", err)
+			}
+			n, err := strconv.Atoi(iter)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid iteration count of database")
+			}
+			withoutProof := "c=biws,r=" + nonce
+			proof, sig := scramProofs(password, saltBytes, n, clientFirstBare+","+serverFirst+","+withoutProof)
+			serverSignature = base64.StdEncoding.EncodeToString(sig)
+			err = writePgMessage(rw, 'p', []byte(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+			if err != nil {
+				return nil, err
+			}
+		case pgAuthSaslFinal:
+			if serverSignature == "" || scramAttr(string(r.rest()), 'v') != serverSignature {
+				return nil, fmt.Errorf("invalid server signature of database")
+			}
+			proven = true
+		default:
+			return nil, fmt.Errorf("unsupported authentication %d of database", code)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Relay forwards messages of the client to the database. Statements of simple queries and parses of extended queries
+// are audited, results of them are the tags of CommandComplete or errors.
+// A blocked statement is replaced by a Sync so that its error is told in order after responses of previous messages,
+// messages of an extended query following it are dropped until Sync as the database does for an error
+func (c *PostgresConn) Relay(audit Audit) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- c.relayResponses()
+	}()
+	go func() {
+		errs <- c.relayMessages(audit)
+	}()
+	return <-errs
+}
+
+func (c *PostgresConn) relayMessages(audit Audit) error {
+	r := bufio.NewReader(c.conn)
+	stmts, portals := map[string]func(string){}, map[string]func(string){}
+	skip := false
+	for {
+		typ, body, err := readPgMessage(r, pgMaxMessage)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if skip && typ != 'S' {
+			continue
+		}
+		skip = false
+		p := &pgPayload{payload{p: body}}
+		switch typ {
+		case 'Q':
+			stmt := p.cstring()
+			done, err := audit(stmt, stmt)
+			if err != nil {
+				if err = c.block(err, true); err != nil {
+					return err
+				}
+				continue
+			}
+			c.push(&pgPending{kind: pendingQuery, done: done})
+		case 'P':
+			name, stmt := p.cstring(), p.cstring()
+			done, err := audit(stmt, stmt)
+			if err != nil {
+				if err = c.block(err, false); err != nil {
+					return err
+				}
+				skip = true
+				continue
+			}
+			stmts[name] = done
+		case 'B':
+			portal := p.cstring()
+			portals[portal] = stmts[p.cstring()]
+		case 'E':
+			c.push(&pgPending{kind: pendingExecute, done: portals[p.cstring()]})
+		case 'S':
+			c.push(&pgPending{kind: pendingSync})
+		case 'F':
+			// functions called directly are not statements to be audited
+			if err = c.block(fmt.Errorf("function call is not allowed"), true); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = writePgMessage(c.remote, typ, body); err != nil {
+			return err
+		}
+		if typ == 'X' {
+			return nil
+		}
+	}
+}
+
+func (c *PostgresConn) relayResponses() error {
+	r := bufio.NewReader(c.remote)
+	w := bufio.NewWriter(c.conn)
+	for {
+		typ, body, err := readPgMessage(r, pgMaxMessage)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		forward := true
+		switch typ {
+		case 'C', 'I', 's', 'E':
+			c.complete(typ, body)
+		case 'Z':
+			if blocked := c.ready(); blocked != nil {
+				if err = writePgMessage(w, 'E', blocked.blocked.body()); err != nil {
+					return err
+				}
+				// the client of an extended query waits for its own Sync
+				forward = blocked.query
+			}
+		}
+		if forward {
+			if err = writePgMessage(w, typ, body); err != nil {
+				return err
+			}
+		}
+		// responses are flushed once the database has no more buffered
+		if r.Buffered() == 0 {
+			if err = w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// block sends a Sync in place of a refused statement, the ReadyForQuery of it is replaced by the error
+func (c *PostgresConn) block(err error, query bool) error {
+	c.push(&pgPending{kind: pendingBlocked, query: query, blocked: &pgError{Severity: "ERROR", Code: "42501", Message: "oneterm: " + err.Error()}})
+	return writePgMessage(c.remote, 'S', nil)
+}
+
+func (c *PostgresConn) push(p *pgPending) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending = append(c.pending, p)
+}
+
+// complete records the result of the first execute or simple query waiting for it
+func (c *PostgresConn) complete(typ byte, body []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.pending) == 0 {
+		return
+	}
+	result := ""
+	switch typ {
+	case 'C':
+		result = string(bytes.TrimSuffix(body, []byte{0}))
+	case 'I':
+		result = "EMPTY"
+	case 's':
+		result = "SUSPENDED"
+	case 'E':
+		result = parsePgError(body).Error()
+	}
+	switch p := c.pending[0]; p.kind {
+	case pendingQuery:
+		p.results = append(p.results, result)
+	case pendingExecute:
+		c.pending = c.pending[1:]
+		if p.done != nil {
+			p.done(result)
+		}
+	}
+}
+
+// ready ends what waits for the ReadyForQuery, it returns the pending blocked statement if the ReadyForQuery is of it.
+// Executes skipped after an error end without results
+func (c *PostgresConn) ready() (blocked *pgPending) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for len(c.pending) > 0 {
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		switch p.kind {
+		case pendingQuery:
+			if p.done != nil {
+				p.done(strings.Join(p.results, "; "))
+			}
+			return nil
+		case pendingSync:
+			return nil
+		case pendingBlocked:
+			return p
+		}
+	}
+	return nil
+}
+
+// Fail sends err to the client if it has not logged in to the database
+func (c *PostgresConn) Fail(err error) {
+	if c.loggedIn {
+		return
+	}
+	e := &pgError{Severity: "FATAL", Code: "08006", Message: err.Error()}
+	if errors.Is(err, ErrAccessDenied) {
+		e.Code, e.Message = "28P01", fmt.Sprintf("password authentication failed for user \"%s\"", c.user)
+	}
+	writePgMessage(c.conn, 'E', e.body())
+}
+
+func (c *PostgresConn) Close() error {
+	return c.conn.Close()
+}
+
+func readPgStartup(r io.Reader) ([]byte, error) {
+	h := make([]byte, 4)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(h))
+	if n < 8 || n > 10240 {
+		return nil, fmt.Errorf("invalid length %d of startup message", n)
+	}
+	body := make([]byte, n-4)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+func writePgStartup(w io.Writer, code int, params []string) error {
+	body := be32(code)
+	if params != nil {
+		for _, s := range params {
+			body = append(body, s...)
+			body = append(body, 0)
+		}
+		body = append(body, 0)
+	}
+	_, err := w.Write(append(be32(len(body)+4), body...))
+	return err
+}
+
+// readPgMessage reads a message of at most limit bytes
+func readPgMessage(r io.Reader, limit int) (typ byte, body []byte, err error) {
+	h := make([]byte, 5)
+	if _, err = io.ReadFull(r, h); err != nil {
+		return
+	}
+	n := int(binary.BigEndian.Uint32(h[1:]))
+	if n < 4 || n > limit {
+		return 0, nil, fmt.Errorf("invalid length %d of message %c", n, h[0])
+	}
+	body = make([]byte, n-4)
+	_, err = io.ReadFull(r, body)
+	return h[0], body, err
+}
+
+func writePgMessage(w io.Writer, typ byte, body []byte) error {
+	_, err := w.Write(append(append([]byte{typ}, be32(len(body)+4)...), body...))
+	return err
+}
+
+func be32(n int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(n))
+}
+
+// scramProofs returns the client proof and the server signature of SCRAM-SHA-256 of RFC 5802
+func scramProofs(password string, salt []byte, iter int, authMessage string) (clientProof, serverSignature []byte) {
+	salted := pbkdf2.Key([]byte(password), salt, iter, sha256.Size, sha256.New)
+	clientKey := hmacSha256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientProof = xor(clientKey, hmacSha256(storedKey[:], authMessage))
+	serverSignature = hmacSha256(hmacSha256(salted, "Server Key"), authMessage)
+	return
+}
+
+func hmacSha256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// scramAttr returns the value of the attribute of a SCRAM message
+func scramAttr(msg string, name byte) string {
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
+
+// cutN cuts s after the nth sep
+func cutN(s, sep string, n int) (before, after string, found bool) {
+	i := 0
+	for ; n > 0; n-- {
+		j := strings.Index(s[i:], sep)
+		if j < 0 {
+			return s, "", false
+		}
+		i += j + len(sep)
+	}
+	return s[:i-len(sep)], s[i:], true
+}
+
+// pgPayload reads fields of a message, reading beyond the end sets err and returns zero values
+type pgPayload struct {
+	payload
+}
+
+func (r *pgPayload) int32() int {
+	if bs := r.next(4); bs != nil {
+		return int(int32(binary.BigEndian.Uint32(bs)))
+	}
+	return 0
+}
@@ -0,0 +1,239 @@
+package dbproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newFakePostgres is a database of user postgres and its password, it answers every statement and records them
+func newFakePostgres(t *testing.T, password string, queries chan<- string) net.Listener {
+	return serve(t, func(conn net.Conn) error {
+		u := NewPostgresConn(conn)
+		user, err := u.Handshake()
+		if err != nil {
+			return err
+		}
+		if user != "postgres" || len(u.params) < 2 || u.params[1] != "postgres" {
+			return fmt.Errorf("login of %s with %v", user, u.params)
+		}
+		if err = u.Verify(password); err != nil {
+			u.Fail(ErrAccessDenied)
+			return err
+		}
+		writePgMessage(conn, 'R', be32(pgAuthOk))
+		writePgMessage(conn, 'Z', []byte{'I'})
+		for {
+			typ, body, err := readPgMessage(conn, pgMaxMessage)
+			if err != nil || typ == 'X' {
+				return nil
+			}
+			p := &pgPayload{payload{p: body}}
+			switch typ {
+			case 'Q':
+				stmt := p.cstring()
+				queries <- stmt
+				writePgMessage(conn, 'C', append([]byte(strings.Fields(stmt)[0]+" 0 1"), 0))
+				writePgMessage(conn, 'Z', []byte{'I'})
+			case 'P':
+				p.cstring()
+				queries <- p.cstring()
+				writePgMessage(conn, '1', nil)
+			case 'B':
+				writePgMessage(conn, '2', nil)
+			case 'E':
+				writePgMessage(conn, 'C', append([]byte("DELETE 3"), 0))
+			case 'S':
+				writePgMessage(conn, 'Z', []byte{'I'})
+			}
+		}
+	})
+}
+
+// pgLogin logs in to addr by the startup message and SCRAM as psql does
+func pgLogin(t *testing.T, addr, user, password string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writePgStartup(conn, pgProtocol3, []string{"user", user, "database", user}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = pgAuthenticate(conn, user, password, false)
+	return conn, err
+}
+
+// pgResponses reads responses until ReadyForQuery and returns their types
+func pgResponses(t *testing.T, conn net.Conn) (types string, pe *pgError) {
+	for {
+		typ, body, err := readPgMessage(conn, pgMaxMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types += string(typ)
+		if typ == 'E' {
+			pe = parsePgError(body)
+		}
+		if typ == 'Z' {
+			return
+		}
+	}
+}
+
+func pgExtended(conn net.Conn, stmt string) {
+	writePgMessage(conn, 'P', []byte("\x00"+stmt+"\x00\x00\x00"))
+	writePgMessage(conn, 'B', []byte("\x00\x00\x00\x00\x00\x00\x00\x00"))
+	writePgMessage(conn, 'E', []byte("\x00\x00\x00\x00\x00"))
+	writePgMessage(conn, 'S', nil)
+}
+
+func TestPostgres(t *testing.T) {
+	queries, results := make(chan string, 4), make(chan string, 4)
+	upstream := newFakePostgres(t, "dbpass", queries)
+	defer upstream.Close()
+
+	proxy := serve(t, func(conn net.Conn) error {
+		c := NewPostgresConn(conn)
+		if _, err := c.Handshake(); err != nil {
+			return err
+		}
+		if err := c.Verify("secret"); err != nil {
+			c.Fail(ErrAccessDenied)
+			return err
+		}
+		remote, err := net.Dial("tcp", upstream.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+		if err = c.Login(remote, "postgres", "dbpass"); err != nil {
+			c.Fail(err)
+			return err
+		}
+		return c.Relay(filterAudit(t, func(stmt, result string) { results <- result }, deny("drop", `(?i)^drop\s`)))
+	})
+	defer proxy.Close()
+
+	conn, err := pgLogin(t, proxy.Addr().String(), "token", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if types, _ := pgResponses(t, conn); types != "Z" {
+		t.Fatalf("responses of login = %q", types)
+	}
+
+	writePgMessage(conn, 'Q', []byte("INSERT INTO t VALUES (1)\x00"))
+	if types, _ := pgResponses(t, conn); types != "CZ" {
+		t.Fatalf("responses of INSERT = %q", types)
+	}
+	if q, r := <-queries, <-results; q != "INSERT INTO t VALUES (1)" || r != "INSERT 0 1" {
+		t.Fatalf("query = %q, result = %q", q, r)
+	}
+
+	writePgMessage(conn, 'Q', []byte("DROP TABLE t\x00"))
+	if types, pe := pgResponses(t, conn); types != "EZ" || pe.Code != "42501" || !strings.Contains(pe.Message, "blocked by drop") {
+		t.Fatalf("responses of DROP = %q, error = %v", types, pe)
+	}
+
+	writePgMessage(conn, 'Q', []byte("SELECT 1; drop table t\x00"))
+	if types, pe := pgResponses(t, conn); types != "EZ" || !strings.Contains(pe.Message, "blocked by drop") {
+		t.Fatalf("responses of SELECT; drop = %q, error = %v", types, pe)
+	}
+
+	pgExtended(conn, "DELETE FROM t")
+	if types, _ := pgResponses(t, conn); types != "12CZ" {
+		t.Fatalf("responses of extended DELETE = %q", types)
+	}
+	if q, r := <-queries, <-results; q != "DELETE FROM t" || r != "DELETE 3" {
+		t.Fatalf("query = %q, result = %q, the blocked one must not be sent", q, r)
+	}
+
+	pgExtended(conn, "DROP TABLE t")
+	if types, pe := pgResponses(t, conn); types != "EZ" || pe.Code != "42501" {
+		t.Fatalf("responses of extended DROP = %q, error = %v", types, pe)
+	}
+
+	writePgMessage(conn, 'Q', []byte("SELECT 1\x00"))
+	if types, _ := pgResponses(t, conn); types != "CZ" {
+		t.Fatalf("responses of SELECT = %q", types)
+	}
+	if q := <-queries; q != "SELECT 1" {
+		t.Fatalf("query = %q, the blocked one must not be sent", q)
+	}
+	writePgMessage(conn, 'X', nil)
+}
+
+func TestPostgresAccessDenied(t *testing.T) {
+	proxy := serve(t, func(conn net.Conn) error {
+		c := NewPostgresConn(conn)
+		if _, err := c.Handshake(); err != nil {
+			return err
+		}
+		if err := c.Verify("secret"); err != nil {
+			c.Fail(ErrAccessDenied)
+		}
+		return nil
+	})
+	defer proxy.Close()
+
+	conn, err := pgLogin(t, proxy.Addr().String(), "token", "wrong")
+	if err == nil {
+		conn.Close()
+	}
+	pe := &pgError{}
+	if !errors.As(err, &pe) || pe.Code != "28P01" {
+		t.Fatalf("login error = %v, want access denied", err)
+	}
+}
+
+func TestPgAuthenticateRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		// requests are written by the database, each after reading a message of the proxy except the first
+		requests [][]byte
+	}{
+		{name: "cleartext without tls", requests: [][]byte{be32(pgAuthCleartext)}},
+		{name: "md5 without tls", requests: [][]byte{append(be32(pgAuthMd5), "salt"...)}},
+		{name: "ok without server signature", requests: [][]byte{append(be32(pgAuthSasl), pgScramSha256+"\x00\x00"...), be32(pgAuthOk)}},
+		{name: "oversized", requests: [][]byte{make([]byte, pgMaxLoginMessage)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan string, 1)
+			upstream := serve(t, func(conn net.Conn) error {
+				var got []byte
+				for i, req := range tt.requests {
+					if i > 0 {
+						_, body, err := readPgMessage(conn, pgMaxLoginMessage)
+						if err != nil {
+							break
+						}
+						got = append(got, body...)
+					}
+					writePgMessage(conn, 'R', req)
+				}
+				rest, _ := io.ReadAll(conn)
+				received <- string(append(got, rest...))
+				return nil
+			})
+			defer upstream.Close()
+
+			conn, err := net.Dial("tcp", upstream.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = pgAuthenticate(conn, "postgres", "dbpass", false)
+			conn.Close()
+			if err == nil {
+				t.Fatal("authenticated, want refused")
+			}
+			if got := <-received; strings.Contains(got, "dbpass") || strings.Contains(got, "md5") {
+				t.Fatalf("sent %q to the database", got)
+			}
+		})
+	}
+}
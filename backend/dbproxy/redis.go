@@ -0,0 +1,482 @@
+package dbproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	redisLoginTimeout = time.Second * 30
+	// redisMaxBulk is the max length of bulk strings as proto-max-bulk-len of the database
+	redisMaxBulk = 512 << 20
+	// redisMaxArgs is the max number of arguments of a command the proxy accepts
+	redisMaxArgs = 1 << 20
+	// redisMaxLoginBulk and redisMaxLoginArgs are the limits before login, commands then are of authentication only
+	redisMaxLoginBulk = 1 << 12
+	redisMaxLoginArgs = 16
+	// redisMaxArg is the max length of arguments kept in statements, longer ones are truncated
+	redisMaxArg = 64
+)
+
+// redisPending is a command waiting for its reply, a reply replaces that of the database if it is not nil
+type redisPending struct {
+	done  func(result string)
+	reply []byte
+}
+
+// RedisConn is a client of RESP2 or RESP3 logging in by AUTH or HELLO
+type RedisConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	remote   net.Conn
+	user     string
+	password string
+	// hello is the HELLO of the client without AUTH, it is sent to the database after login
+	hello    [][]byte
+	loggedIn bool
+
+	mtx     sync.Mutex
+	w       *bufio.Writer
+	pending []*redisPending
+	// untracked is set once the client subscribes or monitors, replies are not matched to commands since then
+	untracked bool
+}
+
+func NewRedisConn(conn net.Conn) *RedisConn {
+	return &RedisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// Handshake reads commands until the client authenticates by AUTH or HELLO, others are refused as the database does.
+// Clients which only send passwords can login with id:secret as the password
+func (c *RedisConn) Handshake() (user string, err error) {
+	for {
+		args, err := readRedisCommand(c.r, redisMaxLoginArgs, redisMaxLoginBulk)
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToUpper(string(args[0])) {
+		case "AUTH":
+			if len(args) != 2 && len(args) != 3 {
+				if err = c.reply(redisError("ERR wrong number of arguments for 'auth' command")); err != nil {
+					return "", err
+				}
+				continue
+			}
+			c.login(args[1:len(args)-1], args[len(args)-1])
+			return c.user, nil
+		case "HELLO":
+			hello := [][]byte{args[0]}
+			for i := 1; i < len(args); i++ {
+				if strings.EqualFold(string(args[i]), "AUTH") && i+2 < len(args) {
+					c.login(args[i+1:i+2], args[i+2])
+					i += 2
+					continue
+				}
+				hello = append(hello, args[i])
+			}
+			if c.password != "" {
+				c.hello = hello
+				return c.user, nil
+			}
+		case "QUIT":
+			c.reply([]byte("+OK\r\n"))
+			return "", io.EOF
+		}
+		if err = c.reply(redisError("NOAUTH Authentication required.")); err != nil {
+			return "", err
+		}
+	}
+}
+
+// login keeps the credentials of AUTH or HELLO, the password is id:secret if the user is omitted or the default one
+func (c *RedisConn) login(user [][]byte, password []byte) {
+	if len(user) == 0 || string(user[0]) == "default" {
+		c.user, c.password, _ = strings.Cut(string(password), ":")
+		return
+	}
+	c.user, c.password = string(user[0]), string(password)
+}
+
+// Verify checks the password of AUTH or HELLO against password
+func (c *RedisConn) Verify(password string) error {
+	if subtle.ConstantTimeCompare([]byte(c.password), []byte(password)) != 1 {
+		return fmt.Errorf("wrong password")
+	}
+	return nil
+}
+
+// Login authenticates to the database on remote as user, the default user logs in by the password only
+// so that databases before ACL are supported. The login of the client is answered by the database
+func (c *RedisConn) Login(remote net.Conn, user, password string) (err error) {
+	c.remote = remote
+	remote.SetDeadline(time.Now().Add(redisLoginTimeout))
+	defer remote.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(remote)
+	if password != "" {
+		auth := [][]byte{[]byte("AUTH"), []byte(password)}
+		if user != "" && user != "default" {
+			auth = [][]byte{[]byte("AUTH"), []byte(user), []byte(password)}
+		}
+		if _, err = remote.Write(redisCommand(auth)); err != nil {
+			return
+		}
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return err
+		}
+		if reply[0] == '-' {
+			return errors.New(redisSummary(reply))
+		}
+	}
+
+	reply := []byte("+OK\r\n")
+	if c.hello != nil {
+		if _, err = remote.Write(redisCommand(c.hello)); err != nil {
+			return
+		}
+		if reply, err = readRedisReply(r); err != nil {
+			return
+		}
+	}
+	if r.Buffered() > 0 {
+		return fmt.Errorf("unexpected reply of database")
+	}
+	if err = c.reply(reply); err == nil {
+		c.loggedIn = true
+	}
+	return
+}
+
+// Relay forwards commands of the client to the database, each of them is audited with its arguments truncated
+// and the result is the summary of its reply. A refused command is replaced by a PING whose reply is replaced by the error,
+// so that replies of pipelined commands stay in order. Authenticating again is refused except the AUTH the client falls back to
+// when the database does not support HELLO, and so is turning replies off which makes them unable to be matched to commands
+func (c *RedisConn) Relay(audit Audit) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- c.relayReplies()
+	}()
+	go func() {
+		errs <- c.relayCommands(audit)
+	}()
+	return <-errs
+}
+
+func (c *RedisConn) relayCommands(audit Audit) error {
+	for {
+		args, err := readRedisCommand(c.r, redisMaxArgs, redisMaxBulk)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		name := strings.ToUpper(string(args[0]))
+		switch {
+		case name == "AUTH":
+			if c.hello != nil && c.sameLogin(args) {
+				err = c.substitute([]byte("+OK\r\n"))
+			} else {
+				err = c.substitute(redisError("ERR oneterm: authenticating again is not allowed"))
+			}
+		case name == "HELLO" && redisHasArg(args, "AUTH"):
+			err = c.substitute(redisError("ERR oneterm: authenticating again is not allowed"))
+		case name == "CLIENT" && len(args) > 1 && strings.EqualFold(string(args[1]), "REPLY"):
+			err = c.substitute(redisError("ERR oneterm: turning replies off is not allowed"))
+		default:
+			done, aerr := audit(redisStmt(args, 0), redisStmt(args, redisMaxArg))
+			if aerr != nil {
+				err = c.substitute(redisError("ERR oneterm: " + aerr.Error()))
+				break
+			}
+			c.push(&redisPending{done: done}, name == "SUBSCRIBE" || name == "PSUBSCRIBE" || name == "SSUBSCRIBE" || name == "MONITOR")
+			_, err = c.remote.Write(redisCommand(args))
+		}
+		if err != nil {
+			return err
+		}
+		if name == "QUIT" {
+			return nil
+		}
+	}
+}
+
+func (c *RedisConn) relayReplies() error {
+	r := bufio.NewReader(c.remote)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var done func(string)
+		c.mtx.Lock()
+		// attributes precede replies and pushes are out of band
+		if reply[0] != '|' && reply[0] != '>' && len(c.pending) > 0 {
+			p := c.pending[0]
+			c.pending = c.pending[1:]
+			if p.reply != nil {
+				reply = p.reply
+			}
+			done = p.done
+		}
+		_, err = c.w.Write(reply)
+		if err == nil && r.Buffered() == 0 {
+			err = c.w.Flush()
+		}
+		c.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+		if done != nil {
+			done(redisSummary(reply))
+		}
+	}
+}
+
+// sameLogin reports whether AUTH has the credentials the client logged in with
+func (c *RedisConn) sameLogin(args [][]byte) bool {
+	if len(args) != 2 && len(args) != 3 {
+		return false
+	}
+	l := &RedisConn{}
+	l.login(args[1:len(args)-1], args[len(args)-1])
+	return l.user == c.user && l.password == c.password
+}
+
+// substitute replies reply to the client in place of the reply of a command not sent
+func (c *RedisConn) substitute(reply []byte) error {
+	c.mtx.Lock()
+	untracked := c.untracked
+	if !untracked {
+		c.pending = append(c.pending, &redisPending{reply: reply})
+	}
+	c.mtx.Unlock()
+	if untracked {
+		return c.reply(reply)
+	}
+	_, err := c.remote.Write(redisCommand([][]byte{[]byte("PING")}))
+	return err
+}
+
+// push waits for the reply of a command, replies are not waited for since the client subscribes or monitors
+func (c *RedisConn) push(p *redisPending, untrack bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.untracked {
+		c.pending = append(c.pending, p)
+	}
+	c.untracked = c.untracked || untrack
+}
+
+func (c *RedisConn) reply(reply []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, err := c.w.Write(reply); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// Fail sends err to the client if it has not logged in to the database
+func (c *RedisConn) Fail(err error) {
+	if c.loggedIn {
+		return
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		c.reply(redisError("WRONGPASS invalid username-password pair or user is disabled."))
+		return
+	}
+	c.reply(redisError("ERR " + err.Error()))
+}
+
+func (c *RedisConn) Close() error {
+	return c.conn.Close()
+}
+
+// readRedisCommand reads a command of an array of bulk strings or an inline command,
+// it has at most maxArgs arguments of at most maxBulk bytes
+func readRedisCommand(r *bufio.Reader, maxArgs, maxBulk int) (args [][]byte, err error) {
+	for len(args) == 0 {
+		line, err := readRedisLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '*' {
+			args = bytes.Fields(line)
+			continue
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > maxArgs {
+			return nil, fmt.Errorf("invalid multibulk length")
+		}
+		for i := 0; i < n; i++ {
+			if line, err = readRedisLine(r); err != nil {
+				return nil, err
+			}
+			if len(line) == 0 || line[0] != '$' {
+				return nil, fmt.Errorf("expected '$', got '%s'", line)
+			}
+			arg, err := readRedisBulk(r, line, maxBulk)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+	}
+	return
+}
+
+// readRedisReply reads a whole reply as it is
+func readRedisReply(r *bufio.Reader) ([]byte, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply of database")
+	}
+	reply := append(line, '\r', '\n')
+	n := 0
+	switch line[0] {
+	case '+', '-', ':', '_', '#', ',', '(':
+		return reply, nil
+	case '$', '!', '=':
+		bulk, err := readRedisBulk(r, line, redisMaxBulk)
+		if err != nil || bulk == nil {
+			return reply, err
+		}
+		return append(append(reply, bulk...), '\r', '\n'), nil
+	case '*', '~', '>':
+		n, err = strconv.Atoi(string(line[1:]))
+	case '%', '|':
+		n, err = strconv.Atoi(string(line[1:]))
+		n *= 2
+	default:
+		return nil, fmt.Errorf("unexpected reply %q of database", line)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply %q of database", line)
+	}
+	for i := 0; i < n; i++ {
+		elem, err := readRedisReply(r)
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, elem...)
+	}
+	return reply, nil
+}
+
+// readRedisLine reads a line without CRLF
+func readRedisLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("too long line")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})), nil
+}
+
+// readRedisBulk reads the bulk string of header of at most limit bytes, it is nil for a null bulk string
+func readRedisBulk(r *bufio.Reader, header []byte, limit int) ([]byte, error) {
+	n, err := strconv.Atoi(string(header[1:]))
+	if err != nil || n > limit {
+		return nil, fmt.Errorf("invalid bulk length")
+	}
+	if n < 0 {
+		return nil, nil
+	}
+	bulk := make([]byte, n+2)
+	if _, err = io.ReadFull(r, bulk); err != nil {
+		return nil, err
+	}
+	return bulk[:n], nil
+}
+
+func redisCommand(args [][]byte) []byte {
+	b := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		b = append(b, fmt.Sprintf("$%d\r\n", len(arg))...)
+		b = append(b, arg...)
+		b = append(b, '\r', '\n')
+	}
+	return b
+}
+
+func redisHasArg(args [][]byte, arg string) bool {
+	for _, a := range args[1:] {
+		if strings.EqualFold(string(a), arg) {
+			return true
+		}
+	}
+	return false
+}
+
+func redisError(msg string) []byte {
+	return []byte("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+// redisStmt is the command as redis-cli shows it, the name is in upper case and arguments longer than maxArg
+// are truncated if maxArg is positive
+func redisStmt(args [][]byte, maxArg int) string {
+	ss := []string{strings.ToUpper(string(args[0]))}
+	for _, arg := range args[1:] {
+		s, truncated := string(arg), false
+		if maxArg > 0 && len(s) > maxArg {
+			s, truncated = s[:maxArg], true
+			for !utf8.ValidString(s) {
+				s = s[:len(s)-1]
+			}
+		}
+		if s == "" || strings.ContainsAny(s, " \"'\\") || strconv.Quote(s) != `"`+s+`"` {
+			s = strconv.Quote(s)
+		}
+		if truncated {
+			s += "..."
+		}
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, " ")
+}
+
+// redisSummary is the result of a reply, errors and simple strings are kept and others are described
+func redisSummary(reply []byte) string {
+	line, rest, _ := bytes.Cut(reply, []byte("\r\n"))
+	s := string(line[1:])
+	switch line[0] {
+	case '+', '-':
+		return s
+	case ':':
+		return "(integer) " + s
+	case '_':
+		return "(nil)"
+	case '$', '!', '=', '*', '~', '%':
+		if s == "-1" {
+			return "(nil)"
+		}
+		if line[0] == '!' {
+			return string(bytes.TrimSuffix(rest, []byte("\r\n")))
+		}
+		if line[0] == '*' || line[0] == '~' || line[0] == '%' {
+			return fmt.Sprintf("(%s elements)", s)
+		}
+		return fmt.Sprintf("(%s bytes)", s)
+	}
+	return s
+}
@@ -0,0 +1,211 @@
+package dbproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newFakeRedis is a database before ACL and HELLO with password, it records commands except PING
+func newFakeRedis(t *testing.T, password string, cmds chan<- string) net.Listener {
+	return serve(t, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		authed := false
+		for {
+			args, err := readRedisCommand(r, redisMaxArgs, redisMaxBulk)
+			if err != nil {
+				return nil
+			}
+			name := strings.ToUpper(string(args[0]))
+			reply := "+OK\r\n"
+			switch {
+			case name == "AUTH":
+				authed = len(args) == 2 && string(args[1]) == password
+				if !authed {
+					reply = "-WRONGPASS invalid password\r\n"
+				}
+			case !authed:
+				reply = "-NOAUTH Authentication required.\r\n"
+			case name == "HELLO":
+				reply = "-ERR unknown command 'HELLO'\r\n"
+			case name == "PING":
+				reply = "+PONG\r\n"
+			case name == "GET":
+				reply = "$1\r\nv\r\n"
+			}
+			if authed && name != "AUTH" && name != "PING" && name != "HELLO" && name != "CLIENT" {
+				cmds <- redisStmt(args, redisMaxArg)
+			}
+			if _, err = conn.Write([]byte(reply)); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func TestRedis(t *testing.T) {
+	cmds, results := make(chan string, 8), make(chan string, 8)
+	upstream := newFakeRedis(t, "dbpass", cmds)
+	defer upstream.Close()
+
+	proxy := serve(t, func(conn net.Conn) error {
+		c := NewRedisConn(conn)
+		if _, err := c.Handshake(); err != nil {
+			return err
+		}
+		if err := c.Verify("secret"); err != nil {
+			c.Fail(ErrAccessDenied)
+			return err
+		}
+		remote, err := net.Dial("tcp", upstream.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+		if err = c.Login(remote, "default", "dbpass"); err != nil {
+			c.Fail(err)
+			return err
+		}
+		return c.Relay(filterAudit(t, func(stmt, result string) {
+			if !strings.HasPrefix(stmt, "CLIENT") {
+				results <- stmt + " => " + result
+			}
+		}, deny("FLUSHALL", `(?i)flushall`), deny("KEYS *", `(?i)^keys \*$`)))
+	})
+	defer proxy.Close()
+
+	ctx := context.Background()
+	rc := redis.NewClient(&redis.Options{Addr: proxy.Addr().String(), Username: "token", Password: "secret", MaxRetries: -1, PoolSize: 1})
+	defer rc.Close()
+
+	value := strings.Repeat("a", 100)
+	if err := rc.Set(ctx, "k", value, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := "SET k " + value[:redisMaxArg] + "..."
+	if c, r := <-cmds, <-results; c != want || r != want+" => OK" {
+		t.Fatalf("command = %q, result = %q", c, r)
+	}
+	if err := rc.Keys(ctx, "*").Err(); err == nil || !strings.Contains(err.Error(), "blocked by KEYS *") {
+		t.Fatalf("Keys() error = %v", err)
+	}
+	script := strings.Repeat(" ", redisMaxArg) + ";redis.call('flushall')"
+	if err := rc.Eval(ctx, script, nil).Err(); err == nil || !strings.Contains(err.Error(), "blocked by FLUSHALL") {
+		t.Fatalf("Eval() error = %v, arguments must be checked beyond the truncated ones", err)
+	}
+
+	pipe := rc.Pipeline()
+	flush, get := pipe.FlushAll(ctx), pipe.Get(ctx, "k")
+	pipe.Exec(ctx)
+	if err := flush.Err(); err == nil || !strings.Contains(err.Error(), "blocked by FLUSHALL") {
+		t.Fatalf("FlushAll() error = %v", err)
+	}
+	if v, err := get.Result(); err != nil || v != "v" {
+		t.Fatalf("Get() = %q, %v", v, err)
+	}
+	if c, r := <-cmds, <-results; c != "GET k" || r != "GET k => (1 bytes)" {
+		t.Fatalf("command = %q, result = %q, blocked ones must not be sent", c, r)
+	}
+}
+
+func TestRedisAccessDenied(t *testing.T) {
+	proxy := serve(t, func(conn net.Conn) error {
+		c := NewRedisConn(conn)
+		if _, err := c.Handshake(); err != nil {
+			return err
+		}
+		if err := c.Verify("secret"); err != nil {
+			c.Fail(ErrAccessDenied)
+		}
+		return nil
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("AUTH token:wrong\r\n"))
+	if line, err := readRedisLine(bufio.NewReader(conn)); err != nil || !strings.HasPrefix(string(line), "-WRONGPASS") {
+		t.Fatalf("AUTH = %q, %v, want access denied", line, err)
+	}
+}
+
+func TestRedisLoginFailed(t *testing.T) {
+	upstream := newFakeRedis(t, "dbpass", make(chan string, 1))
+	defer upstream.Close()
+
+	proxy := serve(t, func(conn net.Conn) error {
+		c := NewRedisConn(conn)
+		if _, err := c.Handshake(); err != nil {
+			return err
+		}
+		if err := c.Verify("secret"); err != nil {
+			c.Fail(ErrAccessDenied)
+			return err
+		}
+		remote, err := net.Dial("tcp", upstream.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+		if err = c.Login(remote, "default", "wrong"); err == nil {
+			return fmt.Errorf("login with a wrong password of the database succeeded")
+		}
+		c.Fail(err)
+		return nil
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("AUTH token:secret\r\n"))
+	r := bufio.NewReader(conn)
+	if line, err := readRedisLine(r); err != nil || !strings.HasPrefix(string(line), "-ERR WRONGPASS") {
+		t.Fatalf("AUTH = %q, %v, want the error of the database", line, err)
+	}
+	if line, err := readRedisLine(r); err != io.EOF {
+		t.Fatalf("replied %q, %v after the error, want only one reply", line, err)
+	}
+}
+
+func TestRedisLoginLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+	}{
+		{name: "bulk", cmd: fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n", redisMaxLoginBulk+1)},
+		{name: "args", cmd: fmt.Sprintf("*%d\r\n", redisMaxLoginArgs+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			proxy := serve(t, func(conn net.Conn) error {
+				_, err := NewRedisConn(conn).Handshake()
+				errs <- err
+				return nil
+			})
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(tt.cmd))
+			if err := <-errs; err == nil || !strings.Contains(err.Error(), "invalid") {
+				t.Fatalf("Handshake() error = %v, want the command refused", err)
+			}
+		})
+	}
+}
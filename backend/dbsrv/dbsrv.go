@@ -0,0 +1,182 @@
+// Package dbsrv serves database protocols to clients logging in by one-time tokens. Clients are relayed to assets
+// as the accounts of their tokens, so they never see the real credentials, and their statements are audited as commands
+package dbsrv
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/veops/oneterm/api/controller"
+	"github.com/veops/oneterm/conf"
+	"github.com/veops/oneterm/dbproxy"
+	myi18n "github.com/veops/oneterm/i18n"
+	"github.com/veops/oneterm/logger"
+	gsession "github.com/veops/oneterm/session"
+)
+
+const (
+	loginTimeout = time.Second * 30
+)
+
+var (
+	ctx, cancel = context.WithCancel(context.Background())
+)
+
+// client is a connection of a database protocol
+type client interface {
+	controller.DbConn
+	// Handshake reads the login of the client and returns its user name
+	Handshake() (user string, err error)
+	// Verify checks the password of the login against secret
+	Verify(secret string) error
+	// Fail tells the client err in its protocol before it is relayed, dbproxy.ErrAccessDenied is told as a failed login
+	Fail(err error)
+}
+
+type server struct {
+	protocol  string
+	port      int
+	newClient func(conn net.Conn) client
+}
+
+func RunDb() error {
+	mysqlKeys := map[string]*rsa.PublicKey{}
+	for _, kv := range conf.Cfg.DbProxy.MysqlServerKeys {
+		key, err := dbproxy.ParseServerKey(kv.Value)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("invalid mysql server key of %s: %w", kv.Key, err)
+		}
+		mysqlKeys[kv.Key] = key
+	}
+	servers := []*server{
+		{protocol: "mysql", port: conf.Cfg.DbProxy.MysqlPort, newClient: func(conn net.Conn) client {
+			m := dbproxy.NewMysqlConn(conn)
+			m.ServerKeys = mysqlKeys
+			return m
+		}},
+		{protocol: "postgresql", port: conf.Cfg.DbProxy.PostgresqlPort, newClient: func(conn net.Conn) client { return dbproxy.NewPostgresConn(conn) }},
+		{protocol: "redis", port: conf.Cfg.DbProxy.RedisPort, newClient: func(conn net.Conn) client { return dbproxy.NewRedisConn(conn) }},
+	}
+
+	g := &errgroup.Group{}
+	for _, s := range servers {
+		if s.port == 0 {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(conf.Cfg.DbProxy.Host, strconv.Itoa(s.port)))
+		if err != nil {
+			cancel()
+			return fmt.Errorf("listen %s proxy failed: %w", s.protocol, err)
+		}
+		context.AfterFunc(ctx, func() { ln.Close() })
+		s := s
+		g.Go(func() error {
+			return accept(ln, s)
+		})
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		return nil
+	})
+
+	return g.Wait()
+}
+
+func StopDb() {
+	defer cancel()
+}
+
+func accept(ln net.Listener, s *server) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go handle(conn, s)
+	}
+}
+
+// handle logs the client in by its token and relays it as the user who created the token
+func handle(conn net.Conn, s *server) {
+	defer conn.Close()
+	c := s.newClient(conn)
+
+	conn.SetDeadline(time.Now().Add(loginTimeout))
+	user, err := c.Handshake()
+	if err != nil {
+		logger.L().Debug("db handshake failed", zap.String("protocol", s.protocol), zap.Error(err))
+		return
+	}
+	token, err := takeToken(user, s.protocol)
+	if err == nil {
+		err = c.Verify(token.Secret)
+	}
+	if err != nil {
+		logger.L().Warn("db login failed", zap.String("protocol", s.protocol), zap.String("user", user), zap.Error(err))
+		c.Fail(dbproxy.ErrAccessDenied)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	gctx := &gin.Context{
+		Request: &http.Request{
+			RemoteAddr: conn.RemoteAddr().String(),
+		},
+		Params: gin.Params{
+			{Key: "account_id", Value: cast.ToString(token.AccountId)},
+			{Key: "asset_id", Value: cast.ToString(token.AssetId)},
+			{Key: "protocol", Value: token.Protocol},
+		},
+	}
+	gctx.Set("session", token.Session)
+
+	if err = controller.ConnectDb(gctx, c); err != nil {
+		logger.L().Warn("db proxy failed", zap.String("protocol", token.Protocol), zap.String("user", token.Session.GetUserName()), zap.Error(err))
+		c.Fail(errors.New(errMessage(err)))
+	}
+}
+
+// takeToken returns the token of the user name if it is for the protocol, it is consumed whether it is valid or not
+func takeToken(user, protocol string) (*gsession.DbToken, error) {
+	token, err := gsession.TakeDbToken(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.ToLower(token.Protocol), protocol+":") {
+		return nil, fmt.Errorf("token is not for %s", protocol)
+	}
+	return token, nil
+}
+
+// errMessage is what clients are told about err
+func errMessage(err error) string {
+	ae := &controller.ApiError{}
+	if !errors.As(err, &ae) {
+		return err.Error()
+	}
+	msg := ae.Message(i18n.NewLocalizer(myi18n.Bundle))
+	if e, ok := ae.Data["err"]; ok {
+		msg = fmt.Sprintf("%s: %v", msg, e)
+	}
+	return msg
+}
@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/veops/oneterm/agent"
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+var (
+	// agents are connections of agents connected to this node by gateway id.
+	// Agents are dialed only through the node they are connected to, so gateways of agents require a single replica
+	// or a load balancer sending agents and sessions using them to the same node
+	agents = &sync.Map{}
+)
+
+// ServeAgent registers the connection of the agent of the gateway until ctx is done,
+// it is called on every request of the agent and a new connection replaces the old one
+func ServeAgent(ctx context.Context, gatewayId int, conn ssh.Conn) {
+	now := time.Now()
+	if v, ok := agents.Load(gatewayId); !ok || v.(ssh.Conn) != conn {
+		agents.Store(gatewayId, conn)
+		if ok {
+			v.(ssh.Conn).Close()
+		}
+		logger.L().Info("agent connected", zap.Int("gatewayId", gatewayId), zap.String("addr", conn.RemoteAddr().String()))
+		manager.online(gatewayId, 0)
+		go func() {
+			<-ctx.Done()
+			if !agents.CompareAndDelete(gatewayId, conn) {
+				return
+			}
+			logger.L().Info("agent disconnected", zap.Int("gatewayId", gatewayId))
+			updateAgent(gatewayId, map[string]any{"status": model.GATEWAYSTATUS_OFFLINE})
+			manager.offline(gatewayId, fmt.Errorf("agent disconnected"))
+		}()
+		go func() {
+			// agents reconnect by themselves, dead connections are closed to be replaced
+			err := manager.keepAlive(gatewayId, conn, func() bool {
+				v, ok := agents.Load(gatewayId)
+				return ok && v.(ssh.Conn) == conn
+			})
+			if err != nil {
+				logger.L().Warn("agent is unreachable", zap.Int("gatewayId", gatewayId), zap.Error(err))
+				conn.Close()
+			}
+		}()
+	}
+	updateAgent(gatewayId, map[string]any{"status": model.GATEWAYSTATUS_ONLINE, "last_seen_at": &now})
+}
+
+func updateAgent(gatewayId int, data map[string]any) {
+	if err := mysql.DB.Model(&model.Gateway{}).Where("id = ?", gatewayId).UpdateColumns(data).Error; err != nil {
+		logger.L().Error("update agent failed", zap.Int("gatewayId", gatewayId), zap.Error(err))
+	}
+}
+
+// agentDialer opens channels to targets through the current connection of the agent
+type agentDialer struct {
+	gatewayId int
+}
+
+func (d *agentDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	v, ok := agents.Load(d.gatewayId)
+	if !ok {
+		return nil, fmt.Errorf("agent of gateway %d is not connected to this node", d.gatewayId)
+	}
+	conn := v.(ssh.Conn)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ch, reqs, err := conn.OpenChannel(agent.ChannelType, ssh.Marshal(&agent.Forward{
+		DestAddr:   host,
+		DestPort:   cast.ToUint32(port),
+		OriginAddr: "127.0.0.1",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return &channelConn{Channel: ch, laddr: conn.LocalAddr(), raddr: conn.RemoteAddr()}, nil
+}
+
+// channelConn is a channel used as net.Conn, deadlines are not supported
+type channelConn struct {
+	ssh.Channel
+	laddr, raddr net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.laddr }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.raddr }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// EnrollTokenHash is what is saved for enrollment tokens of agents
+func EnrollTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
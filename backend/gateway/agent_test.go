@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/veops/oneterm/agent"
+	"github.com/veops/oneterm/model"
+)
+
+// serveAgents starts an ssh server on loopback registering agents of gatewayId as the ssh server of oneterm does
+func serveAgents(t *testing.T, gatewayId int) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ssh.Server{
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool { return ctx.User() == agent.User(gatewayId) },
+		RequestHandlers: map[string]ssh.RequestHandler{
+			agent.RequestType: func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+				ServeAgent(ctx, gatewayId, ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn))
+				return true, nil
+			},
+		},
+	}
+	srv.AddHostKey(signer)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestDialAgent(t *testing.T) {
+	id, target := newId(t), newEcho(t)
+	g := &model.Gateway{Id: id, Name: "agent", Type: model.GATEWAYTYPE_AGENT}
+	ctx := context.Background()
+	if _, err := manager.Dial(ctx, "s1", g, "tcp", target); err == nil {
+		t.Fatal("Dial() through an agent not connected error = nil")
+	}
+
+	addr := serveAgents(t, id)
+	agentCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Run(agentCtx, &agent.Config{Server: addr, GatewayId: id, KeyPath: filepath.Join(t.TempDir(), "agent.key")})
+	}()
+	defer cancel()
+	eventually(t, "agent is not registered", func() bool {
+		_, ok := agents.Load(id)
+		return ok
+	})
+	if h := manager.Health(id); h.Status != model.GATEWAYSTATUS_ONLINE {
+		t.Fatalf("health %+v of a registered agent, want online", h)
+	}
+
+	conn1, err := manager.Dial(ctx, "s1", g, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn1)
+	conn2, err := manager.Dial(ctx, "s2", g, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn2)
+	if n := manager.count(id); n != 2 {
+		t.Fatalf("agent referenced %d times by 2 sessions", n)
+	}
+	manager.Close("s1")
+	if n := manager.count(id); n != 1 {
+		t.Fatalf("agent referenced %d times after a session is closed, want 1", n)
+	}
+	echo(t, conn2)
+	manager.Close("s2")
+	if _, ok, _ := manager.reference(&model.Gateway{Id: id}); ok {
+		t.Fatal("agent is kept after it is released")
+	}
+
+	cancel()
+	if err = <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	eventually(t, "agent disconnected is kept", func() bool {
+		_, ok := agents.Load(id)
+		return !ok
+	})
+	if h := manager.Health(id); h.Status != model.GATEWAYSTATUS_OFFLINE {
+		t.Fatalf("health %+v of a disconnected agent, want offline", h)
+	}
+	if _, err = manager.Dial(ctx, "s3", g, "tcp", target); err == nil {
+		t.Fatal("Dial() through a disconnected agent error = nil")
+	}
+}
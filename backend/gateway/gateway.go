@@ -1,25 +1,33 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/samber/lo"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/veops/oneterm/hostkey"
 	"github.com/veops/oneterm/logger"
 	"github.com/veops/oneterm/model"
 )
 
 var (
 	manager = &GateWayManager{
-		gateways:        map[string]*GatewayTunnel{},
-		sshClients:      map[int]*ssh.Client{},
-		sshClientsCount: map[int]int{},
-		mtx:             sync.Mutex{},
+		sessions:     map[string]*gatewaySession{},
+		clients:      map[int]dialer{},
+		clientsCount: map[int]int{},
+		parents:      map[int]int{},
+		next:         map[int]int{},
+		mtx:          sync.Mutex{},
 	}
 )
 
@@ -27,122 +35,382 @@ func GetGatewayManager() *GateWayManager {
 	return manager
 }
 
+// GatewayTunnel is a listener on localhost for guacd, every connection to it is dialed to the remote address through the gateway
 type GatewayTunnel struct {
 	listener   net.Listener
+	gateway    *model.Gateway
 	GatewayId  int
 	SessionId  string
 	LocalIp    string
 	LocalPort  int
 	RemoteIp   string
 	RemotePort int
-	LocalConn  net.Conn
-	RemoteConn net.Conn
-	Opened     chan struct{}
-}
-
-func (gt *GatewayTunnel) Open() (err error) {
-	go func() {
-		<-time.After(time.Second * 5)
-		logger.L().Debug("timeout 5 second close listener", zap.String("sessionId", gt.SessionId))
-		gt.listener.Close()
-	}()
-	close(gt.Opened)
-	gt.LocalConn, err = gt.listener.Accept()
-	if err != nil {
-		logger.L().Error("accept failed", zap.String("sessionId", gt.SessionId), zap.Error(err))
-		return err
-	}
+}
 
-	remoteAddr := fmt.Sprintf("%s:%d", gt.RemoteIp, gt.RemotePort)
-	gt.RemoteConn, err = manager.sshClients[gt.GatewayId].Dial("tcp", remoteAddr)
-	if err != nil {
-		logger.L().Error("dial remote failed", zap.String("sessionId", gt.SessionId), zap.Error(err))
-		return err
+func (gt *GatewayTunnel) serve() {
+	remoteAddr := net.JoinHostPort(gt.RemoteIp, strconv.Itoa(gt.RemotePort))
+	for {
+		local, err := gt.listener.Accept()
+		if err != nil {
+			logger.L().Debug("gateway listener closed", zap.String("sessionId", gt.SessionId), zap.Error(err))
+			return
+		}
+		if !manager.track(gt.SessionId, local) {
+			return
+		}
+		go func() {
+			defer local.Close()
+			remote, err := manager.Dial(context.Background(), gt.SessionId, gt.gateway, "tcp", remoteAddr)
+			if err != nil {
+				logger.L().Error("dial remote failed", zap.String("sessionId", gt.SessionId), zap.Error(err))
+				return
+			}
+			defer remote.Close()
+			go io.Copy(local, remote)
+			io.Copy(remote, local)
+		}()
 	}
+}
 
-	go io.Copy(gt.LocalConn, gt.RemoteConn)
-	go io.Copy(gt.RemoteConn, gt.LocalConn)
+// dialer is the ssh client of a gateway or the connection of an agent
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
 
-	return
+// gatewaySession is what a session holds through a gateway, all of it is closed by Close of the session.
+// Members are the gateways acquired for the session, they are members of the gateway if it is a group
+type gatewaySession struct {
+	gatewayId int
+	members   []int
+	conns     []net.Conn
+	tunnels   []*GatewayTunnel
 }
 
 type GateWayManager struct {
-	gateways        map[string]*GatewayTunnel
-	sshClients      map[int]*ssh.Client
-	sshClientsCount map[int]int
-	mtx             sync.Mutex
+	sessions     map[string]*gatewaySession
+	clients      map[int]dialer
+	clientsCount map[int]int
+	// parents are the hops clients of gateways are dialed through
+	parents map[int]int
+	// next is the round-robin position of gateway groups
+	next        map[int]int
+	unreachable atomic.Pointer[func(gatewayId int)]
+	mtx         sync.Mutex
 }
 
-func (gm *GateWayManager) Open(sessionId, remoteIp string, remotePort int, gateway *model.Gateway) (g *GatewayTunnel, err error) {
+// Dial connects to addr through the gateway for the session, gateways having a parent are dialed hop by hop
+// through the chain loaded in Parent. Gateway groups dial through a member picked by their strategy
+// and fail over to the next member if it fails. The connection is closed by Close of the session if it is still open
+func (gm *GateWayManager) Dial(ctx context.Context, sessionId string, gateway *model.Gateway, network, addr string) (conn net.Conn, err error) {
 	if gateway == nil {
-		err = fmt.Errorf("gateway is nil")
-		return
+		return nil, fmt.Errorf("gateway is nil")
 	}
-	gm.mtx.Lock()
-	defer gm.mtx.Unlock()
-
-	sshCli, ok := gm.sshClients[gateway.Id]
-	if !ok {
-		var auth ssh.AuthMethod
-		auth, err = gm.getAuth(gateway)
-		if err != nil {
+	for _, member := range gm.candidates(gateway) {
+		if conn, err = gm.dial(ctx, sessionId, gateway.Id, member, network, addr); err == nil {
 			return
 		}
-		sshCli, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", gateway.Host, gateway.Port), &ssh.ClientConfig{
-			User:            gateway.Account,
-			Auth:            []ssh.AuthMethod{auth},
-			Timeout:         time.Second * 3,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		})
-		if err != nil {
+		if gateway.Type == model.GATEWAYTYPE_GROUP {
+			logger.L().Warn("dial through member of gateway group failed", zap.String("group", gateway.Name), zap.String("member", member.Name), zap.Error(err))
+		}
+		if ctx.Err() != nil {
 			return
 		}
 	}
-	gm.sshClients[gateway.Id] = sshCli
-	gm.sshClientsCount[gateway.Id] += 1
-	localPort, err := getAvailablePort()
+	if err == nil {
+		err = fmt.Errorf("gateway group %s has no member", gateway.Name)
+	}
+	return
+}
+
+func (gm *GateWayManager) dial(ctx context.Context, sessionId string, gatewayId int, member *model.Gateway, network, addr string) (conn net.Conn, err error) {
+	cli, err := gm.open(sessionId, gatewayId, member)
 	if err != nil {
 		return
 	}
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "localhost", localPort))
+	if conn, err = cli.DialContext(ctx, network, addr); err != nil {
+		return
+	}
+	conn = counted(member.Id, conn)
+	if !gm.track(sessionId, conn) {
+		conn.Close()
+		return nil, fmt.Errorf("gateway of session %s is closed", sessionId)
+	}
+	return
+}
+
+// candidates returns the gateway or members of the gateway group in the order to be dialed, members having failed are the last resort
+func (gm *GateWayManager) candidates(gateway *model.Gateway) []*model.Gateway {
+	if gateway.Type != model.GATEWAYTYPE_GROUP {
+		return []*model.Gateway{gateway}
+	}
+	members := append([]*model.Gateway{}, gateway.Members...)
+	if len(members) == 0 {
+		return members
+	}
+	healths := lo.SliceToMap(members, func(m *model.Gateway) (int, Health) { return m.Id, gm.Health(m.Id) })
+	switch gateway.Strategy {
+	case model.GATEWAYSTRATEGY_LEASTCONN:
+		sort.SliceStable(members, func(i, j int) bool { return healths[members[i].Id].Tunnels < healths[members[j].Id].Tunnels })
+	default:
+		gm.mtx.Lock()
+		n := gm.next[gateway.Id] % len(members)
+		gm.next[gateway.Id] = n + 1
+		gm.mtx.Unlock()
+		members = append(members[n:], members[:n]...)
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return healths[members[i].Id].Status != model.GATEWAYSTATUS_OFFLINE && healths[members[j].Id].Status == model.GATEWAYSTATUS_OFFLINE
+	})
+	return members
+}
+
+// Listen opens a listener on localhost for guacd which can only connect to assets by address,
+// it is closed along with its connections by Close of the session
+func (gm *GateWayManager) Listen(sessionId, remoteIp string, remotePort int, gateway *model.Gateway) (gt *GatewayTunnel, err error) {
+	if gateway == nil {
+		return nil, fmt.Errorf("gateway is nil")
+	}
+	for _, member := range gm.candidates(gateway) {
+		if _, err = gm.open(sessionId, gateway.Id, member); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		gm.Close(sessionId)
+		return
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
+		gm.Close(sessionId)
 		return
 	}
-	g = &GatewayTunnel{
+	gt = &GatewayTunnel{
 		listener:   listener,
+		gateway:    gateway,
 		GatewayId:  gateway.Id,
 		SessionId:  sessionId,
-		LocalIp:    "localhost",
-		LocalPort:  localPort,
+		LocalIp:    "127.0.0.1",
+		LocalPort:  listener.Addr().(*net.TCPAddr).Port,
 		RemoteIp:   remoteIp,
 		RemotePort: remotePort,
-		Opened:     make(chan struct{}),
 	}
-	gm.gateways[sessionId] = g
-	go g.Open()
 
-	logger.L().Debug("opening gateway", zap.Any("sessionId", sessionId))
-	<-g.Opened
-	logger.L().Debug("opened gateway", zap.Any("sessionId", sessionId))
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	s, ok := gm.sessions[sessionId]
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("gateway of session %s is closed", sessionId)
+	}
+	s.tunnels = append(s.tunnels, gt)
+	go gt.serve()
 
 	return
 }
 
+// Close closes listeners and connections of the sessions and dereferences their gateways
 func (gm *GateWayManager) Close(sessionIds ...string) {
 	gm.mtx.Lock()
 	defer gm.mtx.Unlock()
 	for _, sid := range sessionIds {
-		gt, ok := gm.gateways[sid]
+		s, ok := gm.sessions[sid]
 		if !ok {
+			continue
+		}
+		delete(gm.sessions, sid)
+		for _, gt := range s.tunnels {
+			gt.listener.Close()
+		}
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+		for _, id := range s.members {
+			gm.release(id)
+		}
+	}
+}
+
+// open references the client of the member of the gateway for the session on its first use
+func (gm *GateWayManager) open(sessionId string, gatewayId int, member *model.Gateway) (dialer, error) {
+	if cli, ok, err := gm.opened(sessionId, gatewayId, member.Id); ok || err != nil {
+		return cli, err
+	}
+	cli, err := gm.acquire(member)
+	if err != nil {
+		return nil, err
+	}
+
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	s, ok := gm.sessions[sessionId]
+	if ok && (s.gatewayId != gatewayId || lo.Contains(s.members, member.Id)) {
+		// the session is opened by another dial meanwhile
+		gm.release(member.Id)
+		if s.gatewayId != gatewayId {
+			return nil, fmt.Errorf("session %s is using another gateway", sessionId)
+		}
+		return gm.clients[member.Id], nil
+	}
+	if !ok {
+		s = &gatewaySession{gatewayId: gatewayId}
+		gm.sessions[sessionId] = s
+	}
+	s.members = append(s.members, member.Id)
+	return cli, nil
+}
+
+// opened returns the client of the member if the session has opened it
+func (gm *GateWayManager) opened(sessionId string, gatewayId int, memberId int) (cli dialer, ok bool, err error) {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	s, ok := gm.sessions[sessionId]
+	if ok && s.gatewayId != gatewayId {
+		return nil, false, fmt.Errorf("session %s is using another gateway", sessionId)
+	}
+	if ok && lo.Contains(s.members, memberId) {
+		return gm.clients[memberId], true, nil
+	}
+	return nil, false, nil
+}
+
+func (gm *GateWayManager) track(sessionId string, conn net.Conn) bool {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	s, ok := gm.sessions[sessionId]
+	if ok {
+		s.conns = append(s.conns, conn)
+	}
+	return ok
+}
+
+// acquire returns the client of the gateway and references it, the client of the parent is referenced once
+// by each client dialed through it. Gateways are connected without holding the lock,
+// the client connected by a concurrent call first is used and the others are closed
+func (gm *GateWayManager) acquire(gateway *model.Gateway) (cli dialer, err error) {
+	if cli, ok, err := gm.reference(gateway); ok || err != nil {
+		return cli, err
+	}
+
+	var parent dialer
+	if gateway.ParentId != 0 {
+		if gateway.Parent == nil || gateway.Parent.Id != gateway.ParentId {
+			return nil, fmt.Errorf("parent of gateway %s is not loaded", gateway.Name)
+		}
+		if parent, err = gm.acquire(gateway.Parent); err != nil {
 			return
 		}
-		gm.sshClientsCount[gt.GatewayId] -= 1
-		if gm.sshClientsCount[gt.GatewayId] <= 0 {
-			gm.sshClients[gt.GatewayId].Close()
-			delete(gm.sshClients, gt.GatewayId)
-			delete(gm.sshClientsCount, gt.GatewayId)
+	}
+	start := time.Now()
+	sshCli, err := gm.connect(gateway, parent)
+
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	if err != nil {
+		if gateway.ParentId != 0 {
+			gm.release(gateway.ParentId)
+		}
+		gm.offline(gateway.Id, err)
+		return
+	}
+	if cli, ok := gm.clients[gateway.Id]; ok {
+		sshCli.Close()
+		if gateway.ParentId != 0 {
+			gm.release(gateway.ParentId)
 		}
+		gm.clientsCount[gateway.Id] += 1
+		return cli, nil
 	}
+	gm.online(gateway.Id, time.Since(start))
+	go gm.watch(gateway, sshCli)
+
+	gm.clients[gateway.Id] = sshCli
+	gm.clientsCount[gateway.Id] = 1
+	gm.parents[gateway.Id] = gateway.ParentId
+
+	return sshCli, nil
+}
+
+// reference references the client of the gateway if it is connected, agents are referenced if they are connected to this node
+func (gm *GateWayManager) reference(gateway *model.Gateway) (cli dialer, ok bool, err error) {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	if cli, ok = gm.clients[gateway.Id]; ok {
+		gm.clientsCount[gateway.Id] += 1
+		return
+	}
+	if gateway.Type != model.GATEWAYTYPE_AGENT {
+		return
+	}
+	if _, ok := agents.Load(gateway.Id); !ok {
+		return nil, false, fmt.Errorf("agent of gateway %s is not connected", gateway.Name)
+	}
+	gm.clients[gateway.Id] = &agentDialer{gatewayId: gateway.Id}
+	gm.clientsCount[gateway.Id] = 1
+	return gm.clients[gateway.Id], true, nil
+}
+
+// connect connects to the gateway directly or through parent which is the client of its parent
+func (gm *GateWayManager) connect(gateway *model.Gateway, parent dialer) (*ssh.Client, error) {
+	auth, err := gm.getAuth(gateway)
+	if err != nil {
+		return nil, err
+	}
+	cfg := hostkey.Config(&ssh.ClientConfig{
+		User:    gateway.Account,
+		Auth:    []ssh.AuthMethod{auth},
+		Timeout: time.Second * 3,
+	}, 0, gateway.Id, gateway.Port)
+	addr := fmt.Sprintf("%s:%d", gateway.Host, gateway.Port)
+
+	if gateway.ParentId == 0 {
+		return ssh.Dial("tcp", addr, cfg)
+	}
+
+	if parent == nil {
+		return nil, fmt.Errorf("parent of gateway %s is not connected", gateway.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	conn, err := parent.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial gateway %s through %s failed: %w", gateway.Name, gateway.Parent.Name, err)
+	}
+	return NewClient(counted(gateway.ParentId, conn), cfg)
+}
+
+// release dereferences the client of the gateway, clients no longer referenced are closed along with their hops
+func (gm *GateWayManager) release(id int) {
+	for id != 0 {
+		gm.clientsCount[id] -= 1
+		if gm.clientsCount[id] > 0 {
+			return
+		}
+		if cli, ok := gm.clients[id].(io.Closer); ok {
+			cli.Close()
+		}
+		gm.idle(id)
+		parent := gm.parents[id]
+		delete(gm.clients, id)
+		delete(gm.clientsCount, id)
+		delete(gm.parents, id)
+		id = parent
+	}
+}
+
+// NewClient runs the ssh handshake on conn within the timeout of cfg, channels of gateways do not support deadlines
+// so the handshake is aborted by closing the connection
+func NewClient(conn net.Conn, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	timer := time.AfterFunc(cfg.Timeout, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), cfg)
+	if !timer.Stop() && err == nil {
+		c.Close()
+		err = fmt.Errorf("ssh handshake timeout")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
 func (gm *GateWayManager) getAuth(gateway *model.Gateway) (ssh.AuthMethod, error) {
@@ -167,18 +435,3 @@ func (gm *GateWayManager) getAuth(gateway *model.Gateway) (ssh.AuthMethod, error
 		return nil, fmt.Errorf("invalid authmethod %d", gateway.AccountType)
 	}
 }
-
-func getAvailablePort() (int, error) {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	if err != nil {
-		return 0, err
-	}
-
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return 0, err
-	}
-	defer l.Close()
-
-	return l.Addr().(*net.TCPAddr).Port, nil
-}
@@ -0,0 +1,399 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/model"
+)
+
+// newManager returns a manager of its own so tests do not share clients and sessions
+func newManager() *GateWayManager {
+	return &GateWayManager{
+		sessions:     map[string]*gatewaySession{},
+		clients:      map[int]dialer{},
+		clientsCount: map[int]int{},
+		parents:      map[int]int{},
+		next:         map[int]int{},
+	}
+}
+
+// newId returns a gateway id not used by others, host keys trusted for it are removed after t
+func newId(t *testing.T) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := int(n.Int64()) + 1<<30
+	t.Cleanup(func() {
+		mysql.DB.Where("asset_id = 0 AND gateway_id = ?", id).Delete(&model.HostKey{})
+	})
+	return id
+}
+
+// testGateway is an ssh server on loopback forwarding connections as gateways do
+type testGateway struct {
+	*model.Gateway
+	srv    *ssh.Server
+	signer gossh.Signer
+
+	mtx       sync.Mutex
+	forwarded []string
+}
+
+// newGateway starts a gateway dialed through parent if it is not nil
+func newGateway(t *testing.T, parent *model.Gateway) *testGateway {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &testGateway{}
+	if g.signer, err = gossh.NewSignerFromKey(priv); err != nil {
+		t.Fatal(err)
+	}
+	id := newId(t)
+	g.Gateway = &model.Gateway{
+		Id:          id,
+		Name:        fmt.Sprintf("gateway-%d", id),
+		Host:        "127.0.0.1",
+		AccountType: model.AUTHMETHOD_PASSWORD,
+		Account:     "gateway",
+		Password:    "secret",
+	}
+	if parent != nil {
+		g.ParentId, g.Parent = parent.Id, parent
+	}
+	g.Port = g.serve(t, "127.0.0.1:0")
+	return g
+}
+
+// serve starts the server of the gateway on addr and returns its port, it is restarted with the same host key on the port of the gateway
+func (g *testGateway) serve(t *testing.T, addr string) int {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ssh.Server{
+		PasswordHandler: func(ctx ssh.Context, password string) bool { return password == "secret" },
+		ChannelHandlers: map[string]ssh.ChannelHandler{"direct-tcpip": ssh.DirectTCPIPHandler},
+		LocalPortForwardingCallback: func(ctx ssh.Context, host string, port uint32) bool {
+			g.mtx.Lock()
+			defer g.mtx.Unlock()
+			g.forwarded = append(g.forwarded, net.JoinHostPort(host, fmt.Sprint(port)))
+			return true
+		},
+	}
+	srv.AddHostKey(g.signer)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	g.srv = srv
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func (g *testGateway) addr() string {
+	return net.JoinHostPort(g.Host, fmt.Sprint(g.Port))
+}
+
+func (g *testGateway) forwards() []string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return append([]string{}, g.forwarded...)
+}
+
+// newEcho starts a target on loopback echoing what it reads
+func newEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echo checks conn reaches the echo target
+func echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := "hello"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func (gm *GateWayManager) count(gatewayId int) int {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	return gm.clientsCount[gatewayId]
+}
+
+func TestDialClose(t *testing.T) {
+	gm, g, target := newManager(), newGateway(t, nil), newEcho(t)
+	ctx := context.Background()
+
+	conn1, err := gm.Dial(ctx, "s1", g.Gateway, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn1)
+	conn2, err := gm.Dial(ctx, "s2", g.Gateway, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn2)
+	// more connections of a session reference the gateway once
+	conn3, err := gm.Dial(ctx, "s2", g.Gateway, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn3)
+	if n := gm.count(g.Id); n != 2 {
+		t.Fatalf("gateway referenced %d times by 2 sessions", n)
+	}
+	if h := gm.Health(g.Id); h.Status != model.GATEWAYSTATUS_ONLINE || h.Tunnels != 3 {
+		t.Fatalf("health %+v, want online with 3 tunnels", h)
+	}
+
+	gm.Close("s1")
+	if _, err = conn1.Write([]byte("x")); err == nil {
+		t.Fatal("connection of a closed session is open")
+	}
+	if n := gm.count(g.Id); n != 1 {
+		t.Fatalf("gateway referenced %d times after a session is closed, want 1", n)
+	}
+	echo(t, conn2)
+
+	gm.Close("s2", "s2")
+	if n := gm.count(g.Id); n != 0 {
+		t.Fatalf("gateway referenced %d times after sessions are closed", n)
+	}
+	if _, ok, _ := gm.reference(g.Gateway); ok {
+		t.Fatal("client of the gateway is kept after it is released")
+	}
+	if h := gm.Health(g.Id); h.Status != model.GATEWAYSTATUS_IDLE || h.Tunnels != 0 {
+		t.Fatalf("health %+v, want idle without tunnels", h)
+	}
+	if _, err = gm.Dial(ctx, "s1", g.Gateway, "tcp", target); err != nil {
+		t.Fatalf("Dial() after the gateway is released error = %v", err)
+	}
+	gm.Close("s1")
+}
+
+func TestDialHops(t *testing.T) {
+	gm, target := newManager(), newEcho(t)
+	first := newGateway(t, nil)
+	second := newGateway(t, first.Gateway)
+	last := newGateway(t, second.Gateway)
+	ctx := context.Background()
+
+	conn, err := gm.Dial(ctx, "s1", last.Gateway, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+	if _, err = gm.Dial(ctx, "s2", last.Gateway, "tcp", target); err != nil {
+		t.Fatal(err)
+	}
+	// every hop forwards to the next one
+	for _, tt := range []struct {
+		hop  *testGateway
+		want string
+	}{{first, second.addr()}, {second, last.addr()}, {last, target}} {
+		if got := tt.hop.forwards(); len(got) == 0 || got[0] != tt.want {
+			t.Fatalf("%s forwarded to %v, want %s", tt.hop.Name, got, tt.want)
+		}
+	}
+	// hops are referenced once by the client dialed through them
+	if got := []int{gm.count(first.Id), gm.count(second.Id), gm.count(last.Id)}; got[0] != 1 || got[1] != 1 || got[2] != 2 {
+		t.Fatalf("gateways of the chain referenced %v times, want [1 1 2]", got)
+	}
+
+	gm.Close("s1")
+	if got := []int{gm.count(first.Id), gm.count(second.Id), gm.count(last.Id)}; got[0] != 1 || got[1] != 1 || got[2] != 1 {
+		t.Fatalf("gateways of the chain referenced %v times after a session is closed, want [1 1 1]", got)
+	}
+	gm.Close("s2")
+	for _, g := range []*testGateway{first, second, last} {
+		if n := gm.count(g.Id); n != 0 {
+			t.Fatalf("%s referenced %d times after sessions are closed", g.Name, n)
+		}
+		if h := gm.Health(g.Id); h.Status != model.GATEWAYSTATUS_IDLE || h.Tunnels != 0 {
+			t.Fatalf("health of %s %+v, want idle without tunnels", g.Name, h)
+		}
+	}
+}
+
+func TestDialHopFailed(t *testing.T) {
+	gm := newManager()
+	parent := newGateway(t, nil)
+	child := newGateway(t, parent.Gateway)
+	child.Password = "wrong"
+	if _, err := gm.Dial(context.Background(), "s1", child.Gateway, "tcp", newEcho(t)); err == nil {
+		t.Fatal("Dial() through a failing hop error = nil")
+	}
+	if n := gm.count(parent.Id); n != 0 {
+		t.Fatalf("parent referenced %d times after its child fails", n)
+	}
+
+	child.Parent = nil
+	if _, err := gm.Dial(context.Background(), "s1", child.Gateway, "tcp", newEcho(t)); err == nil || !strings.Contains(err.Error(), "not loaded") {
+		t.Fatalf("Dial() without the parent loaded error = %v", err)
+	}
+}
+
+func TestDialFailed(t *testing.T) {
+	gm, g := newManager(), newGateway(t, nil)
+	g.Password = "wrong"
+	if _, err := gm.Dial(context.Background(), "s1", g.Gateway, "tcp", newEcho(t)); err == nil {
+		t.Fatal("Dial() with a wrong password error = nil")
+	}
+	if n := gm.count(g.Id); n != 0 || len(gm.sessions) != 0 {
+		t.Fatalf("gateway referenced %d times and %d sessions kept after failing", n, len(gm.sessions))
+	}
+	if h := gm.Health(g.Id); h.Status != model.GATEWAYSTATUS_OFFLINE || !strings.Contains(h.LastError, "unable to authenticate") {
+		t.Fatalf("health %+v, want offline with the error", h)
+	}
+}
+
+func TestListen(t *testing.T) {
+	// connections to listeners are dialed by the manager of the process
+	gm, g, target := manager, newGateway(t, nil), newEcho(t)
+	host, port, _ := net.SplitHostPort(target)
+	var p int
+	fmt.Sscan(port, &p)
+	gt, err := gm.Listen("s1", host, p, g.Gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(gt.LocalIp, fmt.Sprint(gt.LocalPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn)
+
+	gm.Close("s1")
+	if n := gm.count(g.Id); n != 0 {
+		t.Fatalf("gateway referenced %d times after the session is closed", n)
+	}
+	if _, err = net.Dial("tcp", net.JoinHostPort(gt.LocalIp, fmt.Sprint(gt.LocalPort))); err == nil {
+		t.Fatal("listener of a closed session is open")
+	}
+}
+
+func newGroup(t *testing.T, strategy int, members ...*model.Gateway) *model.Gateway {
+	return &model.Gateway{Id: newId(t), Name: "group", Type: model.GATEWAYTYPE_GROUP, Strategy: strategy, Members: members}
+}
+
+func ids(gateways []*model.Gateway) (ids []int) {
+	for _, g := range gateways {
+		ids = append(ids, g.Id)
+	}
+	return
+}
+
+func TestCandidates(t *testing.T) {
+	gm := newManager()
+	m1, m2, m3 := &model.Gateway{Id: newId(t)}, &model.Gateway{Id: newId(t)}, &model.Gateway{Id: newId(t)}
+
+	rr := newGroup(t, model.GATEWAYSTRATEGY_ROUNDROBIN, m1, m2, m3)
+	for _, want := range [][]int{{m1.Id, m2.Id, m3.Id}, {m2.Id, m3.Id, m1.Id}, {m3.Id, m1.Id, m2.Id}, {m1.Id, m2.Id, m3.Id}} {
+		if got := ids(gm.candidates(rr)); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("round robin candidates %v, want %v", got, want)
+		}
+	}
+
+	lc := newGroup(t, model.GATEWAYSTRATEGY_LEASTCONN, m1, m2, m3)
+	for id, n := range map[int]int64{m1.Id: 3, m2.Id: 1, m3.Id: 2} {
+		h := getHealth(id)
+		h.mtx.Lock()
+		h.Tunnels = n
+		h.mtx.Unlock()
+	}
+	if got, want := ids(gm.candidates(lc)), []int{m2.Id, m3.Id, m1.Id}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("least connections candidates %v, want %v", got, want)
+	}
+
+	// members failed are the last resort
+	gm.offline(m2.Id, fmt.Errorf("unreachable"))
+	if got, want := ids(gm.candidates(lc)), []int{m3.Id, m1.Id, m2.Id}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("least connections candidates %v with a member offline, want %v", got, want)
+	}
+	if got, want := ids(gm.candidates(rr)), []int{m3.Id, m1.Id, m2.Id}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("round robin candidates %v with a member offline, want %v", got, want)
+	}
+	if got := ids(gm.candidates(newGroup(t, model.GATEWAYSTRATEGY_ROUNDROBIN))); len(got) != 0 {
+		t.Fatalf("candidates of an empty group %v", got)
+	}
+}
+
+func TestDialGroup(t *testing.T) {
+	gm, target := newManager(), newEcho(t)
+	dead, alive := newGateway(t, nil), newGateway(t, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	dead.Port = ln.Addr().(*net.TCPAddr).Port
+	group := newGroup(t, model.GATEWAYSTRATEGY_ROUNDROBIN, dead.Gateway, alive.Gateway)
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		conn, err := gm.Dial(ctx, fmt.Sprint(i), group, "tcp", target)
+		if err != nil {
+			t.Fatalf("Dial() with a dead member error = %v", err)
+		}
+		echo(t, conn)
+	}
+	if h := gm.Health(dead.Id); h.Status != model.GATEWAYSTATUS_OFFLINE {
+		t.Fatalf("health of the dead member %+v, want offline", h)
+	}
+	if got := gm.GroupHealth(dead.Id, alive.Id); got.Status != model.GATEWAYSTATUS_ONLINE || got.Tunnels != 4 {
+		t.Fatalf("health of the group %+v, want online with 4 tunnels", got)
+	}
+	if n, m := gm.count(dead.Id), gm.count(alive.Id); n != 0 || m != 4 {
+		t.Fatalf("members referenced %d and %d times, want the dead one skipped", n, m)
+	}
+
+	gm.Close("0", "1", "2", "3")
+	if n := gm.count(alive.Id); n != 0 {
+		t.Fatalf("member referenced %d times after sessions are closed", n)
+	}
+	if _, err := gm.Dial(ctx, "4", newGroup(t, model.GATEWAYSTRATEGY_ROUNDROBIN), "tcp", target); err == nil {
+		t.Fatal("Dial() through an empty group error = nil")
+	}
+	alive.srv.Close()
+	if _, err := gm.Dial(ctx, "5", group, "tcp", target); err == nil {
+		t.Fatal("Dial() through a group of dead members error = nil")
+	}
+	if _, ok := gm.sessions["5"]; ok {
+		t.Fatal("session is kept after dialing through the group failed")
+	}
+}
@@ -0,0 +1,225 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+const (
+	keepAliveRequest = "keepalive@openssh.com"
+)
+
+var (
+	keepAliveInterval = time.Second * 30
+	keepAliveTimeout  = time.Second * 10
+	reconnectInterval = time.Second * 10
+)
+
+// Health is the connection of this node to a gateway
+type Health struct {
+	// Status is GATEWAYSTATUS_IDLE if the gateway is not in use by this node
+	Status    int
+	Latency   time.Duration
+	LastError string
+	// Tunnels is the number of connections currently dialed through the gateway
+	Tunnels int64
+}
+
+type health struct {
+	Health
+	mtx sync.Mutex
+}
+
+var (
+	// healths are health of gateways by gateway id
+	healths = &sync.Map{}
+)
+
+func getHealth(gatewayId int) *health {
+	v, _ := healths.LoadOrStore(gatewayId, &health{Health: Health{Status: model.GATEWAYSTATUS_IDLE}})
+	return v.(*health)
+}
+
+// Health returns the health of the gateway as seen by this node
+func (gm *GateWayManager) Health(gatewayId int) Health {
+	h := getHealth(gatewayId)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.Health
+}
+
+// GroupHealth returns the health of a gateway group of the members, it is online if any of them is online
+// and its latency is of the fastest member online
+func (gm *GateWayManager) GroupHealth(memberIds ...int) Health {
+	g := Health{Status: model.GATEWAYSTATUS_IDLE}
+	online, offline := false, len(memberIds) > 0
+	for _, id := range memberIds {
+		h := gm.Health(id)
+		g.Tunnels += h.Tunnels
+		if h.LastError != "" {
+			g.LastError = h.LastError
+		}
+		offline = offline && h.Status == model.GATEWAYSTATUS_OFFLINE
+		if h.Status == model.GATEWAYSTATUS_ONLINE && (!online || h.Latency < g.Latency) {
+			online, g.Latency = true, h.Latency
+		}
+	}
+	g.Status = lo.Ternary(online, model.GATEWAYSTATUS_ONLINE, lo.Ternary(offline, model.GATEWAYSTATUS_OFFLINE, model.GATEWAYSTATUS_IDLE))
+	return g
+}
+
+// SetUnreachableHandler sets f to be called when a gateway in use becomes unreachable
+func (gm *GateWayManager) SetUnreachableHandler(f func(gatewayId int)) {
+	gm.unreachable.Store(&f)
+}
+
+func (gm *GateWayManager) online(gatewayId int, latency time.Duration) {
+	h := getHealth(gatewayId)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.Status, h.Latency = model.GATEWAYSTATUS_ONLINE, latency
+}
+
+func (gm *GateWayManager) idle(gatewayId int) {
+	h := getHealth(gatewayId)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.Status = model.GATEWAYSTATUS_IDLE
+}
+
+// offline records err of the gateway, the unreachable handler is called if the gateway was online
+func (gm *GateWayManager) offline(gatewayId int, err error) {
+	h := getHealth(gatewayId)
+	h.mtx.Lock()
+	wasOnline := h.Status == model.GATEWAYSTATUS_ONLINE
+	h.Status, h.Latency, h.LastError = model.GATEWAYSTATUS_OFFLINE, 0, err.Error()
+	h.mtx.Unlock()
+
+	if f := gm.unreachable.Load(); wasOnline && f != nil {
+		go (*f)(gatewayId)
+	}
+}
+
+// countedConn is a connection dialed through a gateway, it is counted in Tunnels of the gateway until closed
+type countedConn struct {
+	net.Conn
+	once sync.Once
+	h    *health
+}
+
+func counted(gatewayId int, conn net.Conn) net.Conn {
+	h := getHealth(gatewayId)
+	h.mtx.Lock()
+	h.Tunnels += 1
+	h.mtx.Unlock()
+	return &countedConn{Conn: conn, h: h}
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.h.mtx.Lock()
+		c.h.Tunnels -= 1
+		c.h.mtx.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// keepAlive pings conn until it fails or current reports conn is no longer the connection to the gateway
+func (gm *GateWayManager) keepAlive(gatewayId int, conn ssh.Conn, current func() bool) error {
+	tk := time.NewTicker(keepAliveInterval)
+	defer tk.Stop()
+	for range tk.C {
+		if !current() {
+			return nil
+		}
+		latency, err := ping(conn)
+		if err != nil {
+			return err
+		}
+		gm.online(gatewayId, latency)
+	}
+	return nil
+}
+
+func ping(conn ssh.Conn) (time.Duration, error) {
+	start := time.Now()
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest(keepAliveRequest, true, nil)
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		return time.Since(start), err
+	case <-time.After(keepAliveTimeout):
+		return 0, fmt.Errorf("no reply to keepalive in %s", keepAliveTimeout)
+	}
+}
+
+// watch keeps the client of the gateway alive and reconnects it once it is dead until it is released.
+// Sessions dial through the client in clients on every dial so they go through the new one transparently
+func (gm *GateWayManager) watch(gateway *model.Gateway, cli *ssh.Client) {
+	err := gm.keepAlive(gateway.Id, cli, func() bool { return gm.current(gateway.Id, cli) })
+	if err == nil {
+		return
+	}
+	logger.L().Warn("gateway is unreachable", zap.String("gateway", gateway.Name), zap.Error(err))
+	cli.Close()
+	gm.offline(gateway.Id, err)
+
+	tk := time.NewTicker(reconnectInterval)
+	defer tk.Stop()
+	for range tk.C {
+		done, err := gm.reconnect(gateway, cli)
+		if done {
+			return
+		}
+		logger.L().Debug("reconnect gateway failed", zap.String("gateway", gateway.Name), zap.Error(err))
+		gm.offline(gateway.Id, err)
+	}
+}
+
+func (gm *GateWayManager) current(gatewayId int, cli dialer) bool {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	return gm.clients[gatewayId] == cli
+}
+
+// reconnect replaces the dead client of the gateway with a new one, it is done if the client is replaced or released.
+// The gateway is connected without holding the lock and the new client is dropped if the dead one is released meanwhile
+func (gm *GateWayManager) reconnect(gateway *model.Gateway, dead *ssh.Client) (done bool, err error) {
+	gm.mtx.Lock()
+	if gm.clients[gateway.Id] != dialer(dead) {
+		gm.mtx.Unlock()
+		return true, nil
+	}
+	parent := gm.clients[gateway.ParentId]
+	gm.mtx.Unlock()
+
+	start := time.Now()
+	cli, err := gm.connect(gateway, parent)
+	if err != nil {
+		return
+	}
+
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	if gm.clients[gateway.Id] != dialer(dead) {
+		cli.Close()
+		return true, nil
+	}
+	logger.L().Info("gateway reconnected", zap.String("gateway", gateway.Name))
+	gm.clients[gateway.Id] = cli
+	gm.online(gateway.Id, time.Since(start))
+	go gm.watch(gateway, cli)
+	return true, nil
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/veops/oneterm/model"
+)
+
+func init() {
+	keepAliveInterval, keepAliveTimeout, reconnectInterval = time.Millisecond*50, time.Second, time.Millisecond*50
+}
+
+// eventually fails t unless ok is true within a few seconds
+func eventually(t *testing.T, msg string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); !ok(); time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	gm, g, target := newManager(), newGateway(t, nil), newEcho(t)
+	unreachable := make(chan int, 1)
+	gm.SetUnreachableHandler(func(gatewayId int) { unreachable <- gatewayId })
+	ctx := context.Background()
+
+	conn, err := gm.Dial(ctx, "s1", g.Gateway, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+	eventually(t, "latency is not measured by keepalive", func() bool { return gm.Health(g.Id).Latency > 0 })
+
+	g.srv.Close()
+	select {
+	case id := <-unreachable:
+		if id != g.Id {
+			t.Fatalf("unreachable handler called for %d, want %d", id, g.Id)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("unreachable handler is not called for a dead gateway")
+	}
+	if h := gm.Health(g.Id); h.Status != model.GATEWAYSTATUS_OFFLINE || h.LastError == "" {
+		t.Fatalf("health %+v, want offline with the error", h)
+	}
+
+	g.serve(t, g.addr())
+	eventually(t, "gateway is not reconnected", func() bool { return gm.Health(g.Id).Status == model.GATEWAYSTATUS_ONLINE })
+	// the session goes through the new client
+	if conn, err = gm.Dial(ctx, "s1", g.Gateway, "tcp", target); err != nil {
+		t.Fatalf("Dial() after reconnecting error = %v", err)
+	}
+	echo(t, conn)
+	if n := gm.count(g.Id); n != 1 {
+		t.Fatalf("gateway referenced %d times after reconnecting, want 1", n)
+	}
+
+	gm.Close("s1")
+	if h := gm.Health(g.Id); h.Status != model.GATEWAYSTATUS_IDLE || h.Tunnels != 0 {
+		t.Fatalf("health %+v after the session is closed, want idle without tunnels", h)
+	}
+}
+
+func TestReconnectReleased(t *testing.T) {
+	gm, g, target := newManager(), newGateway(t, nil), newEcho(t)
+	if _, err := gm.Dial(context.Background(), "s1", g.Gateway, "tcp", target); err != nil {
+		t.Fatal(err)
+	}
+	g.srv.Close()
+	eventually(t, "dead gateway is not offline", func() bool { return gm.Health(g.Id).Status == model.GATEWAYSTATUS_OFFLINE })
+
+	gm.Close("s1")
+	g.serve(t, g.addr())
+	time.Sleep(reconnectInterval * 4)
+	gm.mtx.Lock()
+	_, ok := gm.clients[g.Id]
+	gm.mtx.Unlock()
+	if ok {
+		t.Fatal("gateway released is reconnected")
+	}
+}
+
+func TestGroupHealth(t *testing.T) {
+	gm := newManager()
+	online, fast, offline, idle := newId(t), newId(t), newId(t), newId(t)
+	gm.online(online, time.Millisecond*20)
+	gm.online(fast, time.Millisecond*10)
+	gm.offline(offline, fmt.Errorf("unreachable"))
+	for i := 0; i < 2; i++ {
+		defer counted(online, nopConn{}).Close()
+	}
+
+	tests := []struct {
+		name    string
+		members []int
+		want    Health
+	}{
+		{name: "no member", want: Health{Status: model.GATEWAYSTATUS_IDLE}},
+		{name: "fastest online", members: []int{online, fast, offline}, want: Health{Status: model.GATEWAYSTATUS_ONLINE, Latency: time.Millisecond * 10, LastError: "unreachable", Tunnels: 2}},
+		{name: "offline", members: []int{offline}, want: Health{Status: model.GATEWAYSTATUS_OFFLINE, LastError: "unreachable"}},
+		{name: "idle", members: []int{offline, idle}, want: Health{Status: model.GATEWAYSTATUS_IDLE, LastError: "unreachable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gm.GroupHealth(tt.members...); got != tt.want {
+				t.Errorf("GroupHealth() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+type nopConn struct {
+	net.Conn
+}
+
+func (nopConn) Close() error { return nil }
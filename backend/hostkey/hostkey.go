@@ -0,0 +1,173 @@
+package hostkey
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+var (
+	ErrKeyChanged = errors.New("host key changed")
+
+	hostKeyAlgorithms = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSASHA256,
+		ssh.KeyAlgoRSA,
+	}
+)
+
+// Config verifies host keys of the asset on port or of the gateway by keys stored in host_key,
+// the first key seen is trusted and connections are refused once the key changes until the new key is approved
+func Config(cfg *ssh.ClientConfig, assetId, gatewayId, port int) *ssh.ClientConfig {
+	target := &model.HostKey{AssetId: assetId, GatewayId: gatewayId, Port: port}
+	cfg.HostKeyCallback = callback(target)
+	cfg.HostKeyAlgorithms = algorithms(target)
+	return cfg
+}
+
+// Parse parses a key in authorized_keys format into hk
+func Parse(hk *model.HostKey, s string) (err error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return
+	}
+	fill(hk, key)
+	return
+}
+
+// Scope filters keys of the same asset port or gateway with hk
+func Scope(db *gorm.DB, hk *model.HostKey) *gorm.DB {
+	return db.Where("asset_id = ? AND gateway_id = ? AND port = ?", hk.AssetId, hk.GatewayId, hk.Port)
+}
+
+// ToMap is the content of hk saved in history
+func ToMap(hk *model.HostKey) map[string]any {
+	return map[string]any{
+		"asset_id":    hk.AssetId,
+		"gateway_id":  hk.GatewayId,
+		"port":        hk.Port,
+		"status":      hk.Status,
+		"key_type":    hk.KeyType,
+		"fingerprint": hk.Fingerprint,
+	}
+}
+
+func fill(hk *model.HostKey, key ssh.PublicKey) {
+	hk.KeyType = key.Type()
+	hk.Key = base64.StdEncoding.EncodeToString(key.Marshal())
+	hk.Fingerprint = ssh.FingerprintSHA256(key)
+}
+
+// algorithms prefers algorithms of the trusted key so servers having several keys present the trusted one
+func algorithms(target *model.HostKey) []string {
+	trusted := &model.HostKey{}
+	if err := Scope(mysql.DB.Model(trusted), target).Where("status = ?", model.HOSTKEY_STATUS_TRUSTED).First(trusted).Error; err != nil {
+		return nil
+	}
+	preferred := []string{trusted.KeyType}
+	if trusted.KeyType == ssh.KeyAlgoRSA {
+		preferred = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return lo.Uniq(append(preferred, hostKeyAlgorithms...))
+}
+
+func callback(target *model.HostKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+		presented := &model.HostKey{AssetId: target.AssetId, GatewayId: target.GatewayId, Port: target.Port}
+		fill(presented, key)
+
+		trusted := &model.HostKey{}
+		err = Scope(mysql.DB.Model(trusted), target).Where("status = ?", model.HOSTKEY_STATUS_TRUSTED).First(trusted).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			presented.Status = model.HOSTKEY_STATUS_TRUSTED
+			var created bool
+			if created, err = trust(presented); err != nil {
+				return fmt.Errorf("save host key failed: %w", err)
+			}
+			if created {
+				logger.L().Info("trust host key on first use", zap.String("addr", remote.String()), zap.Any("key", ToMap(presented)))
+				return nil
+			}
+			// another connection trusted its key first, which is compared with as usual
+			err = Scope(mysql.DB.Model(trusted), target).Where("status = ?", model.HOSTKEY_STATUS_TRUSTED).First(trusted).Error
+		}
+		if err != nil {
+			return
+		}
+		if trusted.Key == presented.Key {
+			return
+		}
+
+		pending := &model.HostKey{}
+		err = Scope(mysql.DB.Model(pending), target).Where("status = ?", model.HOSTKEY_STATUS_PENDING).First(pending).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return
+		}
+		if pending.Key != presented.Key {
+			presented.Id = pending.Id
+			presented.Status = model.HOSTKEY_STATUS_PENDING
+			if err := save(presented, trusted, model.ACTION_KEY_CHANGE); err != nil {
+				logger.L().Error("save changed host key failed", zap.Any("key", ToMap(presented)), zap.Error(err))
+			}
+		}
+		logger.L().Warn("host key changed", zap.String("addr", remote.String()), zap.Any("trusted", ToMap(trusted)), zap.Any("presented", ToMap(presented)))
+
+		return fmt.Errorf("%w: %s presented %s but %s is trusted", ErrKeyChanged, remote, presented.Fingerprint, trusted.Fingerprint)
+	}
+}
+
+// trust saves hk as the trusted key unless a trusted key of the same target is saved first
+func trust(hk *model.HostKey) (created bool, err error) {
+	now := time.Now()
+	hk.CreatedAt, hk.UpdatedAt = now, now
+	err = mysql.DB.Transaction(func(tx *gorm.DB) (err error) {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(hk)
+		if err = res.Error; err != nil || res.RowsAffected <= 0 {
+			return
+		}
+		created = true
+		return tx.Create(history(hk, nil, model.ACTION_CREATE, now)).Error
+	})
+	return
+}
+
+func save(hk *model.HostKey, old *model.HostKey, actionType int) error {
+	now := time.Now()
+	hk.CreatedAt, hk.UpdatedAt = now, now
+	return mysql.DB.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Save(hk).Error; err != nil {
+			return
+		}
+		return tx.Create(history(hk, old, actionType, now)).Error
+	})
+}
+
+func history(hk *model.HostKey, old *model.HostKey, actionType int, now time.Time) *model.History {
+	h := &model.History{
+		Type:       hk.TableName(),
+		TargetId:   hk.Id,
+		ActionType: actionType,
+		New:        ToMap(hk),
+		CreatedAt:  now,
+	}
+	if old != nil {
+		h.Old = ToMap(old)
+	}
+	return h
+}
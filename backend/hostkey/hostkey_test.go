@@ -0,0 +1,202 @@
+package hostkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/model"
+)
+
+var remote = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+
+// newTarget returns a target of an asset not used by others, its keys and history are removed after t
+func newTarget(t *testing.T) *model.HostKey {
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &model.HostKey{AssetId: -int(n.Int64()) - 1, Port: 22}
+	t.Cleanup(func() {
+		ids := []int{}
+		Scope(mysql.DB.Model(&model.HostKey{}), target).Pluck("id", &ids)
+		mysql.DB.Where("type = ? AND target_id IN ?", target.TableName(), ids).Delete(&model.History{})
+		Scope(mysql.DB, target).Delete(&model.HostKey{})
+	})
+	return target
+}
+
+func newKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func keys(t *testing.T, target *model.HostKey, status int) (hks []*model.HostKey) {
+	if err := Scope(mysql.DB.Model(&model.HostKey{}), target).Where("status = ?", status).Find(&hks).Error; err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func histories(t *testing.T, hk *model.HostKey, actionType int) (hs []*model.History) {
+	err := mysql.DB.Where("type = ? AND target_id = ? AND action_type = ?", hk.TableName(), hk.Id, actionType).Find(&hs).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	target := newTarget(t)
+	cb, key := callback(target), newKey(t)
+
+	if err := cb("asset", remote, key); err != nil {
+		t.Fatalf("first key error = %v", err)
+	}
+	trusted := keys(t, target, model.HOSTKEY_STATUS_TRUSTED)
+	if len(trusted) != 1 || trusted[0].Fingerprint != ssh.FingerprintSHA256(key) || trusted[0].KeyType != key.Type() {
+		t.Fatalf("trusted keys %v, want the first key", trusted)
+	}
+	if hs := histories(t, trusted[0], model.ACTION_CREATE); len(hs) != 1 || hs[0].New["fingerprint"] != ssh.FingerprintSHA256(key) {
+		t.Fatalf("histories %v, want the key created", hs)
+	}
+
+	if err := cb("asset", remote, key); err != nil {
+		t.Fatalf("trusted key error = %v", err)
+	}
+	if trusted := keys(t, target, model.HOSTKEY_STATUS_TRUSTED); len(trusted) != 1 {
+		t.Fatalf("%d trusted keys, want 1", len(trusted))
+	}
+}
+
+func TestKeyChanged(t *testing.T) {
+	target := newTarget(t)
+	cb, key := callback(target), newKey(t)
+	if err := cb("asset", remote, key); err != nil {
+		t.Fatal(err)
+	}
+	trusted := keys(t, target, model.HOSTKEY_STATUS_TRUSTED)[0]
+
+	changed := newKey(t)
+	if err := cb("asset", remote, changed); !errors.Is(err, ErrKeyChanged) {
+		t.Fatalf("changed key error = %v, want %v", err, ErrKeyChanged)
+	}
+	pending := keys(t, target, model.HOSTKEY_STATUS_PENDING)
+	if len(pending) != 1 || pending[0].Fingerprint != ssh.FingerprintSHA256(changed) {
+		t.Fatalf("pending keys %v, want the changed key", pending)
+	}
+	hs := histories(t, pending[0], model.ACTION_KEY_CHANGE)
+	if len(hs) != 1 || hs[0].Old["fingerprint"] != trusted.Fingerprint || hs[0].New["fingerprint"] != pending[0].Fingerprint {
+		t.Fatalf("histories %v, want the change from the trusted key", hs)
+	}
+
+	// the same key is not saved again while it is pending
+	if err := cb("asset", remote, changed); !errors.Is(err, ErrKeyChanged) {
+		t.Fatalf("pending key error = %v, want %v", err, ErrKeyChanged)
+	}
+	if hs := histories(t, pending[0], model.ACTION_KEY_CHANGE); len(hs) != 1 {
+		t.Fatalf("%d histories of the pending key, want 1", len(hs))
+	}
+
+	// another key replaces the pending one
+	another := newKey(t)
+	if err := cb("asset", remote, another); !errors.Is(err, ErrKeyChanged) {
+		t.Fatalf("another key error = %v, want %v", err, ErrKeyChanged)
+	}
+	replaced := keys(t, target, model.HOSTKEY_STATUS_PENDING)
+	if len(replaced) != 1 || replaced[0].Id != pending[0].Id || replaced[0].Fingerprint != ssh.FingerprintSHA256(another) {
+		t.Fatalf("pending keys %v, want the pending one replaced by another key", replaced)
+	}
+	if got := keys(t, target, model.HOSTKEY_STATUS_TRUSTED); len(got) != 1 || got[0].Key != trusted.Key {
+		t.Fatalf("trusted keys %v, want the first key kept", got)
+	}
+}
+
+func TestTrustRace(t *testing.T) {
+	target := newTarget(t)
+	n := 8
+	presented, errs := make([]ssh.PublicKey, n), make([]error, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		presented[i] = newKey(t)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = callback(target)("asset", remote, presented[i])
+		}(i)
+	}
+	wg.Wait()
+
+	trusted := keys(t, target, model.HOSTKEY_STATUS_TRUSTED)
+	if len(trusted) != 1 {
+		t.Fatalf("%d trusted keys, want 1", len(trusted))
+	}
+	for i, err := range errs {
+		if ssh.FingerprintSHA256(presented[i]) == trusted[0].Fingerprint {
+			if err != nil {
+				t.Errorf("trusted key error = %v", err)
+			}
+		} else if !errors.Is(err, ErrKeyChanged) {
+			t.Errorf("key losing the race error = %v, want %v", err, ErrKeyChanged)
+		}
+	}
+	if hs := histories(t, trusted[0], model.ACTION_CREATE); len(hs) != 1 {
+		t.Fatalf("%d histories of the trusted key, want 1", len(hs))
+	}
+}
+
+// TestTrustInserted covers connections finding no trusted key while another one is saving its key
+func TestTrustInserted(t *testing.T) {
+	target := newTarget(t)
+	first := &model.HostKey{AssetId: target.AssetId, Port: target.Port, Status: model.HOSTKEY_STATUS_TRUSTED}
+	fill(first, newKey(t))
+	if created, err := trust(first); !created || err != nil {
+		t.Fatalf("trust() of the first key = %v, %v", created, err)
+	}
+	second := &model.HostKey{AssetId: target.AssetId, Port: target.Port, Status: model.HOSTKEY_STATUS_TRUSTED}
+	fill(second, newKey(t))
+	if created, err := trust(second); created || err != nil {
+		t.Fatalf("trust() of the second key = %v, %v, want it not created", created, err)
+	}
+	if trusted := keys(t, target, model.HOSTKEY_STATUS_TRUSTED); len(trusted) != 1 || trusted[0].Key != first.Key {
+		t.Fatalf("trusted keys %v, want the first key", trusted)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	target := newTarget(t)
+	if got := algorithms(target); got != nil {
+		t.Fatalf("algorithms() = %v without a trusted key, want defaults", got)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = callback(target)("asset", remote, key); err != nil {
+		t.Fatal(err)
+	}
+	got := algorithms(target)
+	if len(got) != len(hostKeyAlgorithms) || got[0] != ssh.KeyAlgoECDSA256 {
+		t.Fatalf("algorithms() = %v, want the trusted one first", got)
+	}
+}
@@ -156,6 +156,11 @@ var (
 		One:   "Gateway",
 		Other: "Gateway",
 	}
+	MsgTypeMappingHostKey = &i18n.Message{
+		ID:    "MsgTypeMappingHostKey",
+		One:   "Host Key",
+		Other: "Host Key",
+	}
 	MsgTypeMappingNode = &i18n.Message{
 		ID:    "MsgTypeMappingNode",
 		One:   "Node",
@@ -225,6 +230,26 @@ var (
 		One:   "\x1b[0;31m you have no permission to execute command: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
 		Other: "\x1b[0;31m you have no permission to execute command: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
 	}
+	MsgSshCommandApproving = &i18n.Message{
+		ID:    "MsgSshCommandApproving",
+		One:   "\x1b[0;33m waiting for approval of command: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
+		Other: "\x1b[0;33m waiting for approval of command: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
+	}
+	MsgSshCommandApproved = &i18n.Message{
+		ID:    "MsgSshCommandApproved",
+		One:   "\x1b[0;32m command has been approved by {{.Approver}} \x1b[0m\r\n",
+		Other: "\x1b[0;32m command has been approved by {{.Approver}} \x1b[0m\r\n",
+	}
+	MsgSshCommandRejected = &i18n.Message{
+		ID:    "MsgSshCommandRejected",
+		One:   "\x1b[0;31m command has been rejected by {{.Approver}}: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
+		Other: "\x1b[0;31m command has been rejected by {{.Approver}}: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
+	}
+	MsgSshCommandApprovalTimeout = &i18n.Message{
+		ID:    "MsgSshCommandApprovalTimeout",
+		One:   "\x1b[0;31m approval timeout for command: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
+		Other: "\x1b[0;31m approval timeout for command: \x1b[0m  \x1b[0;33m{{.Command}} \x1b[0m\r\n",
+	}
 	MsgSShHostIdleTimeout = &i18n.Message{
 		ID:    "MsgSShHostIdleTimeout",
 		One:   "\r\n\x1b[0;31m disconnect since idle more than\x1b[0m \x1b[0;33m {{.Idle}} \x1b[0m\r\n",
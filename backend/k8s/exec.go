@@ -0,0 +1,180 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// execProtocol is the websocket subprotocol of exec, every message is prefixed by the channel of it
+	execProtocol = "v4.channel.k8s.io"
+
+	channelStdin  = 0
+	channelStdout = 1
+	channelStderr = 2
+	channelError  = 3
+	channelResize = 4
+)
+
+type ExecOptions struct {
+	Namespace string
+	Pod       string
+	Container string
+	Command   []string
+	Width     int
+	Height    int
+}
+
+// Exec is an interactive exec session with a tty in a container, output of the tty is read from it and input is written to it
+type Exec struct {
+	ws   *websocket.Conn
+	wmtx sync.Mutex
+	buf  []byte
+	err  error
+}
+
+// Exec starts the command in the container over the websocket exec api
+//
+//	https://kubernetes.io/docs/reference/kubernetes-api/workload-resources/pod-v1/#get-connect-exec-pod-v1-core
+func (c *Client) Exec(ctx context.Context, opts *ExecOptions) (e *Exec, err error) {
+	q := url.Values{}
+	for _, cmd := range opts.Command {
+		q.Add("command", cmd)
+	}
+	if opts.Container != "" {
+		q.Set("container", opts.Container)
+	}
+	q.Set("stdin", "true")
+	q.Set("stdout", "true")
+	q.Set("tty", "true")
+	u := fmt.Sprintf("wss://%s/api/v1/namespaces/%s/pods/%s/exec?%s", c.cfg.Host, url.PathEscape(opts.Namespace), url.PathEscape(opts.Pod), q.Encode())
+
+	dialer := &websocket.Dialer{
+		NetDialContext:   c.cfg.Dial,
+		TLSClientConfig:  c.tls,
+		Subprotocols:     []string{execProtocol},
+		HandshakeTimeout: defaultTimeout,
+	}
+	h := http.Header{}
+	c.authorize(h)
+	ws, resp, err := dialer.DialContext(ctx, u, h)
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				return nil, statusError(resp)
+			}
+		}
+		return nil, err
+	}
+	if ws.Subprotocol() != execProtocol {
+		ws.Close()
+		return nil, fmt.Errorf("api server does not support %s", execProtocol)
+	}
+
+	e = &Exec{ws: ws}
+	if opts.Width > 0 && opts.Height > 0 {
+		if err = e.Resize(opts.Width, opts.Height); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// Read returns output of the tty, it returns io.EOF once the command exits and Err reports how it exited
+func (e *Exec) Read(p []byte) (n int, err error) {
+	for len(e.buf) == 0 {
+		if e.err != nil {
+			return 0, io.EOF
+		}
+		_, msg, err := e.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case channelStdout, channelStderr:
+			e.buf = msg[1:]
+		case channelError:
+			e.err = exitError(msg[1:])
+		}
+	}
+	n = copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return
+}
+
+func (e *Exec) Write(p []byte) (int, error) {
+	if err := e.send(channelStdin, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (e *Exec) Resize(width, height int) error {
+	bs, _ := json.Marshal(map[string]int{"Width": width, "Height": height})
+	return e.send(channelResize, bs)
+}
+
+// Err returns the error of the command once it exits, it is nil if the command succeeded
+func (e *Exec) Err() error {
+	if errors.Is(e.err, errSuccess) {
+		return nil
+	}
+	return e.err
+}
+
+func (e *Exec) Close() error {
+	return e.ws.Close()
+}
+
+func (e *Exec) send(channel byte, p []byte) error {
+	e.wmtx.Lock()
+	defer e.wmtx.Unlock()
+	return e.ws.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, p...))
+}
+
+var errSuccess = errors.New("success")
+
+// ExitError is the command exiting with a non-zero code
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "command terminated with exit code " + strconv.Itoa(e.Code)
+}
+
+func exitError(bs []byte) error {
+	st := &Status{}
+	if err := json.Unmarshal(bs, st); err != nil {
+		return fmt.Errorf("invalid status of exec: %w", err)
+	}
+	if st.Status == "Success" {
+		return errSuccess
+	}
+	if st.Reason == "NonZeroExitCode" {
+		for _, c := range st.Details.Causes {
+			if c.Reason == "ExitCode" {
+				code, _ := strconv.Atoi(c.Message)
+				return &ExitError{Code: code}
+			}
+		}
+	}
+	return errors.New(st.Message)
+}
@@ -0,0 +1,296 @@
+// Package k8s is a minimal client of the kubernetes api server for browsing pods and exec into their containers
+package k8s
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultTimeout = time.Second * 10
+)
+
+type Config struct {
+	// Host is host:port of the api server, ServerName is verified against its certificate and is the host by default
+	Host       string
+	ServerName string
+	// Namespace is the namespace of the current context of kubeconfig
+	Namespace string
+	Token     string
+	CAData    []byte
+	CertData  []byte
+	KeyData   []byte
+	Insecure  bool
+	// Dial connects to Host, net.Dialer is used if it is nil
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server        string `yaml:"server"`
+			CAData        string `yaml:"certificate-authority-data"`
+			Insecure      bool   `yaml:"insecure-skip-tls-verify"`
+			TLSServerName string `yaml:"tls-server-name"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token    string `yaml:"token"`
+			CertData string `yaml:"client-certificate-data"`
+			KeyData  string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// ParseKubeconfig returns the config of the current context of the kubeconfig, only embedded credentials are supported
+func ParseKubeconfig(bs []byte) (cfg *Config, err error) {
+	kc := &kubeconfig{}
+	if err = yaml.Unmarshal(bs, kc); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig: %w", err)
+	}
+	if kc.CurrentContext == "" && len(kc.Contexts) == 1 {
+		kc.CurrentContext = kc.Contexts[0].Name
+	}
+	cfg = &Config{}
+	for _, c := range kc.Contexts {
+		if c.Name != kc.CurrentContext {
+			continue
+		}
+		cfg.Namespace = c.Context.Namespace
+		for _, cl := range kc.Clusters {
+			if cl.Name != c.Context.Cluster {
+				continue
+			}
+			u, err := url.Parse(cl.Cluster.Server)
+			if err != nil {
+				return nil, fmt.Errorf("invalid server of cluster %s: %w", cl.Name, err)
+			}
+			cfg.Host, cfg.ServerName, cfg.Insecure = u.Host, cl.Cluster.TLSServerName, cl.Cluster.Insecure
+			if cfg.ServerName == "" {
+				cfg.ServerName = u.Hostname()
+			}
+			if cfg.CAData, err = decode(cl.Cluster.CAData); err != nil {
+				return nil, err
+			}
+		}
+		for _, u := range kc.Users {
+			if u.Name != c.Context.User {
+				continue
+			}
+			cfg.Token = u.User.Token
+			if cfg.CertData, err = decode(u.User.CertData); err != nil {
+				return nil, err
+			}
+			if cfg.KeyData, err = decode(u.User.KeyData); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("cluster of current context %s is not found", kc.CurrentContext)
+	}
+	if cfg.Token == "" && len(cfg.CertData) == 0 {
+		return nil, fmt.Errorf("user of current context %s has neither token nor client certificate", kc.CurrentContext)
+	}
+	return
+}
+
+func decode(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+type Client struct {
+	cfg *Config
+	tls *tls.Config
+	cli *http.Client
+}
+
+func NewClient(cfg *Config) (*Client, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.Insecure,
+	}
+	if tlsCfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(cfg.Host)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ServerName = host
+	}
+	if len(cfg.CAData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cfg.CAData) {
+			return nil, fmt.Errorf("invalid certificate authority of the api server")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if len(cfg.CertData) > 0 {
+		cert, err := tls.X509KeyPair(cfg.CertData, cfg.KeyData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.Dial == nil {
+		cfg.Dial = (&net.Dialer{Timeout: defaultTimeout}).DialContext
+	}
+
+	return &Client{
+		cfg: cfg,
+		tls: tlsCfg,
+		cli: &http.Client{
+			Timeout: defaultTimeout,
+			Transport: &http.Transport{
+				DialContext:     cfg.Dial,
+				TLSClientConfig: tlsCfg,
+			},
+		},
+	}, nil
+}
+
+// Close closes idle connections to the api server
+func (c *Client) Close() {
+	c.cli.CloseIdleConnections()
+}
+
+type Pod struct {
+	Name       string   `json:"name"`
+	Namespace  string   `json:"namespace"`
+	Phase      string   `json:"phase"`
+	Containers []string `json:"containers"`
+}
+
+type objectList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			Containers []struct {
+				Name string `json:"name"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// Namespaces returns names of namespaces, the namespace of the config is returned if listing is forbidden
+func (c *Client) Namespaces(ctx context.Context) ([]string, error) {
+	list := &objectList{}
+	if err := c.get(ctx, "/api/v1/namespaces", list); err != nil {
+		if se := (&StatusError{}); c.cfg.Namespace != "" && errors.As(err, &se) && se.Code == http.StatusForbidden {
+			return []string{c.cfg.Namespace}, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(list.Items))
+	for _, item := range list.Items {
+		names = append(names, item.Metadata.Name)
+	}
+	return names, nil
+}
+
+func (c *Client) Pods(ctx context.Context, namespace string) ([]*Pod, error) {
+	list := &objectList{}
+	if err := c.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods", url.PathEscape(namespace)), list); err != nil {
+		return nil, err
+	}
+	pods := make([]*Pod, 0, len(list.Items))
+	for _, item := range list.Items {
+		pod := &Pod{Name: item.Metadata.Name, Namespace: item.Metadata.Namespace, Phase: item.Status.Phase}
+		for _, ct := range item.Spec.Containers {
+			pod.Containers = append(pod.Containers, ct.Name)
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, res any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+c.cfg.Host+path, nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req.Header)
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (c *Client) authorize(h http.Header) {
+	if c.cfg.Token != "" {
+		h.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+}
+
+// Status is the status object of the api server
+//
+//	https://kubernetes.io/docs/reference/kubernetes-api/common-definitions/status/
+type Status struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+	Details struct {
+		Causes []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"causes"`
+	} `json:"details"`
+}
+
+// StatusError is a response of the api server other than 200
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+func statusError(resp *http.Response) error {
+	bs, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	st := &Status{}
+	if json.Unmarshal(bs, st) == nil && st.Message != "" {
+		return &StatusError{Code: resp.StatusCode, Message: st.Message}
+	}
+	return &StatusError{Code: resp.StatusCode, Message: strings.TrimSpace(string(bs))}
+}
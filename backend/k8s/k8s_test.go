@@ -0,0 +1,164 @@
+package k8s
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newFake is an api server with one pod whose exec echoes stdin until "exit" and then exits with code 3
+func newFake(t *testing.T, resizes chan<- string) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{execProtocol}}
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"kind":"Status","status":"Failure","message":"forbidden","code":403}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"default"}},{"metadata":{"name":"kube-system"}}]}`))
+		case "/api/v1/namespaces/default/pods":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"web","namespace":"default"},"spec":{"containers":[{"name":"nginx"},{"name":"sidecar"}]},"status":{"phase":"Running"}}]}`))
+		case "/api/v1/namespaces/default/pods/web/exec":
+			if q := r.URL.Query(); q.Get("container") != "nginx" || q.Get("tty") != "true" || q.Get("command") != "sh" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			for {
+				_, msg, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				switch msg[0] {
+				case channelResize:
+					resizes <- string(msg[1:])
+				case channelStdin:
+					if strings.TrimSpace(string(msg[1:])) == "exit" {
+						ws.WriteMessage(websocket.BinaryMessage, append([]byte{channelError}, `{"status":"Failure","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"3"}]}}`...))
+						ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+						return
+					}
+					ws.WriteMessage(websocket.BinaryMessage, append([]byte{channelStdout}, msg[1:]...))
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func newFakeClient(t *testing.T, srv *httptest.Server, token string) *Client {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: fake
+clusters:
+- name: fake
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+    tls-server-name: example.com
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+    namespace: default
+users:
+- name: fake
+  user:
+    token: %s
+`, srv.URL, base64.StdEncoding.EncodeToString(ca), token)
+	cfg, err := ParseKubeconfig([]byte(kubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestList(t *testing.T) {
+	srv := newFake(t, nil)
+	defer srv.Close()
+	ctx := context.Background()
+
+	cli := newFakeClient(t, srv, "token")
+	namespaces, err := cli.Namespaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(namespaces, ",") != "default,kube-system" {
+		t.Fatalf("Namespaces() = %v", namespaces)
+	}
+	pods, err := cli.Pods(ctx, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 1 || pods[0].Name != "web" || pods[0].Phase != "Running" || strings.Join(pods[0].Containers, ",") != "nginx,sidecar" {
+		bs, _ := json.Marshal(pods)
+		t.Fatalf("Pods() = %s", bs)
+	}
+
+	// the namespace of the context is returned if namespaces can not be listed
+	denied := newFakeClient(t, srv, "bad")
+	if namespaces, err = denied.Namespaces(ctx); err != nil || len(namespaces) != 1 || namespaces[0] != "default" {
+		t.Fatalf("Namespaces() = %v, %v", namespaces, err)
+	}
+	se := &StatusError{}
+	if _, err = denied.Pods(ctx, "default"); !errors.As(err, &se) || se.Code != http.StatusForbidden {
+		t.Fatalf("Pods() error = %v, want 403", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	resizes := make(chan string, 2)
+	srv := newFake(t, resizes)
+	defer srv.Close()
+
+	cli := newFakeClient(t, srv, "token")
+	e, err := cli.Exec(context.Background(), &ExecOptions{Namespace: "default", Pod: "web", Container: "nginx", Command: []string{"sh"}, Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if got := <-resizes; got != `{"Height":24,"Width":80}` {
+		t.Fatalf("resize = %s", got)
+	}
+
+	if _, err = e.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := e.Read(buf)
+	if err != nil || string(buf[:n]) != "hello\n" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+
+	e.Write([]byte("exit\n"))
+	if _, err = io.ReadAll(e); err != nil {
+		t.Fatal(err)
+	}
+	ee := &ExitError{}
+	if !errors.As(e.Err(), &ee) || ee.Code != 3 {
+		t.Fatalf("Err() = %v, want exit code 3", e.Err())
+	}
+}
@@ -1,20 +1,40 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/oklog/run"
+	"github.com/spf13/pflag"
 	"github.com/veops/oneterm/api"
+	"github.com/veops/oneterm/dbsrv"
 	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/replay"
 	"github.com/veops/oneterm/schedule"
 	"github.com/veops/oneterm/sshsrv"
+	"github.com/veops/oneterm/util"
 	"go.uber.org/zap"
 )
 
 func main() {
+	switch pflag.Arg(0) {
+	case "rewrap-replay":
+		// rewrap data keys of recordings after masterKeyId is changed to the new master key
+		if err := replay.RewrapAll(context.Background()); err != nil {
+			logger.L().Fatal("rewrap replay failed", zap.Error(err))
+		}
+		return
+	case "reencrypt":
+		// re-encrypt credentials in the legacy format or by an old key version with the current key
+		if err := util.ReEncryptAll(); err != nil {
+			logger.L().Fatal("re-encrypt failed", zap.Error(err))
+		}
+		return
+	}
+
 	rg := run.Group{}
 	{
 		term := make(chan os.Signal, 1)
@@ -38,6 +58,13 @@ func main() {
 			sshsrv.StopSsh()
 		})
 	}
+	{
+		rg.Add(func() error {
+			return dbsrv.RunDb()
+		}, func(err error) {
+			dbsrv.StopDb()
+		})
+	}
 	{
 		rg.Add(func() error {
 			return schedule.RunConnectable()
@@ -45,6 +72,20 @@ func main() {
 			schedule.StopConnectable()
 		})
 	}
+	{
+		rg.Add(func() error {
+			return schedule.RunPurge()
+		}, func(err error) {
+			schedule.StopPurge()
+		})
+	}
+	{
+		rg.Add(func() error {
+			return schedule.RunRotate()
+		}, func(err error) {
+			schedule.StopRotate()
+		})
+	}
 
 	if err := rg.Run(); err != nil {
 		logger.L().Fatal("", zap.Error(err))
@@ -14,6 +14,12 @@ type Account struct {
 	Password    string `json:"password" gorm:"column:password"`
 	Pk          string `json:"pk" gorm:"column:pk"`
 	Phrase      string `json:"phrase" gorm:"column:phrase"`
+	// SecretPath references credentials in the external secret store, they are not kept in the database if it is set
+	SecretPath string `json:"secret_path" gorm:"column:secret_path"`
+	// Managed accounts get their password rotated every RotateDays, 0 means only on demand
+	Managed    bool       `json:"managed" gorm:"column:managed"`
+	RotateDays int        `json:"rotate_days" gorm:"column:rotate_days"`
+	RotatedAt  *time.Time `json:"rotated_at" gorm:"column:rotated_at"`
 
 	ResourceId int                   `json:"resource_id" gorm:"column:resource_id"`
 	CreatorId  int                   `json:"creator_id" gorm:"column:creator_id"`
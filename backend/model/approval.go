@@ -0,0 +1,29 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	APPROVALSTATUS_PENDING = iota + 1
+	APPROVALSTATUS_APPROVED
+	APPROVALSTATUS_REJECTED
+	APPROVALSTATUS_EXPIRED
+	APPROVALSTATUS_CANCELED
+)
+
+type Approval struct {
+	Id          string    `json:"id"`
+	SessionId   string    `json:"session_id"`
+	Uid         int       `json:"uid"`
+	UserName    string    `json:"user_name"`
+	AssetInfo   string    `json:"asset_info"`
+	AccountInfo string    `json:"account_info"`
+	Cmd         string    `json:"cmd"`
+	CommandId   int       `json:"command_id"`
+	CommandName string    `json:"command_name"`
+	Status      int       `json:"status"`
+	Approver    string    `json:"approver"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiredAt   time.Time `json:"expired_at"`
+}
@@ -6,11 +6,17 @@ import (
 	"gorm.io/plugin/soft_delete"
 )
 
+const (
+	COMMANDACTION_DENY = iota
+	COMMANDACTION_APPROVE
+)
+
 type Command struct {
 	Id     int           `json:"id" gorm:"column:id;primarykey"`
 	Name   string        `json:"name" gorm:"column:name"`
 	Cmds   Slice[string] `json:"cmds" gorm:"column:cmds"`
 	Enable bool          `json:"enable" gorm:"column:enable"`
+	Action int           `json:"action" gorm:"column:action"`
 
 	ResourceId int                   `json:"resource_id" gorm:"column:resource_id"`
 	CreatorId  int                   `json:"creator_id" gorm:"column:creator_id"`
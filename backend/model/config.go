@@ -9,6 +9,10 @@ import (
 type Config struct {
 	Id      int `json:"id" gorm:"column:id;primarykey"`
 	Timeout int `json:"timeout" gorm:"column:timeout"`
+	// ApprovalTimeout is seconds a command waits for approval, 0 means 5 minutes
+	ApprovalTimeout int `json:"approval_timeout" gorm:"column:approval_timeout"`
+	Retention       `json:"retention"`
+	NodeRetentions  Map[int, *Retention] `json:"node_retentions" gorm:"column:node_retentions"`
 
 	CreatorId int                   `json:"creator_id" gorm:"column:creator_id"`
 	UpdaterId int                   `json:"updater_id" gorm:"column:updater_id"`
@@ -20,3 +24,12 @@ type Config struct {
 func (m *Config) TableName() string {
 	return "config"
 }
+
+// Retention is days to keep audit data, 0 means keep forever.
+// In node overrides 0 means inheriting from the parent node
+type Retention struct {
+	ReplayDays      int `json:"replay_days" gorm:"column:replay_days"`
+	SessionDays     int `json:"session_days" gorm:"column:session_days"`
+	FileHistoryDays int `json:"file_history_days" gorm:"column:file_history_days"`
+	HistoryDays     int `json:"history_days" gorm:"column:history_days"`
+}
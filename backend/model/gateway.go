@@ -6,6 +6,24 @@ import (
 	"gorm.io/plugin/soft_delete"
 )
 
+const (
+	GATEWAYTYPE_SSH = iota
+	GATEWAYTYPE_AGENT
+	GATEWAYTYPE_GROUP
+)
+
+const (
+	GATEWAYSTATUS_OFFLINE = iota
+	GATEWAYSTATUS_ONLINE
+	// GATEWAYSTATUS_IDLE is ssh gateways not in use, they are only connected on demand
+	GATEWAYSTATUS_IDLE
+)
+
+const (
+	GATEWAYSTRATEGY_ROUNDROBIN = iota
+	GATEWAYSTRATEGY_LEASTCONN
+)
+
 type Gateway struct {
 	Id          int    `json:"id" gorm:"column:id;primarykey"`
 	Name        string `json:"name" gorm:"column:name"`
@@ -16,6 +34,23 @@ type Gateway struct {
 	Password    string `json:"password" gorm:"column:password"`
 	Pk          string `json:"pk" gorm:"column:pk"`
 	Phrase      string `json:"phrase" gorm:"column:phrase"`
+	// Type is GATEWAYTYPE_AGENT for agents dialing out to oneterm, they have no host and port to be dialed
+	Type int `json:"type" gorm:"column:type"`
+	// Status and LastSeenAt are reported by agents, status of ssh gateways is from the health of connections of this node
+	Status     int        `json:"status" gorm:"column:status"`
+	LastSeenAt *time.Time `json:"last_seen_at" gorm:"column:last_seen_at"`
+	// AgentKey is the public key the agent enrolled with, EnrollToken is the sha256 of the token for enrollment
+	AgentKey        string     `json:"-" gorm:"column:agent_key"`
+	EnrollToken     string     `json:"-" gorm:"column:enroll_token"`
+	EnrollExpiredAt *time.Time `json:"-" gorm:"column:enroll_expired_at"`
+	// ParentId is the gateway this gateway is dialed through, 0 if it is dialed directly
+	ParentId int `json:"parent_id" gorm:"column:parent_id"`
+	// MemberIds are gateways of GATEWAYTYPE_GROUP, one of them is picked by Strategy for every connection
+	// and the others are failed over to
+	MemberIds Slice[int] `json:"member_ids" gorm:"column:member_ids"`
+	Strategy  int        `json:"strategy" gorm:"column:strategy"`
+	// SecretPath references credentials in the external secret store, they are not kept in the database if it is set
+	SecretPath string `json:"secret_path" gorm:"column:secret_path"`
 
 	ResourceId int                   `json:"resource_id" gorm:"column:resource_id"`
 	CreatorId  int                   `json:"creator_id" gorm:"column:creator_id"`
@@ -25,6 +60,12 @@ type Gateway struct {
 	DeletedAt  soft_delete.DeletedAt `json:"-" gorm:"column:deleted_at"`
 
 	AssetCount int64 `json:"asset_count" gorm:"-"`
+	// Latency is in milliseconds, LastError and TunnelCount are of the connection of this node to the gateway
+	Latency     int64      `json:"latency" gorm:"-"`
+	LastError   string     `json:"last_error" gorm:"-"`
+	TunnelCount int64      `json:"tunnel_count" gorm:"-"`
+	Parent      *Gateway   `json:"-" gorm:"-"`
+	Members     []*Gateway `json:"-" gorm:"-"`
 }
 
 func (m *Gateway) TableName() string {
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	HOSTKEY_STATUS_TRUSTED = iota + 1
+	// HOSTKEY_STATUS_PENDING is a changed key waiting for approval, connections are refused until it is approved
+	HOSTKEY_STATUS_PENDING
+)
+
+// HostKey is the ssh host key of an asset on Port, or of a gateway if GatewayId is set
+type HostKey struct {
+	Id          int    `json:"id" gorm:"column:id;primarykey"`
+	AssetId     int    `json:"asset_id" gorm:"column:asset_id"`
+	GatewayId   int    `json:"gateway_id" gorm:"column:gateway_id"`
+	Port        int    `json:"port" gorm:"column:port"`
+	Status      int    `json:"status" gorm:"column:status"`
+	KeyType     string `json:"key_type" gorm:"column:key_type"`
+	Key         string `json:"key" gorm:"column:key"`
+	Fingerprint string `json:"fingerprint" gorm:"column:fingerprint"`
+
+	CreatorId int       `json:"creator_id" gorm:"column:creator_id"`
+	UpdaterId int       `json:"updater_id" gorm:"column:updater_id"`
+	CreatedAt time.Time `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"column:updated_at"`
+}
+
+func (m *HostKey) TableName() string {
+	return "host_key"
+}
+func (m *HostKey) SetId(id int) {
+	m.Id = id
+}
+func (m *HostKey) SetCreatorId(creatorId int) {
+	m.CreatorId = creatorId
+}
+func (m *HostKey) SetUpdaterId(updaterId int) {
+	m.UpdaterId = updaterId
+}
+func (m *HostKey) SetResourceId(resourceId int) {
+
+}
+func (m *HostKey) GetResourceId() int {
+	return 0
+}
+func (m *HostKey) GetName() string {
+	return m.Fingerprint
+}
+func (m *HostKey) GetId() int {
+	return m.Id
+}
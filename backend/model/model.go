@@ -9,6 +9,8 @@ const (
 	ACTION_CREATE = iota + 1
 	ACTION_DELETE
 	ACTION_UPDATE
+	ACTION_ROTATE
+	ACTION_KEY_CHANGE
 )
 
 type Slice[T int | string | Range] []T
@@ -9,6 +9,12 @@ import (
 const (
 	AUTHMETHOD_PASSWORD  = 1
 	AUTHMETHOD_PUBLICKEY = 2
+	// AUTHMETHOD_CERTIFICATE logs in by certificates signed by the built-in ssh ca
+	AUTHMETHOD_CERTIFICATE = 3
+	// AUTHMETHOD_TOKEN is a service account token of kubernetes in password, pk is the optional certificate authority of the api server
+	AUTHMETHOD_TOKEN = 4
+	// AUTHMETHOD_KUBECONFIG is a kubeconfig with embedded credentials in pk
+	AUTHMETHOD_KUBECONFIG = 5
 )
 
 type PublicKey struct {
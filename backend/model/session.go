@@ -15,6 +15,13 @@ const (
 	SESSIONSTATUS_OFFLINE
 )
 
+const (
+	SESSIONCMD_LEVEL_NORMAL = iota
+	SESSIONCMD_LEVEL_BLOCKED
+	SESSIONCMD_LEVEL_APPROVED
+	SESSIONCMD_LEVEL_REJECTED
+)
+
 const (
 	SESSIONACTION_NEW = iota + 1
 	SESSIONACTION_MONITOR
@@ -38,6 +45,13 @@ type Session struct {
 	Status      int        `json:"status" gorm:"column:status"`
 	Duration    int64      `json:"duration" gorm:"-"`
 	ClosedAt    *time.Time `json:"closed_at" gorm:"column:closed_at"`
+	// ReplayDeleted is set once the recording is purged by retention
+	ReplayDeleted bool `json:"replay_deleted" gorm:"column:replay_deleted"`
+	// BytesIn and BytesOut are bytes sent to and received from the asset through tunnels
+	BytesIn  int64 `json:"bytes_in" gorm:"column:bytes_in"`
+	BytesOut int64 `json:"bytes_out" gorm:"column:bytes_out"`
+	// Target is namespace/pod/container of k8s sessions
+	Target string `json:"target" gorm:"column:target"`
 
 	CreatedAt time.Time `json:"created_at" gorm:"column:created_at"`
 	UpdatedAt time.Time `json:"updated_at" gorm:"column:updated_at"`
@@ -63,8 +77,32 @@ func (m *SessionCmd) TableName() string {
 	return "session_cmd"
 }
 
+// IsSsh reports whether the session is a terminal recorded in asciinema, telnet and k8s sessions are terminals as well
 func (m *Session) IsSsh() bool {
-	return strings.HasPrefix(m.Protocol, "ssh")
+	return strings.HasPrefix(m.Protocol, "ssh") || strings.HasPrefix(m.Protocol, "telnet") || strings.HasPrefix(m.Protocol, "k8s")
+}
+
+// IsTunnel reports whether the session is a port forwarding of the ssh server, it has no recording
+func (m *Session) IsTunnel() bool {
+	return strings.HasPrefix(m.Protocol, "tunnel")
+}
+
+// IsDb reports whether the session is a client of the database proxy, its statements are recorded as commands without a recording
+func (m *Session) IsDb() bool {
+	for _, p := range []string{"mysql", "postgresql", "redis"} {
+		if strings.HasPrefix(m.Protocol, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplayName returns file name of the recording of the session
+func (m *Session) ReplayName() string {
+	if m.IsSsh() {
+		return m.SessionId + ".cast"
+	}
+	return m.SessionId
 }
 
 type CmdCount struct {
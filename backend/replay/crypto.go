@@ -0,0 +1,316 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/veops/oneterm/conf"
+)
+
+// Encrypted recordings are laid out as
+//
+//	magic | version | header length(uint16) | header json | frames...
+//
+// the header carries the data key wrapped by a master key, every frame is
+// length(uint32) | aes-gcm sealed chunk, nonce of a frame is the nonce prefix followed by its sequence number.
+// The length is authenticated as additional data, its highest bit marks the empty last frame
+// so that a recording cut off at a frame boundary is told from a finished one
+const (
+	sealMagic    = "OTRP"
+	sealVersion  = 2
+	maxFrameSize = 1 << 24
+	lastFrame    = 1 << 31
+)
+
+var (
+	masterKeys     = map[string][]byte{}
+	currentKeyId   string
+	errNoMasterKey = errors.New("no master key")
+	errTruncated   = errors.New("recording is truncated")
+)
+
+type sealHeader struct {
+	KeyId  string `json:"kid"`
+	Key    []byte `json:"key"`
+	Prefix []byte `json:"prefix"`
+}
+
+func initMasterKeys(cfg conf.ReplayConfig) (err error) {
+	for _, kv := range cfg.MasterKeys {
+		key, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return fmt.Errorf("invalid master key %s: %w", kv.Key, err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("invalid master key %s: length must be 32 bytes", kv.Key)
+		}
+		masterKeys[kv.Key] = key
+	}
+	if cfg.MasterKeyId != "" {
+		if _, ok := masterKeys[cfg.MasterKeyId]; !ok {
+			return fmt.Errorf("master key %s not found", cfg.MasterKeyId)
+		}
+	}
+	currentKeyId = cfg.MasterKeyId
+	return
+}
+
+// Encrypted reports whether new recordings are encrypted
+func Encrypted() bool {
+	return currentKeyId != ""
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapKey(keyId string, dataKey []byte) (wrapped []byte, err error) {
+	master, ok := masterKeys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoMasterKey, keyId)
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyId)), nil
+}
+
+func unwrapKey(keyId string, wrapped []byte) (dataKey []byte, err error) {
+	master, ok := masterKeys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoMasterKey, keyId)
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyId))
+}
+
+func writeHeader(w io.Writer, h *sealHeader) (err error) {
+	bs, err := json.Marshal(h)
+	if err != nil {
+		return
+	}
+	buf := bytes.NewBufferString(sealMagic)
+	buf.WriteByte(sealVersion)
+	binary.Write(buf, binary.BigEndian, uint16(len(bs)))
+	buf.Write(bs)
+	_, err = w.Write(buf.Bytes())
+	return
+}
+
+// readHeader returns nil header if r is not an encrypted recording
+func readHeader(r *bufio.Reader) (h *sealHeader, err error) {
+	magic, err := r.Peek(len(sealMagic) + 1)
+	if err != nil || string(magic[:len(sealMagic)]) != sealMagic {
+		return nil, nil
+	}
+	if magic[len(sealMagic)] != sealVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", magic[len(sealMagic)])
+	}
+	r.Discard(len(magic))
+	var n uint16
+	if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+		return
+	}
+	bs := make([]byte, n)
+	if _, err = io.ReadFull(r, bs); err != nil {
+		return
+	}
+	h = &sealHeader{}
+	err = json.Unmarshal(bs, h)
+	return
+}
+
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint64
+	closed bool
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// NewWriter returns a writer sealing every write as a frame with a new data key, Close writes the last frame
+// and must be called to finish the recording, w itself is not closed. w is written as is if encryption is disabled
+func NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if !Encrypted() {
+		return nopCloser{w}, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapKey(currentKeyId, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sw := &sealWriter{w: w, aead: aead, prefix: make([]byte, aead.NonceSize()-8)}
+	if _, err = rand.Read(sw.prefix); err != nil {
+		return nil, err
+	}
+	if err = writeHeader(w, &sealHeader{KeyId: currentKeyId, Key: wrapped, Prefix: sw.prefix}); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *sealWriter) Write(p []byte) (n int, err error) {
+	if sw.closed {
+		return 0, errors.New("write to closed recording")
+	}
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxFrameSize-sw.aead.Overhead())]
+		if err = sw.writeFrame(chunk, false); err != nil {
+			return
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return
+}
+
+func (sw *sealWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	return sw.writeFrame(nil, true)
+}
+
+func (sw *sealWriter) writeFrame(chunk []byte, last bool) error {
+	size := uint32(len(chunk) + sw.aead.Overhead())
+	if last {
+		size |= lastFrame
+	}
+	nonce := binary.BigEndian.AppendUint64(append([]byte{}, sw.prefix...), sw.seq)
+	header := binary.BigEndian.AppendUint32(nil, size)
+	frame := sw.aead.Seal(header, nonce, chunk, header[:4])
+	sw.seq++
+	_, err := sw.w.Write(frame)
+	return err
+}
+
+type openReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint64
+	buf    []byte
+	last   bool
+}
+
+// NewReader returns a reader of the plaintext, r is read as is if it is not encrypted.
+// Reading an encrypted recording fails if a frame is tampered with or the recording is truncated
+func NewReader(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil || h == nil {
+		return br, false, err
+	}
+	dataKey, err := unwrapKey(h.KeyId, h.Key)
+	if err != nil {
+		return nil, true, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(h.Prefix)+8 != aead.NonceSize() {
+		return nil, true, errors.New("invalid nonce prefix")
+	}
+	return &openReader{r: br, aead: aead, prefix: h.Prefix}, true, nil
+}
+
+func (or *openReader) Read(p []byte) (n int, err error) {
+	for len(or.buf) <= 0 {
+		if or.last {
+			if _, err = or.r.Peek(1); err == nil {
+				err = errors.New("data after the last frame")
+			}
+			return 0, err
+		}
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(or.r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errTruncated
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		last := size&lastFrame != 0
+		if size &^= lastFrame; size > maxFrameSize {
+			return 0, errors.New("invalid frame size")
+		}
+		frame := make([]byte, size)
+		if _, err = io.ReadFull(or.r, frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errTruncated
+			}
+			return
+		}
+		nonce := binary.BigEndian.AppendUint64(append([]byte{}, or.prefix...), or.seq)
+		if or.buf, err = or.aead.Open(frame[:0], nonce, frame, header); err != nil {
+			return
+		}
+		or.seq++
+		or.last = last
+	}
+	n = copy(p, or.buf)
+	or.buf = or.buf[n:]
+	return
+}
+
+// rewrap copies the encrypted recording from r to w with its data key wrapped by the current master key,
+// frames are copied untouched. It returns false if the recording is plain or already wrapped by the current key
+func rewrap(r io.Reader, w io.Writer) (ok bool, err error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil || h == nil || h.KeyId == currentKeyId {
+		return
+	}
+	dataKey, err := unwrapKey(h.KeyId, h.Key)
+	if err != nil {
+		return
+	}
+	if h.Key, err = wrapKey(currentKeyId, dataKey); err != nil {
+		return
+	}
+	h.KeyId = currentKeyId
+	if err = writeHeader(w, h); err != nil {
+		return
+	}
+	_, err = io.Copy(w, br)
+	return err == nil, err
+}
@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// useMasterKeys replaces master keys by random keys of ids, current is the key new recordings are wrapped by
+func useMasterKeys(t *testing.T, current string, ids ...string) {
+	keys, id := masterKeys, currentKeyId
+	t.Cleanup(func() { masterKeys, currentKeyId = keys, id })
+	masterKeys = map[string][]byte{}
+	for _, id := range ids {
+		masterKeys[id] = make([]byte, 32)
+		rand.Read(masterKeys[id])
+	}
+	currentKeyId = current
+}
+
+// sealed returns plain written through the sealing writer in writes of chunk bytes
+func sealed(t *testing.T, plain []byte, chunk int) []byte {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plain; len(p) > 0; p = p[min(chunk, len(p)):] {
+		if _, err = w.Write(p[:min(chunk, len(p))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readAll(r io.Reader) ([]byte, bool, error) {
+	rd, encrypted, err := NewReader(r)
+	if err != nil {
+		return nil, encrypted, err
+	}
+	bs, err := io.ReadAll(rd)
+	return bs, encrypted, err
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	useMasterKeys(t, "k1", "k1")
+	plain := []byte(strings.Repeat(`[0.1, "o", "hello"]`+"\r\n", 1000))
+	for _, chunk := range []int{1, 100, len(plain)} {
+		bs := sealed(t, plain, chunk)
+		if bytes.Contains(bs, []byte("hello")) {
+			t.Fatal("recording is written in plain")
+		}
+		got, encrypted, err := readAll(bytes.NewReader(bs))
+		if err != nil || !encrypted || !bytes.Equal(got, plain) {
+			t.Fatalf("read by writes of %d bytes = %d bytes, %v, %v", chunk, len(got), encrypted, err)
+		}
+	}
+}
+
+func TestSealDisabled(t *testing.T) {
+	useMasterKeys(t, "")
+	plain := []byte(`{"version": 2}` + "\r\n")
+	bs := sealed(t, plain, len(plain))
+	if !bytes.Equal(bs, plain) {
+		t.Fatalf("written %q without encryption, want %q", bs, plain)
+	}
+}
+
+func TestReadLegacy(t *testing.T) {
+	useMasterKeys(t, "k1", "k1")
+	for _, plain := range []string{"", "OT", `{"version": 2}` + "\r\n"} {
+		got, encrypted, err := readAll(strings.NewReader(plain))
+		if err != nil || encrypted || string(got) != plain {
+			t.Fatalf("read %q = %q, %v, %v", plain, got, encrypted, err)
+		}
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	useMasterKeys(t, "old", "old", "new")
+	plain := []byte("recorded before the master key is rotated")
+	bs := sealed(t, plain, 8)
+
+	currentKeyId = "new"
+	out := &bytes.Buffer{}
+	if ok, err := rewrap(bytes.NewReader(bs), out); !ok || err != nil {
+		t.Fatalf("rewrap() = %v, %v", ok, err)
+	}
+	delete(masterKeys, "old")
+	if got, _, err := readAll(bytes.NewReader(out.Bytes())); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("read rewrapped = %q, %v", got, err)
+	}
+	if ok, err := rewrap(bytes.NewReader(out.Bytes()), io.Discard); ok || err != nil {
+		t.Fatalf("rewrap() of the current key = %v, %v, want nothing done", ok, err)
+	}
+	if ok, err := rewrap(bytes.NewReader(bs), io.Discard); ok || !errors.Is(err, errNoMasterKey) {
+		t.Fatalf("rewrap() without the old key = %v, %v", ok, err)
+	}
+}
+
+func TestReadTampered(t *testing.T) {
+	useMasterKeys(t, "k1", "k1")
+	plain := []byte(strings.Repeat("x", 100))
+	bs := sealed(t, plain, 10)
+	// every frame is length, 10 bytes and the tag, the last one has no bytes
+	frameLen := 4 + 10 + 16
+	headerLen := len(bs) - 10*frameLen - 20
+
+	tests := []struct {
+		name string
+		bs   []byte
+		err  error
+	}{
+		{name: "flipped byte", bs: flip(bs, len(bs)-frameLen-1)},
+		{name: "last frame mark flipped", bs: flip(bs, len(bs)-20)},
+		{name: "frames swapped", bs: swap(bs, headerLen, frameLen)},
+		{name: "cut at a frame boundary", bs: bs[:len(bs)-20], err: errTruncated},
+		{name: "cut in a frame", bs: bs[:len(bs)-25], err: errTruncated},
+		{name: "cut after the header", bs: bs[:headerLen], err: errTruncated},
+		{name: "appended", bs: append(append([]byte{}, bs...), bs[headerLen:headerLen+frameLen]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readAll(bytes.NewReader(tt.bs))
+			if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Fatalf("read error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func flip(bs []byte, i int) []byte {
+	bs = append([]byte{}, bs...)
+	bs[i] ^= 0x80
+	return bs
+}
+
+// swap swaps the first two frames of n bytes after the header of n0 bytes
+func swap(bs []byte, n0, n int) []byte {
+	out := append([]byte{}, bs[:n0]...)
+	out = append(out, bs[n0+n:n0+2*n]...)
+	out = append(out, bs[n0:n0+n]...)
+	return append(out, bs[n0+2*n:]...)
+}
@@ -0,0 +1,44 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalStorage keeps recordings in a local directory
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) Put(ctx context.Context, name string, r io.Reader, size int64) (err error) {
+	f, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return
+}
+
+func (s *LocalStorage) Get(ctx context.Context, name string) (rc io.ReadCloser, size int64, err error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	return f, info.Size(), nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
@@ -0,0 +1,367 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/veops/oneterm/conf"
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+const (
+	STORAGE_LOCAL = "local"
+	STORAGE_S3    = "s3"
+
+	// orphanAge is how long a recording of an offline session is left untouched before it is taken as orphaned,
+	// recordings finished by others such as guacd are uploaded a while after their sessions end
+	orphanAge       = time.Minute
+	orphanBatchSize = 500
+)
+
+var (
+	storage Storage
+	// offlineSessions returns the offline ones of the sessions
+	offlineSessions = func(ids []string) (sessions []*model.Session, err error) {
+		err = mysql.DB.
+			Model(&model.Session{}).
+			Where("session_id IN ?", ids).
+			Where("status = ?", model.SESSIONSTATUS_OFFLINE).
+			Find(&sessions).
+			Error
+		return
+	}
+)
+
+// Storage keeps finished recordings, recordings are always written to the local replay path first
+type Storage interface {
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	Get(ctx context.Context, name string) (io.ReadCloser, int64, error)
+	Delete(ctx context.Context, name string) error
+}
+
+func init() {
+	cfg := conf.Cfg.Replay
+	if err := os.MkdirAll(cfg.Path, 0755); err != nil {
+		logger.L().Fatal("create replay path failed", zap.String("path", cfg.Path), zap.Error(err))
+	}
+	if err := initMasterKeys(cfg); err != nil {
+		logger.L().Fatal("init replay master keys failed", zap.Error(err))
+	}
+	switch cfg.Storage {
+	case "", STORAGE_LOCAL:
+		storage = NewLocalStorage(cfg.Path)
+	case STORAGE_S3:
+		s, err := NewS3Storage(cfg.S3)
+		if err != nil {
+			logger.L().Fatal("init s3 replay storage failed", zap.Error(err))
+		}
+		storage = s
+	default:
+		logger.L().Fatal("unknown replay storage", zap.String("storage", cfg.Storage))
+	}
+}
+
+func GetStorage() Storage {
+	return storage
+}
+
+// LocalPath returns where the recording is written while the session is online
+func LocalPath(name string) string {
+	return filepath.Join(conf.Cfg.Replay.Path, name)
+}
+
+// Upload encrypts the finished recording if it is written in plain by others such as guacd,
+// then moves it from the local replay path into the storage.
+// The local file is kept if the upload fails so it can still be downloaded
+func Upload(ctx context.Context, name string) (err error) {
+	defer func() {
+		if err != nil {
+			logger.L().Error("upload replay failed", zap.String("name", name), zap.Error(err))
+		}
+	}()
+	if err = seal(name); err != nil {
+		return
+	}
+	if _, ok := storage.(*LocalStorage); ok {
+		return
+	}
+
+	f, err := os.Open(LocalPath(name))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if err = storage.Put(ctx, name, f, info.Size()); err != nil {
+		return
+	}
+
+	return os.Remove(LocalPath(name))
+}
+
+// Save writes the recording read from r to the local replay path, encrypted if encryption is enabled,
+// then uploads it as recordings of sessions
+func Save(ctx context.Context, name string, r io.Reader) (err error) {
+	path := LocalPath(name)
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	w, err := NewWriter(out)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return
+	}
+	return Upload(ctx, name)
+}
+
+// UploadOrphans uploads recordings left in the local replay path by offline sessions,
+// they are those not uploaded because the process was restarted or crashed before their sessions ended
+func UploadOrphans(ctx context.Context) (err error) {
+	if _, ok := storage.(*LocalStorage); ok && !Encrypted() {
+		return
+	}
+	entries, err := os.ReadDir(conf.Cfg.Replay.Path)
+	if err != nil {
+		return
+	}
+	names := make(map[string]string)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < orphanAge {
+			continue
+		}
+		names[strings.TrimSuffix(e.Name(), ".cast")] = e.Name()
+	}
+	ids := make([]string, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+
+	cnt := 0
+	for i := 0; i < len(ids); i += orphanBatchSize {
+		sessions, err := offlineSessions(ids[i:min(i+orphanBatchSize, len(ids))])
+		if err != nil {
+			return err
+		}
+		for _, s := range sessions {
+			if s.ReplayName() != names[s.SessionId] {
+				continue
+			}
+			if Upload(ctx, s.ReplayName()) == nil {
+				cnt++
+			}
+		}
+	}
+	if cnt > 0 {
+		logger.L().Info("upload orphaned replays done", zap.Int("count", cnt))
+	}
+	return
+}
+
+// Open returns the decrypted recording, size is -1 if it is unknown
+func Open(ctx context.Context, name string) (rc io.ReadCloser, size int64, err error) {
+	raw, size, err := openRaw(ctx, name)
+	if err != nil {
+		return
+	}
+	r, encrypted, err := NewReader(raw)
+	if err != nil {
+		raw.Close()
+		return nil, 0, err
+	}
+	if encrypted {
+		size = -1
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, raw}, size, nil
+}
+
+// openRaw returns the recording as it is stored, recordings not uploaded yet are read from the local replay path
+func openRaw(ctx context.Context, name string) (rc io.ReadCloser, size int64, err error) {
+	f, err := os.Open(LocalPath(name))
+	if err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
+	return storage.Get(ctx, name)
+}
+
+// Remove deletes the recording from both the storage and the local replay path
+func Remove(ctx context.Context, name string) (err error) {
+	if err = storage.Delete(ctx, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err = os.Remove(LocalPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove local replay failed: %w", err)
+	}
+	return nil
+}
+
+// seal encrypts the plain recording in the local replay path in place
+func seal(name string) (err error) {
+	if !Encrypted() {
+		return
+	}
+	path := LocalPath(name)
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if h, err := readHeader(br); err != nil || h != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	w, err := NewWriter(out)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 64*1024)
+	if _, err = io.CopyBuffer(w, br, buf); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// Rewrap rewraps the data key of the recording with the current master key.
+// It returns false if the recording is not encrypted or is already wrapped by the current key
+func Rewrap(ctx context.Context, name string) (ok bool, err error) {
+	if !Encrypted() {
+		return false, errNoMasterKey
+	}
+	src, _, err := openRaw(ctx, name)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	path := LocalPath(name)
+	_, local := src.(*os.File)
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	if ok, err = rewrap(src, out); err != nil || !ok {
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	if local {
+		return ok, os.Rename(tmp, path)
+	}
+
+	f, err := os.Open(tmp)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	return ok, storage.Put(ctx, name, f, info.Size())
+}
+
+// RewrapAll rewraps data keys of all finished recordings with the current master key, it is used after the master key is rotated.
+// Recordings of online sessions are still being written and are left as they are
+func RewrapAll(ctx context.Context) (err error) {
+	lastId, cnt, failed := 0, 0, 0
+	for {
+		sessions := make([]*model.Session, 0)
+		if err = mysql.DB.
+			Model(&model.Session{}).
+			Where("id > ?", lastId).
+			Where("status = ?", model.SESSIONSTATUS_OFFLINE).
+			Where("replay_deleted = ?", false).
+			Order("id").
+			Limit(500).
+			Find(&sessions).
+			Error; err != nil {
+			return
+		}
+		if len(sessions) <= 0 {
+			break
+		}
+		lastId = sessions[len(sessions)-1].Id
+		for _, s := range sessions {
+			ok, err := Rewrap(ctx, s.ReplayName())
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				failed++
+				logger.L().Error("rewrap replay failed", zap.String("sessionId", s.SessionId), zap.Error(err))
+				continue
+			}
+			if ok {
+				cnt++
+			}
+		}
+	}
+	logger.L().Info("rewrap replays done", zap.String("keyId", currentKeyId), zap.Int("count", cnt), zap.Int("failed", failed))
+	if failed > 0 {
+		return fmt.Errorf("%d replays failed to rewrap", failed)
+	}
+	return
+}
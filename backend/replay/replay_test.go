@@ -0,0 +1,143 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/veops/oneterm/conf"
+	"github.com/veops/oneterm/model"
+)
+
+// useStorage replaces the storage by s and the local replay path by a temporary directory
+func useStorage(t *testing.T, s Storage) string {
+	old, path := storage, conf.Cfg.Replay.Path
+	t.Cleanup(func() { storage, conf.Cfg.Replay.Path = old, path })
+	storage, conf.Cfg.Replay.Path = s, t.TempDir()
+	return conf.Cfg.Replay.Path
+}
+
+func read(t *testing.T, name string) (string, error) {
+	rc, _, err := Open(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	bs, err := io.ReadAll(rc)
+	return string(bs), err
+}
+
+func TestLocalStorage(t *testing.T) {
+	ctx := context.Background()
+	dir := useStorage(t, nil)
+	storage = NewLocalStorage(dir)
+
+	if err := storage.Put(ctx, "a.cast", strings.NewReader("recording"), 9); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(t, "a.cast"); err != nil || got != "recording" {
+		t.Fatalf("Open() = %q, %v", got, err)
+	}
+	if err := Remove(ctx, "a.cast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(t, "a.cast"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open() after Remove() error = %v, want not exist", err)
+	}
+	if err := Remove(ctx, "a.cast"); err != nil {
+		t.Fatalf("Remove() of a removed recording error = %v", err)
+	}
+}
+
+func TestSaveToS3(t *testing.T) {
+	useMasterKeys(t, "k1", "k1")
+	ctx := context.Background()
+	fake := newFakeS3(t)
+	s3, err := NewS3Storage(fake.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := useStorage(t, s3)
+
+	content := `{"version": 2}` + "\r\n" + `[0.1, "o", "hello"]` + "\r\n"
+	if err = Save(ctx, "a.cast", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "a.cast")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("local recording is left after upload, stat error = %v", err)
+	}
+	if bs, ok := fake.object("/oneterm-replay/a.cast"); !ok || strings.Contains(string(bs), "hello") {
+		t.Fatalf("object = %q, %v, want it encrypted", bs, ok)
+	}
+	if got, err := read(t, "a.cast"); err != nil || got != content {
+		t.Fatalf("Open() = %q, %v", got, err)
+	}
+	if err = Remove(ctx, "a.cast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.object("/oneterm-replay/a.cast"); ok {
+		t.Fatal("object is left after Remove()")
+	}
+}
+
+func TestUploadOrphans(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3(t)
+	s3, err := NewS3Storage(fake.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := useStorage(t, s3)
+	old := offlineSessions
+	t.Cleanup(func() { offlineSessions = old })
+	offlineSessions = func(ids []string) (sessions []*model.Session, err error) {
+		for _, id := range ids {
+			if id != "online" {
+				sessions = append(sessions, &model.Session{SessionId: id, Protocol: "ssh:22"})
+			}
+		}
+		return
+	}
+
+	past := time.Now().Add(-orphanAge * 2)
+	for name, modTime := range map[string]time.Time{
+		"offline.cast":     past,
+		"online.cast":      past,
+		"recent.cast":      time.Now(),
+		"offline.cast.tmp": past,
+	} {
+		path := filepath.Join(dir, name)
+		if err = os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = UploadOrphans(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if bs, ok := fake.object("/oneterm-replay/offline.cast"); !ok || string(bs) != "offline.cast" {
+		t.Fatalf("orphan = %q, %v, want it uploaded", bs, ok)
+	}
+	for _, name := range []string{"online.cast", "recent.cast", "offline.cast.tmp"} {
+		if _, ok := fake.object("/oneterm-replay/" + name); ok {
+			t.Errorf("%s is uploaded", name)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if want := "offline.cast.tmp,online.cast,recent.cast"; strings.Join(left, ",") != want {
+		t.Fatalf("left %v, want %s", left, want)
+	}
+}
@@ -0,0 +1,163 @@
+package replay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/veops/oneterm/conf"
+)
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Storage keeps recordings in a bucket of s3 compatible object storage such as minio.
+// Objects are addressed path-style and requests are signed with signature v4
+type S3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	cli       *http.Client
+}
+
+func NewS3Storage(cfg conf.S3Config) (s *S3Storage, err error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return
+	}
+	if endpoint.Scheme == "" {
+		endpoint, err = url.Parse("https://" + cfg.Endpoint)
+		if err != nil {
+			return
+		}
+	}
+	s = &S3Storage{
+		endpoint:  endpoint,
+		region:    cfg.Region,
+		bucket:    cfg.Bucket,
+		prefix:    strings.Trim(cfg.Prefix, "/"),
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		cli:       &http.Client{},
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	return
+}
+
+func (s *S3Storage) Put(ctx context.Context, name string, r io.Reader, size int64) (err error) {
+	resp, err := s.do(ctx, http.MethodPut, name, r, size)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (s *S3Storage) Get(ctx context.Context, name string) (rc io.ReadCloser, size int64, err error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, 0)
+	if err != nil {
+		return
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, name string) (err error) {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, 0)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (s *S3Storage) do(ctx context.Context, method, name string, body io.Reader, size int64) (resp *http.Response, err error) {
+	key := name
+	if s.prefix != "" {
+		key = s.prefix + "/" + name
+	}
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = ""
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now())
+
+	resp, err = s.cli.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 object %s: %w", key, fs.ErrNotExist)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s failed: %s %s", method, key, resp.Status, msg)
+	}
+	return
+}
+
+// sign signs the request with aws signature version 4, the payload is left unsigned
+//
+//	https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := strings.Join([]string{date, s.region, "s3", "aws4_request"}, "/")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, v := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSha256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
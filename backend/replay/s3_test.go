@@ -0,0 +1,184 @@
+package replay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/veops/oneterm/conf"
+)
+
+// fakeS3 is an s3 compatible storage addressed path-style as minio, requests are verified by signature v4
+type fakeS3 struct {
+	*httptest.Server
+	accessKey string
+	secretKey string
+	region    string
+
+	mtx     sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	s := &fakeS3{accessKey: "minioadmin", secretKey: "miniosecret", region: "us-east-1", objects: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.verify(r); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>%s</Message></Error>", err)
+			return
+		}
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			bs, err := io.ReadAll(r.Body)
+			if err != nil || int64(len(bs)) != r.ContentLength {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s.objects[r.URL.Path] = bs
+		case http.MethodGet:
+			bs, ok := s.objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(bs)
+		case http.MethodDelete:
+			delete(s.objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeS3) object(path string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	bs, ok := s.objects[path]
+	return bs, ok
+}
+
+func (s *fakeS3) config() conf.S3Config {
+	return conf.S3Config{Endpoint: s.URL, Region: s.region, Bucket: "oneterm-replay", AccessKey: s.accessKey, SecretKey: s.secretKey}
+}
+
+// verify checks the signature v4 of r as the storage does
+func (s *fakeS3) verify(r *http.Request) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return errors.New("unsupported authorization")
+	}
+	fields := map[string]string{}
+	for _, f := range strings.Split(auth, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+		fields[k] = v
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || time.Since(t).Abs() > time.Minute*15 {
+		return errors.New("invalid date")
+	}
+	scope := strings.Join([]string{amzDate[:8], s.region, "s3", "aws4_request"}, "/")
+	if fields["Credential"] != s.accessKey+"/"+scope {
+		return fmt.Errorf("invalid credential %s", fields["Credential"])
+	}
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !strings.Contains(fields["SignedHeaders"], "host") || !strings.Contains(fields["SignedHeaders"], "x-amz-date") {
+		return errors.New("host and date must be signed")
+	}
+	var headers []string
+	for _, h := range signed {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers = append(headers, h+":"+strings.TrimSpace(v))
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		strings.Join(headers, "\n") + "\n",
+		fields["SignedHeaders"],
+		r.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(sum[:])}, "\n")
+	key := []byte("AWS4" + s.secretKey)
+	for _, v := range strings.Split(scope, "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(v))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(toSign))
+	if want := hex.EncodeToString(mac.Sum(nil)); fields["Signature"] != want {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func TestS3Storage(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3(t)
+	cfg := fake.config()
+	cfg.Prefix = "/replays/"
+	s, err := NewS3Storage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "recording"
+	if err = s.Put(ctx, "a.cast", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if bs, ok := fake.object("/oneterm-replay/replays/a.cast"); !ok || string(bs) != content {
+		t.Fatalf("object = %q, %v, want it at the path of the bucket", bs, ok)
+	}
+	rc, size, err := s.Get(ctx, "a.cast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(bs) != content || size != int64(len(content)) {
+		t.Fatalf("Get() = %q, %d, %v", bs, size, err)
+	}
+	if err = s.Delete(ctx, "a.cast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Get(ctx, "a.cast"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get() after Delete() error = %v, want not exist", err)
+	}
+}
+
+func TestS3StorageWrongSecret(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := fake.config()
+	cfg.SecretKey = "wrong"
+	s, err := NewS3Storage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(context.Background(), "a.cast", strings.NewReader("x"), 1); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Put() error = %v, want forbidden", err)
+	}
+	if _, ok := fake.object("/oneterm-replay/a.cast"); ok {
+		t.Fatal("object is put with a wrong secret")
+	}
+}
@@ -2,14 +2,11 @@ package schedule
 
 import (
 	"context"
-	"fmt"
-	"net"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/samber/lo"
-	"github.com/spf13/cast"
 	"go.uber.org/zap"
 
 	mysql "github.com/veops/oneterm/db"
@@ -25,6 +22,7 @@ var (
 )
 
 func RunConnectable() (err error) {
+	ggateway.GetGatewayManager().SetUnreachableHandler(checkGateway)
 	tk := time.NewTicker(d)
 	for {
 		select {
@@ -40,6 +38,18 @@ func StopConnectable() {
 	defer cancel()
 }
 
+// checkGateway checks assets of the gateway which became unreachable
+func checkGateway(gatewayId int) {
+	ids := make([]int, 0)
+	if err := mysql.DB.Model(&model.Asset{}).Where("gateway_id = ?", gatewayId).Pluck("id", &ids).Error; err != nil {
+		logger.L().Warn("get assets of gateway failed", zap.Int("gatewayId", gatewayId), zap.Error(err))
+		return
+	}
+	if len(ids) > 0 {
+		CheckUpdate(ids...)
+	}
+}
+
 func CheckUpdate(ids ...int) (err error) {
 	defer func() {
 		if err != nil {
@@ -60,22 +70,15 @@ func CheckUpdate(ids ...int) (err error) {
 		return
 	}
 	gids := lo.Without(lo.Uniq(lo.Map(assets, func(a *model.Asset, _ int) int { return a.GatewayId })), 0)
-	gateways := make([]*model.Gateway, 0)
-	if len(gids) > 0 {
-		if err = mysql.DB.
-			Model(gateways).
-			Where("id IN ?", gids).
-			Find(&gateways).Error; err != nil {
-			logger.L().Debug("get gatewats to test connectable failed", zap.Error(err))
-			return
+	gatewayMap := make(map[int]*model.Gateway)
+	for _, gid := range gids {
+		g, err := util.GetGateway(ctx, gid)
+		if err != nil {
+			logger.L().Warn("get gateway failed", zap.Int("id", gid), zap.Error(err))
+			continue
 		}
+		gatewayMap[gid] = g
 	}
-	for _, g := range gateways {
-		g.Password = util.DecryptAES(g.Password)
-		g.Pk = util.DecryptAES(g.Pk)
-		g.Phrase = util.DecryptAES(g.Phrase)
-	}
-	gatewayMap := lo.SliceToMap(gateways, func(g *model.Gateway) (int, *model.Gateway) { return g.Id, g })
 
 	all, oks := lo.Map(assets, func(a *model.Asset, _ int) int { return a.Id }), make([]int, 0)
 	sids := make([]string, 0)
@@ -103,27 +106,14 @@ func CheckUpdate(ids ...int) (err error) {
 func checkOne(asset *model.Asset, gateway *model.Gateway) (sid string, ok bool) {
 	sid = uuid.New().String()
 	for _, p := range asset.Protocols {
-		ip, port := asset.Ip, cast.ToInt(strings.Split(p, ":")[1])
-		var (
-			gt  *ggateway.GatewayTunnel
-			err error
-		)
-		if asset.GatewayId != 0 {
-			gt, err = ggateway.GetGatewayManager().Open(sid, ip, port, gateway)
-			if err != nil {
-				logger.L().Debug("open gateway failed", zap.Error(err))
-				continue
-			}
-			ip, port = gt.LocalIp, gt.LocalPort
-			<-gt.Opened
-		}
-		addr := fmt.Sprintf("%s:%d", ip, port)
-		net, err := net.DialTimeout("tcp", addr, time.Second*3)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		conn, err := util.Proxy(ctx, sid, strings.ToLower(p), asset, gateway)
 		if err != nil {
-			logger.L().Debug("dail failed", zap.String("addr", addr), zap.Error(err))
+			logger.L().Debug("dail failed", zap.String("protocol", p), zap.Error(err))
 			continue
 		}
-		defer net.Close()
+		defer conn.Close()
 
 		ok = true
 		return
@@ -0,0 +1,253 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/replay"
+)
+
+const (
+	purgeInterval  = time.Minute * 10
+	purgeBatchSize = 500
+)
+
+// RunPurge deletes audit data older than the retention days in config.
+// It also uploads recordings left by sessions of a previous run, those of crashed nodes are offline only after they are reaped
+func RunPurge() (err error) {
+	tk := time.NewTicker(purgeInterval)
+	uploadOrphans()
+	Purge()
+	for {
+		select {
+		case <-tk.C:
+			uploadOrphans()
+			Purge()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func StopPurge() {
+	defer cancel()
+}
+
+func uploadOrphans() {
+	if err := replay.UploadOrphans(ctx); err != nil {
+		logger.L().Warn("upload orphaned replays failed", zap.Error(err))
+	}
+}
+
+// retentionGroup is assets sharing the same retention, assets is nil for the default group
+type retentionGroup struct {
+	model.Retention
+	assetIds []int
+}
+
+func (g *retentionGroup) scope(db *gorm.DB, others []int) *gorm.DB {
+	if g.assetIds != nil {
+		return db.Where("asset_id IN ?", g.assetIds)
+	}
+	if len(others) > 0 {
+		return db.Where("asset_id NOT IN ?", others)
+	}
+	return db
+}
+
+func Purge() {
+	cfg := &model.Config{}
+	if err := mysql.DB.Model(cfg).First(cfg).Error; err != nil {
+		logger.L().Debug("get config to purge failed", zap.Error(err))
+		return
+	}
+	now := time.Now()
+
+	groups, err := getRetentionGroups(cfg)
+	if err != nil {
+		logger.L().Warn("get retention groups failed", zap.Error(err))
+		return
+	}
+	others := lo.Flatten(lo.Map(groups, func(g *retentionGroup, _ int) []int { return g.assetIds }))
+	for _, g := range groups {
+		if g.ReplayDays > 0 {
+			purgeReplays(g.scope(mysql.DB.Model(&model.Session{}), others), now.AddDate(0, 0, -g.ReplayDays))
+		}
+		if g.SessionDays > 0 {
+			purgeSessions(g.scope(mysql.DB.Model(&model.Session{}), others), now.AddDate(0, 0, -g.SessionDays))
+		}
+		if g.FileHistoryDays > 0 {
+			purgeRows(g.scope(mysql.DB, others), &model.FileHistory{}, now.AddDate(0, 0, -g.FileHistoryDays))
+		}
+	}
+	if cfg.HistoryDays > 0 {
+		purgeRows(mysql.DB, &model.History{}, now.AddDate(0, 0, -cfg.HistoryDays))
+	}
+}
+
+// getRetentionGroups groups assets by retention merged from the nearest overridden nodes and the config,
+// the last group is the default one
+func getRetentionGroups(cfg *model.Config) (groups []*retentionGroup, err error) {
+	def := &retentionGroup{Retention: cfg.Retention}
+	if len(cfg.NodeRetentions) <= 0 {
+		return []*retentionGroup{def}, nil
+	}
+
+	nodes := make([]*model.NodeIdPid, 0)
+	if err = mysql.DB.Model(nodes).Find(&nodes).Error; err != nil {
+		return
+	}
+	assets := make([]*model.AssetIdPid, 0)
+	if err = mysql.DB.Model(assets).Find(&assets).Error; err != nil {
+		return
+	}
+	parents := lo.SliceToMap(nodes, func(n *model.NodeIdPid) (int, int) { return n.Id, n.ParentId })
+
+	resolved := map[int]model.Retention{}
+	var resolve func(id int, depth int) model.Retention
+	resolve = func(id int, depth int) model.Retention {
+		if r, ok := resolved[id]; ok {
+			return r
+		}
+		pid, ok := parents[id]
+		if !ok || depth > len(parents) {
+			return cfg.Retention
+		}
+		r := resolve(pid, depth+1)
+		if o := cfg.NodeRetentions[id]; o != nil {
+			r.ReplayDays = lo.Ternary(o.ReplayDays > 0, o.ReplayDays, r.ReplayDays)
+			r.SessionDays = lo.Ternary(o.SessionDays > 0, o.SessionDays, r.SessionDays)
+			r.FileHistoryDays = lo.Ternary(o.FileHistoryDays > 0, o.FileHistoryDays, r.FileHistoryDays)
+		}
+		resolved[id] = r
+		return r
+	}
+
+	m := map[model.Retention]*retentionGroup{}
+	for _, a := range assets {
+		r := resolve(a.ParentId, 0)
+		if r == cfg.Retention {
+			continue
+		}
+		if _, ok := m[r]; !ok {
+			m[r] = &retentionGroup{Retention: r, assetIds: []int{}}
+			groups = append(groups, m[r])
+		}
+		m[r].assetIds = append(m[r].assetIds, a.Id)
+	}
+	groups = append(groups, def)
+
+	return
+}
+
+func purgeReplays(db *gorm.DB, before time.Time) {
+	cnt := 0
+	for {
+		sessions := make([]*model.Session, 0)
+		if err := db.Session(&gorm.Session{}).
+			Where("status = ?", model.SESSIONSTATUS_OFFLINE).
+			Where("replay_deleted = ?", false).
+			Where("created_at < ?", before).
+			Limit(purgeBatchSize).
+			Find(&sessions).
+			Error; err != nil {
+			logger.L().Warn("get sessions to purge replay failed", zap.Error(err))
+			return
+		}
+		if len(sessions) <= 0 {
+			break
+		}
+		ids := removeReplays(sessions)
+		if err := mysql.DB.
+			Model(&model.Session{}).
+			Where("session_id IN ?", ids).
+			Update("replay_deleted", true).
+			Error; err != nil {
+			logger.L().Warn("mark replay deleted failed", zap.Error(err))
+			return
+		}
+		cnt += len(ids)
+		if len(ids) < len(sessions) {
+			break
+		}
+	}
+	if cnt > 0 {
+		logger.L().Info("purged replays", zap.Int("count", cnt), zap.Time("before", before))
+	}
+}
+
+func purgeSessions(db *gorm.DB, before time.Time) {
+	cnt, cmdCnt := int64(0), int64(0)
+	for {
+		sessions := make([]*model.Session, 0)
+		if err := db.Session(&gorm.Session{}).
+			Where("status = ?", model.SESSIONSTATUS_OFFLINE).
+			Where("created_at < ?", before).
+			Limit(purgeBatchSize).
+			Find(&sessions).
+			Error; err != nil {
+			logger.L().Warn("get sessions to purge failed", zap.Error(err))
+			return
+		}
+		if len(sessions) <= 0 {
+			break
+		}
+		// sessions whose recording fails to be removed are kept for the next round
+		ids := removeReplays(lo.Filter(sessions, func(s *model.Session, _ int) bool { return !s.ReplayDeleted }))
+		for _, s := range sessions {
+			if s.ReplayDeleted {
+				ids = append(ids, s.SessionId)
+			}
+		}
+		if err := mysql.DB.Transaction(func(tx *gorm.DB) error {
+			res := tx.Where("session_id IN ?", ids).Delete(&model.SessionCmd{})
+			if res.Error != nil {
+				return res.Error
+			}
+			cmdCnt += res.RowsAffected
+			res = tx.Where("session_id IN ?", ids).Delete(&model.Session{})
+			cnt += res.RowsAffected
+			return res.Error
+		}); err != nil {
+			logger.L().Warn("purge sessions failed", zap.Error(err))
+			return
+		}
+		if len(ids) < len(sessions) {
+			break
+		}
+	}
+	if cnt > 0 {
+		logger.L().Info("purged sessions", zap.Int64("count", cnt), zap.Int64("cmdCount", cmdCnt), zap.Time("before", before))
+	}
+}
+
+func purgeRows(db *gorm.DB, m any, before time.Time) {
+	res := db.Where("created_at < ?", before).Delete(m)
+	if res.Error != nil {
+		logger.L().Warn("purge rows failed", zap.String("table", fmt.Sprintf("%T", m)), zap.Error(res.Error))
+		return
+	}
+	if res.RowsAffected > 0 {
+		logger.L().Info("purged rows", zap.String("table", fmt.Sprintf("%T", m)), zap.Int64("count", res.RowsAffected), zap.Time("before", before))
+	}
+}
+
+// removeReplays removes recordings of sessions and returns ids of those removed
+func removeReplays(sessions []*model.Session) (ids []string) {
+	for _, s := range sessions {
+		name := s.ReplayName()
+		if err := replay.Remove(ctx, name); err != nil {
+			logger.L().Warn("remove replay failed", zap.String("name", name), zap.Error(err))
+			continue
+		}
+		ids = append(ids, s.SessionId)
+	}
+	return
+}
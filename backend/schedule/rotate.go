@@ -0,0 +1,341 @@
+package schedule
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	redis "github.com/veops/oneterm/cache"
+	mysql "github.com/veops/oneterm/db"
+	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/hostkey"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/util"
+)
+
+const (
+	rotateInterval   = time.Minute * 10
+	rotateLockTTL    = time.Minute * 10
+	rotateLockKeyFmt = "oneterm:rotate:%d"
+	// rotateFailuresKey keeps failures of scheduled rotations by account id, failed accounts are retried with backoff
+	// and are not rotated by schedule after rotateMaxFailures until they are rotated manually
+	rotateFailuresKey = "oneterm:rotate:failures"
+	rotateMaxFailures = 5
+	rotateMaxBackoff  = time.Hour * 24
+
+	passwordLength = 24
+	passwordLower  = "abcdefghijkmnopqrstuvwxyz"
+	passwordUpper  = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	passwordDigit  = "23456789"
+	passwordSymbol = "!@#%^*-_=+"
+)
+
+var (
+	ErrRotating   = errors.New("password of the account is being rotated")
+	ErrNotManaged = errors.New("only managed password accounts without secret path can be rotated")
+)
+
+// RotateResult is the result of changing the password on one asset
+type RotateResult struct {
+	AssetId   int    `json:"asset_id"`
+	AssetName string `json:"asset_name"`
+	Ok        bool   `json:"ok"`
+	Err       string `json:"err,omitempty"`
+}
+
+// RotateRecord is the result of one rotation, it is saved as history of the account
+type RotateRecord struct {
+	Ok      bool            `json:"ok"`
+	Err     string          `json:"err,omitempty"`
+	Results []*RotateResult `json:"results"`
+}
+
+type rotateFailure struct {
+	Count  int       `json:"count"`
+	NextAt time.Time `json:"next_at"`
+}
+
+// RunRotate rotates passwords of managed accounts once their rotate days are passed
+func RunRotate() (err error) {
+	tk := time.NewTicker(rotateInterval)
+	for {
+		select {
+		case <-tk.C:
+			RotateDue()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func StopRotate() {
+	defer cancel()
+}
+
+func RotateDue() {
+	accounts := make([]*model.Account, 0)
+	if err := mysql.DB.
+		Model(accounts).
+		Where("managed = ? AND rotate_days > 0", true).
+		Find(&accounts).
+		Error; err != nil {
+		logger.L().Debug("get accounts to rotate failed", zap.Error(err))
+		return
+	}
+	failures, err := redis.RC.HGetAll(ctx, rotateFailuresKey).Result()
+	if err != nil {
+		logger.L().Debug("get rotate failures failed", zap.Error(err))
+		return
+	}
+	now := time.Now()
+	for _, a := range accounts {
+		if a.RotatedAt != nil && a.RotatedAt.AddDate(0, 0, a.RotateDays).After(now) {
+			continue
+		}
+		f := &rotateFailure{}
+		if v, ok := failures[cast.ToString(a.Id)]; ok && json.Unmarshal([]byte(v), f) == nil &&
+			(f.Count >= rotateMaxFailures || now.Before(f.NextAt)) {
+			continue
+		}
+		record, err := Rotate(ctx, a.Id, 0, "")
+		if errors.Is(err, ErrRotating) || (err == nil && record.Ok) {
+			continue
+		}
+		logger.L().Warn("rotate password failed", zap.Int("accountId", a.Id), zap.Any("record", record), zap.Error(err))
+		f.Count++
+		f.NextAt = now.Add(min(rotateInterval<<f.Count, rotateMaxBackoff))
+		if f.Count >= rotateMaxFailures {
+			logger.L().Error("stop rotating password of account until it is rotated manually", zap.Int("accountId", a.Id), zap.Int("failures", f.Count))
+		}
+		bs, _ := json.Marshal(f)
+		redis.RC.HSet(ctx, rotateFailuresKey, a.Id, bs)
+	}
+}
+
+// Rotate changes the password of the account on all its authorized assets and verifies it by logging in again,
+// the new password is saved only if every asset succeeds, otherwise assets already changed are rolled back
+func Rotate(ctx context.Context, accountId int, creatorId int, remoteIp string) (record *RotateRecord, err error) {
+	key := fmt.Sprintf(rotateLockKeyFmt, accountId)
+	ok, err := redis.RC.SetNX(ctx, key, time.Now().Unix(), rotateLockTTL).Result()
+	if err != nil {
+		return
+	}
+	if !ok {
+		return nil, ErrRotating
+	}
+	defer redis.RC.Del(context.Background(), key)
+
+	account := &model.Account{}
+	if err = mysql.DB.Model(account).Where("id = ?", accountId).First(account).Error; err != nil {
+		return
+	}
+	if !account.Managed || account.AccountType != model.AUTHMETHOD_PASSWORD || account.SecretPath != "" {
+		return nil, ErrNotManaged
+	}
+	account.Password = util.DecryptAES(account.Password)
+
+	record = &RotateRecord{Results: make([]*RotateResult, 0)}
+	defer func() {
+		record.Ok = err == nil
+		if err != nil {
+			record.Err = err.Error()
+		} else {
+			redis.RC.HDel(context.Background(), rotateFailuresKey, cast.ToString(account.Id))
+		}
+		if e := mysql.DB.Create(&model.History{
+			RemoteIp:   remoteIp,
+			Type:       account.TableName(),
+			TargetId:   account.Id,
+			ActionType: model.ACTION_ROTATE,
+			New:        map[string]any{"ok": record.Ok, "err": record.Err, "results": record.Results},
+			CreatorId:  creatorId,
+			CreatedAt:  time.Now(),
+		}).Error; e != nil {
+			logger.L().Error("record rotation failed", zap.Int("accountId", account.Id), zap.Error(e))
+		}
+		// errors of assets are in the record
+		err = nil
+	}()
+
+	assets, gateways, err := getRotateAssets(ctx, account.Id)
+	if err != nil {
+		return
+	}
+	if len(assets) <= 0 {
+		err = errors.New("no ssh asset is authorized with the account")
+		return
+	}
+	password, err := genPassword()
+	if err != nil {
+		return
+	}
+
+	change := func(asset *model.Asset, from, to string) error {
+		return changePassword(asset, gateways[asset.GatewayId], account.Account, from, to)
+	}
+	err = changeAll(record, assets, change, account.Password, password, func() error {
+		now := time.Now()
+		return mysql.DB.
+			Model(account).
+			Where("id = ?", account.Id).
+			UpdateColumns(map[string]any{"password": util.EncryptAES(password), "rotated_at": &now}).
+			Error
+	})
+
+	return
+}
+
+// changeAll changes the password on assets in order and saves the new one once all of them succeed.
+// Assets already changed are changed back to the old password if an asset or save fails, results of assets are added to record
+func changeAll(record *RotateRecord, assets []*model.Asset, change func(asset *model.Asset, from, to string) error,
+	oldPassword, newPassword string, save func() error) (err error) {
+	results := make([]*RotateResult, 0, len(assets))
+	defer func() {
+		record.Results = append(record.Results, results...)
+		if err == nil {
+			return
+		}
+		for i, res := range results {
+			if !res.Ok {
+				continue
+			}
+			if e := change(assets[i], newPassword, oldPassword); e != nil {
+				logger.L().Error("roll back password failed", zap.Int("assetId", res.AssetId), zap.Error(e))
+				res.Err = fmt.Sprintf("roll back failed: %s", e)
+				continue
+			}
+			res.Ok, res.Err = false, "rolled back"
+		}
+	}()
+
+	for _, asset := range assets {
+		res := &RotateResult{AssetId: asset.Id, AssetName: asset.Name}
+		results = append(results, res)
+		if err = change(asset, oldPassword, newPassword); err != nil {
+			res.Err = err.Error()
+			err = fmt.Errorf("change password on asset %s failed", asset.Name)
+			return
+		}
+		res.Ok = true
+	}
+
+	return save()
+}
+
+// getRotateAssets returns the ssh assets authorized with the account and their gateways
+func getRotateAssets(ctx context.Context, accountId int) (assets []*model.Asset, gateways map[int]*model.Gateway, err error) {
+	assets = make([]*model.Asset, 0)
+	if err = mysql.DB.
+		Model(assets).
+		Where("id IN (?)", mysql.DB.Model(&model.Authorization{}).Select("asset_id").Where("account_id = ?", accountId)).
+		Find(&assets).
+		Error; err != nil {
+		return
+	}
+	// passwords are changed over ssh, the account may be used on assets of other protocols as well
+	assets = lo.Filter(assets, func(a *model.Asset, _ int) bool { return util.GetPort("ssh", a) != 0 })
+	gateways = make(map[int]*model.Gateway)
+	for _, gid := range lo.Without(lo.Uniq(lo.Map(assets, func(a *model.Asset, _ int) int { return a.GatewayId })), 0) {
+		if gateways[gid], err = util.GetGateway(ctx, gid); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// changePassword sets password of user from oldPassword to newPassword by chpasswd, it is run by sudo if user is not root.
+// The old password is sent to sudo only if sudo asks for one.
+// The new password is verified by logging in with it
+func changePassword(asset *model.Asset, gateway *model.Gateway, user, oldPassword, newPassword string) (err error) {
+	sid := uuid.New().String()
+	defer ggateway.GetGatewayManager().Close(sid)
+	cli, err := dialPassword(sid, asset, gateway, user, oldPassword)
+	if err != nil {
+		return
+	}
+	defer cli.Close()
+	cmd, stdin := "chpasswd", fmt.Sprintf("%s:%s\n", user, newPassword)
+	if user != "root" {
+		cmd = "sudo -n chpasswd"
+		// sudo -n fails instead of prompting if a password is required
+		if _, err = run(cli, "sudo -n true", ""); err != nil {
+			cmd, stdin = "sudo -S -p '' chpasswd", fmt.Sprintf("%s\n%s", oldPassword, stdin)
+		}
+	}
+	if out, err := run(cli, cmd, stdin); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	verify, err := dialPassword(sid, asset, gateway, user, newPassword)
+	if err != nil {
+		return fmt.Errorf("verify new password failed: %w", err)
+	}
+	verify.Close()
+
+	return
+}
+
+func run(cli *ssh.Client, cmd, stdin string) (out []byte, err error) {
+	sess, err := cli.NewSession()
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	sess.Stdin = strings.NewReader(stdin)
+	return sess.CombinedOutput(cmd)
+}
+
+func dialPassword(sid string, asset *model.Asset, gateway *model.Gateway, user, password string) (*ssh.Client, error) {
+	auth, err := util.GetAuth(&model.Account{AccountType: model.AUTHMETHOD_PASSWORD, Account: user, Password: password}, "")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := util.Proxy(context.Background(), sid, "ssh", asset, gateway)
+	if err != nil {
+		return nil, err
+	}
+	return ggateway.NewClient(conn, hostkey.Config(&ssh.ClientConfig{
+		User:    user,
+		Auth:    []ssh.AuthMethod{auth},
+		Timeout: time.Second * 3,
+	}, asset.Id, 0, util.GetPort("ssh", asset)))
+}
+
+// genPassword generates a random password containing lower, upper, digit and symbol characters
+func genPassword() (string, error) {
+	sets := []string{passwordLower, passwordUpper, passwordDigit, passwordSymbol}
+	all := strings.Join(sets, "")
+	bs := make([]byte, passwordLength)
+	for i := range bs {
+		set := all
+		if i < len(sets) {
+			set = sets[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+		if err != nil {
+			return "", err
+		}
+		bs[i] = set[n.Int64()]
+	}
+	for i := len(bs) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		bs[i], bs[j] = bs[j], bs[i]
+	}
+	return string(bs), nil
+}
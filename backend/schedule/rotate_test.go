@@ -0,0 +1,117 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/veops/oneterm/model"
+)
+
+func TestGenPassword(t *testing.T) {
+	all := passwordLower + passwordUpper + passwordDigit + passwordSymbol
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		p, err := genPassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) != passwordLength {
+			t.Fatalf("length of %q = %d, want %d", p, len(p), passwordLength)
+		}
+		for _, set := range []string{passwordLower, passwordUpper, passwordDigit, passwordSymbol} {
+			if !strings.ContainsAny(p, set) {
+				t.Fatalf("%q has none of %q", p, set)
+			}
+		}
+		if strings.Trim(p, all) != "" {
+			t.Fatalf("%q has characters out of %q", p, all)
+		}
+		if seen[p] {
+			t.Fatalf("%q is generated twice", p)
+		}
+		seen[p] = true
+	}
+}
+
+func TestChangeAll(t *testing.T) {
+	assets := []*model.Asset{{Id: 1, Name: "a"}, {Id: 2, Name: "b"}, {Id: 3, Name: "c"}}
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name string
+		// fail is the change failing as asset id and the password it changes to
+		fail    string
+		saveErr error
+		calls   []string
+		results []RotateResult
+		wantErr bool
+	}{
+		{
+			name:    "all changed",
+			calls:   []string{"1:new", "2:new", "3:new"},
+			results: []RotateResult{{AssetId: 1, AssetName: "a", Ok: true}, {AssetId: 2, AssetName: "b", Ok: true}, {AssetId: 3, AssetName: "c", Ok: true}},
+		},
+		{
+			name:  "rolled back",
+			fail:  "2:new",
+			calls: []string{"1:new", "2:new", "1:old"},
+			results: []RotateResult{{AssetId: 1, AssetName: "a", Err: "rolled back"},
+				{AssetId: 2, AssetName: "b", Err: "failed"}},
+			wantErr: true,
+		},
+		{
+			name:    "rolled back after save failed",
+			saveErr: errFailed,
+			calls:   []string{"1:new", "2:new", "3:new", "1:old", "2:old", "3:old"},
+			results: []RotateResult{{AssetId: 1, AssetName: "a", Err: "rolled back"}, {AssetId: 2, AssetName: "b", Err: "rolled back"},
+				{AssetId: 3, AssetName: "c", Err: "rolled back"}},
+			wantErr: true,
+		},
+		{
+			name:  "roll back failed",
+			fail:  "1:old",
+			calls: []string{"1:new", "2:new", "3:new", "1:old", "2:old", "3:old"},
+			results: []RotateResult{{AssetId: 1, AssetName: "a", Ok: true, Err: "roll back failed: failed"},
+				{AssetId: 2, AssetName: "b", Err: "rolled back"}, {AssetId: 3, AssetName: "c", Err: "rolled back"}},
+			saveErr: errFailed,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			change := func(asset *model.Asset, from, to string) error {
+				call := fmt.Sprintf("%d:%s", asset.Id, to)
+				calls = append(calls, call)
+				if call == tt.fail {
+					return errFailed
+				}
+				return nil
+			}
+			saved := false
+			record := &RotateRecord{}
+			err := changeAll(record, assets, change, "old", "new", func() error {
+				saved = true
+				return tt.saveErr
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("changeAll() error = %v", err)
+			}
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("changes = %q, want %q", calls, tt.calls)
+			}
+			if want := tt.fail != "2:new"; saved != want {
+				t.Errorf("saved = %v, want %v", saved, want)
+			}
+			var results []RotateResult
+			for _, res := range record.Results {
+				results = append(results, *res)
+			}
+			if !reflect.DeepEqual(results, tt.results) {
+				t.Errorf("results = %+v, want %+v", results, tt.results)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package secret
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store reads secrets by path, a secret is a set of key values such as password, pk and phrase
+type Store interface {
+	Get(ctx context.Context, path string) (map[string]string, error)
+}
+
+type cacheItem struct {
+	data     map[string]string
+	expireAt time.Time
+}
+
+// Cache keeps secrets read from the underlying store for a short time
+type Cache struct {
+	store Store
+	ttl   time.Duration
+	items map[string]*cacheItem
+	mtx   sync.Mutex
+}
+
+func NewCache(store Store, ttl time.Duration) *Cache {
+	return &Cache{
+		store: store,
+		ttl:   ttl,
+		items: map[string]*cacheItem{},
+	}
+}
+
+func (c *Cache) Get(ctx context.Context, path string) (data map[string]string, err error) {
+	now := time.Now()
+	c.mtx.Lock()
+	item, ok := c.items[path]
+	for k, v := range c.items {
+		if now.After(v.expireAt) {
+			delete(c.items, k)
+		}
+	}
+	c.mtx.Unlock()
+	if ok && now.Before(item.expireAt) {
+		return item.data, nil
+	}
+
+	if data, err = c.store.Get(ctx, path); err != nil {
+		return
+	}
+	c.mtx.Lock()
+	c.items[path] = &cacheItem{data: data, expireAt: now.Add(c.ttl)}
+	c.mtx.Unlock()
+	return
+}
+
+// Invalidate drops the cached secret, e.g. after it is rotated
+func (c *Cache) Invalidate(path string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.items, path)
+}
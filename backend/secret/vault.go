@@ -0,0 +1,97 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type VaultOptions struct {
+	Addr      string
+	Token     string
+	Mount     string
+	Namespace string
+	Timeout   time.Duration
+}
+
+// Vault reads secrets from a hashicorp vault kv v2 compatible http api
+//
+//	https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2#read-secret-version
+type Vault struct {
+	opts VaultOptions
+	cli  *http.Client
+}
+
+func NewVault(opts VaultOptions) (*Vault, error) {
+	if opts.Addr == "" {
+		return nil, fmt.Errorf("vault addr is required")
+	}
+	if _, err := url.Parse(opts.Addr); err != nil {
+		return nil, err
+	}
+	if opts.Mount == "" {
+		opts.Mount = "secret"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second * 5
+	}
+	return &Vault{
+		opts: opts,
+		cli:  &http.Client{Timeout: opts.Timeout},
+	}, nil
+}
+
+func (v *Vault) Get(ctx context.Context, path string) (data map[string]string, err error) {
+	u := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimRight(v.opts.Addr, "/"), strings.Trim(v.opts.Mount, "/"), strings.Trim(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Vault-Token", v.opts.Token)
+	if v.opts.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.opts.Namespace)
+	}
+
+	resp, err := v.cli.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("secret %s not found", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		res := &struct {
+			Errors []string `json:"errors"`
+		}{}
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(bs, res)
+		return nil, fmt.Errorf("read secret %s failed: %s %s", path, resp.Status, strings.Join(res.Errors, "; "))
+	}
+
+	res := &struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return
+	}
+	if res.Data.Data == nil {
+		return nil, fmt.Errorf("secret %s is deleted", path)
+	}
+	data = make(map[string]string, len(res.Data.Data))
+	for k, v := range res.Data.Data {
+		if s, ok := v.(string); ok {
+			data[k] = s
+		} else {
+			data[k] = fmt.Sprint(v)
+		}
+	}
+	return
+}
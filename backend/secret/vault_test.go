@@ -0,0 +1,93 @@
+package secret
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStub(t *testing.T, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/data/oneterm/root":
+			w.Write([]byte(`{"data":{"data":{"password":"secret","port":22},"metadata":{"version":3}}}`))
+		case "/v1/kv/data/oneterm/deleted":
+			w.Write([]byte(`{"data":{"data":null,"metadata":{"version":1}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestVaultGet(t *testing.T) {
+	hits := int32(0)
+	srv := newStub(t, &hits)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		path    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "ok", token: "token", path: "oneterm/root", want: map[string]string{"password": "secret", "port": "22"}},
+		{name: "not found", token: "token", path: "oneterm/none", wantErr: true},
+		{name: "deleted", token: "token", path: "oneterm/deleted", wantErr: true},
+		{name: "denied", token: "bad", path: "oneterm/root", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewVault(VaultOptions{Addr: srv.URL, Token: tt.token, Mount: "kv"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := v.Get(context.Background(), tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("Get()[%s] = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	hits := int32(0)
+	srv := newStub(t, &hits)
+	defer srv.Close()
+
+	v, _ := NewVault(VaultOptions{Addr: srv.URL, Token: "token", Mount: "kv"})
+	c := NewCache(v, time.Millisecond*50)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(context.Background(), "oneterm/root"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("hits = %d, want 1", hits)
+	}
+	time.Sleep(time.Millisecond * 60)
+	c.Get(context.Background(), "oneterm/root")
+	if hits != 2 {
+		t.Errorf("hits after expired = %d, want 2", hits)
+	}
+	c.Get(context.Background(), "oneterm/none")
+	c.Get(context.Background(), "oneterm/none")
+	if hits != 4 {
+		t.Errorf("errors should not be cached, hits = %d, want 4", hits)
+	}
+}
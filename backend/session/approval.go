@@ -0,0 +1,184 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	redis "github.com/veops/oneterm/cache"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+const (
+	// approvalsKey keeps pending approvals of all nodes, an approval is resolved by whom deletes it
+	approvalsKey = "oneterm:approvals"
+	// approvalChannel tells all nodes new and resolved approvals
+	approvalChannel = "oneterm:approval"
+	// approvalGrace is how long an approval is kept after it expires, it is dropped if its node is gone by then
+	approvalGrace = time.Minute
+)
+
+var (
+	// approvals are pending approvals of sessions on this node
+	approvals        = &sync.Map{}
+	approvalWatchers = &sync.Map{}
+)
+
+type approvalItem struct {
+	sess  *Session
+	timer *time.Timer
+}
+
+type approvalWatcher struct {
+	ws  *websocket.Conn
+	mtx sync.Mutex
+}
+
+func (w *approvalWatcher) send(as ...*model.Approval) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, a := range as {
+		w.ws.WriteJSON(a)
+	}
+}
+
+// NewApproval holds cmd of sess until an admin on any node resolves it or timeout passes
+func NewApproval(sess *Session, cmd string, command *model.Command, timeout time.Duration) *model.Approval {
+	now := time.Now()
+	a := &model.Approval{
+		Id:          uuid.New().String(),
+		SessionId:   sess.SessionId,
+		Uid:         sess.Uid,
+		UserName:    sess.UserName,
+		AssetInfo:   sess.AssetInfo,
+		AccountInfo: sess.AccountInfo,
+		Cmd:         cmd,
+		CommandId:   command.Id,
+		CommandName: command.Name,
+		Status:      model.APPROVALSTATUS_PENDING,
+		CreatedAt:   now,
+		ExpiredAt:   now.Add(timeout),
+	}
+	approvals.Store(a.Id, &approvalItem{
+		sess: sess,
+		timer: time.AfterFunc(timeout, func() {
+			ResolveApproval(a.Id, model.APPROVALSTATUS_EXPIRED, "")
+		}),
+	})
+
+	ctx := context.Background()
+	bs, _ := json.Marshal(a)
+	if err := redis.RC.HSet(ctx, approvalsKey, a.Id, bs).Err(); err != nil {
+		logger.L().Error("save approval failed", zap.String("id", a.Id), zap.Error(err))
+	}
+	publishApproval(ctx, a)
+
+	return a
+}
+
+func GetApprovalById(id string) *model.Approval {
+	bs, err := redis.RC.HGet(context.Background(), approvalsKey, id).Bytes()
+	if err != nil {
+		return nil
+	}
+	a := &model.Approval{}
+	if json.Unmarshal(bs, a) != nil {
+		return nil
+	}
+	return a
+}
+
+// GetPendingApprovals returns pending approvals of all nodes, those left by dead nodes are dropped
+func GetPendingApprovals() (res []*model.Approval) {
+	res = make([]*model.Approval, 0)
+	ctx := context.Background()
+	m, err := redis.RC.HGetAll(ctx, approvalsKey).Result()
+	if err != nil {
+		logger.L().Error("get approvals failed", zap.Error(err))
+		return
+	}
+	for id, v := range m {
+		a := &model.Approval{}
+		if json.Unmarshal([]byte(v), a) != nil || time.Since(a.ExpiredAt) > approvalGrace {
+			redis.RC.HDel(ctx, approvalsKey, id)
+			continue
+		}
+		res = append(res, a)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return
+}
+
+// ResolveApproval ends a pending approval of any node, only the first call takes effect.
+// The result is delivered to its session by the node serving it
+func ResolveApproval(id string, status int, approver string) (res *model.Approval, ok bool) {
+	ctx := context.Background()
+	bs, err := redis.RC.HGet(ctx, approvalsKey, id).Bytes()
+	if err != nil {
+		return
+	}
+	if n, err := redis.RC.HDel(ctx, approvalsKey, id).Result(); err != nil || n <= 0 {
+		return
+	}
+	res = &model.Approval{}
+	if err = json.Unmarshal(bs, res); err != nil {
+		return nil, false
+	}
+	res.Status, res.Approver = status, approver
+	publishApproval(ctx, res)
+
+	return res, true
+}
+
+// WatchApprovals pushes all pending and later changed approvals to ws
+func WatchApprovals(key string, ws *websocket.Conn) {
+	w := &approvalWatcher{ws: ws}
+	approvalWatchers.Store(key, w)
+	w.send(GetPendingApprovals()...)
+}
+
+func UnwatchApprovals(key string) {
+	approvalWatchers.Delete(key)
+}
+
+func publishApproval(ctx context.Context, a *model.Approval) {
+	bs, _ := json.Marshal(a)
+	if _, err := publish(ctx, approvalChannel, &clusterMsg{Type: clusterMsgApproval, Data: bs}); err != nil {
+		logger.L().Error("publish approval failed", zap.String("id", a.Id), zap.Error(err))
+	}
+}
+
+// handleApproval notifies watchers of this node and delivers resolved approvals to sessions of this node
+func handleApproval(msg *clusterMsg) {
+	a := &model.Approval{}
+	if err := json.Unmarshal(msg.Data, a); err != nil {
+		logger.L().Warn("invalid approval", zap.ByteString("data", msg.Data), zap.Error(err))
+		return
+	}
+	approvalWatchers.Range(func(key, value any) bool {
+		value.(*approvalWatcher).send(a)
+		return true
+	})
+	if a.Status == model.APPROVALSTATUS_PENDING {
+		return
+	}
+	v, ok := approvals.LoadAndDelete(a.Id)
+	if !ok {
+		return
+	}
+	item := v.(*approvalItem)
+	item.timer.Stop()
+	go func() {
+		select {
+		case item.sess.Chans.ApprovalChan <- a:
+		case <-item.sess.Gctx.Done():
+		}
+	}()
+}
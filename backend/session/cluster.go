@@ -0,0 +1,346 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	goredis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	redis "github.com/veops/oneterm/cache"
+	mysql "github.com/veops/oneterm/db"
+	myi18n "github.com/veops/oneterm/i18n"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+const (
+	nodeTTL           = time.Second * 30
+	heartbeatInterval = time.Second * 10
+	reapInterval      = time.Minute
+
+	nodeKeyFmt        = "oneterm:node:%s"
+	nodeChannelFmt    = "oneterm:node:%s:msg"
+	monitorChannelFmt = "oneterm:monitor:%s"
+	sessionOwnerKey   = "oneterm:session:owner"
+)
+
+const (
+	clusterMsgClose = iota + 1
+	clusterMsgMonitor
+	clusterMsgUnmonitor
+	clusterMsgOutput
+	clusterMsgEnd
+	clusterMsgApproval
+)
+
+var (
+	// NodeId identifies this replica, sessions served here are owned by it
+	NodeId = newNodeId()
+)
+
+type sessionOwner struct {
+	NodeId       string `json:"node_id"`
+	Protocol     string `json:"protocol"`
+	ConnectionId string `json:"connection_id"`
+}
+
+type clusterMsg struct {
+	Type      int    `json:"type"`
+	SessionId string `json:"session_id"`
+	Key       string `json:"key,omitempty"`
+	Closer    string `json:"closer,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+}
+
+func newNodeId() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%s", host, uuid.New().String()[:8])
+}
+
+// startNode registers this node, keeps its heartbeat and serves messages sent to it by other nodes and approvals of all nodes
+func startNode(ctx context.Context) (err error) {
+	if err = heartbeat(ctx); err != nil {
+		return
+	}
+	sub := redis.RC.Subscribe(ctx, fmt.Sprintf(nodeChannelFmt, NodeId), approvalChannel)
+	if _, err = sub.Receive(ctx); err != nil {
+		return
+	}
+
+	go func() {
+		defer sub.Close()
+		tk, tkReap := time.NewTicker(heartbeatInterval), time.NewTicker(reapInterval)
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tk.C:
+				if err := heartbeat(ctx); err != nil {
+					logger.L().Error("node heartbeat failed", zap.String("node", NodeId), zap.Error(err))
+				}
+			case <-tkReap.C:
+				reapSessions(ctx)
+			case m := <-ch:
+				msg := &clusterMsg{}
+				if err := json.Unmarshal([]byte(m.Payload), msg); err != nil {
+					logger.L().Warn("invalid cluster message", zap.String("payload", m.Payload), zap.Error(err))
+					continue
+				}
+				handleClusterMsg(msg)
+			}
+		}
+	}()
+
+	return
+}
+
+func heartbeat(ctx context.Context) error {
+	return redis.RC.SetEx(ctx, fmt.Sprintf(nodeKeyFmt, NodeId), time.Now().Unix(), nodeTTL).Err()
+}
+
+func nodeAlive(ctx context.Context, nodeId string) bool {
+	n, err := redis.RC.Exists(ctx, fmt.Sprintf(nodeKeyFmt, nodeId)).Result()
+	return err != nil || n > 0
+}
+
+// reapSessions marks online sessions whose owner is gone as offline.
+// Owners are read after sessions since sessions are registered before they are saved online
+func reapSessions(ctx context.Context) {
+	sessions := make([]*Session, 0)
+	if err := mysql.DB.
+		Model(sessions).
+		Where("status = ?", model.SESSIONSTATUS_ONLINE).
+		Find(&sessions).
+		Error; err != nil {
+		logger.L().Error("get sessions failed", zap.Error(err))
+		return
+	}
+	owners, err := redis.RC.HGetAll(ctx, sessionOwnerKey).Result()
+	if err != nil {
+		logger.L().Error("get session owners failed", zap.Error(err))
+		return
+	}
+	alive := map[string]bool{NodeId: true}
+	isAlive := func(sessionId string) bool {
+		o := &sessionOwner{}
+		if json.Unmarshal([]byte(owners[sessionId]), o) != nil {
+			return false
+		}
+		if _, ok := alive[o.NodeId]; !ok {
+			alive[o.NodeId] = nodeAlive(ctx, o.NodeId)
+		}
+		return alive[o.NodeId]
+	}
+
+	now := time.Now()
+	for _, s := range sessions {
+		if isAlive(s.SessionId) {
+			continue
+		}
+		logger.L().Info("reap session of dead node", zap.String("sessionId", s.SessionId))
+		s.Status = model.SESSIONSTATUS_OFFLINE
+		s.ClosedAt = &now
+		UpsertSession(s)
+	}
+	for id := range owners {
+		if !isAlive(id) {
+			redis.RC.HDel(ctx, sessionOwnerKey, id)
+		}
+	}
+}
+
+func handleClusterMsg(msg *clusterMsg) {
+	sess := GetOnlineSessionById(msg.SessionId)
+	switch msg.Type {
+	case clusterMsgClose:
+		if sess != nil {
+			go OfflineSession(msg.SessionId, msg.Closer, sess.Localizer)
+		}
+	case clusterMsgMonitor:
+		if sess != nil {
+			sess.RemoteMonitors.Store(msg.Key, struct{}{})
+		}
+	case clusterMsgUnmonitor:
+		if sess != nil {
+			sess.RemoteMonitors.Delete(msg.Key)
+		}
+	case clusterMsgApproval:
+		handleApproval(msg)
+	}
+}
+
+func publish(ctx context.Context, channel string, msg *clusterMsg) (n int64, err error) {
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	return redis.RC.Publish(ctx, channel, bs).Result()
+}
+
+func getSessionOwner(ctx context.Context, sessionId string) (o *sessionOwner, err error) {
+	bs, err := redis.RC.HGet(ctx, sessionOwnerKey, sessionId).Bytes()
+	if err != nil {
+		return
+	}
+	o = &sessionOwner{}
+	err = json.Unmarshal(bs, o)
+	return
+}
+
+// RegisterSession makes the session visible to all nodes with this node as its owner
+func RegisterSession(sess *Session) {
+	onlineSession.Store(sess.SessionId, sess)
+	bs, _ := json.Marshal(&sessionOwner{
+		NodeId:       NodeId,
+		Protocol:     sess.Protocol,
+		ConnectionId: sess.ConnectionId,
+	})
+	if err := redis.RC.HSet(context.Background(), sessionOwnerKey, sess.SessionId, bs).Err(); err != nil {
+		logger.L().Error("register session failed", zap.String("sessionId", sess.SessionId), zap.Error(err))
+	}
+}
+
+// UnregisterSession removes the session from the registry and ends its monitors on other nodes
+func UnregisterSession(sessionId string) {
+	ctx := context.Background()
+	onlineSession.Delete(sessionId)
+	if err := redis.RC.HDel(ctx, sessionOwnerKey, sessionId).Err(); err != nil {
+		logger.L().Error("unregister session failed", zap.String("sessionId", sessionId), zap.Error(err))
+	}
+	publish(ctx, fmt.Sprintf(monitorChannelFmt, sessionId), &clusterMsg{Type: clusterMsgEnd, SessionId: sessionId})
+}
+
+// RelayToMonitors publishes the output of the session to monitors on other nodes
+func RelayToMonitors(sess *Session, out []byte) {
+	if len(out) <= 0 || !sess.HasRemoteMonitors() {
+		return
+	}
+	n, err := publish(context.Background(), fmt.Sprintf(monitorChannelFmt, sess.SessionId), &clusterMsg{Type: clusterMsgOutput, SessionId: sess.SessionId, Data: out})
+	if err == nil && n <= 0 {
+		sess.RemoteMonitors.Range(func(key, value any) bool {
+			sess.RemoteMonitors.Delete(key)
+			return true
+		})
+	}
+}
+
+// OfflineSession closes the session and ends its monitors, sessions owned by other nodes are closed by their owners
+func OfflineSession(sessionId string, closer string, localizer *i18n.Localizer) {
+	session := GetOnlineSessionById(sessionId)
+	if session == nil {
+		o, err := getSessionOwner(context.Background(), sessionId)
+		if err != nil || o.NodeId == NodeId {
+			return
+		}
+		publish(context.Background(), fmt.Sprintf(nodeChannelFmt, o.NodeId), &clusterMsg{Type: clusterMsgClose, SessionId: sessionId, Closer: closer})
+		return
+	}
+	defer UnregisterSession(sessionId)
+	if closer != "" && session.Chans != nil {
+		select {
+		case session.Chans.CloseChan <- closer:
+			break
+		case <-time.After(time.Second):
+			break
+		}
+	}
+	if localizer == nil {
+		localizer = i18n.NewLocalizer(myi18n.Bundle)
+	}
+	cfg := &i18n.LocalizeConfig{
+		TemplateData:   map[string]any{"sessionId": sessionId},
+		DefaultMessage: myi18n.MsgSessionEnd,
+	}
+	msg, _ := localizer.Localize(cfg)
+	session.Monitors.Range(func(key, value any) bool {
+		ws, ok := value.(*websocket.Conn)
+		if ok && ws != nil {
+			ws.WriteMessage(websocket.TextMessage, []byte(msg))
+			ws.Close()
+		}
+		return true
+	})
+}
+
+// GetRemoteSession returns a replica of a session owned by another node, nil if it is not online anywhere.
+// Output of the session is written to monitors of the replica and its AwayChan is closed once the session ends or ctx is done
+func GetRemoteSession(ctx context.Context, sessionId string, key string) (sess *Session) {
+	o, err := getSessionOwner(ctx, sessionId)
+	if err != nil {
+		if !errors.Is(err, goredis.Nil) {
+			logger.L().Error("get session owner failed", zap.String("sessionId", sessionId), zap.Error(err))
+		}
+		return
+	}
+	if o.NodeId == NodeId || !nodeAlive(ctx, o.NodeId) {
+		return
+	}
+
+	sub := redis.RC.Subscribe(ctx, fmt.Sprintf(monitorChannelFmt, sessionId))
+	if _, err = sub.Receive(ctx); err != nil {
+		logger.L().Error("subscribe session failed", zap.String("sessionId", sessionId), zap.Error(err))
+		sub.Close()
+		return
+	}
+
+	sess = NewSession(ctx)
+	sess.Session = &model.Session{
+		SessionId: sessionId,
+		Protocol:  o.Protocol,
+		Status:    model.SESSIONSTATUS_ONLINE,
+	}
+	sess.ConnectionId = o.ConnectionId
+
+	nodeChannel := fmt.Sprintf(nodeChannelFmt, o.NodeId)
+	if sess.IsSsh() {
+		publish(ctx, nodeChannel, &clusterMsg{Type: clusterMsgMonitor, SessionId: sessionId, Key: key})
+	}
+
+	go func() {
+		defer close(sess.Chans.AwayChan)
+		defer sub.Close()
+		if sess.IsSsh() {
+			defer publish(context.Background(), nodeChannel, &clusterMsg{Type: clusterMsgUnmonitor, SessionId: sessionId, Key: key})
+		}
+		tk := time.NewTicker(nodeTTL)
+		defer tk.Stop()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tk.C:
+				if o, err := getSessionOwner(ctx, sessionId); errors.Is(err, goredis.Nil) || (err == nil && !nodeAlive(ctx, o.NodeId)) {
+					return
+				}
+			case m := <-ch:
+				msg := &clusterMsg{}
+				if err := json.Unmarshal([]byte(m.Payload), msg); err != nil {
+					continue
+				}
+				switch msg.Type {
+				case clusterMsgOutput:
+					sess.Monitors.Range(func(key, value any) bool {
+						if ws, ok := value.(*websocket.Conn); ok && ws != nil {
+							ws.WriteMessage(websocket.TextMessage, msg.Data)
+						}
+						return true
+					})
+				case clusterMsgEnd:
+					return
+				}
+			}
+		}
+	}()
+
+	return
+}
@@ -0,0 +1,34 @@
+package session
+
+import (
+	"go.uber.org/zap"
+
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+const (
+	cmdQueueSize = 1024
+)
+
+var (
+	cmdQueue = make(chan *model.SessionCmd, cmdQueueSize)
+)
+
+func init() {
+	go saveCmds()
+}
+
+// RecordCmd queues cmd to be saved, terminals are not held by a slow database unless the queue is full
+func RecordCmd(cmd *model.SessionCmd) {
+	cmdQueue <- cmd
+}
+
+func saveCmds() {
+	for cmd := range cmdQueue {
+		if err := mysql.DB.Create(cmd).Error; err != nil {
+			logger.L().Error("record session cmd failed", zap.String("sessionId", cmd.SessionId), zap.Error(err))
+		}
+	}
+}
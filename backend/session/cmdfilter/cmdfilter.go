@@ -0,0 +1,66 @@
+// Package cmdfilter matches command lines and statements of sessions with patterns of commands
+package cmdfilter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/veops/oneterm/model"
+)
+
+type Filter struct {
+	cmds []*model.Command
+	regs [][]*regexp.Regexp
+}
+
+// New compiles patterns of cmds, invalid patterns are skipped and returned as errs
+func New(cmds []*model.Command) (f *Filter, errs []error) {
+	f = &Filter{cmds: cmds}
+	for _, c := range cmds {
+		regs := make([]*regexp.Regexp, 0, len(c.Cmds))
+		for _, s := range c.Cmds {
+			r, err := regexp.Compile(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid pattern %q of command %d: %w", s, c.Id, err))
+				continue
+			}
+			regs = append(regs, r)
+		}
+		f.regs = append(f.regs, regs)
+	}
+	return
+}
+
+// Empty reports whether no command is enabled
+func (f *Filter) Empty() bool {
+	return f == nil || len(f.cmds) <= 0
+}
+
+// Match returns the line hit by enabled commands and the command itself, deny takes precedence over approve
+func (f *Filter) Match(lines ...string) (hit string, cmd *model.Command) {
+	if f == nil {
+		return
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		for i, regs := range f.regs {
+			for _, r := range regs {
+				if !r.MatchString(line) {
+					continue
+				}
+				if f.cmds[i].Action != model.COMMANDACTION_APPROVE {
+					return line, f.cmds[i]
+				}
+				if cmd == nil {
+					hit, cmd = line, f.cmds[i]
+				}
+				break
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,43 @@
+package cmdfilter
+
+import (
+	"testing"
+
+	"github.com/veops/oneterm/model"
+)
+
+func TestMatch(t *testing.T) {
+	f, errs := New([]*model.Command{
+		{Id: 1, Name: "reboot", Cmds: []string{`^reboot`, `(`}, Action: model.COMMANDACTION_APPROVE},
+		{Id: 2, Name: "rm", Cmds: []string{`^rm\s+-rf\s+/`}, Action: model.COMMANDACTION_DENY},
+	})
+	if len(errs) != 1 {
+		t.Fatalf("errs = %v, want the invalid pattern", errs)
+	}
+	tests := []struct {
+		name  string
+		lines []string
+		hit   string
+		cmd   string
+	}{
+		{name: "passed", lines: []string{"ls", "pwd"}},
+		{name: "denied", lines: []string{"  rm -rf / "}, hit: "rm -rf /", cmd: "rm"},
+		{name: "approved", lines: []string{"ls", "reboot now"}, hit: "reboot now", cmd: "reboot"},
+		{name: "deny takes precedence", lines: []string{"reboot", "rm -rf /tmp"}, hit: "rm -rf /tmp", cmd: "rm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hit, cmd := f.Match(tt.lines...)
+			name := ""
+			if cmd != nil {
+				name = cmd.Name
+			}
+			if hit != tt.hit || name != tt.cmd {
+				t.Errorf("Match() = %q, %q, want %q, %q", hit, name, tt.hit, tt.cmd)
+			}
+		})
+	}
+	if !(*Filter)(nil).Empty() || f.Empty() {
+		t.Error("Empty() is wrong")
+	}
+}
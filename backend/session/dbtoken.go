@@ -0,0 +1,66 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/veops/oneterm/acl"
+	redis "github.com/veops/oneterm/cache"
+)
+
+const (
+	dbTokenKeyFmt = "oneterm:dbtoken:%s"
+)
+
+// DbToken lets a database client login to the proxy once as the user who created it,
+// the client logs in with Id as the user name and Secret as the password
+type DbToken struct {
+	Id        string       `json:"id"`
+	Secret    string       `json:"secret"`
+	Session   *acl.Session `json:"session"`
+	AssetId   int          `json:"asset_id"`
+	AccountId int          `json:"account_id"`
+	Protocol  string       `json:"protocol"`
+	ExpiredAt time.Time    `json:"expired_at"`
+}
+
+func NewDbToken(ctx context.Context, sess *acl.Session, assetId, accountId int, protocol string, ttl time.Duration) (t *DbToken, err error) {
+	t = &DbToken{
+		Session:   sess,
+		AssetId:   assetId,
+		AccountId: accountId,
+		Protocol:  protocol,
+		ExpiredAt: time.Now().Add(ttl),
+	}
+	if t.Id, err = randomHex(8); err != nil {
+		return
+	}
+	if t.Secret, err = randomHex(16); err != nil {
+		return
+	}
+	err = redis.SetEx(ctx, fmt.Sprintf(dbTokenKeyFmt, t.Id), t, ttl)
+	return
+}
+
+// TakeDbToken returns the token and removes it, a token can only be tried once whether the login succeeds or not
+func TakeDbToken(ctx context.Context, id string) (t *DbToken, err error) {
+	bs, err := redis.RC.GetDel(ctx, fmt.Sprintf(dbTokenKeyFmt, id)).Bytes()
+	if err != nil {
+		return
+	}
+	t = &DbToken{}
+	err = json.Unmarshal(bs, t)
+	return
+}
+
+func randomHex(n int) (string, error) {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
@@ -0,0 +1,31 @@
+package session
+
+import (
+	"go.uber.org/zap"
+
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/session/cmdfilter"
+)
+
+type CmdFilter = cmdfilter.Filter
+
+func NewCmdFilter(cmdIds []int) (f *CmdFilter, err error) {
+	cmds := make([]*model.Command, 0)
+	if len(cmdIds) > 0 {
+		if err = mysql.DB.
+			Model(&model.Command{}).
+			Where("id IN ?", cmdIds).
+			Where("enable = ?", true).
+			Find(&cmds).
+			Error; err != nil {
+			return
+		}
+	}
+	f, errs := cmdfilter.New(cmds)
+	for _, err := range errs {
+		logger.L().Warn("invalid command pattern", zap.Error(err))
+	}
+	return
+}
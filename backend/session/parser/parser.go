@@ -0,0 +1,510 @@
+// Package parser rebuilds command lines of terminal sessions from the input and the echoed output
+package parser
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spf13/cast"
+
+	"github.com/veops/oneterm/model"
+)
+
+const (
+	maxResultLen = 1024
+	maxLines     = 100
+	keepLines    = 50
+
+	pasteStart = "\x1b[200~"
+	pasteEnd   = "\x1b[201~"
+)
+
+var (
+	// clearLine moves to the end of the line, kills it and enters an empty line for a new prompt
+	clearLine = []byte{0x05, 0x15, '\r'}
+)
+
+// Verdict is what to do with a command line being entered
+type Verdict int
+
+const (
+	// Pass sends the enter
+	Pass Verdict = iota
+	// Hold keeps the line without its enter, the caller sends the enter or clears the line later
+	Hold
+	// Block clears the line
+	Block
+)
+
+// Parser rebuilds command lines from what the user types and what the remote shell echoes.
+// The input only tells when a line is submitted, the echoed output is replayed on a tiny
+// line emulator so history, tab completion and line editing are resolved by the shell itself.
+type Parser struct {
+	SessionId string
+	// record saves commands once their results are complete
+	record func(cmd *model.SessionCmd)
+
+	typing    bool
+	enter     bool
+	paste     bool
+	discard   bool
+	multiline bool
+	level     int
+	prompt    string
+	typed     []byte
+	inEsc     []byte
+	term      *lineTerm
+	cmd       *model.SessionCmd
+	results   []string
+}
+
+func NewParser(sessionId string, record func(cmd *model.SessionCmd)) *Parser {
+	return &Parser{
+		SessionId: sessionId,
+		record:    record,
+		term:      newLineTerm(),
+	}
+}
+
+// AddInput feeds bytes which are going to be written to the remote side
+func (p *Parser) AddInput(in []byte) {
+	if p == nil {
+		return
+	}
+	for _, b := range in {
+		if p.term.alt {
+			continue
+		}
+		if !p.typing {
+			p.startTyping()
+		}
+		if p.escape(b) {
+			continue
+		}
+		switch b {
+		case '\r', '\n':
+			p.enter = p.enter || !p.paste
+			p.multiline = p.multiline || p.paste
+			p.typed = append(p.typed, '\n')
+		case 0x7f, '\b':
+			_, size := utf8.DecodeLastRune(p.typed)
+			p.typed = p.typed[:len(p.typed)-size]
+		case 0x03, 0x15:
+			p.typed = p.typed[:0]
+		default:
+			if b >= 0x20 {
+				p.typed = append(p.typed, b)
+			}
+		}
+	}
+}
+
+// escape feeds b to the escape sequence being typed and tracks bracketed pastes, it reports whether b is part of one
+func (p *Parser) escape(b byte) bool {
+	if len(p.inEsc) == 0 && b != 0x1b {
+		return false
+	}
+	p.inEsc = append(p.inEsc, b)
+	if !escDone(p.inEsc) {
+		return true
+	}
+	switch string(p.inEsc) {
+	case pasteStart:
+		p.paste = true
+	case pasteEnd:
+		p.paste = false
+	}
+	p.inEsc = p.inEsc[:0]
+	return true
+}
+
+// Input writes in to w and feeds it to the parser. Every enter, CR or LF whether it is in a paste or not,
+// is written only if check passes the command line. The rest of in is dropped once a line is held,
+// a blocked line is cleared and so is the rest of its paste, which is dropped until the paste ends
+func (p *Parser) Input(in []byte, w io.Writer, check func(lines ...string) Verdict) {
+	for len(in) > 0 {
+		if p.discard {
+			p.escape(in[0])
+			in = in[1:]
+			if !p.paste {
+				p.discard = false
+				w.Write(append([]byte(pasteEnd), clearLine...))
+			}
+			continue
+		}
+		n := bytes.IndexAny(in, "\r\n") + 1
+		if n <= 0 {
+			n = len(in)
+		}
+		seg := in[:n]
+		in = in[n:]
+		if enter := seg[n-1]; enter != '\r' && enter != '\n' {
+			p.AddInput(seg)
+			w.Write(seg)
+			continue
+		}
+		p.AddInput(seg[:n-1])
+		w.Write(seg[:n-1])
+		switch check(p.CurrentCmd(), p.TypedCmd()) {
+		case Hold:
+			return
+		case Block:
+			if p.paste {
+				p.discard = true
+			} else {
+				w.Write(clearLine)
+			}
+			continue
+		}
+		p.AddInput(seg[n-1:])
+		w.Write(seg[n-1:])
+	}
+}
+
+// AddOutput feeds bytes which are echoed by the remote side
+func (p *Parser) AddOutput(out []byte) {
+	if p == nil {
+		return
+	}
+	p.term.write(out, func() {
+		if !p.typing || !p.enter {
+			return
+		}
+		p.finishTyping()
+	})
+}
+
+// CurrentCmd returns the command line being edited
+func (p *Parser) CurrentCmd() string {
+	if p == nil || !p.typing {
+		return ""
+	}
+	return p.stripPrompt(p.term.current())
+}
+
+// TypedCmd returns what was typed since the prompt, it may be ahead of the echo
+func (p *Parser) TypedCmd() string {
+	if p == nil || !p.typing {
+		return ""
+	}
+	ss := strings.Split(string(p.typed), "\n")
+	return ss[len(ss)-1]
+}
+
+func (p *Parser) Pasting() bool {
+	return p != nil && p.paste
+}
+
+// SetLevel sets the level of the command being edited
+func (p *Parser) SetLevel(level int) {
+	if p == nil {
+		return
+	}
+	p.level = level
+}
+
+// Reject records cmd with level and drops the command line being edited
+func (p *Parser) Reject(cmd string, level int, result string) {
+	if p == nil {
+		return
+	}
+	p.flush()
+	p.cmd = &model.SessionCmd{
+		SessionId: p.SessionId,
+		Cmd:       cmd,
+		Level:     level,
+		CreatedAt: time.Now(),
+	}
+	p.results = []string{result}
+	p.flush()
+	p.level = model.SESSIONCMD_LEVEL_NORMAL
+	p.typing, p.enter, p.multiline = false, false, false
+	p.typed = p.typed[:0]
+	p.term.reset("")
+}
+
+// Exec records cmd which is run without a shell, its output is the result once the parser is closed
+func (p *Parser) Exec(cmd string) {
+	if p == nil {
+		return
+	}
+	p.cmd = &model.SessionCmd{
+		SessionId: p.SessionId,
+		Cmd:       cmd,
+		Level:     p.level,
+		CreatedAt: time.Now(),
+	}
+}
+
+// Stdin records a line of the input of the command run by Exec, the output is kept as the result of the command.
+// Lines which are not text are not recorded unless they are refused
+func (p *Parser) Stdin(line string, level int, result string) {
+	if p == nil {
+		return
+	}
+	line = strings.TrimSpace(line)
+	if line == "" || (level == model.SESSIONCMD_LEVEL_NORMAL && !isText(line)) {
+		return
+	}
+	p.record(&model.SessionCmd{
+		SessionId: p.SessionId,
+		Cmd:       truncate(line, maxResultLen),
+		Level:     level,
+		Result:    result,
+		CreatedAt: time.Now(),
+	})
+}
+
+// Close records the last command if there is one
+func (p *Parser) Close() {
+	if p == nil {
+		return
+	}
+	if !p.typing {
+		p.results = p.term.text()
+	}
+	p.flush()
+}
+
+func (p *Parser) startTyping() {
+	lines := p.term.text()
+	p.prompt = lines[len(lines)-1]
+	p.results = lines[:len(lines)-1]
+	p.flush()
+	p.term.reset(p.prompt)
+	p.typing = true
+}
+
+func (p *Parser) finishTyping() {
+	cmd := p.stripPrompt(p.term.current())
+	if p.multiline {
+		lines := p.term.text()
+		lines[0] = p.stripPrompt(lines[0])
+		cmd = strings.Join(lines, "\n")
+	}
+	cmd = strings.TrimSpace(cmd)
+	p.typing, p.enter, p.multiline = false, false, false
+	p.typed = p.typed[:0]
+	p.term.reset("")
+	if cmd == "" {
+		p.level = model.SESSIONCMD_LEVEL_NORMAL
+		return
+	}
+	p.cmd = &model.SessionCmd{
+		SessionId: p.SessionId,
+		Cmd:       cmd,
+		Level:     p.level,
+		CreatedAt: time.Now(),
+	}
+	p.level = model.SESSIONCMD_LEVEL_NORMAL
+}
+
+func (p *Parser) stripPrompt(line string) string {
+	if p.prompt != "" && strings.HasPrefix(line, p.prompt) {
+		return line[len(p.prompt):]
+	}
+	return line
+}
+
+func (p *Parser) flush() {
+	defer func() {
+		p.cmd, p.results = nil, nil
+	}()
+	if p.cmd == nil {
+		return
+	}
+	p.cmd.Result = truncate(strings.TrimSpace(strings.Join(p.results, "\n")), maxResultLen)
+	p.record(p.cmd)
+}
+
+func isText(s string) bool {
+	return utf8.ValidString(s) && strings.IndexFunc(s, func(r rune) bool { return r != '\t' && unicode.IsControl(r) }) < 0
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// escDone reports whether an escape sequence starting with ESC is complete
+func escDone(seq []byte) bool {
+	if len(seq) < 2 {
+		return false
+	}
+	switch seq[1] {
+	case '[':
+		last := seq[len(seq)-1]
+		return len(seq) > 2 && last >= 0x40 && last <= 0x7e
+	case ']':
+		last := seq[len(seq)-1]
+		return last == 0x07 || (len(seq) > 3 && last == '\\' && seq[len(seq)-2] == 0x1b)
+	case 'O', '(', ')':
+		return len(seq) > 2
+	default:
+		return true
+	}
+}
+
+// lineTerm is a minimal terminal emulator which only keeps plain text lines
+type lineTerm struct {
+	lines [][]rune
+	col   int
+	alt   bool
+	esc   []byte
+	rest  []byte
+}
+
+func newLineTerm() *lineTerm {
+	t := &lineTerm{}
+	t.reset("")
+	return t
+}
+
+func (t *lineTerm) reset(s string) {
+	rs := []rune(s)
+	t.lines = [][]rune{rs}
+	t.col = len(rs)
+}
+
+func (t *lineTerm) current() string {
+	return string(t.lines[len(t.lines)-1])
+}
+
+func (t *lineTerm) text() []string {
+	res := make([]string, 0, len(t.lines))
+	for _, l := range t.lines {
+		res = append(res, strings.TrimRight(string(l), " "))
+	}
+	return res
+}
+
+func (t *lineTerm) write(p []byte, onNewline func()) {
+	p = append(t.rest, p...)
+	t.rest = nil
+	for len(p) > 0 {
+		if len(t.esc) > 0 {
+			t.esc = append(t.esc, p[0])
+			p = p[1:]
+			if escDone(t.esc) {
+				t.handleEsc(string(t.esc))
+				t.esc = t.esc[:0]
+			}
+			continue
+		}
+		rn, size := utf8.DecodeRune(p)
+		if rn == utf8.RuneError && size <= 1 && !utf8.FullRune(p) {
+			t.rest = append(t.rest, p...)
+			return
+		}
+		p = p[size:]
+		switch rn {
+		case 0x1b:
+			t.esc = append(t.esc, 0x1b)
+		case '\r':
+			t.col = 0
+		case '\n':
+			if t.alt {
+				continue
+			}
+			onNewline()
+			t.newline()
+		case '\b':
+			t.col = max(0, t.col-1)
+		case '\t':
+			t.put(' ')
+		default:
+			if rn < 0x20 || rn == 0x7f || rn == utf8.RuneError {
+				continue
+			}
+			t.put(rn)
+		}
+	}
+}
+
+func (t *lineTerm) put(rn rune) {
+	if t.alt {
+		return
+	}
+	l := t.lines[len(t.lines)-1]
+	for len(l) < t.col {
+		l = append(l, ' ')
+	}
+	if t.col < len(l) {
+		l[t.col] = rn
+	} else {
+		l = append(l, rn)
+	}
+	t.lines[len(t.lines)-1] = l
+	t.col++
+}
+
+func (t *lineTerm) newline() {
+	t.lines = append(t.lines, []rune{})
+	t.col = 0
+	if len(t.lines) > maxLines {
+		t.lines = append(t.lines[:keepLines], t.lines[keepLines+1:]...)
+	}
+}
+
+func (t *lineTerm) handleEsc(seq string) {
+	if len(seq) < 3 || seq[1] != '[' {
+		return
+	}
+	final, params := seq[len(seq)-1], seq[2:len(seq)-1]
+	if strings.HasPrefix(params, "?") {
+		switch params[1:] {
+		case "1049", "1047", "47":
+			t.alt = final == 'h'
+		}
+		return
+	}
+	if t.alt {
+		return
+	}
+	n := max(1, cast.ToInt(strings.Split(params, ";")[0]))
+	l := t.lines[len(t.lines)-1]
+	switch final {
+	case 'C':
+		t.col += n
+	case 'D':
+		t.col = max(0, t.col-n)
+	case 'G':
+		t.col = n - 1
+	case 'K':
+		switch params {
+		case "", "0":
+			if t.col < len(l) {
+				l = l[:t.col]
+			}
+		case "1":
+			for i := 0; i < min(t.col+1, len(l)); i++ {
+				l[i] = ' '
+			}
+		case "2":
+			l = l[:0]
+		}
+	case 'P':
+		if t.col < len(l) {
+			l = append(l[:t.col], l[min(t.col+n, len(l)):]...)
+		}
+	case '@':
+		if t.col < len(l) {
+			l = append(l[:t.col], append([]rune(strings.Repeat(" ", n)), l[t.col:]...)...)
+		}
+	case 'J':
+		if params == "2" || params == "3" {
+			t.reset("")
+			return
+		}
+	}
+	t.lines[len(t.lines)-1] = l
+}
@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/veops/oneterm/model"
+)
+
+// step is input typed by the user or output echoed by the shell
+type step struct {
+	in  string
+	out string
+}
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+		want  []string
+	}{
+		{
+			name:  "plain",
+			steps: []step{{out: "$ "}, {in: "ls\r"}, {out: "ls\r\nfile\r\n$ "}, {in: "x"}},
+			want:  []string{"ls", "file"},
+		},
+		{
+			name:  "newline submits",
+			steps: []step{{out: "$ "}, {in: "pwd\n"}, {out: "pwd\r\n/root\r\n$ "}, {in: "x"}},
+			want:  []string{"pwd", "/root"},
+		},
+		{
+			name:  "backspace",
+			steps: []step{{out: "$ "}, {in: "lss"}, {out: "lss"}, {in: "\x7f"}, {out: "\b\x1b[K"}, {in: "\r"}, {out: "\r\n$ "}, {in: "x"}},
+			want:  []string{"ls", ""},
+		},
+		{
+			name: "insert after cursor moves",
+			steps: []step{{out: "$ "}, {in: "ech hi"}, {out: "ech hi"}, {in: "\x1b[D\x1b[D\x1b[D"}, {out: "\b\b\b"},
+				{in: "o"}, {out: "\x1b[1@o"}, {in: "\r"}, {out: "\r\nhi\r\n$ "}, {in: "x"}},
+			want: []string{"echo hi", "hi"},
+		},
+		{
+			name:  "tab completion",
+			steps: []step{{out: "$ "}, {in: "ec\t"}, {out: "echo "}, {in: "hi\r"}, {out: "hi\r\nhi\r\n$ "}, {in: "x"}},
+			want:  []string{"echo hi", "hi"},
+		},
+		{
+			name:  "history recall",
+			steps: []step{{out: "$ "}, {in: "\x1b[A"}, {out: "ls -l"}, {in: "\r"}, {out: "\r\ntotal 0\r\n$ "}, {in: "x"}},
+			want:  []string{"ls -l", "total 0"},
+		},
+		{
+			name: "history recall over a longer line",
+			steps: []step{{out: "$ "}, {in: "cat foo"}, {out: "cat foo"}, {in: "\x1b[A"}, {out: "\b\b\b\b\b\b\bls -l\x1b[K"},
+				{in: "\r"}, {out: "\r\n$ "}, {in: "x"}},
+			want: []string{"ls -l", ""},
+		},
+		{
+			name: "ctrl+c drops the line",
+			steps: []step{{out: "$ "}, {in: "rm x"}, {out: "rm x"}, {in: "\x03"}, {out: "^C\r\n$ "},
+				{in: "ls\r"}, {out: "ls\r\n$ "}, {in: "x"}},
+			want: []string{"ls", ""},
+		},
+		{
+			name: "bracketed paste",
+			steps: []step{{out: "$ "}, {in: "\x1b[200~echo a\recho b\x1b[201~"}, {out: "echo a\r\necho b"},
+				{in: "\r"}, {out: "\r\na\r\nb\r\n$ "}, {in: "x"}},
+			want: []string{"echo a\necho b", "a\nb"},
+		},
+		{
+			name: "full screen programs",
+			steps: []step{{out: "$ "}, {in: "vi\r"}, {out: "vi\r\n\x1b[?1049h"}, {in: ":q\r"}, {out: "~\r\n~\r\n\x1b[?1049l$ "},
+				{in: "x"}},
+			want: []string{"vi", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			p := NewParser("test", func(cmd *model.SessionCmd) {
+				got = append(got, cmd.Cmd, cmd.Result)
+			})
+			for _, s := range tt.steps {
+				p.AddInput([]byte(s.in))
+				p.AddOutput([]byte(s.out))
+			}
+			p.Close()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands and results = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParserExec(t *testing.T) {
+	var got *model.SessionCmd
+	p := NewParser("test", func(cmd *model.SessionCmd) { got = cmd })
+	p.Exec("uname")
+	p.AddOutput([]byte("Linux\r\n"))
+	p.Close()
+	if got == nil || got.Cmd != "uname" || got.Result != "Linux" {
+		t.Fatalf("recorded %+v", got)
+	}
+}
+
+func TestParserStdin(t *testing.T) {
+	var got []string
+	p := NewParser("test", func(cmd *model.SessionCmd) { got = append(got, cmd.Cmd, cmd.Result) })
+	p.Exec("sh")
+	p.Stdin("ls\n", model.SESSIONCMD_LEVEL_NORMAL, "")
+	p.Stdin("\x00\x01\n", model.SESSIONCMD_LEVEL_NORMAL, "")
+	p.Stdin("rm -rf /\n", model.SESSIONCMD_LEVEL_BLOCKED, "blocked")
+	p.AddOutput([]byte("file\r\n"))
+	p.Close()
+	if want := []string{"ls", "", "rm -rf /", "blocked", "sh", "file"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands and results = %q, want %q", got, want)
+	}
+}
+
+func TestParserInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		ins     []string
+		written string
+	}{
+		{
+			name:    "passed",
+			ins:     []string{"ls\r"},
+			written: "ls\r",
+		},
+		{
+			name:    "blocked by carriage return",
+			ins:     []string{"rm -rf /\r", "ls\r"},
+			written: "rm -rf /\x05\x15\rls\r",
+		},
+		{
+			name:    "blocked by line feed",
+			ins:     []string{"rm -rf /\n"},
+			written: "rm -rf /\x05\x15\r",
+		},
+		{
+			name:    "paste passed",
+			ins:     []string{"\x1b[200~ls\rpwd\x1b[201~\r"},
+			written: "\x1b[200~ls\rpwd\x1b[201~\r",
+		},
+		{
+			name:    "paste blocked by a line before the last",
+			ins:     []string{"\x1b[200~rm -rf /\rls\x1b[201~\r"},
+			written: "\x1b[200~rm -rf /\x1b[201~\x05\x15\r\r",
+		},
+		{
+			name:    "paste typed byte by byte",
+			ins:     strings.Split("\x1b[200~rm -rf /\rls\x1b[201~\r", ""),
+			written: "\x1b[200~rm -rf /\x1b[201~\x05\x15\r\r",
+		},
+		{
+			name:    "paste never ended",
+			ins:     []string{"\x1b[200~", "rm -rf /\r", "ls\r"},
+			written: "\x1b[200~rm -rf /",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, blocked := &bytes.Buffer{}, 0
+			p := NewParser("test", func(cmd *model.SessionCmd) {})
+			check := func(lines ...string) Verdict {
+				for _, line := range lines {
+					if strings.Contains(line, "rm -rf /") {
+						blocked++
+						p.Reject(line, model.SESSIONCMD_LEVEL_BLOCKED, "blocked")
+						return Block
+					}
+				}
+				return Pass
+			}
+			for _, in := range tt.ins {
+				p.Input([]byte(in), w, check)
+			}
+			if w.String() != tt.written {
+				t.Errorf("written %q, want %q", w.String(), tt.written)
+			}
+			if want := strings.Contains(tt.written, "rm"); (blocked == 1) != want {
+				t.Errorf("blocked %d lines", blocked)
+			}
+		})
+	}
+}
@@ -1,29 +1,42 @@
 package session
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/replay"
 )
 
 type Asciinema struct {
+	name string
 	file *os.File
+	w    io.WriteCloser
 	ts   time.Time
+	mu   sync.Mutex
 }
 
 func NewAsciinema(id string, w, h int) (ret *Asciinema, err error) {
-	f, err := os.Create(filepath.Join("/replay", fmt.Sprintf("%s.cast", id)))
+	name := fmt.Sprintf("%s.cast", id)
+	f, err := os.Create(replay.LocalPath(name))
 	if err != nil {
 		logger.L().Error("open cast failed", zap.String("id", id), zap.Error(err))
 		return
 	}
-	ret = &Asciinema{file: f, ts: time.Now()}
+	enc, err := replay.NewWriter(f)
+	if err != nil {
+		logger.L().Error("encrypt cast failed", zap.String("id", id), zap.Error(err))
+		f.Close()
+		return
+	}
+	ret = &Asciinema{name: name, file: f, w: enc, ts: time.Now()}
 	bs, _ := json.Marshal(map[string]any{
 		"version":   2,
 		"width":     w,
@@ -35,7 +48,7 @@ func NewAsciinema(id string, w, h int) (ret *Asciinema, err error) {
 			"TERM":  "xterm-256color",
 		},
 	})
-	ret.file.Write(append(bs, '\r', '\n'))
+	ret.w.Write(append(bs, '\r', '\n'))
 	return
 }
 
@@ -45,7 +58,9 @@ func (a *Asciinema) Write(p []byte) {
 	o[1] = "o"
 	o[2] = string(p)
 	bs, _ := json.Marshal(o)
-	a.file.Write(append(bs, '\r', '\n'))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(append(bs, '\r', '\n'))
 }
 
 func (a *Asciinema) Resize(w, h int) {
@@ -54,5 +69,19 @@ func (a *Asciinema) Resize(w, h int) {
 	r[1] = "r"
 	r[2] = fmt.Sprintf("%dx%d", w, h)
 	bs, _ := json.Marshal(r)
-	a.file.Write(append(bs, '\r', '\n'))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(append(bs, '\r', '\n'))
+}
+
+// Close finishes the recording and uploads it to the replay storage
+func (a *Asciinema) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.w.Close()
+	a.mu.Unlock()
+	a.file.Close()
+	go replay.Upload(context.Background(), a.name)
 }
@@ -6,11 +6,13 @@ import (
 	"context"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/gorilla/websocket"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"gorm.io/gorm/clause"
@@ -19,6 +21,7 @@ import (
 	mysql "github.com/veops/oneterm/db"
 	"github.com/veops/oneterm/logger"
 	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/session/parser"
 )
 
 var (
@@ -26,20 +29,11 @@ var (
 )
 
 func init() {
-	sessions := make([]*Session, 0)
-	if err := mysql.DB.
-		Model(sessions).
-		Where("status = ?", model.SESSIONSTATUS_ONLINE).
-		Find(&sessions).
-		Error; err != nil {
-		logger.L().Fatal("get sessions failed", zap.Error(err))
-	}
-	now := time.Now()
-	for _, s := range sessions {
-		s.Status = model.SESSIONSTATUS_OFFLINE
-		s.ClosedAt = &now
-		UpsertSession(s)
+	ctx := context.Background()
+	if err := startNode(ctx); err != nil {
+		logger.L().Fatal("start node failed", zap.String("node", NodeId), zap.Error(err))
 	}
+	reapSessions(ctx)
 }
 
 func GetOnlineSession() *sync.Map {
@@ -57,6 +51,8 @@ func GetOnlineSessionById(id string) (sess *Session) {
 type CliRW struct {
 	Reader *bufio.Reader
 	Writer io.Writer
+	// Stderr is where messages to clients of exec requests are written, it is nil for terminals
+	Stderr io.Writer
 }
 
 func (rw *CliRW) Read() []byte {
@@ -77,50 +73,61 @@ func (rw *CliRW) Write(p []byte) {
 }
 
 type SessionChans struct {
-	Rin        io.ReadCloser
-	Win        io.WriteCloser
-	Rout       io.ReadCloser
-	Wout       io.WriteCloser
-	ErrChan    chan error
-	InChan     chan []byte
-	OutChan    chan []byte
-	OutBuf     *bytes.Buffer
-	WindowChan chan ssh.Window
-	AwayChan   chan struct{}
-	CloseChan  chan string
+	Rin          io.ReadCloser
+	Win          io.WriteCloser
+	Rout         io.ReadCloser
+	Wout         io.WriteCloser
+	ErrChan      chan error
+	InChan       chan []byte
+	OutChan      chan []byte
+	OutBuf       *bytes.Buffer
+	WindowChan   chan ssh.Window
+	AwayChan     chan struct{}
+	CloseChan    chan string
+	ApprovalChan chan *model.Approval
 }
 
 func NewSessionChans() *SessionChans {
 	rin, win := io.Pipe()
 	rout, wout := io.Pipe()
 	return &SessionChans{
-		Rin:        rin,
-		Win:        win,
-		Rout:       rout,
-		Wout:       wout,
-		ErrChan:    make(chan error),
-		InChan:     make(chan []byte, 8),
-		OutChan:    make(chan []byte, 8),
-		OutBuf:     &bytes.Buffer{},
-		WindowChan: make(chan ssh.Window),
-		AwayChan:   make(chan struct{}),
-		CloseChan:  make(chan string),
+		Rin:          rin,
+		Win:          win,
+		Rout:         rout,
+		Wout:         wout,
+		ErrChan:      make(chan error),
+		InChan:       make(chan []byte, 8),
+		OutChan:      make(chan []byte, 8),
+		OutBuf:       &bytes.Buffer{},
+		WindowChan:   make(chan ssh.Window),
+		AwayChan:     make(chan struct{}),
+		CloseChan:    make(chan string),
+		ApprovalChan: make(chan *model.Approval, 1),
 	}
 }
 
 type Session struct {
 	*model.Session
-	G            *errgroup.Group `json:"-" gorm:"-"`
-	Gctx         context.Context `json:"-" gorm:"-"`
-	Ws           *websocket.Conn `json:"-" gorm:"-"`
-	CliRw        *CliRW          `json:"-" gorm:"-"`
-	Monitors     *sync.Map       `json:"-" gorm:"-"`
-	Chans        *SessionChans   `json:"-" gorm:"-"`
-	ConnectionId string          `json:"-" gorm:"-"`
-	GuacdTunnel  *guacd.Tunnel   `json:"-" gorm:"-"`
-	IdleTimout   time.Duration   `json:"-" gorm:"-"`
-	IdleTk       *time.Ticker    `json:"-" gorm:"-"`
-	SshRecoder   *Asciinema      `json:"-" gorm:"-"`
+	G              *errgroup.Group `json:"-" gorm:"-"`
+	Gctx           context.Context `json:"-" gorm:"-"`
+	Ws             *websocket.Conn `json:"-" gorm:"-"`
+	CliRw          *CliRW          `json:"-" gorm:"-"`
+	Monitors       *sync.Map       `json:"-" gorm:"-"`
+	RemoteMonitors *sync.Map       `json:"-" gorm:"-"`
+	Chans          *SessionChans   `json:"-" gorm:"-"`
+	ConnectionId   string          `json:"-" gorm:"-"`
+	GuacdTunnel    *guacd.Tunnel   `json:"-" gorm:"-"`
+	IdleTimout     time.Duration   `json:"-" gorm:"-"`
+	IdleTk         *time.Ticker    `json:"-" gorm:"-"`
+	SshRecoder     *Asciinema      `json:"-" gorm:"-"`
+	SshParser      *parser.Parser  `json:"-" gorm:"-"`
+	// CmdFilter is replaced while the session is running, so it is read by goroutines of the session atomically
+	CmdFilter atomic.Pointer[CmdFilter] `json:"-" gorm:"-"`
+	Localizer *i18n.Localizer           `json:"-" gorm:"-"`
+	Approval  *model.Approval           `json:"-" gorm:"-"`
+	// Command is run instead of a shell for exec requests, ExitCode is its exit status
+	Command  string `json:"-" gorm:"-"`
+	ExitCode int    `json:"-" gorm:"-"`
 }
 
 func NewSession(ctx context.Context) *Session {
@@ -128,6 +135,7 @@ func NewSession(ctx context.Context) *Session {
 	s.G, s.Gctx = errgroup.WithContext(ctx)
 	s.Chans = NewSessionChans()
 	s.Monitors = &sync.Map{}
+	s.RemoteMonitors = &sync.Map{}
 	return s
 }
 
@@ -139,10 +147,18 @@ func (m *Session) HasMonitors() (has bool) {
 	return
 }
 
+func (m *Session) HasRemoteMonitors() (has bool) {
+	m.RemoteMonitors.Range(func(key, value any) bool {
+		has = true
+		return false
+	})
+	return
+}
+
 func UpsertSession(data *Session) (err error) {
 	return mysql.DB.
 		Clauses(clause.OnConflict{
-			DoUpdates: clause.AssignmentColumns([]string{"status", "closed_at"}),
+			DoUpdates: clause.AssignmentColumns([]string{"status", "closed_at", "bytes_in", "bytes_out"}),
 		}).
 		Create(data).
 		Error
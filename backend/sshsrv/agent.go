@@ -0,0 +1,95 @@
+package sshsrv
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/agent"
+	mysql "github.com/veops/oneterm/db"
+	ggateway "github.com/veops/oneterm/gateway"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+func getAgentGateway(gatewayId int) (*model.Gateway, error) {
+	g := &model.Gateway{}
+	err := mysql.DB.Model(g).Where("id = ? AND type = ?", gatewayId, model.GATEWAYTYPE_AGENT).First(g).Error
+	return g, err
+}
+
+// agentPublicKey accepts agents by the keys they enrolled with, other keys are kept to be enrolled by tokens.
+// Nothing is recorded for accepted keys since keys are also accepted when they are only queried without signatures
+func agentPublicKey(ctx ssh.Context, gatewayId int, key ssh.PublicKey) bool {
+	g, err := getAgentGateway(gatewayId)
+	if err != nil {
+		return false
+	}
+	if g.AgentKey != "" && g.AgentKey == string(gossh.MarshalAuthorizedKey(key)) {
+		return true
+	}
+	ctx.SetValue("agentKey", key)
+	return false
+}
+
+// agentPassword enrolls the key offered by the agent if the password is the enrollment token of the gateway,
+// the token is consumed by the enrollment
+func agentPassword(ctx ssh.Context, gatewayId int, token string) bool {
+	key, ok := ctx.Value("agentKey").(ssh.PublicKey)
+	if !ok {
+		return false
+	}
+	g, err := getAgentGateway(gatewayId)
+	if err != nil || g.EnrollToken == "" || g.EnrollExpiredAt == nil || time.Now().After(*g.EnrollExpiredAt) {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(ggateway.EnrollTokenHash(token)), []byte(g.EnrollToken)) != 1 {
+		return false
+	}
+	res := mysql.DB.
+		Model(g).
+		Where("id = ? AND enroll_token = ?", g.Id, g.EnrollToken).
+		UpdateColumns(map[string]any{"agent_key": string(gossh.MarshalAuthorizedKey(key)), "enroll_token": "", "enroll_expired_at": nil})
+	if res.Error != nil || res.RowsAffected != 1 {
+		logger.L().Error("enroll agent failed", zap.Int("gatewayId", gatewayId), zap.Error(res.Error))
+		return false
+	}
+	logger.L().Info("agent enrolled", zap.Int("gatewayId", gatewayId), zap.String("fingerprint", gossh.FingerprintSHA256(key)))
+	return true
+}
+
+// agentRequestHandler registers the connection of the agent, agents repeat the request to keep alive.
+// The gateway is taken from the user the connection is finally authenticated as, users may be switched during authentication
+// so connections carrying a user session are refused
+func agentRequestHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return false, nil
+	}
+	gatewayId, ok := agent.ParseUser(conn.User())
+	if !ok {
+		return false, nil
+	}
+	if sess, _ := ctx.Value("session").(*acl.Session); sess != nil {
+		logger.L().Warn("refuse agent with a user session", zap.Int("gatewayId", gatewayId), zap.String("addr", conn.RemoteAddr().String()))
+		return false, nil
+	}
+	ggateway.ServeAgent(ctx, gatewayId, conn)
+	return true, nil
+}
+
+// userOnly rejects channels of agents which are only dialed by oneterm
+func userOnly(h ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		sess, _ := ctx.Value("session").(*acl.Session)
+		if _, isAgent := agent.ParseUser(conn.User()); isAgent || sess == nil {
+			newChan.Reject(gossh.Prohibited, "channels are not allowed for agents")
+			return
+		}
+		h(srv, conn, newChan, ctx)
+	}
+}
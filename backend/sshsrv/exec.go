@@ -0,0 +1,130 @@
+package sshsrv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gliderlabs/ssh"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+
+	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/api/controller"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/session"
+	"github.com/veops/oneterm/util"
+)
+
+const (
+	execExitFailed = 255
+	execWidth      = 80
+	execHeight     = 24
+)
+
+// execHandler runs the command of `ssh user@oneterm account@asset -- command` on the asset
+// through the same path as interactive sessions and exits with the status of the command
+func execHandler(sess ssh.Session) {
+	currentUser := sess.Context().Value("session").(*acl.Session)
+
+	target, command := parseExec(sess.RawCommand())
+	if command == "" {
+		fmt.Fprintln(sess.Stderr(), "usage: ssh user@oneterm <account>@<asset> -- <command>")
+		sess.Exit(execExitFailed)
+		return
+	}
+	auth, err := findAuthorized(currentUser, target)
+	if err != nil {
+		fmt.Fprintln(sess.Stderr(), err)
+		sess.Exit(execExitFailed)
+		return
+	}
+
+	ctx := &gin.Context{
+		Request: &http.Request{
+			RemoteAddr: sess.RemoteAddr().String(),
+			URL: &url.URL{
+				RawQuery: fmt.Sprintf("w=%d&h=%d", execWidth, execHeight),
+			},
+		},
+		Params: gin.Params{
+			{Key: "account_id", Value: cast.ToString(auth.account.Id)},
+			{Key: "asset_id", Value: cast.ToString(auth.asset.Id)},
+			{Key: "protocol", Value: fmt.Sprintf("ssh:%d", util.GetPort("ssh", auth.asset))},
+		},
+	}
+	ctx.Set("sessionType", model.SESSIONTYPE_CLIENT)
+	ctx.Set("session", currentUser)
+	ctx.Set("command", command)
+	ctx.Set("stderr", sess.Stderr())
+
+	gsess, err := controller.DoConnect(ctx, nil)
+	if err != nil {
+		if ae, ok := err.(*controller.ApiError); ok {
+			err = fmt.Errorf("%s", controller.Err2Msg[ae.Code].One)
+		}
+		fmt.Fprintln(sess.Stderr(), err)
+		sess.Exit(execExitFailed)
+		return
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		io.Copy(w, sess)
+		w.Close()
+	}()
+	gsess.CliRw = &session.CliRW{
+		Reader: bufio.NewReader(r),
+		Writer: sess,
+		Stderr: sess.Stderr(),
+	}
+	gsess.G.Go(func() error {
+		defer r.Close()
+		select {
+		case <-sess.Context().Done():
+			close(gsess.Chans.AwayChan)
+		case <-gsess.Gctx.Done():
+		}
+		return nil
+	})
+	if err = controller.HandleSsh(gsess); err != nil {
+		logger.L().Debug("exec stopped", zap.String("id", gsess.SessionId), zap.Error(err))
+	}
+
+	sess.Exit(gsess.ExitCode)
+}
+
+// parseExec splits the raw command into the target account@asset and the command to run on it
+func parseExec(raw string) (target string, command string) {
+	raw = strings.TrimSpace(raw)
+	target, command, _ = strings.Cut(raw, " ")
+	command = strings.TrimSpace(command)
+	if command == "--" || strings.HasPrefix(command, "-- ") {
+		command = strings.TrimSpace(strings.TrimPrefix(command, "--"))
+	}
+	return
+}
+
+func findAuthorized(currentUser *acl.Session, target string) (*authorized, error) {
+	idx := strings.LastIndex(target, "@")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid target %s, it should be <account>@<asset>", target)
+	}
+	accountName, assetName := target[:idx], target[idx+1:]
+
+	auths, err := getAuthorized(currentUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range auths {
+		if a.account.Name == accountName && a.asset.Name == assetName && util.GetPort("ssh", a.asset) != 0 {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no ssh access to %s", target)
+}
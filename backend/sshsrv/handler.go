@@ -25,6 +25,10 @@ func handler(sess ssh.Session) {
 	defer acl.Logout(sess.Context().Value("session").(*acl.Session))
 	pty, _, isPty := sess.Pty()
 	if !isPty {
+		if sess.RawCommand() != "" {
+			execHandler(sess)
+			return
+		}
 		logger.L().Error("not a pty request")
 		return
 	}
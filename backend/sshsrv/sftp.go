@@ -0,0 +1,326 @@
+package sshsrv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+
+	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/api/controller"
+	"github.com/veops/oneterm/api/file"
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/util"
+)
+
+// sftpHandler serves a virtual filesystem, the top level has a directory named account@asset for each
+// authorized asset and paths below it are proxied to the asset.
+// Directories of the same name are suffixed by ids of their accounts and assets
+func sftpHandler(sess ssh.Session) {
+	currentUser := sess.Context().Value("session").(*acl.Session)
+	defer acl.Logout(currentUser)
+
+	auths, err := getAuthorized(currentUser)
+	if err != nil {
+		logger.L().Error("get authorized assets failed", zap.Error(err))
+		return
+	}
+	fs := &sftpFs{
+		currentUser: currentUser,
+		clientIp:    util.IpFromNetAddr(sess.RemoteAddr()),
+		dirs:        map[string]*authorized{},
+	}
+	auths = lo.Filter(auths, func(a *authorized, _ int) bool { return util.GetPort("sftp,ssh", a.asset) != 0 })
+	dirName := func(a *authorized) string { return strings.ReplaceAll(a.account.Name+"@"+a.asset.Name, "/", "_") }
+	cnts := make(map[string]int)
+	for _, a := range auths {
+		cnts[dirName(a)]++
+	}
+	for _, a := range auths {
+		name := dirName(a)
+		if cnts[name] > 1 {
+			name = fmt.Sprintf("%s#%d-%d", name, a.account.Id, a.asset.Id)
+		}
+		fs.dirs[name] = a
+	}
+
+	srv := sftp.NewRequestServer(sess, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+	defer srv.Close()
+	if err = srv.Serve(); err != nil && err != io.EOF {
+		logger.L().Debug("sftp stopped", zap.Error(err))
+	}
+}
+
+type sftpFs struct {
+	currentUser *acl.Session
+	clientIp    string
+	dirs        map[string]*authorized
+}
+
+// resolve splits p into the authorized asset and the path on it, auth is nil for the root
+func (fs *sftpFs) resolve(p string) (auth *authorized, cli *sftp.Client, remote string, err error) {
+	ss := strings.SplitN(strings.TrimPrefix(path.Clean("/"+p), "/"), "/", 2)
+	if ss[0] == "" {
+		return
+	}
+	auth, ok := fs.dirs[ss[0]]
+	if !ok {
+		return nil, nil, "", os.ErrNotExist
+	}
+	if !controller.CheckTime(auth.asset.AccessAuth) {
+		return nil, nil, "", os.ErrPermission
+	}
+	remote = "/"
+	if len(ss) > 1 {
+		remote += ss[1]
+	}
+	if cli, err = file.GetFileManager().GetFileClient(auth.asset.Id, auth.account.Id); err == nil && cli == nil {
+		err = fmt.Errorf("sftp of %s is not available", auth.asset.Name)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return
+}
+
+func (fs *sftpFs) record(auth *authorized, action int, remote string, filename string) {
+	h := &model.FileHistory{
+		Uid:       fs.currentUser.GetUid(),
+		UserName:  fs.currentUser.GetUserName(),
+		AssetId:   auth.asset.Id,
+		AccountId: auth.account.Id,
+		ClientIp:  fs.clientIp,
+		Action:    action,
+		Dir:       path.Dir(remote),
+		Filename:  lo.Ternary(filename != "", filename, path.Base(remote)),
+	}
+	if err := mysql.DB.Model(h).Create(h).Error; err != nil {
+		logger.L().Error("record sftp failed", zap.Error(err), zap.Any("history", h))
+	}
+}
+
+func (fs *sftpFs) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	auth, cli, remote, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		return nil, os.ErrPermission
+	}
+	f, err := cli.Open(remote)
+	if err != nil {
+		return nil, err
+	}
+	fs.record(auth, model.FILE_ACTION_DOWNLOAD, remote, "")
+	return f, nil
+}
+
+func (fs *sftpFs) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	auth, cli, remote, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		return nil, os.ErrPermission
+	}
+	flags, pflags := os.O_WRONLY, r.Pflags()
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	f, err := cli.OpenFile(remote, flags)
+	if err != nil {
+		return nil, err
+	}
+	fs.record(auth, model.FILE_ACTION_UPLOAD, remote, "")
+	return f, nil
+}
+
+func (fs *sftpFs) Filecmd(r *sftp.Request) (err error) {
+	// Filepath of symlink is where the link points to and Target is the link
+	p := lo.Ternary(r.Method == "Symlink", r.Target, r.Filepath)
+	auth, cli, remote, err := fs.resolve(p)
+	if err != nil {
+		return
+	}
+	if auth == nil || remote == "/" {
+		return os.ErrPermission
+	}
+
+	action, filename := 0, ""
+	switch r.Method {
+	case "Setstat":
+		action, err = model.FILE_ACTION_SETSTAT, fs.setstat(cli, remote, r)
+	case "Rename", "PosixRename":
+		var target *authorized
+		var to string
+		if target, _, to, err = fs.resolve(r.Target); err != nil {
+			return
+		}
+		if target != auth {
+			return os.ErrPermission
+		}
+		action, filename = model.FILE_ACTION_RENAME, path.Base(remote)+" -> "+to
+		if r.Method == "Rename" {
+			err = cli.Rename(remote, to)
+		} else {
+			err = cli.PosixRename(remote, to)
+		}
+	case "Rmdir":
+		action, err = model.FILE_ACTION_REMOVE, cli.RemoveDirectory(remote)
+	case "Remove":
+		action, err = model.FILE_ACTION_REMOVE, cli.Remove(remote)
+	case "Mkdir":
+		action, err = model.FILE_ACTION_MKDIR, cli.Mkdir(remote)
+	case "Symlink":
+		oldname := r.Filepath
+		if path.IsAbs(oldname) {
+			var target *authorized
+			if target, _, oldname, err = fs.resolve(oldname); err != nil {
+				return
+			}
+			if target != auth {
+				return os.ErrPermission
+			}
+		}
+		action, filename = model.FILE_ACTION_SYMLINK, path.Base(remote)+" -> "+oldname
+		err = cli.Symlink(oldname, remote)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if err != nil {
+		return
+	}
+	fs.record(auth, action, remote, filename)
+
+	return
+}
+
+func (fs *sftpFs) setstat(cli *sftp.Client, remote string, r *sftp.Request) (err error) {
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err = cli.Truncate(remote, int64(attrs.Size)); err != nil {
+			return
+		}
+	}
+	if flags.Permissions {
+		if err = cli.Chmod(remote, attrs.FileMode()); err != nil {
+			return
+		}
+	}
+	if flags.UidGid {
+		if err = cli.Chown(remote, int(attrs.UID), int(attrs.GID)); err != nil {
+			return
+		}
+	}
+	if flags.Acmodtime {
+		err = cli.Chtimes(remote, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+	}
+	return
+}
+
+func (fs *sftpFs) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	return fs.list(r, false)
+}
+
+func (fs *sftpFs) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	return fs.list(r, true)
+}
+
+func (fs *sftpFs) list(r *sftp.Request, lstat bool) (sftp.ListerAt, error) {
+	auth, cli, remote, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Method == "List" {
+		if auth == nil {
+			infos := make(listerAt, 0, len(fs.dirs))
+			for name := range fs.dirs {
+				infos = append(infos, dirInfo(name))
+			}
+			return infos, nil
+		}
+		infos, err := cli.ReadDir(remote)
+		if err != nil {
+			return nil, err
+		}
+		fs.record(auth, model.FILE_ACTION_LS, remote, "")
+		return listerAt(infos), nil
+	}
+
+	if auth == nil {
+		return listerAt{dirInfo("/")}, nil
+	}
+	if remote == "/" {
+		return listerAt{dirInfo(path.Base(r.Filepath))}, nil
+	}
+	stat := cli.Stat
+	if lstat {
+		stat = cli.Lstat
+	}
+	info, err := stat(remote)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// Readlink returns targets in the virtual filesystem for absolute links
+func (fs *sftpFs) Readlink(p string) (string, error) {
+	auth, cli, remote, err := fs.resolve(p)
+	if err != nil {
+		return "", err
+	}
+	if auth == nil {
+		return "", os.ErrInvalid
+	}
+	target, err := cli.ReadLink(remote)
+	if err != nil {
+		return "", err
+	}
+	if path.IsAbs(target) {
+		target = path.Join("/", strings.SplitN(strings.TrimPrefix(path.Clean("/"+p), "/"), "/", 2)[0], target)
+	}
+	return target, nil
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// dirInfo is a directory of the virtual filesystem
+type dirInfo string
+
+func (d dirInfo) Name() string       { return string(d) }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() os.FileMode  { return os.ModeDir | 0o555 }
+func (d dirInfo) ModTime() time.Time { return time.Time{} }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() any           { return nil }
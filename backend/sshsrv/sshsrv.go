@@ -8,6 +8,7 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/agent"
 	"github.com/veops/oneterm/conf"
 	"github.com/veops/oneterm/util"
 )
@@ -22,17 +23,33 @@ func init() {
 		Addr:    fmt.Sprintf("%s:%d", conf.Cfg.Ssh.Host, conf.Cfg.Ssh.Port),
 		Handler: handler,
 		PasswordHandler: func(ctx ssh.Context, password string) bool {
+			if gatewayId, ok := agent.ParseUser(ctx.User()); ok {
+				return agentPassword(ctx, gatewayId, password)
+			}
 			sess, err := acl.LoginByPassword(ctx, ctx.User(), password, util.IpFromNetAddr(ctx.RemoteAddr()))
 
 			ctx.SetValue("session", sess)
 			return err == nil
 		},
 		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			if gatewayId, ok := agent.ParseUser(ctx.User()); ok {
+				return agentPublicKey(ctx, gatewayId, key)
+			}
 			sess, err := acl.LoginByPublicKey(ctx, ctx.User(), string(gossh.MarshalAuthorizedKey(key)), util.IpFromNetAddr(ctx.RemoteAddr()))
 			ctx.SetValue("session", sess)
 			return err == nil
 		},
 		HostSigners: []ssh.Signer{signer()},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      userOnly(ssh.DefaultSessionHandler),
+			"direct-tcpip": userOnly(directTcpipHandler),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			agent.RequestType: agentRequestHandler,
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
 	}
 }
 
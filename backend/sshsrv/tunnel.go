@@ -0,0 +1,89 @@
+package sshsrv
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gliderlabs/ssh"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/veops/oneterm/acl"
+	"github.com/veops/oneterm/api/controller"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+// directTcpip is the payload of direct-tcpip channels opened by `ssh -L` and `ssh -J`
+type directTcpip struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// directTcpipHandler forwards the channel to an authorized asset whose name or ip is the destination
+// and one of whose protocols is on the destination port
+func directTcpipHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, sctx ssh.Context) {
+	d := &directTcpip{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	currentUser, ok := sctx.Value("session").(*acl.Session)
+	if !ok || currentUser == nil {
+		newChan.Reject(gossh.Prohibited, "not logged in")
+		return
+	}
+
+	auth, err := findTunnelTarget(currentUser, d.DestAddr, int(d.DestPort))
+	if err != nil {
+		newChan.Reject(gossh.Prohibited, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	ctx := &gin.Context{
+		Request: &http.Request{
+			RemoteAddr: conn.RemoteAddr().String(),
+		},
+		Params: gin.Params{
+			{Key: "account_id", Value: cast.ToString(auth.account.Id)},
+			{Key: "asset_id", Value: cast.ToString(auth.asset.Id)},
+			{Key: "protocol", Value: fmt.Sprintf("tunnel:%d", d.DestPort)},
+		},
+	}
+	ctx.Set("sessionType", model.SESSIONTYPE_CLIENT)
+	ctx.Set("session", currentUser)
+
+	if err = controller.ConnectTunnel(ctx, ch); err != nil {
+		logger.L().Warn("tunnel failed", zap.String("dest", net.JoinHostPort(d.DestAddr, cast.ToString(d.DestPort))), zap.Error(err))
+	}
+}
+
+func findTunnelTarget(currentUser *acl.Session, host string, port int) (*authorized, error) {
+	auths, err := getAuthorized(currentUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range auths {
+		if a.asset.Name != host && a.asset.Ip != host {
+			continue
+		}
+		for _, p := range a.asset.Protocols {
+			if _, pt, _ := strings.Cut(p, ":"); cast.ToInt(pt) == port {
+				return a, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no access to %s", net.JoinHostPort(host, cast.ToString(port)))
+}
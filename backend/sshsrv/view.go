@@ -42,6 +42,11 @@ var (
 	errStyle     = lipgloss.NewStyle().Foreground(hotPink)
 	hintStyle    = lipgloss.NewStyle().Foreground(darkGray)
 	hiddenBorder = lipgloss.HiddenBorder()
+	// terminalProtocols are protocols which can be connected from here with their default ports
+	terminalProtocols = map[string]int{
+		"ssh":    22,
+		"telnet": 23,
+	}
 )
 
 func init() {
@@ -137,13 +142,13 @@ func (m *view) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.cmdsIdx = len(m.cmds) - 1
 			if cmd == "exit" {
 				return m, tea.Sequence(hisCmd, tea.Quit)
-			} else if strings.HasPrefix(cmd, "ssh") {
+			} else if protocol, ok := cmdProtocol(cmd); ok {
 				pty, _, _ := m.Sess.Pty()
 				m.Ctx.Request.URL.RawQuery = fmt.Sprintf("w=%d&h=%d", pty.Window.Width, pty.Window.Height)
 				m.Ctx.Params = nil
 				m.Ctx.Params = append(m.Ctx.Params, gin.Param{Key: "account_id", Value: cast.ToString(m.combines[cmd][0])})
 				m.Ctx.Params = append(m.Ctx.Params, gin.Param{Key: "asset_id", Value: cast.ToString(m.combines[cmd][1])})
-				m.Ctx.Params = append(m.Ctx.Params, gin.Param{Key: "protocol", Value: fmt.Sprintf("ssh:%d", m.combines[cmd][2])})
+				m.Ctx.Params = append(m.Ctx.Params, gin.Param{Key: "protocol", Value: fmt.Sprintf("%s:%d", protocol, m.combines[cmd][2])})
 				m.Ctx = m.Ctx.Copy()
 				m.connecting = true
 				return m, tea.Sequence(hisCmd, tea.Exec(&connector{Ctx: m.Ctx, Sess: m.Sess, Vw: m, gctx: m.gctx}, func(err error) tea.Msg {
@@ -222,7 +227,59 @@ func (m *view) possible() string {
 	return tb.Render()
 }
 
+// cmdProtocol returns the protocol cmd connects with
+func cmdProtocol(cmd string) (string, bool) {
+	protocol, _, _ := strings.Cut(cmd, " ")
+	_, ok := terminalProtocols[protocol]
+	return protocol, ok
+}
+
 func (m *view) refresh() {
+	auths, err := getAuthorized(m.currentUser)
+	if err != nil {
+		logger.L().Error("refresh failed", zap.Error(err))
+		return
+	}
+
+	m.combines = make(map[string][3]int)
+	for _, auth := range auths {
+		for _, p := range auth.asset.Protocols {
+			for protocol, defaultPort := range terminalProtocols {
+				if !strings.HasPrefix(p, protocol) {
+					continue
+				}
+				ss := strings.Split(p, ":")
+				if len(ss) != 2 || cast.ToInt(ss[1]) == 0 {
+					continue
+				}
+				port := cast.ToInt(ss[1])
+				k := fmt.Sprintf("%s %s@%s", protocol, auth.account.Name, auth.asset.Name)
+				m.combines[lo.Ternary(port == defaultPort, k, fmt.Sprintf("%s:%s", k, ss[1]))] = [3]int{auth.account.Id, auth.asset.Id, port}
+			}
+		}
+	}
+
+	eg := &errgroup.Group{}
+	eg.Go(func() error {
+		var err error
+		if len(m.cmds) != 0 {
+			return err
+		}
+		m.cmds, err = redis.RC.LRange(m.Ctx, fmt.Sprintf(hisCmdsFmt, m.currentUser.GetUid()), -100, -1).Result()
+		m.cmdsIdx = len(m.cmds) - 1
+		return err
+	})
+
+	m.textinput.SetSuggestions(lo.Keys(m.combines))
+}
+
+// authorized is an asset with an account the user is authorized to access it by
+type authorized struct {
+	asset   *model.Asset
+	account *model.Account
+}
+
+func getAuthorized(currentUser *acl.Session) (res []*authorized, err error) {
 	auths := make([]*model.Authorization, 0)
 	assets := make([]*model.Asset, 0)
 	accounts := make([]*model.Account, 0)
@@ -230,16 +287,14 @@ func (m *view) refresh() {
 	dbAsset := mysql.DB.Model(assets)
 	dbAccount := mysql.DB.Model(accounts)
 
-	if !acl.IsAdmin(m.currentUser) {
-		rs, err := acl.GetRoleResources(ctx, m.currentUser.Acl.Rid, conf.GetResourceTypeName(conf.RESOURCE_AUTHORIZATION))
+	if !acl.IsAdmin(currentUser) {
+		rs, err := acl.GetRoleResources(ctx, currentUser.Acl.Rid, conf.GetResourceTypeName(conf.RESOURCE_AUTHORIZATION))
 		if err != nil {
-			logger.L().Error("auths", zap.Error(err))
-			return
+			return nil, err
 		}
 		dbAuth = dbAuth.Where("resource_id IN ?", lo.Map(rs, func(r *acl.Resource, _ int) int { return r.ResourceId }))
 	}
-	if err := dbAuth.Find(&auths).Error; err != nil {
-		logger.L().Error("auths", zap.Error(err))
+	if err = dbAuth.Find(&auths).Error; err != nil {
 		return
 	}
 	dbAccount = dbAccount.Where("id IN ?", lo.Map(auths, func(a *model.Authorization, _ int) int { return a.AccountId }))
@@ -252,15 +307,12 @@ func (m *view) refresh() {
 	eg.Go(func() error {
 		return dbAccount.Find(&accounts).Error
 	})
-	if err := eg.Wait(); err != nil {
-		logger.L().Error("refresh failed", zap.Error(err))
+	if err = eg.Wait(); err != nil {
 		return
 	}
 
 	assetMap := lo.SliceToMap(assets, func(a *model.Asset) (int, *model.Asset) { return a.Id, a })
 	accountMap := lo.SliceToMap(accounts, func(a *model.Account) (int, *model.Account) { return a.Id, a })
-
-	m.combines = make(map[string][3]int)
 	for _, auth := range auths {
 		asset, ok := assetMap[auth.AssetId]
 		if !ok {
@@ -270,30 +322,10 @@ func (m *view) refresh() {
 		if !ok {
 			continue
 		}
-		k := fmt.Sprintf("ssh %s@%s", account.Name, asset.Name)
-		for _, p := range asset.Protocols {
-			if strings.HasPrefix(p, "ssh") {
-				ss := strings.Split(p, ":")
-				port := cast.ToInt(ss[1])
-				if len(ss) != 2 || port == 0 {
-					continue
-				}
-				m.combines[lo.Ternary(port == 22, k, fmt.Sprintf("%s:%s", k, ss[1]))] = [3]int{account.Id, asset.Id, port}
-			}
-		}
+		res = append(res, &authorized{asset: asset, account: account})
 	}
 
-	eg.Go(func() error {
-		var err error
-		if len(m.cmds) != 0 {
-			return err
-		}
-		m.cmds, err = redis.RC.LRange(m.Ctx, fmt.Sprintf(hisCmdsFmt, m.currentUser.GetUid()), -100, -1).Result()
-		m.cmdsIdx = len(m.cmds) - 1
-		return err
-	})
-
-	m.textinput.SetSuggestions(lo.Keys(m.combines))
+	return
 }
 
 func (m *view) magicn() tea.Msg {
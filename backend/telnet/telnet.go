@@ -0,0 +1,286 @@
+// Package telnet is a telnet client of RFC 854 for terminals of legacy network devices, it negotiates
+// echo, suppress go ahead, terminal type and window size and logs in by answering login prompts
+package telnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	IAC  = 255
+	DONT = 254
+	DO   = 253
+	WONT = 252
+	WILL = 251
+	SB   = 250
+	SE   = 240
+
+	OPT_ECHO  = 1
+	OPT_SGA   = 3
+	OPT_TTYPE = 24
+	OPT_NAWS  = 31
+
+	TTYPE_IS   = 0
+	TTYPE_SEND = 1
+
+	loginTimeout = time.Second * 30
+	loginTail    = 64
+)
+
+var (
+	// options enabled on our side if asked by DO and on the side of the server if offered by WILL
+	ourOptions   = map[byte]bool{OPT_SGA: true, OPT_TTYPE: true, OPT_NAWS: true}
+	theirOptions = map[byte]bool{OPT_ECHO: true, OPT_SGA: true}
+
+	userPrompt     = regexp.MustCompile(`(?i)(login|user ?name|user)\s*:\s*$`)
+	passwordPrompt = regexp.MustCompile(`(?i)pass(word|code)?\s*:\s*$`)
+)
+
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	term   string
+	width  int
+	height int
+	us     map[byte]bool
+	him    map[byte]bool
+	login  *login
+	mtx    sync.Mutex
+}
+
+// login answers the first user and password prompts with the account until the deadline or the user types
+type login struct {
+	user, password string
+	userSent       bool
+	deadline       time.Time
+	tail           []byte
+}
+
+// NewConn wraps conn of a telnet server, user and password are sent to login prompts if user is not empty
+func NewConn(conn net.Conn, term string, width, height int, user, password string) *Conn {
+	c := &Conn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		term:   term,
+		width:  width,
+		height: height,
+		us:     map[byte]bool{},
+		him:    map[byte]bool{},
+	}
+	if user != "" {
+		c.login = &login{user: user, password: password, deadline: time.Now().Add(loginTimeout)}
+	}
+	return c
+}
+
+// Read returns data from the server, commands in it are handled and stripped
+func (c *Conn) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if n > 0 && c.reader.Buffered() == 0 {
+			break
+		}
+		var b byte
+		if b, err = c.reader.ReadByte(); err != nil {
+			break
+		}
+		switch b {
+		case IAC:
+			var literal bool
+			if literal, err = c.command(); err != nil {
+				break
+			}
+			if literal {
+				p[n] = IAC
+				n++
+			}
+		case '\r':
+			p[n] = b
+			n++
+			// CR NUL is a bare carriage return
+			if next, err := c.reader.Peek(1); err == nil && next[0] == 0 {
+				c.reader.Discard(1)
+			}
+		default:
+			p[n] = b
+			n++
+		}
+		if err != nil {
+			break
+		}
+	}
+	if n > 0 {
+		c.answerLogin(p[:n])
+		err = nil
+	}
+	return
+}
+
+// Write sends data of the user to the server, the user taking over ends the automatic login
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	c.login = nil
+	c.mtx.Unlock()
+	if _, err := c.write(bytes.ReplaceAll(p, []byte{IAC}, []byte{IAC, IAC})); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WindowChange sends the window size to the server if it has asked for it
+func (c *Conn) WindowChange(width, height int) error {
+	c.mtx.Lock()
+	c.width, c.height = width, height
+	naws := c.us[OPT_NAWS]
+	c.mtx.Unlock()
+	if !naws {
+		return nil
+	}
+	return c.sendNaws()
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// command handles the command following IAC, it reports whether it is an escaped 255 of data
+func (c *Conn) command() (literal bool, err error) {
+	cmd, err := c.reader.ReadByte()
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case IAC:
+		return true, nil
+	case DO, DONT, WILL, WONT:
+		opt, err := c.reader.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		return false, c.negotiate(cmd, opt)
+	case SB:
+		return false, c.subnegotiate()
+	}
+	// NOP, GA and others need no reply
+	return
+}
+
+// negotiate replies to requests of the server only if they change the state of the option to avoid loops of RFC 1143
+func (c *Conn) negotiate(cmd, opt byte) (err error) {
+	c.mtx.Lock()
+	var reply []byte
+	switch cmd {
+	case DO:
+		if !ourOptions[opt] {
+			reply = []byte{IAC, WONT, opt}
+		} else if !c.us[opt] {
+			c.us[opt] = true
+			reply = []byte{IAC, WILL, opt}
+		}
+	case DONT:
+		if c.us[opt] {
+			c.us[opt] = false
+			reply = []byte{IAC, WONT, opt}
+		}
+	case WILL:
+		if !theirOptions[opt] {
+			reply = []byte{IAC, DONT, opt}
+		} else if !c.him[opt] {
+			c.him[opt] = true
+			reply = []byte{IAC, DO, opt}
+		}
+	case WONT:
+		if c.him[opt] {
+			c.him[opt] = false
+			reply = []byte{IAC, DONT, opt}
+		}
+	}
+	c.mtx.Unlock()
+
+	if reply != nil {
+		if _, err = c.write(reply); err != nil {
+			return
+		}
+	}
+	if cmd == DO && opt == OPT_NAWS {
+		err = c.sendNaws()
+	}
+	return
+}
+
+func (c *Conn) subnegotiate() error {
+	data := make([]byte, 0, 8)
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == IAC {
+			if b, err = c.reader.ReadByte(); err != nil {
+				return err
+			}
+			if b == SE {
+				break
+			}
+		}
+		data = append(data, b)
+	}
+	if len(data) == 2 && data[0] == OPT_TTYPE && data[1] == TTYPE_SEND {
+		reply := append([]byte{IAC, SB, OPT_TTYPE, TTYPE_IS}, c.term...)
+		_, err := c.write(append(reply, IAC, SE))
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) sendNaws() error {
+	c.mtx.Lock()
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint16(size[:2], uint16(c.width))
+	binary.BigEndian.PutUint16(size[2:], uint16(c.height))
+	c.mtx.Unlock()
+	msg := []byte{IAC, SB, OPT_NAWS}
+	msg = append(msg, bytes.ReplaceAll(size, []byte{IAC}, []byte{IAC, IAC})...)
+	_, err := c.write(append(msg, IAC, SE))
+	return err
+}
+
+func (c *Conn) answerLogin(p []byte) {
+	c.mtx.Lock()
+	l := c.login
+	if l == nil {
+		c.mtx.Unlock()
+		return
+	}
+	if time.Now().After(l.deadline) {
+		c.login = nil
+		c.mtx.Unlock()
+		return
+	}
+	l.tail = append(l.tail, p...)
+	if len(l.tail) > loginTail {
+		l.tail = l.tail[len(l.tail)-loginTail:]
+	}
+	var answer string
+	if !l.userSent && userPrompt.Match(l.tail) {
+		l.userSent, l.tail, answer = true, nil, l.user
+	} else if passwordPrompt.Match(l.tail) {
+		c.login, answer = nil, l.password
+	}
+	c.mtx.Unlock()
+
+	if answer != "" {
+		c.write([]byte(answer + "\r\n"))
+	}
+}
+
+func (c *Conn) write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conn.Write(p)
+}
@@ -0,0 +1,201 @@
+package telnet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pair returns the server side of a loopback connection and the client on the other side
+func pair(t *testing.T, width, height int, user, password string) (net.Conn, *Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConn(conn, "xterm", width, height, user, password)
+	t.Cleanup(func() { srv.Close(); c.Close() })
+	return srv, c
+}
+
+// send writes bs by the server and returns n bytes of data read by the client
+func send(t *testing.T, srv net.Conn, c *Conn, n int, bs ...byte) []byte {
+	if _, err := srv.Write(bs); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// replies returns what the client has sent to the server
+func replies(t *testing.T, srv net.Conn) []byte {
+	out := &bytes.Buffer{}
+	buf := make([]byte, 256)
+	for {
+		srv.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, err := srv.Read(buf)
+		out.Write(buf[:n])
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return out.Bytes()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	srv, c := pair(t, 80, 24, "", "")
+
+	got := send(t, srv, c, 2,
+		IAC, DO, OPT_NAWS, IAC, DO, OPT_TTYPE, IAC, DO, OPT_ECHO,
+		IAC, WILL, OPT_ECHO, IAC, WILL, OPT_SGA, IAC, WILL, OPT_TTYPE, 'h', 'i')
+	if string(got) != "hi" {
+		t.Fatalf("read %q, want commands stripped", got)
+	}
+	want := []byte{
+		IAC, WILL, OPT_NAWS, IAC, SB, OPT_NAWS, 0, 80, 0, 24, IAC, SE, IAC, WILL, OPT_TTYPE, IAC, WONT, OPT_ECHO,
+		IAC, DO, OPT_ECHO, IAC, DO, OPT_SGA, IAC, DONT, OPT_TTYPE}
+	if got := replies(t, srv); !bytes.Equal(got, want) {
+		t.Fatalf("replies %v, want %v", got, want)
+	}
+
+	// requests of the current state are acknowledgements and must not be answered again
+	send(t, srv, c, 1, IAC, DO, OPT_TTYPE, IAC, WILL, OPT_ECHO, IAC, WILL, OPT_SGA, IAC, WONT, OPT_TTYPE, IAC, DONT, OPT_ECHO, 'x')
+	if got := replies(t, srv); len(got) != 0 {
+		t.Fatalf("replies %v to acknowledgements, want none", got)
+	}
+
+	send(t, srv, c, 1, IAC, DONT, OPT_TTYPE, IAC, DONT, OPT_TTYPE, IAC, WONT, OPT_ECHO, IAC, WONT, OPT_ECHO, 'x')
+	want = []byte{IAC, WONT, OPT_TTYPE, IAC, DONT, OPT_ECHO}
+	if got := replies(t, srv); !bytes.Equal(got, want) {
+		t.Fatalf("replies %v to disabling, want %v", got, want)
+	}
+}
+
+func TestTerminalType(t *testing.T) {
+	srv, c := pair(t, 80, 24, "", "")
+	send(t, srv, c, 1, IAC, SB, OPT_TTYPE, TTYPE_SEND, IAC, SE, 'x')
+	want := append(append([]byte{IAC, SB, OPT_TTYPE, TTYPE_IS}, "xterm"...), IAC, SE)
+	if got := replies(t, srv); !bytes.Equal(got, want) {
+		t.Fatalf("replies %v, want %v", got, want)
+	}
+}
+
+func TestWindowChange(t *testing.T) {
+	srv, c := pair(t, 255, 24, "", "")
+	if err := c.WindowChange(255, 24); err != nil {
+		t.Fatal(err)
+	}
+	if got := replies(t, srv); len(got) != 0 {
+		t.Fatalf("sent %v before the server asks for the window size", got)
+	}
+
+	send(t, srv, c, 1, IAC, DO, OPT_NAWS, 'x')
+	want := []byte{IAC, WILL, OPT_NAWS, IAC, SB, OPT_NAWS, 0, IAC, IAC, 0, 24, IAC, SE}
+	if got := replies(t, srv); !bytes.Equal(got, want) {
+		t.Fatalf("replies %v, want 255 escaped as %v", got, want)
+	}
+
+	if err := c.WindowChange(511, 255); err != nil {
+		t.Fatal(err)
+	}
+	want = []byte{IAC, SB, OPT_NAWS, 1, IAC, IAC, 0, IAC, IAC, IAC, SE}
+	if got := replies(t, srv); !bytes.Equal(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{name: "escaped iac", in: []byte{'a', IAC, IAC, 'b'}, want: "a\xffb"},
+		{name: "cr nul", in: []byte("a\r\x00b\r\n"), want: "a\rb\r\n"},
+		{name: "cr nul after a command", in: []byte{'a', '\r', 0, IAC, 241, '\r', 0}, want: "a\r\r"},
+		{name: "commands only between data", in: []byte{IAC, 241, 'a', IAC, 249, IAC, IAC}, want: "a\xff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, c := pair(t, 80, 24, "", "")
+			if got := send(t, srv, c, len(tt.want), tt.in...); string(got) != tt.want {
+				t.Fatalf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	srv, c := pair(t, 80, 24, "", "")
+	if n, err := c.Write([]byte{'a', IAC, 'b'}); n != 3 || err != nil {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if got, want := replies(t, srv), []byte{'a', IAC, IAC, 'b'}; !bytes.Equal(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv, c := pair(t, 80, 24, "admin", "secret")
+
+	send(t, srv, c, 12, []byte("\r\nUsername: ")...)
+	if got := replies(t, srv); string(got) != "admin\r\n" {
+		t.Fatalf("answered %q to the user prompt", got)
+	}
+	send(t, srv, c, 10, []byte("Password: ")...)
+	if got := replies(t, srv); string(got) != "secret\r\n" {
+		t.Fatalf("answered %q to the password prompt", got)
+	}
+	send(t, srv, c, 19, []byte("\r\nlogin: Password: ")...)
+	if got := replies(t, srv); len(got) != 0 {
+		t.Fatalf("answered %q after login", got)
+	}
+}
+
+func TestLoginPromptSplit(t *testing.T) {
+	srv, c := pair(t, 80, 24, "admin", "secret")
+	send(t, srv, c, 3, []byte("log")...)
+	send(t, srv, c, 4, []byte("in: ")...)
+	if got := replies(t, srv); string(got) != "admin\r\n" {
+		t.Fatalf("answered %q to a prompt read in parts", got)
+	}
+}
+
+func TestLoginTakenOver(t *testing.T) {
+	srv, c := pair(t, 80, 24, "admin", "secret")
+	c.Write([]byte("root\r\n"))
+	replies(t, srv)
+	send(t, srv, c, 10, []byte("Password: ")...)
+	if got := replies(t, srv); len(got) != 0 {
+		t.Fatalf("answered %q after the user types", got)
+	}
+}
+
+func TestLoginDeadline(t *testing.T) {
+	srv, c := pair(t, 80, 24, "admin", "secret")
+	c.login.deadline = time.Now().Add(-time.Second)
+	send(t, srv, c, 7, []byte("login: ")...)
+	if got := replies(t, srv); len(got) != 0 {
+		t.Fatalf("answered %q after the deadline", got)
+	}
+	if c.login != nil {
+		t.Fatal("login is not ended by the deadline")
+	}
+}
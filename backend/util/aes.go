@@ -1,52 +1,197 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+
+	"github.com/veops/oneterm/conf"
+	"github.com/veops/oneterm/logger"
+)
+
+const (
+	ENV_ENCRYPTION_KEYS    = "ONETERM_ENCRYPTION_KEYS"
+	ENV_ENCRYPTION_VERSION = "ONETERM_ENCRYPTION_VERSION"
 )
 
 var (
-	key = []byte("thisis32bitlongpassphraseimusing")
-	iv  = []byte("0123456789abcdef")
+	// legacyKey and legacyIv are only used to decrypt data encrypted before keys are managed
+	legacyKey = []byte("thisis32bitlongpassphraseimusing")
+	legacyIv  = []byte("0123456789abcdef")
+
+	keys       = map[int][]byte{}
+	keyVersion int
 )
 
-func EncryptAES(plainText string) string {
-	block, _ := aes.NewCipher(key)
-	bs := []byte(plainText)
-	bs = paddingPKCS7(bs, aes.BlockSize)
+func init() {
+	if err := loadKeys(conf.Cfg.Encryption); err != nil {
+		logger.L().Fatal("load encryption keys failed", zap.Error(err))
+	}
+}
 
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(bs, bs)
+// loadKeys loads keys from config, then the key file, then env, the later overrides the former with the same version.
+// Keys in the key file and env are written as version=base64 key, separated by new lines or commas
+func loadKeys(cfg conf.EncryptionConfig) (err error) {
+	kvs := make([]*conf.KV, 0, len(cfg.Keys))
+	kvs = append(kvs, cfg.Keys...)
+	if cfg.KeyFile != "" {
+		bs, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, parseKeys(string(bs))...)
+	}
+	kvs = append(kvs, parseKeys(os.Getenv(ENV_ENCRYPTION_KEYS))...)
+
+	for _, kv := range kvs {
+		version, err := cast.ToIntE(kv.Key)
+		if err != nil || version <= 0 {
+			return fmt.Errorf("invalid key version %q", kv.Key)
+		}
+		key, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("key of version %d must be base64 encoded 32 bytes", version)
+		}
+		keys[version] = key
+	}
 
-	return base64.StdEncoding.EncodeToString(bs)
+	keyVersion = cfg.Version
+	if v := os.Getenv(ENV_ENCRYPTION_VERSION); v != "" {
+		keyVersion = cast.ToInt(v)
+	}
+	if keyVersion <= 0 {
+		for v := range keys {
+			keyVersion = max(keyVersion, v)
+		}
+	}
+	if _, ok := keys[keyVersion]; !ok {
+		return fmt.Errorf("no key of version %d, set encryption.keys, encryption.keyFile or %s", keyVersion, ENV_ENCRYPTION_KEYS)
+	}
+	return
 }
 
-func DecryptAES(cipherText string) string {
-	bs, _ := base64.StdEncoding.DecodeString(cipherText)
-	block, err := aes.NewCipher(key)
+func parseKeys(s string) (kvs []*conf.KV) {
+	sc := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(s, ",", "\n")))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, _ := strings.Cut(line, "=")
+		kvs = append(kvs, &conf.KV{Key: strings.TrimSpace(k), Value: strings.TrimSpace(v)})
+	}
+	return
+}
+
+// EncryptAES encrypts with aes-gcm by the current key, the ciphertext is prefixed with the key version like v1:
+func EncryptAES(plainText string) string {
+	block, err := aes.NewCipher(keys[keyVersion])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
 	if err != nil {
 		panic(err)
 	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	bs := aead.Seal(nonce, nonce, []byte(plainText), nil)
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(bs, bs)
+	return fmt.Sprintf("v%d:%s", keyVersion, base64.StdEncoding.EncodeToString(bs))
+}
 
-	return string(unPaddingPKCS7(bs))
+// DecryptAES decrypts text encrypted by EncryptAES or in the legacy format, it returns empty string if it fails
+func DecryptAES(cipherText string) string {
+	s, err := decryptAES(cipherText)
+	if err != nil {
+		logger.L().Error("decrypt failed", zap.Error(err))
+	}
+	return s
+}
+
+// NeedReEncrypt reports whether the text is in the legacy format or encrypted by an old key
+func NeedReEncrypt(cipherText string) bool {
+	version, _, ok := parseCipherText(cipherText)
+	return !ok || version != keyVersion
+}
+
+func parseCipherText(cipherText string) (version int, data string, ok bool) {
+	prefix, data, ok := strings.Cut(cipherText, ":")
+	if !ok || !strings.HasPrefix(prefix, "v") {
+		return 0, "", false
+	}
+	version, err := cast.ToIntE(prefix[1:])
+	return version, data, err == nil
+}
+
+func decryptAES(cipherText string) (string, error) {
+	version, data, ok := parseCipherText(cipherText)
+	if !ok {
+		return decryptLegacy(cipherText)
+	}
+	key, ok := keys[version]
+	if !ok {
+		return "", fmt.Errorf("no key of version %d", version)
+	}
+	bs, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(bs) < aead.NonceSize() {
+		return "", errors.New("invalid cipher text")
+	}
+	bs, err = aead.Open(nil, bs[:aead.NonceSize()], bs[aead.NonceSize():], nil)
+	return string(bs), err
 }
 
-func paddingPKCS7(plaintext []byte, blockSize int) []byte {
-	paddingSize := blockSize - len(plaintext)%blockSize
-	paddingText := bytes.Repeat([]byte{byte(paddingSize)}, paddingSize)
-	return append(plaintext, paddingText...)
+func decryptLegacy(cipherText string) (string, error) {
+	bs, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return "", err
+	}
+	if len(bs)%aes.BlockSize != 0 {
+		return "", errors.New("invalid legacy cipher text")
+	}
+	block, err := aes.NewCipher(legacyKey)
+	if err != nil {
+		return "", err
+	}
+
+	mode := cipher.NewCBCDecrypter(block, legacyIv)
+	mode.CryptBlocks(bs, bs)
+
+	bs, err = unPaddingPKCS7(bs)
+	return string(bs), err
 }
 
-func unPaddingPKCS7(s []byte) []byte {
+func unPaddingPKCS7(s []byte) ([]byte, error) {
 	length := len(s)
 	if length == 0 {
-		return s
+		return s, nil
 	}
 	unPadding := int(s[length-1])
-	return s[:(length - unPadding)]
+	if unPadding <= 0 || unPadding > length || !bytes.Equal(s[length-unPadding:], bytes.Repeat([]byte{byte(unPadding)}, unPadding)) {
+		return nil, errors.New("invalid padding")
+	}
+	return s[:(length - unPadding)], nil
 }
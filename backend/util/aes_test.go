@@ -1,30 +1,44 @@
 package util
 
 import (
+	"strings"
 	"testing"
 )
 
 func TestEncryptAES(t *testing.T) {
+	keys[1] = []byte("0123456789abcdef0123456789abcdef")
+	keyVersion = 1
 	type args struct {
 		plaintext string
 	}
 	tests := []struct {
 		name string
 		args args
-		want string
 	}{
 		{
 			name: "Test 1",
 			args: args{
 				plaintext: "123456789abcdefghijklmnopqrstuvwxyz",
 			},
-			want: "hrr23HSXrZEOw5haacoj32QJLrHdpj42jaQcPVRf9AI8SzeSdWJhzTrYgsOgmNoN",
+		},
+		{
+			name: "Empty",
+			args: args{
+				plaintext: "",
+			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := EncryptAES(tt.args.plaintext); got != tt.want {
-				t.Errorf("EncryptAES() = %v, want %v", got, tt.want)
+			got := EncryptAES(tt.args.plaintext)
+			if !strings.HasPrefix(got, "v1:") || got == EncryptAES(tt.args.plaintext) {
+				t.Errorf("EncryptAES() = %v, want versioned and nonced cipher text", got)
+			}
+			if NeedReEncrypt(got) {
+				t.Errorf("NeedReEncrypt(%v) = true, want false", got)
+			}
+			if plain := DecryptAES(got); plain != tt.args.plaintext {
+				t.Errorf("DecryptAES() = %v, want %v", plain, tt.args.plaintext)
 			}
 		})
 	}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+
+	mysql "github.com/veops/oneterm/db"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+)
+
+// ReEncryptAll re-encrypts credentials which are in the legacy format or encrypted by an old key with the current key.
+// It is safe to run again, e.g. after rotating to a new key version
+func ReEncryptAll() (err error) {
+	tables := []model.Pair[string, []string]{
+		{First: (&model.Account{}).TableName(), Second: []string{"password", "pk", "phrase"}},
+		{First: (&model.Gateway{}).TableName(), Second: []string{"password", "pk", "phrase"}},
+		{First: (&model.PublicKey{}).TableName(), Second: []string{"pk"}},
+	}
+	failed := 0
+	for _, t := range tables {
+		cnt, fcnt, err := reEncryptTable(t.First, t.Second)
+		if err != nil {
+			return err
+		}
+		failed += fcnt
+		logger.L().Info("re-encrypt done", zap.String("table", t.First), zap.Int("count", cnt), zap.Int("failed", fcnt))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d rows failed to re-encrypt", failed)
+	}
+	return
+}
+
+func reEncryptTable(table string, cols []string) (cnt int, failed int, err error) {
+	lastId := 0
+	for {
+		rows := make([]map[string]any, 0)
+		if err = mysql.DB.
+			Table(table).
+			Select(append([]string{"id"}, cols...)).
+			Where("id > ?", lastId).
+			Order("id").
+			Limit(500).
+			Find(&rows).
+			Error; err != nil {
+			return
+		}
+		if len(rows) <= 0 {
+			return
+		}
+		lastId = cast.ToInt(rows[len(rows)-1]["id"])
+		for _, row := range rows {
+			updates := map[string]any{}
+			for _, c := range cols {
+				v := cast.ToString(row[c])
+				if v == "" || !NeedReEncrypt(v) {
+					continue
+				}
+				plain, err := decryptAES(v)
+				if err != nil {
+					logger.L().Error("decrypt failed", zap.String("table", table), zap.Any("id", row["id"]), zap.String("column", c), zap.Error(err))
+					updates = nil
+					break
+				}
+				updates[c] = EncryptAES(plain)
+			}
+			if updates == nil {
+				failed++
+				continue
+			}
+			if len(updates) <= 0 {
+				continue
+			}
+			if err := mysql.DB.Table(table).Where("id = ?", row["id"]).UpdateColumns(updates).Error; err != nil {
+				logger.L().Error("re-encrypt failed", zap.String("table", table), zap.Any("id", row["id"]), zap.Error(err))
+				failed++
+				continue
+			}
+			cnt++
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/veops/oneterm/conf"
+	"github.com/veops/oneterm/logger"
+	"github.com/veops/oneterm/model"
+	"github.com/veops/oneterm/secret"
+)
+
+var (
+	secretStore *secret.Cache
+)
+
+func init() {
+	cfg := conf.Cfg.Secret.Vault
+	if cfg.Addr == "" {
+		cfg.Addr = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Addr == "" {
+		return
+	}
+	if cfg.Token == "" && cfg.TokenFile != "" {
+		bs, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			logger.L().Fatal("read vault token failed", zap.String("path", cfg.TokenFile), zap.Error(err))
+		}
+		cfg.Token = strings.TrimSpace(string(bs))
+	}
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	v, err := secret.NewVault(secret.VaultOptions{
+		Addr:      cfg.Addr,
+		Token:     cfg.Token,
+		Mount:     cfg.Mount,
+		Namespace: cfg.Namespace,
+	})
+	if err != nil {
+		logger.L().Fatal("init vault failed", zap.Error(err))
+	}
+	secretStore = secret.NewCache(v, time.Second*time.Duration(max(conf.Cfg.Secret.CacheTtl, 0)))
+}
+
+// GetSecret reads the secret at path from the external secret store
+func GetSecret(ctx context.Context, path string) (data map[string]string, err error) {
+	if secretStore == nil {
+		return nil, fmt.Errorf("no secret store is configured")
+	}
+	return secretStore.Get(ctx, path)
+}
+
+// DecryptAccount fills in credentials of the account, they are read from the external secret store if the account references one
+func DecryptAccount(ctx context.Context, account *model.Account) (err error) {
+	if account.SecretPath == "" {
+		account.Password = DecryptAES(account.Password)
+		account.Pk = DecryptAES(account.Pk)
+		account.Phrase = DecryptAES(account.Phrase)
+		return
+	}
+	data, err := GetSecret(ctx, account.SecretPath)
+	if err != nil {
+		return
+	}
+	account.Password, account.Pk, account.Phrase = data["password"], data["pk"], data["phrase"]
+	return
+}
+
+// DecryptGateway fills in credentials of the gateway, they are read from the external secret store if the gateway references one
+func DecryptGateway(ctx context.Context, gateway *model.Gateway) (err error) {
+	if gateway.SecretPath == "" {
+		gateway.Password = DecryptAES(gateway.Password)
+		gateway.Pk = DecryptAES(gateway.Pk)
+		gateway.Phrase = DecryptAES(gateway.Phrase)
+		return
+	}
+	data, err := GetSecret(ctx, gateway.SecretPath)
+	if err != nil {
+		return
+	}
+	gateway.Password, gateway.Pk, gateway.Phrase = data["password"], data["pk"], data["phrase"]
+	return
+}
@@ -1,8 +1,12 @@
 package util
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
@@ -12,6 +16,9 @@ import (
 	"github.com/veops/oneterm/model"
 )
 
+// MaxGatewayHops limits the length of gateway chains
+const MaxGatewayHops = 8
+
 func GetAAG(assetId int, accountId int) (asset *model.Asset, account *model.Account, gateway *model.Gateway, err error) {
 	asset, account, gateway = &model.Asset{}, &model.Account{}, &model.Gateway{}
 	if err = mysql.DB.Model(asset).Where("id = ?", assetId).First(asset).Error; err != nil {
@@ -20,22 +27,58 @@ func GetAAG(assetId int, accountId int) (asset *model.Asset, account *model.Acco
 	if err = mysql.DB.Model(account).Where("id = ?", accountId).First(account).Error; err != nil {
 		return
 	}
-	account.Password = DecryptAES(account.Password)
-	account.Pk = DecryptAES(account.Pk)
-	account.Phrase = DecryptAES(account.Phrase)
+	if err = DecryptAccount(context.Background(), account); err != nil {
+		return
+	}
 	if asset.GatewayId != 0 {
-		if err = mysql.DB.Model(gateway).Where("id = ?", asset.GatewayId).First(gateway).Error; err != nil {
+		if gateway, err = GetGateway(context.Background(), asset.GatewayId); err != nil {
 			return
 		}
-		gateway.Password = DecryptAES(gateway.Password)
-		gateway.Pk = DecryptAES(gateway.Pk)
-		gateway.Phrase = DecryptAES(gateway.Phrase)
 	}
 
 	return
 }
 
-func GetAuth(account *model.Account) (ssh.AuthMethod, error) {
+// GetGateway loads the gateway with the chain of its parents, credentials of every hop are decrypted.
+// Members of gateway groups are loaded the same way
+func GetGateway(ctx context.Context, id int) (gateway *model.Gateway, err error) {
+	var child *model.Gateway
+	for hops := 0; id != 0; hops++ {
+		if hops >= MaxGatewayHops {
+			return nil, fmt.Errorf("gateway chain is longer than %d hops", MaxGatewayHops)
+		}
+		g := &model.Gateway{}
+		if err = mysql.DB.Model(g).Where("id = ?", id).First(g).Error; err != nil {
+			return
+		}
+		if err = DecryptGateway(ctx, g); err != nil {
+			return
+		}
+		if child == nil {
+			gateway = g
+		} else {
+			child.Parent = g
+		}
+		child, id = g, g.ParentId
+	}
+	if gateway == nil || gateway.Type != model.GATEWAYTYPE_GROUP {
+		return
+	}
+	for _, mid := range gateway.MemberIds {
+		member, err := GetGateway(ctx, mid)
+		if err != nil {
+			return nil, err
+		}
+		if member.Type == model.GATEWAYTYPE_GROUP {
+			return nil, fmt.Errorf("member %s of gateway group %s is a group", member.Name, gateway.Name)
+		}
+		gateway.Members = append(gateway.Members, member)
+	}
+	return
+}
+
+// GetAuth returns the auth method of the account, keyId identifies certificates of certificate accounts
+func GetAuth(account *model.Account, keyId string) (ssh.AuthMethod, error) {
 	switch account.AccountType {
 	case model.AUTHMETHOD_PASSWORD:
 		return ssh.Password(account.Password), nil
@@ -53,32 +96,41 @@ func GetAuth(account *model.Account) (ssh.AuthMethod, error) {
 			}
 			return ssh.PublicKeys(pk), nil
 		}
+	case model.AUTHMETHOD_CERTIFICATE:
+		signer, err := SignCert(account.Account, keyId)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.PublicKeys(signer), nil
 	default:
 		return nil, fmt.Errorf("invalid authmethod %d", account.AccountType)
 	}
 }
 
-func Proxy(sessionId string, protocol string, asset *model.Asset, gateway *model.Gateway) (ip string, port int, err error) {
-	ip, port = asset.Ip, 0
+// GetPort returns port of the asset for the first matched protocol in protocol split by comma
+func GetPort(protocol string, asset *model.Asset) (port int) {
 	for _, tp := range strings.Split(protocol, ",") {
 		for _, p := range asset.Protocols {
-			if strings.HasPrefix(strings.ToLower(p), tp) {
-				if port = cast.ToInt(strings.Split(p, ":")[1]); port != 0 {
-					break
-				}
+			if !strings.HasPrefix(strings.ToLower(p), tp) {
+				continue
+			}
+			_, pt, _ := strings.Cut(p, ":")
+			if port = cast.ToInt(pt); port != 0 {
+				return
 			}
 		}
 	}
+	return
+}
+
+// Proxy connects to the port of the protocol of the asset, through its gateway if it has one.
+// Connections through gateways are closed along with the session by Close of the gateway manager
+func Proxy(ctx context.Context, sessionId string, protocol string, asset *model.Asset, gateway *model.Gateway) (net.Conn, error) {
+	addr := net.JoinHostPort(asset.Ip, strconv.Itoa(GetPort(protocol, asset)))
 
 	if asset.GatewayId == 0 || gateway == nil {
-		return
+		return (&net.Dialer{Timeout: time.Second * 3}).DialContext(ctx, "tcp", addr)
 	}
 
-
-	g, err := ggateway.GetGatewayManager().Open(sessionId, ip, port, gateway)
-	if err != nil {
-		return
-	}
-	ip, port = g.LocalIp, g.LocalPort
-	return
+	return ggateway.GetGatewayManager().Dial(ctx, sessionId, gateway, "tcp", addr)
 }
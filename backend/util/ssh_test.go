@@ -0,0 +1,31 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/veops/oneterm/model"
+)
+
+func TestGetPort(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocol  string
+		protocols []string
+		want      int
+	}{
+		{name: "matched", protocol: "ssh", protocols: []string{"rdp:3389", "ssh:22"}, want: 22},
+		{name: "first protocol", protocol: "sftp,ssh", protocols: []string{"ssh:22", "sftp:2222"}, want: 2222},
+		{name: "fallback protocol", protocol: "sftp,ssh", protocols: []string{"rdp:3389", "ssh:22"}, want: 22},
+		{name: "first port of the protocol", protocol: "ssh", protocols: []string{"ssh:22", "ssh:2022"}, want: 22},
+		{name: "case insensitive", protocol: "ssh", protocols: []string{"SSH:22"}, want: 22},
+		{name: "invalid port skipped", protocol: "ssh", protocols: []string{"ssh", "ssh:x", "ssh:22"}, want: 22},
+		{name: "not matched", protocol: "telnet", protocols: []string{"ssh:22"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetPort(tt.protocol, &model.Asset{Protocols: tt.protocols}); got != tt.want {
+				t.Errorf("GetPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/veops/oneterm/conf"
+	"github.com/veops/oneterm/logger"
+)
+
+const (
+	defaultCertValidity = time.Minute * 5
+	// certBackdate tolerates clocks of assets running behind
+	certBackdate = time.Minute
+)
+
+var (
+	caSigner ssh.Signer
+	errNoCa  = errors.New("ssh ca is not configured")
+)
+
+func init() {
+	if conf.Cfg.Ssh.CaKey == "" {
+		return
+	}
+	var err error
+	if caSigner, err = ssh.ParsePrivateKey([]byte(conf.Cfg.Ssh.CaKey)); err != nil {
+		logger.L().Fatal("parse ssh ca key failed", zap.Error(err))
+	}
+}
+
+// CaPublicKey returns the public key of the ssh ca in authorized_keys format, assets trust it by TrustedUserCAKeys
+func CaPublicKey() ([]byte, error) {
+	if caSigner == nil {
+		return nil, errNoCa
+	}
+	return ssh.MarshalAuthorizedKey(caSigner.PublicKey()), nil
+}
+
+// SignCert mints an ephemeral key with a short-lived user certificate signed by the ssh ca,
+// principal is the user to login and keyId is logged by sshd of the asset
+func SignCert(principal string, keyId string) (ssh.Signer, error) {
+	if caSigner == nil {
+		return nil, errNoCa
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	validity := defaultCertValidity
+	if conf.Cfg.Ssh.CertValidity > 0 {
+		validity = time.Second * time.Duration(conf.Cfg.Ssh.CertValidity)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           keyId,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(now.Add(-certBackdate).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":             "",
+				"permit-port-forwarding": "",
+			},
+		},
+	}
+	if err = cert.SignCert(rand.Reader, caSigner); err != nil {
+		return nil, err
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,127 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/veops/oneterm/conf"
+)
+
+// useCa replaces the ssh ca by a random key and returns its public key
+func useCa(t *testing.T, validity int) ssh.PublicKey {
+	signer, certValidity := caSigner, conf.Cfg.Ssh.CertValidity
+	t.Cleanup(func() { caSigner, conf.Cfg.Ssh.CertValidity = signer, certValidity })
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caSigner, err = ssh.NewSignerFromKey(priv); err != nil {
+		t.Fatal(err)
+	}
+	conf.Cfg.Ssh.CertValidity = validity
+	return caSigner.PublicKey()
+}
+
+func TestSignCert(t *testing.T) {
+	tests := []struct {
+		name     string
+		validity int
+		want     time.Duration
+	}{
+		{name: "default validity", want: defaultCertValidity},
+		{name: "configured validity", validity: 3600, want: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caKey := useCa(t, tt.validity)
+			now := time.Now()
+			signer, err := SignCert("root", "alice@session-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, ok := signer.PublicKey().(*ssh.Certificate)
+			if !ok {
+				t.Fatalf("SignCert() public key is %T, want a certificate", signer.PublicKey())
+			}
+
+			checker := &ssh.CertChecker{
+				IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return string(auth.Marshal()) == string(caKey.Marshal())
+				},
+			}
+			if err = checker.CheckCert("root", cert); err != nil {
+				t.Fatalf("CheckCert() of the principal error = %v", err)
+			}
+			if err = checker.CheckCert("admin", cert); err == nil {
+				t.Fatal("CheckCert() of another principal error = nil")
+			}
+			if _, err = checker.Authenticate(connMetadata("root"), cert); err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if cert.CertType != ssh.UserCert || cert.KeyId != "alice@session-1" || len(cert.ValidPrincipals) != 1 {
+				t.Fatalf("certificate type %d, key id %q, principals %v", cert.CertType, cert.KeyId, cert.ValidPrincipals)
+			}
+
+			after, before := time.Unix(int64(cert.ValidAfter), 0), time.Unix(int64(cert.ValidBefore), 0)
+			if d := now.Add(-certBackdate).Sub(after); d < 0 || d > time.Second*2 {
+				t.Errorf("valid after %v, want backdated by %v from %v", after, certBackdate, now)
+			}
+			if d := now.Add(tt.want).Sub(before); d < -time.Second*2 || d > time.Second*2 {
+				t.Errorf("valid before %v, want %v after %v", before, tt.want, now)
+			}
+			checker.Clock = func() time.Time { return before.Add(time.Second) }
+			if err = checker.CheckCert("root", cert); err == nil {
+				t.Fatal("CheckCert() after the validity error = nil")
+			}
+
+			data := []byte("session")
+			sig, err := signer.Sign(rand.Reader, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cert.Key.Verify(data, sig); err != nil {
+				t.Fatalf("signature of the ephemeral key is not verified by the certificate: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignCertOtherCa(t *testing.T) {
+	useCa(t, 0)
+	signer, err := SignCert("root", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := useCa(t, 0)
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(other.Marshal())
+		},
+	}
+	if _, err = checker.Authenticate(connMetadata("root"), signer.PublicKey()); err == nil {
+		t.Fatal("Authenticate() of a certificate signed by another ca error = nil")
+	}
+}
+
+func TestSignCertNoCa(t *testing.T) {
+	useCa(t, 0)
+	caSigner = nil
+	if _, err := SignCert("root", "alice"); !errors.Is(err, errNoCa) {
+		t.Fatalf("SignCert() error = %v, want %v", err, errNoCa)
+	}
+}
+
+type connMetadata string
+
+func (c connMetadata) User() string          { return string(c) }
+func (c connMetadata) SessionID() []byte     { return nil }
+func (c connMetadata) ClientVersion() []byte { return nil }
+func (c connMetadata) ServerVersion() []byte { return nil }
+func (c connMetadata) RemoteAddr() net.Addr  { return nil }
+func (c connMetadata) LocalAddr() net.Addr   { return nil }
@@ -11,6 +11,10 @@ CREATE TABLE
         `password` TEXT NOT NULL,
         `pk` TEXT NOT NULL,
         `phrase` TEXT NOT NULL,
+        `secret_path` VARCHAR(256) NOT NULL DEFAULT '',
+        `managed` TINYINT(1) NOT NULL DEFAULT 0,
+        `rotate_days` INT NOT NULL DEFAULT 0,
+        `rotated_at` TIMESTAMP NULL,
         `resource_id` INT NOT NULL DEFAULT 0,
         `creator_id` INT NOT NULL DEFAULT 0,
         `updater_id` INT NOT NULL DEFAULT 0,
@@ -54,6 +58,7 @@ CREATE TABLE
         `name` VARCHAR(64) NOT NULL DEFAULT '',
         `cmds` JSON NOT NULL,
         `enable` TINYINT(1) NOT NULL DEFAULT 0,
+        `action` INT NOT NULL DEFAULT 0,
         `resource_id` INT NOT NULL DEFAULT 0,
         `creator_id` INT NOT NULL DEFAULT 0,
         `updater_id` INT NOT NULL DEFAULT 0,
@@ -75,6 +80,16 @@ CREATE TABLE
         `password` TEXT NOT NULL,
         `pk` TEXT NOT NULL,
         `phrase` TEXT NOT NULL,
+        `type` INT NOT NULL DEFAULT 0,
+        `status` INT NOT NULL DEFAULT 0,
+        `last_seen_at` TIMESTAMP NULL,
+        `agent_key` TEXT NOT NULL,
+        `enroll_token` VARCHAR(64) NOT NULL DEFAULT '',
+        `enroll_expired_at` TIMESTAMP NULL,
+        `parent_id` INT NOT NULL DEFAULT 0,
+        `member_ids` JSON NOT NULL,
+        `strategy` INT NOT NULL DEFAULT 0,
+        `secret_path` VARCHAR(256) NOT NULL DEFAULT '',
         `resource_id` INT NOT NULL DEFAULT 0,
         `creator_id` INT NOT NULL DEFAULT 0,
         `updater_id` INT NOT NULL DEFAULT 0,
@@ -129,6 +144,24 @@ CREATE TABLE
         )
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 
+CREATE TABLE
+    IF NOT EXISTS oneterm.host_key(
+        `id` INT NOT NULL AUTO_INCREMENT,
+        `asset_id` INT NOT NULL DEFAULT 0,
+        `gateway_id` INT NOT NULL DEFAULT 0,
+        `port` INT NOT NULL DEFAULT 0,
+        `status` INT NOT NULL DEFAULT 0,
+        `key_type` VARCHAR(64) NOT NULL DEFAULT '',
+        `key` TEXT NOT NULL,
+        `fingerprint` VARCHAR(128) NOT NULL DEFAULT '',
+        `creator_id` INT NOT NULL DEFAULT 0,
+        `updater_id` INT NOT NULL DEFAULT 0,
+        `created_at` TIMESTAMP NOT NULL,
+        `updated_at` TIMESTAMP NOT NULL,
+        PRIMARY KEY (`id`),
+        UNIQUE KEY `target_status` (`asset_id`, `gateway_id`, `port`, `status`)
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
 CREATE TABLE
     IF NOT EXISTS oneterm.history(
         `id` INT NOT NULL AUTO_INCREMENT,
@@ -162,8 +195,13 @@ CREATE TABLE
         `created_at` TIMESTAMP NOT NULL,
         `updated_at` TIMESTAMP NOT NULL,
         `closed_at` TIMESTAMP,
+        `replay_deleted` TINYINT(1) NOT NULL DEFAULT 0,
+        `bytes_in` BIGINT NOT NULL DEFAULT 0,
+        `bytes_out` BIGINT NOT NULL DEFAULT 0,
+        `target` VARCHAR(512) NOT NULL DEFAULT '',
         PRIMARY KEY(`id`),
-        UNIQUE KEY `session_id` (`session_id`)
+        UNIQUE KEY `session_id` (`session_id`),
+        KEY `created_at` (`created_at`)
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 
 CREATE TABLE
@@ -174,7 +212,8 @@ CREATE TABLE
         `result` TEXT NOT NULL,
         `level` INT NOT NULL DEFAULT 0,
         `created_at` TIMESTAMP NOT NULL,
-        PRIMARY KEY(`id`)
+        PRIMARY KEY(`id`),
+        KEY `session_id` (`session_id`)
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 
 CREATE TABLE
@@ -200,6 +239,12 @@ CREATE TABLE
     IF NOT EXISTS oneterm.config(
         `id` INT NOT NULL AUTO_INCREMENT,
         `timeout` INT NOT NULL,
+        `approval_timeout` INT NOT NULL DEFAULT 0,
+        `replay_days` INT NOT NULL DEFAULT 0,
+        `session_days` INT NOT NULL DEFAULT 0,
+        `file_history_days` INT NOT NULL DEFAULT 0,
+        `history_days` INT NOT NULL DEFAULT 0,
+        `node_retentions` JSON NOT NULL,
         `creator_id` INT NOT NULL DEFAULT 0,
         `created_at` TIMESTAMP NOT NULL,
         `updater_id` INT NOT NULL DEFAULT 0,
@@ -209,7 +254,7 @@ CREATE TABLE
         UNIQUE KEY `deleted_at` (`deleted_at`)
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 
-INSERT INTO oneterm.config (timeout) VALUES (7200);
+INSERT INTO oneterm.config (timeout, node_retentions) VALUES (7200, '{}');
 
 
 CREATE TABLE